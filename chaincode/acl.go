@@ -7,6 +7,7 @@ package chaincode
 import (
     "encoding/json"
     "fmt"
+    "strings"
 
     "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
     "github.com/google/uuid"
@@ -16,6 +17,26 @@ func (s *SmartContract) initacls(ctx contractapi.TransactionContextInterface) er
     return nil
 }
 
+// Make sure only defined permission bits are set.
+func validateperms(perms uint32) error {
+    if (perms & ^ACL_Perms_All) != 0 {
+        return fmt.Errorf("invalid permission bits 0x%x", perms & ^ACL_Perms_All)
+    }
+
+    return nil
+}
+
+func validatepermsmap(perms map[string]uint32) error {
+    for k, v := range perms {
+        err := validateperms(v)
+        if err != nil {
+            return fmt.Errorf("%v for %s", err, k)
+        }
+    }
+
+    return nil
+}
+
 func (s *SmartContract) GetACLByID(ctx contractapi.TransactionContextInterface,
                                    id string) (*ACLTemplate, error) {
     stateid, _ := ctx.GetStub().CreateCompositeKey("ACL", []string{id})
@@ -61,7 +82,18 @@ func (s *SmartContract) getuseraclbyname(ctx contractapi.TransactionContextInter
                                          id string,
                                          name string) (*ACLTemplate, error) {
     // TODO: Use explicit index
-    query := fmt.Sprintf(`{"selector":{"type":"ACL","name":"%s","owner":"%s"}}`, name, id)
+    // Build the selector properly so a name with quotes in it can't change
+    // what the query matches (like whose templates it looks at).
+    js, err := json.Marshal(map[string]string {
+        "type":     "ACL",
+        "name":     name,
+        "owner":    id,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    query := fmt.Sprintf(`{"selector":%s}`, js)
     resultsIterator, err := ctx.GetStub().GetQueryResult(query)
     if err != nil {
         return nil, err
@@ -94,18 +126,34 @@ func (s *SmartContract) CreateACL(ctx contractapi.TransactionContextInterface,
         return "", err
     }
 
+    err = validatepermsmap(uperms)
+    if err != nil {
+        return "", err
+    }
+
+    err = validatepermsmap(gperms)
+    if err != nil {
+        return "", err
+    }
+
     // Make sure we don't already have an ACL template with this name...
     tmp, _ := s.getuseraclbyname(ctx, myuser.ID, name)
     if tmp != nil {
         return "", fmt.Errorf("ACL already exists")
     }
 
+    ctime, err := gettxtime(ctx)
+    if err != nil {
+        return "", err
+    }
+
     acl := ACLTemplate {
         Type:           "ACL",
         ID:             uuid.NewString(),
         Owner:          myuser.ID,
         Name:           name,
         Permissions:    make([]ACLEntry, len(uperms) + len(gperms)),
+        CTime:          ctime,
     }
 
     // Fill in the group and user permissions that were passed in.
@@ -143,15 +191,10 @@ func (s *SmartContract) CreateACL(ctx contractapi.TransactionContextInterface,
         i++
     }
 
-    aclJSON, err := json.Marshal(acl)
-    if err != nil {
-        return "", err
-    }
-
     stateid, _ := ctx.GetStub().CreateCompositeKey("ACL", []string{acl.ID})
-    err = ctx.GetStub().PutState(stateid, aclJSON)
+    err = s.putStateChecked(ctx, stateid, acl)
     if err != nil {
-        return "", fmt.Errorf("failed to put to world state. %v", err)
+        return "", err
     }
 
     return acl.ID, nil
@@ -167,7 +210,7 @@ func (s *SmartContract) DeleteACLEntry(ctx contractapi.TransactionContextInterfa
 
     var id string
 
-    if entrytype == ACL_EntryType_User {
+    if entrytype == ACL_EntryType_User || entrytype == ACL_EntryType_UserTree {
         usr, err := s.GetUserByUID(ctx, entity)
         if err != nil {
             return false, fmt.Errorf("unknown user")
@@ -198,15 +241,10 @@ func (s *SmartContract) DeleteACLEntry(ctx contractapi.TransactionContextInterfa
         return false, nil
     }
 
-    aclJSON, err := json.Marshal(acl)
-    if err != nil {
-        return false, err
-    }
-
     stateid, _ := ctx.GetStub().CreateCompositeKey("ACL", []string{acl.ID})
-    err = ctx.GetStub().PutState(stateid, aclJSON)
+    err = s.putStateChecked(ctx, stateid, acl)
     if err != nil {
-        return false, fmt.Errorf("failed to put to world state. %v", err)
+        return false, err
     }
 
     return removed, nil
@@ -215,6 +253,44 @@ func (s *SmartContract) DeleteACLEntry(ctx contractapi.TransactionContextInterfa
 func (s *SmartContract) AddACLEntry(ctx contractapi.TransactionContextInterface,
                                     name string, entrytype uint32,
                                     entity string, perms uint32) (bool, error) {
+    return s.addaclentry(ctx, name, entrytype, entity, perms, false, 0)
+}
+
+// Add an entry that denies the specified permissions to the entity, regardless
+// of what any other entries in the ACL grant.
+func (s *SmartContract) AddACLDenyEntry(ctx contractapi.TransactionContextInterface,
+                                        name string, entrytype uint32,
+                                        entity string, perms uint32) (bool, error) {
+    return s.addaclentry(ctx, name, entrytype, entity, perms, true, 0)
+}
+
+// Add an entry that grants the specified permissions to the entity until the
+// given time (in seconds since the epoch), after which it is ignored.
+func (s *SmartContract) AddTemporaryACLEntry(ctx contractapi.TransactionContextInterface,
+                                             name string, entrytype uint32,
+                                             entity string, perms uint32,
+                                             expiresAt int64) (bool, error) {
+    now, err := gettxtime(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    if expiresAt <= now {
+        return false, fmt.Errorf("expiry must be in the future")
+    }
+
+    return s.addaclentry(ctx, name, entrytype, entity, perms, false, expiresAt)
+}
+
+func (s *SmartContract) addaclentry(ctx contractapi.TransactionContextInterface,
+                                    name string, entrytype uint32,
+                                    entity string, perms uint32,
+                                    deny bool, expires int64) (bool, error) {
+    err := validateperms(perms)
+    if err != nil {
+        return false, err
+    }
+
     acl, err := s.GetMyACLByName(ctx, name)
     if err != nil || acl == nil {
         return false, fmt.Errorf("unknown acl")
@@ -222,7 +298,7 @@ func (s *SmartContract) AddACLEntry(ctx contractapi.TransactionContextInterface,
 
     var id string
 
-    if entrytype == ACL_EntryType_User {
+    if entrytype == ACL_EntryType_User || entrytype == ACL_EntryType_UserTree {
         usr, err := s.GetUserByUID(ctx, entity)
         if err != nil {
             return false, fmt.Errorf("unknown user")
@@ -251,19 +327,16 @@ func (s *SmartContract) AddACLEntry(ctx contractapi.TransactionContextInterface,
         Entity:         entity,
         EntryType:      entrytype,
         Permissions:    perms,
+        Deny:           deny,
+        ExpiresAt:      expires,
     }
 
     // Update our entry in the db
     acl.Permissions = append(acl.Permissions, ent)
-    aclJSON, err := json.Marshal(acl)
-    if err != nil {
-        return false, err
-    }
-
     stateid, _ := ctx.GetStub().CreateCompositeKey("ACL", []string{acl.ID})
-    err = ctx.GetStub().PutState(stateid, aclJSON)
+    err = s.putStateChecked(ctx, stateid, acl)
     if err != nil {
-        return false, fmt.Errorf("failed to put to world state. %v", err)
+        return false, err
     }
 
     return true, nil
@@ -273,6 +346,11 @@ func (s *SmartContract) EditACLEntry(ctx contractapi.TransactionContextInterface
                                      name string, entrytype uint32,
                                      entity string,
                                      perms uint32) (bool, error) {
+    err := validateperms(perms)
+    if err != nil {
+        return false, err
+    }
+
     acl, err := s.GetMyACLByName(ctx, name)
     if err != nil || acl == nil {
         return false, fmt.Errorf("unknown acl")
@@ -280,7 +358,7 @@ func (s *SmartContract) EditACLEntry(ctx contractapi.TransactionContextInterface
 
     var id string
 
-    if entrytype == ACL_EntryType_User {
+    if entrytype == ACL_EntryType_User || entrytype == ACL_EntryType_UserTree {
         usr, err := s.GetUserByUID(ctx, entity)
         if err != nil {
             return false, fmt.Errorf("unknown user")
@@ -311,20 +389,294 @@ func (s *SmartContract) EditACLEntry(ctx contractapi.TransactionContextInterface
     }
 
     // Update our entry in the db
-    aclJSON, err := json.Marshal(acl)
+    stateid, _ := ctx.GetStub().CreateCompositeKey("ACL", []string{acl.ID})
+    err = s.putStateChecked(ctx, stateid, acl)
     if err != nil {
         return false, err
     }
 
+    return true, nil
+}
+
+// Find any entries in one of the caller's ACL templates that refer to users or
+// groups that no longer exist.
+func (s *SmartContract) ValidateACL(ctx contractapi.TransactionContextInterface,
+                                    name string) ([]ACLEntry, error) {
+    acl, err := s.GetMyACLByName(ctx, name)
+    if err != nil || acl == nil {
+        return nil, fmt.Errorf("unknown acl")
+    }
+
+    dead := make([]ACLEntry, 0)
+    for _, ent := range acl.Permissions {
+        if !s.aclentryvalid(ctx, ent) {
+            dead = append(dead, ent)
+        }
+    }
+
+    return dead, nil
+}
+
+// Remove any entries from one of the caller's ACL templates that refer to users
+// or groups that no longer exist (or that have expired), returning how many
+// were removed.
+func (s *SmartContract) CompactACL(ctx contractapi.TransactionContextInterface,
+                                   name string) (uint64, error) {
+    acl, err := s.GetMyACLByName(ctx, name)
+    if err != nil || acl == nil {
+        return 0, fmt.Errorf("unknown acl")
+    }
+
+    live := make([]ACLEntry, 0, len(acl.Permissions))
+    for _, ent := range acl.Permissions {
+        if s.aclentryvalid(ctx, ent) {
+            live = append(live, ent)
+        }
+    }
+
+    removed := uint64(len(acl.Permissions) - len(live))
+    if removed == 0 {
+        return 0, nil
+    }
+
+    // Update our entry in the db
+    acl.Permissions = live
+    stateid, _ := ctx.GetStub().CreateCompositeKey("ACL", []string{acl.ID})
+    err = s.putStateChecked(ctx, stateid, acl)
+    if err != nil {
+        return 0, err
+    }
+
+    return removed, nil
+}
+
+// Rewrite the display strings on the entries of one of the caller's ACL
+// templates from the current UIDs and group names they refer to. Entries for
+// users or groups that no longer exist are left alone (see CompactACL).
+func (s *SmartContract) RefreshACLEntities(ctx contractapi.TransactionContextInterface,
+                                           name string) (bool, error) {
+    acl, err := s.GetMyACLByName(ctx, name)
+    if err != nil || acl == nil {
+        return false, fmt.Errorf("unknown acl")
+    }
+
+    changed := false
+    for i := range acl.Permissions {
+        ent := &acl.Permissions[i]
+        entity := ent.Entity
+
+        if ent.EntryType == ACL_EntryType_User ||
+           ent.EntryType == ACL_EntryType_UserTree {
+            usr, _ := s.GetUserByID(ctx, ent.ID)
+            if usr != nil {
+                entity = fmt.Sprintf("User: %s", usr.UID)
+            }
+        } else if ent.EntryType == ACL_EntryType_Group {
+            grp, _ := s.GetGroupByID(ctx, ent.ID)
+            if grp != nil {
+                entity = fmt.Sprintf("Group: %s", grp.Name)
+            }
+        } else if ent.EntryType == ACL_EntryType_Public {
+            entity = "Public"
+        }
+
+        if entity != ent.Entity {
+            ent.Entity = entity
+            changed = true
+        }
+    }
+
+    if !changed {
+        return false, nil
+    }
+
+    // Update our entry in the db
     stateid, _ := ctx.GetStub().CreateCompositeKey("ACL", []string{acl.ID})
-    err = ctx.GetStub().PutState(stateid, aclJSON)
+    err = s.putStateChecked(ctx, stateid, acl)
     if err != nil {
-        return false, fmt.Errorf("failed to put to world state. %v", err)
+        return false, err
     }
 
     return true, nil
 }
 
+// Does the entity an ACL entry refers to still exist?
+func (s *SmartContract) aclentryvalid(ctx contractapi.TransactionContextInterface,
+                                      ent ACLEntry) bool {
+    if ent.ExpiresAt != 0 {
+        now, err := gettxtime(ctx)
+        if err == nil && ent.ExpiresAt <= now {
+            return false
+        }
+    }
+
+    if ent.EntryType == ACL_EntryType_User ||
+       ent.EntryType == ACL_EntryType_UserTree {
+        usr, _ := s.GetUserByID(ctx, ent.ID)
+        return usr != nil
+    } else if ent.EntryType == ACL_EntryType_Group {
+        grp, _ := s.GetGroupByID(ctx, ent.ID)
+        return grp != nil
+    } else if ent.EntryType == ACL_EntryType_Public {
+        return true
+    }
+
+    return false
+}
+
+// Export one of the caller's ACL templates as JSON that can be imported on
+// another ledger with ImportACL.
+func (s *SmartContract) ExportACL(ctx contractapi.TransactionContextInterface,
+                                  name string) (string, error) {
+    acl, err := s.GetMyACLByName(ctx, name)
+    if err != nil || acl == nil {
+        return "", fmt.Errorf("unknown acl")
+    }
+
+    rv := ExportedACL {
+        Name:       acl.Name,
+        Entries:    make([]ExportedACLEntry, 0, len(acl.Permissions)),
+    }
+
+    for _, ent := range acl.Permissions {
+        var ename string
+
+        if ent.EntryType == ACL_EntryType_User ||
+           ent.EntryType == ACL_EntryType_UserTree {
+            usr, err := s.GetUserByID(ctx, ent.ID)
+            if err != nil {
+                return "", fmt.Errorf("acl references unknown user %s", ent.ID)
+            }
+
+            ename = usr.UID
+        } else if ent.EntryType == ACL_EntryType_Group {
+            grp, err := s.GetGroupByID(ctx, ent.ID)
+            if err != nil || grp == nil {
+                return "", fmt.Errorf("acl references unknown group %s", ent.ID)
+            }
+
+            ename = grp.Name
+        } else if ent.EntryType != ACL_EntryType_Public {
+            return "", fmt.Errorf("invalid entry type %d", ent.EntryType)
+        }
+
+        rv.Entries = append(rv.Entries, ExportedACLEntry {
+            Name:           ename,
+            EntryType:      ent.EntryType,
+            Permissions:    ent.Permissions,
+            Deny:           ent.Deny,
+            ExpiresAt:      ent.ExpiresAt,
+        })
+    }
+
+    js, err := json.Marshal(rv)
+    if err != nil {
+        return "", err
+    }
+
+    return string(js), nil
+}
+
+// Create a new ACL template for the caller from JSON produced by ExportACL,
+// looking up the users and groups it names on this ledger. If any of them
+// can't be found, nothing is created and all of the missing names are
+// reported. Quietly dropping entries isn't an option, as a missing deny entry
+// would grant more access than the original template did.
+func (s *SmartContract) ImportACL(ctx contractapi.TransactionContextInterface,
+                                  name string, aclJSON string) (string, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return "", err
+    }
+
+    var in ExportedACL
+    err = json.Unmarshal([]byte(aclJSON), &in)
+    if err != nil {
+        return "", fmt.Errorf("invalid acl: %v", err)
+    }
+
+    if name == "" {
+        name = in.Name
+    }
+
+    tmp, _ := s.getuseraclbyname(ctx, myuser.ID, name)
+    if tmp != nil {
+        return "", fmt.Errorf("ACL already exists")
+    }
+
+    ctime, err := gettxtime(ctx)
+    if err != nil {
+        return "", err
+    }
+
+    acl := ACLTemplate {
+        Type:           "ACL",
+        ID:             uuid.NewString(),
+        Owner:          myuser.ID,
+        Name:           name,
+        Permissions:    make([]ACLEntry, 0, len(in.Entries)),
+        CTime:          ctime,
+    }
+
+    missing := make([]string, 0)
+
+    for _, ent := range in.Entries {
+        err = validateperms(ent.Permissions)
+        if err != nil {
+            return "", err
+        }
+
+        var id, entity string
+
+        if ent.EntryType == ACL_EntryType_User ||
+           ent.EntryType == ACL_EntryType_UserTree {
+            usr, err := s.GetUserByUID(ctx, ent.Name)
+            if err != nil || usr == nil {
+                missing = append(missing, "user " + ent.Name)
+                continue
+            }
+
+            id = usr.ID
+            entity = fmt.Sprintf("User: %s", ent.Name)
+        } else if ent.EntryType == ACL_EntryType_Group {
+            grp, err := s.GetGroupByName(ctx, ent.Name)
+            if err != nil || grp == nil {
+                missing = append(missing, "group " + ent.Name)
+                continue
+            }
+
+            id = grp.ID
+            entity = fmt.Sprintf("Group: %s", ent.Name)
+        } else if ent.EntryType == ACL_EntryType_Public {
+            id = "*"
+        } else {
+            return "", fmt.Errorf("invalid entry type %d", ent.EntryType)
+        }
+
+        acl.Permissions = append(acl.Permissions, ACLEntry {
+            ID:             id,
+            Entity:         entity,
+            EntryType:      ent.EntryType,
+            Permissions:    ent.Permissions,
+            Deny:           ent.Deny,
+            ExpiresAt:      ent.ExpiresAt,
+        })
+    }
+
+    if len(missing) != 0 {
+        return "", fmt.Errorf("unresolvable acl entries: %s",
+                              strings.Join(missing, ", "))
+    }
+
+    stateid, _ := ctx.GetStub().CreateCompositeKey("ACL", []string{acl.ID})
+    err = s.putStateChecked(ctx, stateid, acl)
+    if err != nil {
+        return "", err
+    }
+
+    return acl.ID, nil
+}
+
 func (s *SmartContract) DeleteMyACL(ctx contractapi.TransactionContextInterface,
                                     name string) (bool, error) {
     acl, err := s.GetMyACLByName(ctx, name)
@@ -415,7 +767,12 @@ func (s *SmartContract) GetAllMyACLs(ctx contractapi.TransactionContextInterface
         return nil, err
     }
 
-    query := fmt.Sprintf(`{"selector":{"type":"ACL","owner":"%s"}}`, myuser.ID)
+    return s.getuseracls(ctx, myuser.ID)
+}
+
+func (s *SmartContract) getuseracls(ctx contractapi.TransactionContextInterface,
+                                    id string) ([]*ACLTemplate, error) {
+    query := fmt.Sprintf(`{"selector":{"type":"ACL","owner":"%s"}}`, id)
     resultsIterator, err := ctx.GetStub().GetQueryResult(query)
     if err != nil {
         return nil, err
@@ -441,6 +798,48 @@ func (s *SmartContract) GetAllMyACLs(ctx contractapi.TransactionContextInterface
     return acls, nil
 }
 
+// Find all ACL templates that have an entry for the specified user or group
+func (s *SmartContract) FindACLsReferencing(ctx contractapi.TransactionContextInterface,
+                                            entrytype uint32,
+                                            entity string) ([]*ACLTemplate, error) {
+    var id string
+
+    if entrytype == ACL_EntryType_User || entrytype == ACL_EntryType_UserTree {
+        usr, err := s.GetUserByUID(ctx, entity)
+        if err != nil {
+            return nil, fmt.Errorf("unknown user")
+        }
+
+        id = usr.ID
+    } else if entrytype == ACL_EntryType_Group {
+        grp, err := s.GetGroupByName(ctx, entity)
+        if err != nil {
+            return nil, fmt.Errorf("unknown group")
+        }
+
+        id = grp.ID
+    } else {
+        return nil, fmt.Errorf("invalid entry type")
+    }
+
+    all, err := s.GetAllACLs(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    acls := make([]*ACLTemplate, 0)
+    for _, acl := range all {
+        for _, ent := range acl.Permissions {
+            if ent.EntryType == entrytype && ent.ID == id {
+                acls = append(acls, acl)
+                break
+            }
+        }
+    }
+
+    return acls, nil
+}
+
 var access_to_bits = [...]uint32 {
     ACL_Perms_ReadObject,
     ACL_Perms_CreateObject,
@@ -449,10 +848,194 @@ var access_to_bits = [...]uint32 {
     ACL_Perms_ListObjects,
 }
 
+// Gather up everywhere a user has been given access: the permissions their
+// parent gave them as a sub-user, the groups they're directly in, and the
+// bucket and object ACL entries that name them, one of their ancestors (for
+// user tree entries), or one of their groups. Only one page worth of buckets
+// and of objects are looked at; Truncated is set if there may be more. Callers
+// can look at themselves, their sub-users, or anyone if they're an admin.
+func (s *SmartContract) GetGrantsForUser(ctx contractapi.TransactionContextInterface,
+                                         uid string) (*UserGrants, error) {
+    me, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    user, err := s.GetUserByUID(ctx, uid)
+    if err != nil {
+        return nil, err
+    }
+
+    if user.ID != me.ID && !isadmin(me) &&
+       !s.isuserdescendent(ctx, user, me.ID) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    rv := UserGrants {
+        UID:        user.UID,
+        Groups:     make([]string, 0),
+        Buckets:    make([]ACLGrant, 0),
+        Objects:    make([]ACLGrant, 0),
+    }
+
+    // Which IDs could an ACL entry use to refer to this user?
+    users := map[string]bool{ user.ID: true }
+    trees := map[string]bool{ user.ID: true }
+    groups := map[string]bool{}
+    ids := []string{ user.ID }
+
+    if user.Parent != "" {
+        parent, _ := s.GetUserByID(ctx, user.Parent)
+        if parent != nil {
+            rv.Parent = parent.UID
+            for _, su := range parent.SubUsers {
+                if su.ID == user.ID {
+                    rv.SubUserPerms = su.Perms
+                }
+            }
+        }
+
+        for p := parent; p != nil && len(ids) < 64; {
+            trees[p.ID] = true
+            ids = append(ids, p.ID)
+
+            if p.Parent == "" {
+                break
+            }
+
+            p, _ = s.GetUserByID(ctx, p.Parent)
+        }
+    }
+
+    grps, err := s.getusergroups(ctx, user.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, g := range grps {
+        rv.Groups = append(rv.Groups, g.Name)
+        groups[g.ID] = true
+        ids = append(ids, g.ID)
+    }
+
+    applies := func(ent ACLEntry) bool {
+        switch ent.EntryType {
+        case ACL_EntryType_User:
+            return users[ent.ID]
+        case ACL_EntryType_UserTree:
+            return trees[ent.ID]
+        case ACL_EntryType_Group:
+            return groups[ent.ID]
+        }
+
+        return false
+    }
+
+    for _, kind := range []string{ "Bucket", "Object" } {
+        querymap := map[string]interface{} {
+            "type":     kind,
+            "perms":    map[string]interface{} {
+                "$elemMatch": map[string]interface{} {
+                    "id": map[string]interface{} { "$in": ids },
+                },
+            },
+        }
+
+        js, err := json.Marshal(querymap)
+        if err != nil {
+            return nil, err
+        }
+
+        max := s.pagesize(0)
+        dbquery := fmt.Sprintf(`{"selector":%s}`, js)
+        iter, _, err := ctx.GetStub().GetQueryResultWithPagination(dbquery,
+                int32(max), "")
+        if err != nil {
+            return nil, err
+        }
+
+        var count uint32 = 0
+        for iter.HasNext() {
+            resp, err := iter.Next()
+            if err != nil {
+                iter.Close()
+                return nil, err
+            }
+
+            count++
+
+            // Just pull out the bits that buckets and objects have in common.
+            var doc struct {
+                Name        string  `json:"name"`
+                Bucket      string  `json:"bucket"`
+                Key         string  `json:"key"`
+                Permissions ACL     `json:"perms"`
+            }
+
+            err = json.Unmarshal(resp.Value, &doc)
+            if err != nil {
+                iter.Close()
+                return nil, err
+            }
+
+            for _, ent := range doc.Permissions {
+                if !applies(ent) {
+                    continue
+                }
+
+                if kind == "Bucket" {
+                    rv.Buckets = append(rv.Buckets, ACLGrant {
+                        Bucket:     doc.Name,
+                        Entry:      ent,
+                    })
+                } else {
+                    rv.Objects = append(rv.Objects, ACLGrant {
+                        Bucket:     doc.Bucket,
+                        Key:        doc.Key,
+                        Entry:      ent,
+                    })
+                }
+            }
+        }
+
+        iter.Close()
+
+        if count >= max {
+            rv.Truncated = true
+        }
+    }
+
+    return &rv, nil
+}
+
+// Check a user's access to an object through the ACLs in effect on it. If the
+// object has an ACL, it controls the access. Otherwise, the bucket's ACL does.
+// With no object (e.g, when creating one), only the bucket's ACL applies.
+// Ownership isn't considered here, so callers need to check that first.
+func (s *SmartContract) checkObjectAccess(ctx contractapi.TransactionContextInterface,
+                                          obj *Object, bkt *Bucket,
+                                          uid string, access uint32) bool {
+    if obj != nil && len(obj.Permissions) != 0 {
+        return s.testaclaccess(ctx, obj.Permissions, uid, bkt.Name, access)
+    } else if len(bkt.Permissions) != 0 {
+        return s.testaclaccess(ctx, bkt.Permissions, uid, bkt.Name, access)
+    }
+
+    return false
+}
+
 func (s *SmartContract) testaclaccess(ctx contractapi.TransactionContextInterface,
                                       acl ACL, uid string, bucket string,
                                       access uint32) bool {
-    if access > uint32(len(access_to_bits)) {
+    return s.traceaclaccess(ctx, acl, uid, bucket, access, nil)
+}
+
+// Does the work of testaclaccess, optionally recording how the decision was
+// made in the trace passed in.
+func (s *SmartContract) traceaclaccess(ctx contractapi.TransactionContextInterface,
+                                       acl ACL, uid string, bucket string,
+                                       access uint32, trace *AccessTrace) bool {
+    if access >= uint32(len(access_to_bits)) {
         return false
     }
 
@@ -471,25 +1054,72 @@ func (s *SmartContract) testaclaccess(ctx contractapi.TransactionContextInterfac
         return false
     }
 
-    // Run through each entry in the ACL, testing each one that might
+    if trace != nil {
+        trace.UserPerms = iuser
+        trace.GroupPerms = groups
+    }
+
+    now, err := gettxtime(ctx)
+    if err != nil {
+        return false
+    }
+
+    // Deny entries are looked at first, since they override any grants. After
+    // that, run through each entry in the ACL, testing each one that might
     // potentially give us the access requested.
-    for _, ent := range acl {
-        // Don't bother looking at ACL entries that don't have enough permission
-        if (access_to_bits[access] & ent.Permissions) == 0 {
-            continue
-        }
+    for _, deny := range []bool{true, false} {
+        for i, ent := range acl {
+            if ent.Deny != deny {
+                continue
+            }
 
-        if ent.EntryType == ACL_EntryType_User {
-            // The iuser map includes both direct and inherited permissions.
-            p := iuser[ent.ID]
-            if (p & ent.Permissions) != 0 {
-                return true
+            // Temporary entries stop counting once they've expired.
+            if ent.ExpiresAt != 0 && ent.ExpiresAt <= now {
+                continue
             }
-        } else if ent.EntryType == ACL_EntryType_Group {
-            // The groups map includes both direct and inherited permissions.
-            p := groups[ent.ID]
-            if (p & ent.Permissions) != 0 {
-                return true
+
+            // Don't bother looking at ACL entries that don't cover the access
+            // we're interested in.
+            if (access_to_bits[access] & ent.Permissions) == 0 {
+                continue
+            }
+
+            var p uint32
+            if ent.EntryType == ACL_EntryType_User {
+                // The iuser map includes both direct and inherited permissions.
+                p = iuser[ent.ID]
+            } else if ent.EntryType == ACL_EntryType_UserTree {
+                // Anyone at or below the user in the tree matches, but only
+                // with what was delegated down to them on the way.
+                if user.ID == ent.ID || s.isuserdescendent(ctx, user, ent.ID) {
+                    p = iuser[ent.ID]
+                }
+            } else if ent.EntryType == ACL_EntryType_Group {
+                // The groups map includes both direct and inherited permissions.
+                p = groups[ent.ID]
+            } else if ent.EntryType == ACL_EntryType_Public {
+                // Public entries apply to everyone.
+                p = 0x000000ff
+            }
+
+            // What we hold through the entry only counts if it covers the
+            // access in question, not just anything the entry grants.
+            matched := (p & ent.Permissions & access_to_bits[access]) != 0
+
+            if trace != nil {
+                trace.Entries = append(trace.Entries, ACLEntryTrace {
+                    Entry:      ent,
+                    Held:       p,
+                    Granted:    matched && !deny,
+                })
+
+                if matched {
+                    trace.Decider = &acl[i]
+                }
+            }
+
+            if matched {
+                return !deny
             }
         }
     }
@@ -497,6 +1127,70 @@ func (s *SmartContract) testaclaccess(ctx contractapi.TransactionContextInterfac
     return false
 }
 
+// Explain how an access decision for a user on a bucket or object is made.
+// Callers can trace themselves, anything in buckets they own, or anything at
+// all if they're an admin.
+func (s *SmartContract) TraceAccess(ctx contractapi.TransactionContextInterface,
+                                    uid string, bucket string, key string,
+                                    access uint32) (*AccessTrace, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    if myuser.UID != uid && bkt.Owner != myuser.ID && !isadmin(myuser) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    user, err := s.GetUserByUID(ctx, uid)
+    if err != nil {
+        return nil, err
+    }
+
+    trace := AccessTrace {
+        UID:            uid,
+        Bucket:         bucket,
+        Key:            key,
+        AccessType:     access,
+        Entries:        make([]ACLEntryTrace, 0),
+    }
+
+    var obj *Object
+    if key != "" {
+        obj, err = s.getobject(ctx, bucket, key)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    // Follow the same order of precedence as the real checks: ownership first,
+    // then the object's ACL if it has one, then the bucket's.
+    if obj != nil && obj.Owner == user.ID {
+        trace.Source = "owner"
+        trace.Granted = true
+    } else if obj == nil && bkt.Owner == user.ID {
+        trace.Source = "owner"
+        trace.Granted = true
+    } else if obj != nil && len(obj.Permissions) != 0 {
+        trace.Source = "object"
+        trace.Granted = s.traceaclaccess(ctx, obj.Permissions, uid, bucket,
+                                         access, &trace)
+    } else if len(bkt.Permissions) != 0 {
+        trace.Source = "bucket"
+        trace.Granted = s.traceaclaccess(ctx, bkt.Permissions, uid, bucket,
+                                         access, &trace)
+    } else {
+        trace.Source = "none"
+    }
+
+    return &trace, nil
+}
+
 func (s *SmartContract) TestMyACL(ctx contractapi.TransactionContextInterface,
                                   name string, tests []ACLTest) ([]bool, error) {
     acl, err := s.GetMyACLByName(ctx, name)
@@ -513,17 +1207,107 @@ func (s *SmartContract) TestMyACL(ctx contractapi.TransactionContextInterface,
     return rvs, nil
 }
 
-// Convert a template into a stored ACL for an object or bucket
-func templatetoacl(tacl *ACLTemplate) ACL {
+// Test access against the ACLs actually in effect on a set of objects. An
+// object's ACL controls the access if it has one, otherwise the bucket's ACL
+// does. Create access (or any access to an object that doesn't exist yet) is
+// tested against the bucket alone. As with TraceAccess, callers can only test
+// themselves, anyone in buckets they own, or anyone at all if they're an admin.
+func (s *SmartContract) TestAccessBatch(ctx contractapi.TransactionContextInterface,
+                                        tests []ObjectAccessTest) ([]bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    rvs := make([]bool, len(tests))
+    bkts := map[string]*Bucket{}
+
+    for i, ent := range tests {
+        bkt, ok := bkts[ent.Bucket]
+        if !ok {
+            bkt, _ = s.GetBucket(ctx, ent.Bucket)
+            bkts[ent.Bucket] = bkt
+        }
+
+        if bkt == nil {
+            continue
+        }
+
+        if ent.UID != myuser.UID && bkt.Owner != myuser.ID && !isadmin(myuser) {
+            return nil, fmt.Errorf("permission denied")
+        }
+
+        user, _ := s.GetUserByUID(ctx, ent.UID)
+        if user == nil {
+            continue
+        }
+
+        var obj *Object
+        if ent.Key != "" && ent.AccessType != ACL_AccessType_Create &&
+           ent.AccessType != ACL_AccessType_List {
+            obj, _ = s.getobject(ctx, ent.Bucket, ent.Key)
+            if obj == nil {
+                continue
+            }
+        }
+
+        if obj != nil && obj.Owner == user.ID {
+            rvs[i] = true
+        } else if obj == nil && bkt.Owner == user.ID {
+            rvs[i] = true
+        } else {
+            rvs[i] = s.checkObjectAccess(ctx, obj, bkt, ent.UID,
+                                         ent.AccessType)
+        }
+    }
+
+    return rvs, nil
+}
+
+// Look up one of a user's ACL templates by name and convert it into an ACL to
+// be stored on an object or bucket. Templates can only be applied by the user
+// that owns them. An empty name gives an empty ACL.
+func (s *SmartContract) resolveacltemplate(ctx contractapi.TransactionContextInterface,
+                                           user *User,
+                                           name string) (ACL, error) {
+    if name == "" {
+        return templatetoacl(nil, 0), nil
+    }
+
+    tacl, err := s.getuseraclbyname(ctx, user.ID, name)
+    if err != nil {
+        return nil, err
+    } else if tacl.Owner != user.ID {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    now, err := gettxtime(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    return templatetoacl(tacl, now), nil
+}
+
+// Convert a template into a stored ACL for an object or bucket. Temporary
+// entries keep their expiry, and any that have already run out as of now are
+// left out.
+func templatetoacl(tacl *ACLTemplate, now int64) ACL {
     if tacl != nil {
-        acl := make([]ACLEntry, len(tacl.Permissions))
+        acl := make([]ACLEntry, 0, len(tacl.Permissions))
 
-        for i, _ := range tacl.Permissions {
-            acl[i] = ACLEntry {
-                ID:             tacl.Permissions[i].ID,
-                EntryType:      tacl.Permissions[i].EntryType,
-                Permissions:    tacl.Permissions[i].Permissions,
+        for _, ent := range tacl.Permissions {
+            if ent.ExpiresAt != 0 && ent.ExpiresAt <= now {
+                continue
             }
+
+            acl = append(acl, ACLEntry {
+                ID:             ent.ID,
+                EntryType:      ent.EntryType,
+                Permissions:    ent.Permissions,
+                Deny:           ent.Deny,
+                ExpiresAt:      ent.ExpiresAt,
+            })
         }
 
         return acl
@@ -0,0 +1,1077 @@
+/*
+    Copyright (C) 2024 Lawrence Sebald
+    All Rights Reserved
+*/
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/hyperledger/fabric-chaincode-go/v2/shim"
+)
+
+// Ask, as the given caller, whether the named user has a kind of access to a
+// bucket (or an object in it, if key isn't empty).
+func (e *testenv) access(caller string, user string, bucket string,
+                         key string, access uint32) bool {
+    e.t.Helper()
+
+    rvs := mustcall(e, caller, func(ctx txctx) ([]bool, error) {
+        return e.cc.TestAccessBatch(ctx, []ObjectAccessTest{{
+            UID:        uidof(user),
+            Bucket:     bucket,
+            Key:        key,
+            AccessType: access,
+        }})
+    })
+
+    return rvs[0]
+}
+
+// Make an ACL template owned by the named user, granting permissions to users
+// (by name) and groups.
+func (e *testenv) createacl(user string, name string, uperms map[string]uint32,
+                            gperms map[string]uint32) {
+    e.t.Helper()
+
+    byuid := map[string]uint32{}
+    for k, v := range uperms {
+        byuid[uidof(k)] = v
+    }
+
+    mustcall(e, user, func(ctx txctx) (string, error) {
+        return e.cc.CreateACL(ctx, name, byuid, gperms)
+    })
+}
+
+func TestAccessBatchUsesEffectiveACL(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+
+    env.createacl("alice", "bob-reads", map[string]uint32{
+        "bob":      ACL_Perms_ReadObject | ACL_Perms_ListObjects,
+    }, nil)
+    env.createacl("alice", "carol-reads", map[string]uint32{
+        "carol":    ACL_Perms_ReadObject,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "bob-reads")
+    })
+
+    // One object falls back on the bucket's ACL, the other has its own.
+    env.putobject("alice", "bucket-a", "bucket.txt", "data", nil, false)
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "bucket-a", "own.txt", 4, md5hex("data"),
+                                   nil, nil, "carol-reads", false)
+    })
+
+    tests := []ObjectAccessTest{
+        {uidof("bob"), "bucket-a", "bucket.txt", ACL_AccessType_Read},
+        {uidof("bob"), "bucket-a", "own.txt", ACL_AccessType_Read},
+        {uidof("carol"), "bucket-a", "bucket.txt", ACL_AccessType_Read},
+        {uidof("carol"), "bucket-a", "own.txt", ACL_AccessType_Read},
+        {uidof("alice"), "bucket-a", "own.txt", ACL_AccessType_Delete},
+        {uidof("bob"), "bucket-a", "missing.txt", ACL_AccessType_Read},
+    }
+    want := []bool{true, false, false, true, true, false}
+
+    got := mustcall(env, "alice", func(ctx txctx) ([]bool, error) {
+        return env.cc.TestAccessBatch(ctx, tests)
+    })
+
+    for i := range tests {
+        if got[i] != want[i] {
+            t.Errorf("test %d (%+v) = %v, want %v", i, tests[i], got[i],
+                     want[i])
+        }
+    }
+}
+
+func TestAccessBatchLimitedToOwnersAndSelf(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+
+    probe := func(caller string, user string) error {
+        _, err := call(env, caller, func(ctx txctx) ([]bool, error) {
+            return env.cc.TestAccessBatch(ctx, []ObjectAccessTest{{
+                UID:        uidof(user),
+                Bucket:     "bucket-a",
+                AccessType: ACL_AccessType_Read,
+            }})
+        })
+        return err
+    }
+
+    if err := probe("bob", "bob"); err != nil {
+        t.Errorf("testing own access failed: %v", err)
+    }
+
+    if err := probe("alice", "carol"); err != nil {
+        t.Errorf("bucket owner testing another user failed: %v", err)
+    }
+
+    if err := probe("admin", "carol"); err != nil {
+        t.Errorf("admin testing another user failed: %v", err)
+    }
+
+    if err := probe("bob", "carol"); err == nil {
+        t.Errorf("unrelated user allowed to probe someone else's access")
+    }
+}
+
+func TestFindACLsReferencingGroup(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups)
+    env.adduser("bob", 0)
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "guests", false)
+    })
+
+    env.createacl("alice", "staff-only", nil, map[string]uint32{
+        "staff":    ACL_Perms_ReadObject | ACL_Perms_DeleteObject,
+    })
+    env.createacl("alice", "guests-only", nil, map[string]uint32{
+        "guests":   ACL_Perms_ReadObject,
+    })
+    env.createacl("bob", "mixed", map[string]uint32{
+        "alice":    ACL_Perms_ReadObject,
+    }, map[string]uint32{
+        "staff":    ACL_Perms_ReadObject,
+        "guests":   ACL_Perms_ReadObject,
+    })
+
+    acls := mustcall(env, "alice", func(ctx txctx) ([]*ACLTemplate, error) {
+        return env.cc.FindACLsReferencing(ctx, ACL_EntryType_Group, "staff")
+    })
+
+    names := map[string]bool{}
+    for _, acl := range acls {
+        names[acl.Name] = true
+    }
+
+    if len(acls) != 2 || !names["staff-only"] || !names["mixed"] {
+        t.Errorf("templates referencing staff = %v, want staff-only and mixed",
+                 names)
+    }
+
+    _, err := call(env, "alice", func(ctx txctx) ([]*ACLTemplate, error) {
+        return env.cc.FindACLsReferencing(ctx, ACL_EntryType_Group, "nobody")
+    })
+    if err == nil {
+        t.Errorf("looking up an unknown group succeeded")
+    }
+}
+
+func TestTraceAccessFindsGrantingEntry(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets | User_SysPerms_AddGroups)
+    env.adduser("bob", 0)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.AddUserToGroup(ctx, "staff", uidof("bob"))
+    })
+
+    env.createacl("alice", "mixed", map[string]uint32{
+        "bob":      ACL_Perms_DeleteObject,
+        "carol":    ACL_Perms_ReadObject,
+    }, map[string]uint32{
+        "staff":    ACL_Perms_ReadObject | ACL_Perms_ListObjects,
+    })
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "mixed")
+    })
+    env.putobject("alice", "bucket-a", "a.txt", "data", nil, false)
+
+    staff := mustcall(env, "alice", func(ctx txctx) (*Group, error) {
+        return env.cc.GetGroupByName(ctx, "staff")
+    })
+
+    trace := mustcall(env, "alice", func(ctx txctx) (*AccessTrace, error) {
+        return env.cc.TraceAccess(ctx, uidof("bob"), "bucket-a", "a.txt",
+                                  ACL_AccessType_Read)
+    })
+
+    if !trace.Granted || trace.Source != "bucket" {
+        t.Fatalf("trace = %+v, want granted through the bucket", trace)
+    }
+
+    if trace.Decider == nil || trace.Decider.EntryType != ACL_EntryType_Group ||
+       trace.Decider.ID != staff.ID {
+        t.Errorf("deciding entry = %+v, want the staff group's", trace.Decider)
+    }
+
+    // Bob's own entry doesn't cover reading, so it shouldn't even be looked at.
+    for _, ent := range trace.Entries {
+        if ent.Entry.EntryType == ACL_EntryType_User {
+            t.Errorf("entry %+v looked at for read access", ent.Entry)
+        }
+    }
+
+    trace = mustcall(env, "alice", func(ctx txctx) (*AccessTrace, error) {
+        return env.cc.TraceAccess(ctx, uidof("alice"), "bucket-a", "a.txt",
+                                  ACL_AccessType_Delete)
+    })
+    if !trace.Granted || trace.Source != "owner" || trace.Decider != nil {
+        t.Errorf("owner trace = %+v, want granted by ownership", trace)
+    }
+
+    _, err := call(env, "carol", func(ctx txctx) (*AccessTrace, error) {
+        return env.cc.TraceAccess(ctx, uidof("bob"), "bucket-a", "a.txt",
+                                  ACL_AccessType_Read)
+    })
+    if err == nil {
+        t.Errorf("unrelated user traced someone else's access")
+    }
+}
+
+func TestCompactACL(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddSubUsers | User_SysPerms_AddGroups)
+    bob := env.adduser("bob", 0)
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubUser(ctx, uidof("carol"), nil, 0)
+    })
+    for _, name := range []string{"staff", "temps"} {
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddGroup(ctx, name, false)
+        })
+    }
+
+    env.createacl("alice", "mixed", map[string]uint32{
+        "bob":      ACL_Perms_ReadObject,
+        "carol":    ACL_Perms_ReadObject,
+    }, map[string]uint32{
+        "staff":    ACL_Perms_ReadObject,
+        "temps":    ACL_Perms_ReadObject,
+    })
+
+    // Carol and the temps group go away, leaving their entries dangling.
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.RemoveSubUser(ctx, uidof("carol"))
+    })
+    temps := env.getgroup("temps")
+    key, _ := shim.CreateCompositeKey("Group", []string{temps.ID})
+    delete(env.state, key)
+
+    dead := mustcall(env, "alice", func(ctx txctx) ([]ACLEntry, error) {
+        return env.cc.ValidateACL(ctx, "mixed")
+    })
+    if len(dead) != 2 {
+        t.Errorf("ValidateACL found %d dangling entries, want 2", len(dead))
+    }
+
+    _, err := call(env, "bob", func(ctx txctx) (uint64, error) {
+        return env.cc.CompactACL(ctx, "mixed")
+    })
+    if err == nil {
+        t.Errorf("someone other than the owner compacted an ACL")
+    }
+
+    removed := mustcall(env, "alice", func(ctx txctx) (uint64, error) {
+        return env.cc.CompactACL(ctx, "mixed")
+    })
+    if removed != 2 {
+        t.Errorf("CompactACL removed %d entries, want 2", removed)
+    }
+
+    acl := mustcall(env, "alice", func(ctx txctx) (*ACLTemplate, error) {
+        return env.cc.GetMyACLByName(ctx, "mixed")
+    })
+    staff := env.getgroup("staff")
+    if len(acl.Permissions) != 2 {
+        t.Fatalf("entries left = %+v, want bob and staff", acl.Permissions)
+    }
+
+    for _, ent := range acl.Permissions {
+        if ent.ID != staff.ID && ent.ID != bob {
+            t.Errorf("unexpected entry left: %+v", ent)
+        }
+    }
+
+    // Once it's clean, there's nothing more to do.
+    removed = mustcall(env, "alice", func(ctx txctx) (uint64, error) {
+        return env.cc.CompactACL(ctx, "mixed")
+    })
+    if removed != 0 {
+        t.Errorf("second compaction removed %d entries", removed)
+    }
+}
+
+func TestUserTreeEntry(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("olivia", User_SysPerms_AddBuckets)
+    env.adduser("alice", User_SysPerms_AddSubUsers)
+    env.adduser("carol", 0)
+    env.addbucket("olivia", "bucket-a")
+
+    // Alice hands bob reading and listing, and bob passes reading on to dave.
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubUser(ctx, uidof("bob"), map[string]uint32{
+            "bucket-a": ACL_Perms_ReadObject | ACL_Perms_ListObjects,
+        }, User_SysPerms_AddSubUsers)
+    })
+    mustcall(env, "bob", func(ctx txctx) (string, error) {
+        return env.cc.AddSubUser(ctx, uidof("dave"), map[string]uint32{
+            "bucket-a": ACL_Perms_ReadObject,
+        }, 0)
+    })
+
+    env.createacl("olivia", "tree", nil, nil)
+    err := env.tx("olivia", func(ctx txctx) error {
+        _, err := env.cc.AddACLEntry(ctx, "tree", ACL_EntryType_UserTree,
+                                     uidof("alice"),
+                                     ACL_Perms_ReadObject | ACL_Perms_ListObjects |
+                                     ACL_Perms_DeleteObject)
+        return err
+    })
+    if err != nil {
+        t.Fatalf("adding user tree entry: %v", err)
+    }
+    mustcall(env, "olivia", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "tree")
+    })
+
+    tests := []struct {
+        user    string
+        access  uint32
+        want    bool
+    }{
+        {"alice", ACL_AccessType_Delete, true},
+        {"bob", ACL_AccessType_List, true},
+        {"bob", ACL_AccessType_Delete, false},
+        {"dave", ACL_AccessType_Read, true},
+        {"dave", ACL_AccessType_List, false},
+        {"carol", ACL_AccessType_Read, false},
+    }
+
+    for _, tc := range tests {
+        got := env.access("olivia", tc.user, "bucket-a", "", tc.access)
+        if got != tc.want {
+            t.Errorf("%s access %d = %v, want %v", tc.user, tc.access, got,
+                     tc.want)
+        }
+    }
+}
+
+func TestDenyEntryOverridesGrant(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets | User_SysPerms_AddGroups)
+    env.adduser("bob", 0)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "interns", false)
+    })
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.AddUserToGroup(ctx, "interns", uidof("bob"))
+    })
+
+    // Both bob and carol get everything by name, but interns can't delete. The
+    // deny comes last to show that order in the ACL doesn't matter.
+    env.createacl("alice", "mixed", map[string]uint32{
+        "bob":      ACL_Perms_ReadObject | ACL_Perms_DeleteObject,
+        "carol":    ACL_Perms_ReadObject | ACL_Perms_DeleteObject,
+    }, nil)
+    err := env.tx("alice", func(ctx txctx) error {
+        _, err := env.cc.AddACLDenyEntry(ctx, "mixed", ACL_EntryType_Group,
+                                         "interns", ACL_Perms_DeleteObject)
+        return err
+    })
+    if err != nil {
+        t.Fatalf("adding deny entry: %v", err)
+    }
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "mixed")
+    })
+
+    tests := []struct {
+        user    string
+        access  uint32
+        want    bool
+    }{
+        {"bob", ACL_AccessType_Read, true},
+        {"bob", ACL_AccessType_Delete, false},
+        {"carol", ACL_AccessType_Delete, true},
+    }
+
+    for _, tc := range tests {
+        got := env.access("alice", tc.user, "bucket-a", "", tc.access)
+        if got != tc.want {
+            t.Errorf("%s access %d = %v, want %v", tc.user, tc.access, got,
+                     tc.want)
+        }
+    }
+
+    trace := mustcall(env, "alice", func(ctx txctx) (*AccessTrace, error) {
+        return env.cc.TraceAccess(ctx, uidof("bob"), "bucket-a", "",
+                                  ACL_AccessType_Delete)
+    })
+    if trace.Granted || trace.Decider == nil || !trace.Decider.Deny {
+        t.Errorf("trace = %+v, want denied by the interns entry", trace)
+    }
+}
+
+func TestUndefinedPermissionBitsRejected(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets | User_SysPerms_AddGroups |
+                         User_SysPerms_AddSubUsers)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubGroup(ctx, "staff", "team", nil, false)
+    })
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubUser(ctx, uidof("carol"), nil, 0)
+    })
+
+    attempts := map[string]func(ctx txctx, perms uint32) error{
+        "CreateACL": func(ctx txctx, perms uint32) error {
+            _, err := env.cc.CreateACL(ctx, fmt.Sprintf("acl-%x", perms),
+                                       map[string]uint32{uidof("bob"): perms},
+                                       nil)
+            return err
+        },
+        "AddACLEntry": func(ctx txctx, perms uint32) error {
+            _, err := env.cc.AddACLEntry(ctx, "base", ACL_EntryType_Group,
+                                         "staff", perms)
+            return err
+        },
+        "EditACLEntry": func(ctx txctx, perms uint32) error {
+            _, err := env.cc.EditACLEntry(ctx, "base", ACL_EntryType_User,
+                                          uidof("bob"), perms)
+            return err
+        },
+        "SetSubGroupPermission": func(ctx txctx, perms uint32) error {
+            _, err := env.cc.SetSubGroupPermission(ctx, "staff", "team",
+                                                   "bucket-a", perms)
+            return err
+        },
+        "SetSubGroupPermissions": func(ctx txctx, perms uint32) error {
+            _, err := env.cc.SetSubGroupPermissions(ctx, "staff", "team",
+                    map[string]uint32{"bucket-a": perms})
+            return err
+        },
+        "SetSubUserPermission": func(ctx txctx, perms uint32) error {
+            _, err := env.cc.SetSubUserPermission(ctx, uidof("carol"),
+                                                  "bucket-a", perms)
+            return err
+        },
+    }
+
+    for name, fn := range attempts {
+        env.createacl("alice", "base", map[string]uint32{
+            "bob":      ACL_Perms_ReadObject,
+        }, nil)
+
+        if err := env.tx("alice", func(ctx txctx) error {
+            return fn(ctx, ACL_Perms_All)
+        }); err != nil {
+            t.Errorf("%s with every defined bit failed: %v", name, err)
+        }
+
+        for _, perms := range []uint32{0x20, ACL_Perms_ReadObject | 0x80000000} {
+            if err := env.tx("alice", func(ctx txctx) error {
+                return fn(ctx, perms)
+            }); err == nil {
+                t.Errorf("%s accepted undefined bits 0x%x", name, perms)
+            }
+        }
+
+        mustcall(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.DeleteMyACL(ctx, "base")
+        })
+    }
+
+    _, err := call(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubUser(ctx, uidof("dave"),
+                                 map[string]uint32{"bucket-a": 0x40}, 0)
+    })
+    if err == nil {
+        t.Errorf("sub-user added with undefined permission bits")
+    }
+
+    _, err = call(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubGroup(ctx, "staff", "temps",
+                                  map[string]uint32{"*": 0x40}, false)
+    })
+    if err == nil {
+        t.Errorf("sub-group added with undefined permission bits")
+    }
+}
+
+func TestExportImportACL(t *testing.T) {
+    // Users and groups for the template to name, made in a different order on
+    // each ledger so nothing can line up by accident.
+    setup := func(users []string, groups []string) *testenv {
+        env := newtestenv(t)
+        env.adduser("alice", User_SysPerms_AddGroups |
+                             User_SysPerms_AddBuckets)
+        for _, u := range users {
+            env.adduser(u, 0)
+        }
+        for _, g := range groups {
+            mustcall(env, "alice", func(ctx txctx) (string, error) {
+                return env.cc.AddGroup(ctx, g, false)
+            })
+        }
+        return env
+    }
+
+    src := setup([]string{"bob", "carol", "dave"}, []string{"staff", "guests"})
+    src.createacl("alice", "shared", map[string]uint32{
+        "bob":      ACL_Perms_ReadObject,
+    }, map[string]uint32{
+        "staff":    ACL_Perms_ListObjects | ACL_Perms_ReadObject,
+    })
+    for _, ent := range []struct {
+        deny        bool
+        enttype     uint32
+        entity      string
+    }{
+        { true,  ACL_EntryType_User,     uidof("carol") },
+        { false, ACL_EntryType_UserTree, uidof("dave") },
+    } {
+        mustcall(src, "alice", func(ctx txctx) (bool, error) {
+            if ent.deny {
+                return src.cc.AddACLDenyEntry(ctx, "shared", ent.enttype,
+                                              ent.entity, ACL_Perms_ReadObject)
+            }
+            return src.cc.AddACLEntry(ctx, "shared", ent.enttype, ent.entity,
+                                      ACL_Perms_ReadObject)
+        })
+    }
+
+    exported := mustcall(src, "alice", func(ctx txctx) (string, error) {
+        return src.cc.ExportACL(ctx, "shared")
+    })
+    if strings.Contains(exported, src.getgroup("staff").ID) {
+        t.Errorf("export has internal ids: %s", exported)
+    }
+
+    dst := setup([]string{"dave", "carol", "bob", "erin"},
+                 []string{"guests", "staff"})
+    mustcall(dst, "alice", func(ctx txctx) (string, error) {
+        return dst.cc.ImportACL(ctx, "", exported)
+    })
+
+    acl := mustcall(dst, "alice", func(ctx txctx) (*ACLTemplate, error) {
+        return dst.cc.GetMyACLByName(ctx, "shared")
+    })
+
+    want := map[string]string{
+        dst.getgroup("staff").ID:   "staff",
+    }
+    for _, u := range []string{"bob", "carol", "dave"} {
+        usr := mustcall(dst, "admin", func(ctx txctx) (*User, error) {
+            return dst.cc.GetUserByUID(ctx, uidof(u))
+        })
+        want[usr.ID] = u
+    }
+
+    if len(acl.Permissions) != len(want) {
+        t.Fatalf("imported acl = %+v", acl.Permissions)
+    }
+    for _, ent := range acl.Permissions {
+        if _, ok := want[ent.ID]; !ok {
+            t.Errorf("imported entry %+v doesn't point at this ledger", ent)
+        }
+    }
+
+    // Access on the new ledger works out the same as it would have on the old.
+    dst.addbucket("alice", "bucket-a")
+    mustcall(dst, "alice", func(ctx txctx) (bool, error) {
+        return dst.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "shared")
+    })
+    for u, ok := range map[string]bool{
+        "bob":      true,
+        "carol":    false,
+        "dave":     true,
+        "erin":     false,
+    } {
+        if dst.access("alice", u, "bucket-a", "", ACL_AccessType_Read) != ok {
+            t.Errorf("%s read access on the new ledger isn't %v", u, ok)
+        }
+    }
+
+    // Exporting it again gives back exactly what went in.
+    again := mustcall(dst, "alice", func(ctx txctx) (string, error) {
+        return dst.cc.ExportACL(ctx, "shared")
+    })
+    if again != exported {
+        t.Errorf("re-exported acl = %s, want %s", again, exported)
+    }
+
+    // Names that don't exist here are all reported, and nothing is made.
+    bare := setup([]string{"bob", "dave"}, []string{"guests"})
+    _, err := call(bare, "alice", func(ctx txctx) (string, error) {
+        return bare.cc.ImportACL(ctx, "copy", exported)
+    })
+    if err == nil || !strings.Contains(err.Error(), uidof("carol")) ||
+       !strings.Contains(err.Error(), "staff") {
+        t.Errorf("import with missing names = %v", err)
+    }
+
+    _, err = call(bare, "alice", func(ctx txctx) (*ACLTemplate, error) {
+        return bare.cc.GetMyACLByName(ctx, "copy")
+    })
+    if err == nil {
+        t.Error("failed import still created the acl")
+    }
+}
+
+func TestCheckObjectAccess(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+
+    env.createacl("alice", "bob-all", map[string]uint32{
+        "bob":      ACL_Perms_All,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "bob-all")
+    })
+
+    env.putobject("alice", "bucket-a", "plain.txt", "data", nil, false)
+    env.createacl("alice", "bob-reads", map[string]uint32{
+        "bob":      ACL_Perms_ReadObject,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "bucket-a", "guarded.txt", 4,
+                                   md5hex("data"), nil, nil, "bob-reads", false)
+    })
+
+    check := func(user string, key string, access uint32) bool {
+        var rv bool
+        err := env.tx("admin", func(ctx txctx) error {
+            bkt, err := env.cc.GetBucket(ctx, "bucket-a")
+            if err != nil {
+                return err
+            }
+
+            var obj *Object
+            if key != "" {
+                obj = env.getobject("bucket-a", key)
+            }
+
+            rv = env.cc.checkObjectAccess(ctx, obj, bkt, uidof(user), access)
+            return nil
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+        return rv
+    }
+
+    for _, tc := range []struct {
+        user    string
+        key     string
+        access  uint32
+        want    bool
+    }{
+        // Without an ACL of its own, the bucket's ACL decides.
+        { "bob", "plain.txt", ACL_AccessType_Read,      true },
+        { "bob", "plain.txt", ACL_AccessType_Overwrite, true },
+        { "bob", "plain.txt", ACL_AccessType_Delete,    true },
+
+        // An object's own ACL replaces the bucket's, rather than adding to it.
+        { "bob", "guarded.txt", ACL_AccessType_Read,      true },
+        { "bob", "guarded.txt", ACL_AccessType_Overwrite, false },
+        { "bob", "guarded.txt", ACL_AccessType_Delete,    false },
+
+        // Creating is checked against the bucket, there being no object yet.
+        { "bob", "", ACL_AccessType_Create, true },
+
+        { "carol", "plain.txt",   ACL_AccessType_Read,   false },
+        { "carol", "guarded.txt", ACL_AccessType_Read,   false },
+        { "carol", "",            ACL_AccessType_Create, false },
+    } {
+        if got := check(tc.user, tc.key, tc.access); got != tc.want {
+            t.Errorf("%s access %d to %q = %v, want %v", tc.user, tc.access,
+                     tc.key, got, tc.want)
+        }
+
+        // The batch test goes through the same rules, as do the real calls.
+        if tc.key == "" {
+            continue
+        }
+
+        if got := env.access("alice", tc.user, "bucket-a", tc.key,
+                             tc.access); got != tc.want {
+            t.Errorf("TestAccessBatch: %s access %d to %q = %v, want %v",
+                     tc.user, tc.access, tc.key, got, tc.want)
+        }
+    }
+
+    _, err := call(env, "bob", func(ctx txctx) (string, error) {
+        return env.cc.ReadObject(ctx, "bucket-a", "guarded.txt")
+    })
+    if err != nil {
+        t.Errorf("bob couldn't read guarded.txt: %v", err)
+    }
+
+    _, err = call(env, "bob", func(ctx txctx) (string, error) {
+        return env.cc.RemoveObject(ctx, "bucket-a", "guarded.txt")
+    })
+    if err == nil {
+        t.Error("bob removed guarded.txt through the bucket's ACL")
+    }
+
+    _, err = call(env, "bob", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "bucket-a", "plain.txt", 3,
+                                   md5hex("new"), nil, nil, "", true)
+    })
+    if err != nil {
+        t.Errorf("bob couldn't overwrite plain.txt: %v", err)
+    }
+}
+
+func TestRefreshACLEntities(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups)
+    env.adduser("bob", 0)
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    env.createacl("alice", "shared", map[string]uint32{
+        "bob":      ACL_Perms_ReadObject,
+    }, map[string]uint32{
+        "staff":    ACL_Perms_ListObjects,
+    })
+
+    refresh := func() bool {
+        return mustcall(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.RefreshACLEntities(ctx, "shared")
+        })
+    }
+
+    entities := func() map[uint32]string {
+        acl := mustcall(env, "alice", func(ctx txctx) (*ACLTemplate, error) {
+            return env.cc.GetMyACLByName(ctx, "shared")
+        })
+
+        rv := map[uint32]string{}
+        for _, ent := range acl.Permissions {
+            rv[ent.EntryType] = ent.Entity
+        }
+        return rv
+    }
+
+    // Nothing's changed since the template was made.
+    if refresh() {
+        t.Error("refresh of an up to date acl changed something")
+    }
+
+    // There's no way to rename a group through the chaincode yet, so do it
+    // behind its back.
+    grp := env.getgroup("staff")
+    grp.Name = "employees"
+    sid, _ := shim.CreateCompositeKey("Group", []string{grp.ID})
+    env.state[sid], _ = json.Marshal(grp)
+
+    if got := entities()[ACL_EntryType_Group]; got != "Group: staff" {
+        t.Fatalf("group entity before refresh = %q", got)
+    }
+
+    if !refresh() {
+        t.Error("refresh didn't notice the renamed group")
+    }
+
+    want := map[uint32]string{
+        ACL_EntryType_User:     "User: " + uidof("bob"),
+        ACL_EntryType_Group:    "Group: employees",
+    }
+    if got := entities(); !reflect.DeepEqual(got, want) {
+        t.Errorf("entities after refresh = %v, want %v", got, want)
+    }
+
+    if refresh() {
+        t.Error("second refresh changed something")
+    }
+
+    // Only the template's owner can refresh it.
+    _, err := call(env, "bob", func(ctx txctx) (bool, error) {
+        return env.cc.RefreshACLEntities(ctx, "shared")
+    })
+    if err == nil {
+        t.Error("bob refreshed alice's acl")
+    }
+}
+
+func TestGetGrantsForUser(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets | User_SysPerms_AddGroups |
+                         User_SysPerms_AddSubUsers)
+    env.adduser("bob", 0)
+    env.adduser("carol", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+    env.addbucket("carol", "bucket-c")
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.AddUserToGroup(ctx, "staff", uidof("bob"))
+    })
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubUser(ctx, uidof("dave"),
+                                 map[string]uint32{"*": ACL_Perms_ReadObject},
+                                 0)
+    })
+
+    env.createacl("alice", "shared", map[string]uint32{
+        "bob":      ACL_Perms_ReadObject,
+    }, map[string]uint32{
+        "staff":    ACL_Perms_ListObjects,
+    })
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.AddACLEntry(ctx, "shared", ACL_EntryType_UserTree,
+                                  uidof("alice"), ACL_Perms_ListObjects)
+    })
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "shared")
+    })
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "bucket-a", "a.txt", 4, md5hex("data"),
+                                   nil, nil, "shared", false)
+    })
+
+    // Nothing in carol's bucket mentions anyone else.
+    env.putobject("carol", "bucket-c", "c.txt", "data", nil, false)
+
+    grants := func(caller string, user string) (*UserGrants, error) {
+        return call(env, caller, func(ctx txctx) (*UserGrants, error) {
+            return env.cc.GetGrantsForUser(ctx, uidof(user))
+        })
+    }
+
+    g, err := grants("bob", "bob")
+    if err != nil {
+        t.Fatalf("GetGrantsForUser: %v", err)
+    }
+
+    if !reflect.DeepEqual(g.Groups, []string{"staff"}) {
+        t.Errorf("bob's groups = %v", g.Groups)
+    }
+
+    // The bucket names bob directly and through staff.
+    kinds := map[uint32]string{}
+    for _, b := range g.Buckets {
+        kinds[b.Entry.EntryType] = b.Bucket
+    }
+    want := map[uint32]string{
+        ACL_EntryType_User:     "bucket-a",
+        ACL_EntryType_Group:    "bucket-a",
+    }
+    if !reflect.DeepEqual(kinds, want) {
+        t.Errorf("bob's bucket grants = %+v", g.Buckets)
+    }
+
+    if len(g.Objects) != 2 || g.Objects[0].Key != "a.txt" || g.Truncated {
+        t.Errorf("bob's object grants = %+v (truncated %v)", g.Objects,
+                 g.Truncated)
+    }
+
+    // Sub-users see what their parent gave them, and anything granted to
+    // their parent's tree.
+    g, err = grants("alice", "dave")
+    if err != nil {
+        t.Fatalf("alice getting dave's grants: %v", err)
+    }
+    if g.Parent != uidof("alice") ||
+       g.SubUserPerms["*"] != ACL_Perms_ReadObject {
+        t.Errorf("dave's sub-user grant = %s %v", g.Parent, g.SubUserPerms)
+    }
+    if len(g.Buckets) != 1 ||
+       g.Buckets[0].Entry.EntryType != ACL_EntryType_UserTree {
+        t.Errorf("dave's bucket grants = %+v", g.Buckets)
+    }
+    if len(g.Objects) != 1 || g.Objects[0].Key != "a.txt" {
+        t.Errorf("dave's object grants = %+v", g.Objects)
+    }
+
+    if _, err := grants("carol", "bob"); err == nil {
+        t.Error("carol looked up bob's grants")
+    }
+    if _, err := grants("admin", "bob"); err != nil {
+        t.Errorf("admin couldn't look up bob's grants: %v", err)
+    }
+}
+
+func TestApplyingOthersACLTemplate(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    bob := env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    env.createacl("bob", "bob-acl", map[string]uint32{
+        "bob":      ACL_Perms_All,
+    }, nil)
+
+    // A name crafted to widen the template lookup to someone else's
+    // templates has to be treated as just a name.
+    sneaky := fmt.Sprintf(`bob-acl","owner":"%s`, bob)
+
+    for _, name := range []string{"bob-acl", sneaky} {
+        tries := map[string]func(ctx txctx) error{
+            "CreateObject": func(ctx txctx) error {
+                _, err := env.cc.CreateObject(ctx, "bucket-a", "a.txt", 4,
+                                              md5hex("data"), nil, nil, name,
+                                              false)
+                return err
+            },
+            "SetBucketACLFromTemplate": func(ctx txctx) error {
+                _, err := env.cc.SetBucketACLFromTemplate(ctx, "bucket-a",
+                                                          name)
+                return err
+            },
+            "AddBucketWithACL": func(ctx txctx) error {
+                _, err := env.cc.AddBucketWithACL(ctx, "bucket-b", nil, name)
+                return err
+            },
+            "DiffBucketACL": func(ctx txctx) error {
+                _, err := env.cc.DiffBucketACL(ctx, "bucket-a", name)
+                return err
+            },
+        }
+
+        for fn, try := range tries {
+            if err := env.tx("alice", try); err == nil {
+                t.Errorf("%s applied bob's template as %q", fn, name)
+            }
+        }
+    }
+
+    if env.access("alice", "bob", "bucket-a", "", ACL_AccessType_List) {
+        t.Error("bob got access to alice's bucket through bob's template")
+    }
+}
+
+func TestTemporaryACLEntry(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    carol := env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+    env.addbucket("alice", "bucket-b")
+
+    env.createacl("alice", "temp", nil, nil)
+
+    addtemp := func(user string, expires int64) error {
+        _, err := call(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.AddTemporaryACLEntry(ctx, "temp",
+                                               ACL_EntryType_User,
+                                               uidof(user),
+                                               ACL_Perms_ListObjects, expires)
+        })
+        return err
+    }
+
+    if addtemp("bob", env.now()) == nil {
+        t.Error("temporary entry that has already expired accepted")
+    }
+
+    // Bob's grant runs out in an hour, carol's in a day.
+    if err := addtemp("bob", env.now() + 3600); err != nil {
+        t.Fatalf("AddTemporaryACLEntry: %v", err)
+    }
+    if err := addtemp("carol", env.now() + 86400); err != nil {
+        t.Fatalf("AddTemporaryACLEntry: %v", err)
+    }
+
+    apply := func(bucket string) {
+        mustcall(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.SetBucketACLFromTemplate(ctx, bucket, "temp")
+        })
+    }
+
+    canlist := func(user string, bucket string) bool {
+        return env.access("alice", user, bucket, "", ACL_AccessType_List)
+    }
+
+    apply("bucket-a")
+    if !canlist("bob", "bucket-a") || !canlist("carol", "bucket-a") {
+        t.Error("active temporary grants don't give access")
+    }
+
+    env.advance(2 * time.Hour)
+    if canlist("bob", "bucket-a") {
+        t.Error("expired temporary grant still gives access")
+    }
+    if !canlist("carol", "bucket-a") {
+        t.Error("carol's grant stopped working before it expired")
+    }
+
+    // Applying the template now leaves out what has already expired, but keeps
+    // the expiry on what hasn't.
+    apply("bucket-b")
+    bkt := mustcall(env, "alice", func(ctx txctx) (*Bucket, error) {
+        return env.cc.GetBucket(ctx, "bucket-b")
+    })
+    if len(bkt.Permissions) != 1 || bkt.Permissions[0].ID != carol ||
+       bkt.Permissions[0].ExpiresAt == 0 {
+        t.Errorf("bucket-b ACL = %+v, want only carol's expiring entry",
+                 bkt.Permissions)
+    }
+
+    // Compacting the template drops the expired entry.
+    n := mustcall(env, "alice", func(ctx txctx) (uint64, error) {
+        return env.cc.CompactACL(ctx, "temp")
+    })
+    if n != 1 {
+        t.Errorf("CompactACL removed %d entries, want 1", n)
+    }
+}
+
+func TestACLCTime(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", 0)
+
+    env.advance(time.Hour)
+    env.createacl("alice", "created", nil, nil)
+    created := env.now()
+
+    env.advance(time.Hour)
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.ImportACL(ctx, "imported", `{"entries":[]}`)
+    })
+
+    want := map[string]int64{"created": created, "imported": env.now()}
+    acls := mustcall(env, "alice", env.cc.GetAllMyACLs)
+    if len(acls) != len(want) {
+        t.Fatalf("alice has %d ACLs, want %d", len(acls), len(want))
+    }
+    for _, acl := range acls {
+        if acl.CTime != want[acl.Name] {
+            t.Errorf("%s ctime = %d, want %d", acl.Name, acl.CTime,
+                     want[acl.Name])
+        }
+    }
+}
@@ -0,0 +1,242 @@
+/*
+    Copyright (C) 2024 Lawrence Sebald
+    All Rights Reserved
+*/
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// Aliases give an object a second, stable name within its bucket that clients
+// can hold on to even if the key itself changes. They are stored as
+// Alias~Bucket~Alias, with the document pointing at the object's current key.
+
+func (s *SmartContract) CreateObjectAlias(ctx contractapi.TransactionContextInterface,
+                                          bucket string, key string,
+                                          alias string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    if alias == "" || strings.ContainsRune(alias, 0) {
+        return false, fmt.Errorf("invalid alias")
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.ReadOnly {
+        return false, fmt.Errorf("bucket is read-only")
+    }
+
+    obj, err := s.getobject(ctx, bucket, key)
+    if err != nil {
+        return false, err
+    }
+
+    if obj.Owner != myuser.ID && bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    tmp, _ := s.getobjectalias(ctx, bucket, alias)
+    if tmp != nil {
+        return false, fmt.Errorf("alias already exists")
+    }
+
+    a := ObjectAlias {
+        Type:       "ObjectAlias",
+        Bucket:     bucket,
+        Alias:      alias,
+        Key:        key,
+        Owner:      myuser.ID,
+    }
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Alias", []string{bucket, alias})
+    err = s.putStateChecked(ctx, sid, a)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+func (s *SmartContract) RemoveObjectAlias(ctx contractapi.TransactionContextInterface,
+                                          bucket string,
+                                          alias string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    a, err := s.getobjectalias(ctx, bucket, alias)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.ReadOnly {
+        return false, fmt.Errorf("bucket is read-only")
+    }
+
+    if a.Owner != myuser.ID && bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Alias", []string{bucket, alias})
+    err = ctx.GetStub().DelState(sid)
+    if err != nil {
+        return false, fmt.Errorf("failed to delete from world state. %v", err)
+    }
+
+    return true, nil
+}
+
+func (s *SmartContract) GetObjectByAlias(ctx contractapi.TransactionContextInterface,
+                                         bucket string,
+                                         alias string) (*Object, error) {
+    key, err := s.resolvealias(ctx, bucket, alias)
+    if err != nil {
+        return nil, err
+    }
+
+    return s.GetObjectByPath(ctx, bucket, key)
+}
+
+func (s *SmartContract) ReadObjectByAlias(ctx contractapi.TransactionContextInterface,
+                                          bucket string,
+                                          alias string) (string, error) {
+    key, err := s.resolvealias(ctx, bucket, alias)
+    if err != nil {
+        return "", err
+    }
+
+    return s.ReadObject(ctx, bucket, key)
+}
+
+func (s *SmartContract) getobjectalias(ctx contractapi.TransactionContextInterface,
+                                       bucket string,
+                                       alias string) (*ObjectAlias, error) {
+    sid, _ := ctx.GetStub().CreateCompositeKey("Alias", []string{bucket, alias})
+    aJSON, err := ctx.GetStub().GetState(sid)
+    if err != nil {
+        return nil, err
+    } else if aJSON == nil {
+        return nil, fmt.Errorf("unknown alias")
+    }
+
+    var a ObjectAlias
+    err = json.Unmarshal(aJSON, &a)
+    if err != nil {
+        return nil, err
+    }
+
+    return &a, nil
+}
+
+// Look up the key an alias points at, making sure there's still an object
+// there.
+func (s *SmartContract) resolvealias(ctx contractapi.TransactionContextInterface,
+                                     bucket string,
+                                     alias string) (string, error) {
+    a, err := s.getobjectalias(ctx, bucket, alias)
+    if err != nil {
+        return "", err
+    }
+
+    tmp, _ := s.getobject(ctx, bucket, a.Key)
+    if tmp == nil {
+        return "", fmt.Errorf("dangling alias: %s -> %s", alias, a.Key)
+    }
+
+    return a.Key, nil
+}
+
+// Drop every alias pointing at a key, for when the object goes away.
+func (s *SmartContract) removeobjectaliases(ctx contractapi.TransactionContextInterface,
+                                            bucket string, key string) error {
+    querymap := map[string]string {
+        "type":     "ObjectAlias",
+        "bucket":   bucket,
+        "key":      key,
+    }
+
+    js, err := json.Marshal(querymap)
+    if err != nil {
+        return err
+    }
+
+    iter, err := ctx.GetStub().GetQueryResult(fmt.Sprintf(`{"selector":%s}`, js))
+    if err != nil {
+        return err
+    }
+    defer iter.Close()
+
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return err
+        }
+
+        err = ctx.GetStub().DelState(resp.Key)
+        if err != nil {
+            return fmt.Errorf("failed to delete from world state. %v", err)
+        }
+    }
+
+    return nil
+}
+
+// Point any aliases for an object at the key it has been moved to.
+func (s *SmartContract) retargetobjectaliases(ctx contractapi.TransactionContextInterface,
+                                              bucket string, oldkey string,
+                                              newkey string) error {
+    querymap := map[string]string {
+        "type":     "ObjectAlias",
+        "bucket":   bucket,
+        "key":      oldkey,
+    }
+
+    js, err := json.Marshal(querymap)
+    if err != nil {
+        return err
+    }
+
+    iter, err := ctx.GetStub().GetQueryResult(fmt.Sprintf(`{"selector":%s}`, js))
+    if err != nil {
+        return err
+    }
+    defer iter.Close()
+
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return err
+        }
+
+        var a ObjectAlias
+        err = json.Unmarshal(resp.Value, &a)
+        if err != nil {
+            return err
+        }
+
+        a.Key = newkey
+        err = s.putStateChecked(ctx, resp.Key, a)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
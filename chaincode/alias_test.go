@@ -0,0 +1,93 @@
+/*
+    Copyright (C) 2024 Lawrence Sebald
+    All Rights Reserved
+*/
+package chaincode
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+
+    "github.com/hyperledger/fabric-chaincode-go/v2/shim"
+)
+
+func TestObjectAlias(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+    env.putobject("alice", "bucket-a", "reports/2024.txt", "data", nil, false)
+
+    alias := func(user string, key string, name string) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.CreateObjectAlias(ctx, "bucket-a", key, name)
+        })
+        return err
+    }
+
+    byalias := func(user string, name string) (*Object, error) {
+        return call(env, user, func(ctx txctx) (*Object, error) {
+            return env.cc.GetObjectByAlias(ctx, "bucket-a", name)
+        })
+    }
+
+    if err := alias("alice", "reports/2024.txt", "latest"); err != nil {
+        t.Fatalf("CreateObjectAlias: %v", err)
+    }
+
+    obj, err := byalias("alice", "latest")
+    if err != nil || obj.Key != "reports/2024.txt" {
+        t.Errorf("GetObjectByAlias = %+v, %v", obj, err)
+    }
+
+    url := mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.ReadObjectByAlias(ctx, "bucket-a", "latest")
+    })
+    if url == "" {
+        t.Error("ReadObjectByAlias gave back no url")
+    }
+
+    if alias("alice", "reports/2024.txt", "latest") == nil {
+        t.Error("same alias created twice")
+    }
+    if alias("alice", "reports/2024.txt", "") == nil {
+        t.Error("empty alias accepted")
+    }
+    if alias("bob", "reports/2024.txt", "bobs") == nil {
+        t.Error("bob aliased alice's object")
+    }
+
+    // Going through an alias doesn't get around the object's permissions.
+    if _, err := byalias("bob", "latest"); err == nil {
+        t.Error("bob read alice's object through an alias")
+    }
+
+    // Removing the object takes its aliases with it.
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.RemoveObject(ctx, "bucket-a", "reports/2024.txt")
+    })
+
+    sid, _ := shim.CreateCompositeKey("Alias", []string{"bucket-a", "latest"})
+    if _, ok := env.state[sid]; ok {
+        t.Error("alias survived its object being removed")
+    }
+    if _, err := byalias("alice", "latest"); err == nil {
+        t.Error("alias still resolves after its object was removed")
+    }
+
+    // An alias left pointing at nothing is reported as such.
+    js, _ := json.Marshal(ObjectAlias {
+        Type:       "ObjectAlias",
+        Bucket:     "bucket-a",
+        Alias:      "stale",
+        Key:        "reports/2023.txt",
+    })
+    sid, _ = shim.CreateCompositeKey("Alias", []string{"bucket-a", "stale"})
+    env.state[sid] = js
+
+    _, err = byalias("alice", "stale")
+    if err == nil || !strings.Contains(err.Error(), "dangling") {
+        t.Errorf("resolving a dangling alias = %v", err)
+    }
+}
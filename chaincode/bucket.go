@@ -7,6 +7,8 @@ package chaincode
 import (
     "encoding/json"
     "fmt"
+    "net"
+    "regexp"
     "strings"
     "time"
 
@@ -19,6 +21,11 @@ func (s *SmartContract) initbuckets(ctx contractapi.TransactionContextInterface)
 
 func (s *SmartContract) GetBucket(ctx contractapi.TransactionContextInterface,
                                   name string) (*Bucket, error) {
+    err := validatebucketname(name)
+    if err != nil {
+        return nil, err
+    }
+
     sid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{name})
     bktJSON, err := ctx.GetStub().GetState(sid)
     if err != nil {
@@ -55,6 +62,86 @@ func (s *SmartContract) GetUserBuckets(ctx contractapi.TransactionContextInterfa
     return s.getuserbuckets(ctx, user.ID)
 }
 
+// List the buckets owned by a user, a page at a time. Anyone but an admin can
+// only list their own buckets.
+func (s *SmartContract) ListBucketsByOwner(ctx contractapi.TransactionContextInterface,
+                                           uid string, maxbuckets uint32,
+                                           token string) (*BucketListing, error) {
+    // Set a sane default on the maximum number of buckets in one call...
+    maxbuckets = s.pagesize(maxbuckets)
+
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    user := myuser
+    if uid != myuser.UID {
+        if !isadmin(myuser) {
+            return nil, fmt.Errorf("permission denied")
+        }
+
+        user, err = s.GetUserByUID(ctx, uid)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    querymap := map[string]string {
+        "type":     "Bucket",
+        "owner":    user.ID,
+    }
+
+    js, err := json.Marshal(querymap)
+    if err != nil {
+        return nil, err
+    }
+
+    dbquery := fmt.Sprintf(`{"selector":%s}`, js)
+    iter, meta, err := ctx.GetStub().GetQueryResultWithPagination(dbquery,
+            int32(maxbuckets), token)
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    if meta.FetchedRecordsCount < 0 {
+        return nil, fmt.Errorf("Invalid response for bucket listing")
+    }
+
+    bkts := make([]ListingBucket, 0, meta.FetchedRecordsCount)
+
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var bkt Bucket
+        err = json.Unmarshal(resp.Value, &bkt)
+        if err != nil {
+            return nil, err
+        }
+
+        bkts = append(bkts, ListingBucket {
+            Name:       bkt.Name,
+            Owner:      bkt.Owner,
+            CTime:      bkt.CTime,
+            Metadata:   bkt.Metadata,
+            Public:     bucketispublic(&bkt),
+        })
+    }
+
+    // Fill in the metadata wrapping the listing
+    rv := BucketListing {
+        Count:          uint64(len(bkts)),
+        Token:          meta.Bookmark,
+        Buckets:        bkts,
+    }
+
+    return &rv, nil
+}
+
 func (s *SmartContract) getuserbuckets(ctx contractapi.TransactionContextInterface,
                                        id string) ([]*Bucket, error) {
     query := fmt.Sprintf(`{"selector":{"type":"Bucket","owner":"%s"}}`, id)
@@ -86,6 +173,25 @@ func (s *SmartContract) getuserbuckets(ctx contractapi.TransactionContextInterfa
 func (s *SmartContract) AddBucket(ctx contractapi.TransactionContextInterface,
                                   name string,
                                   metadata map[string]string) (string, error) {
+    return s.addbucket(ctx, name, metadata, "")
+}
+
+// Create a bucket with one of the caller's ACL templates already applied to
+// it, so that it is never left open between creating it and setting its ACL.
+func (s *SmartContract) AddBucketWithACL(ctx contractapi.TransactionContextInterface,
+                                         name string,
+                                         metadata map[string]string,
+                                         aclTemplate string) (string, error) {
+    if aclTemplate == "" {
+        return "", fmt.Errorf("unknown acl")
+    }
+
+    return s.addbucket(ctx, name, metadata, aclTemplate)
+}
+
+func (s *SmartContract) addbucket(ctx contractapi.TransactionContextInterface,
+                                  name string, metadata map[string]string,
+                                  aclTemplate string) (string, error) {
     myuser, err := s.GetMyUser(ctx)
     if err != nil {
         return "", err
@@ -95,34 +201,95 @@ func (s *SmartContract) AddBucket(ctx contractapi.TransactionContextInterface,
         return "", fmt.Errorf("permission denied")
     }
 
+    err = validateS3BucketName(name)
+    if err != nil {
+        return "", err
+    }
+
     bkt, _ := s.GetBucket(ctx, name)
     if bkt != nil {
         return "", fmt.Errorf("bucket exists")
     }
 
+    acl, err := s.resolveacltemplate(ctx, myuser, aclTemplate)
+    if err != nil {
+        return "", err
+    }
+
     bucket := Bucket {
         Type:           "Bucket",
         Name:           name,
         Owner:          myuser.ID,
         Metadata:       metadata,
         CTime:          time.Now().Unix(),
-        Permissions:    make([]ACLEntry, 0),
+        Permissions:    acl,
     }
 
-    bktJSON, err := json.Marshal(bucket)
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{name})
+    err = s.putStateChecked(ctx, stateid, bucket)
     if err != nil {
         return "", err
     }
 
-    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{name})
-    err = ctx.GetStub().PutState(stateid, bktJSON)
-    if err != nil {
-        return "", fmt.Errorf("failed to put to world state. %v", err)
-    }
+    s.indexbucket(ctx, &bucket)
 
     return "true", nil
 }
 
+// Catch missing bucket names before they get anywhere near the world state.
+// Anything else wrong with a name just means the bucket can't exist, since
+// validateS3BucketName keeps it from ever being created.
+func validatebucketname(name string) error {
+    if name == "" {
+        return fmt.Errorf("bucket name must not be empty")
+    }
+
+    return nil
+}
+
+// Buckets map directly onto buckets on the backing store, so make sure the name
+// is one that S3 will accept.
+func validateS3BucketName(name string) error {
+    if len(name) < 3 || len(name) > 63 {
+        return fmt.Errorf("invalid bucket name: must be 3 to 63 characters long")
+    }
+
+    for _, c := range name {
+        if c >= 'A' && c <= 'Z' {
+            return fmt.Errorf("invalid bucket name: must be lowercase")
+        } else if c == '_' {
+            return fmt.Errorf("invalid bucket name: must not contain underscores")
+        } else if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+                    c == '.' || c == '-') {
+            return fmt.Errorf("invalid bucket name: invalid character '%c'", c)
+        }
+    }
+
+    first := name[0]
+    last := name[len(name) - 1]
+    if first == '.' || first == '-' || last == '.' || last == '-' {
+        return fmt.Errorf("invalid bucket name: must begin and end with a letter or number")
+    }
+
+    if strings.Contains(name, "..") {
+        return fmt.Errorf("invalid bucket name: must not contain adjacent periods")
+    }
+
+    if net.ParseIP(name) != nil {
+        return fmt.Errorf("invalid bucket name: must not be formatted as an IP address")
+    }
+
+    if strings.HasPrefix(name, "xn--") {
+        return fmt.Errorf("invalid bucket name: must not start with xn--")
+    }
+
+    if strings.HasSuffix(name, "-s3alias") {
+        return fmt.Errorf("invalid bucket name: must not end with -s3alias")
+    }
+
+    return nil
+}
+
 func (s *SmartContract) RemoveBucket(ctx contractapi.TransactionContextInterface,
                                      name string) (string, error) {
     myuser, err := s.GetMyUser(ctx)
@@ -139,6 +306,10 @@ func (s *SmartContract) RemoveBucket(ctx contractapi.TransactionContextInterface
         return "", fmt.Errorf("permission denied")
     }
 
+    if bkt.ReadOnly {
+        return "", fmt.Errorf("bucket is read-only")
+    }
+
     empty, err := s.isbucketempty(ctx, name)
     if err != nil {
         return "", err
@@ -152,6 +323,8 @@ func (s *SmartContract) RemoveBucket(ctx contractapi.TransactionContextInterface
         return "", fmt.Errorf("failed to delete from world state. %v", err)
     }
 
+    s.unindexbucket(ctx, bkt)
+
     return "true", nil
 }
 
@@ -172,36 +345,807 @@ func (s *SmartContract) SetBucketACLFromTemplate(ctx contractapi.TransactionCont
         return false, fmt.Errorf("permission denied")
     }
 
-    tacl, err := s.GetMyACLByName(ctx, aclname)
+    if aclname == "" {
+        return false, fmt.Errorf("unknown acl")
+    }
+
+    acl, err := s.resolveacltemplate(ctx, myuser, aclname)
+    if err != nil {
+        return false, err
+    }
+
+    // Update the state in the db
+    bkt.Permissions = acl
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bktname})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Show what applying an ACL template to a bucket would do to the bucket's ACL,
+// without changing anything.
+func (s *SmartContract) DiffBucketACL(ctx contractapi.TransactionContextInterface,
+                                      bktname string,
+                                      aclname string) (*ACLDiff, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bktname)
+    if err != nil {
+        return nil, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    if aclname == "" {
+        return nil, fmt.Errorf("unknown acl")
+    }
+
+    acl, err := s.resolveacltemplate(ctx, myuser, aclname)
+    if err != nil {
+        return nil, err
+    }
+
+    return diffacl(bkt.Permissions, acl), nil
+}
+
+// Compare two ACLs, matching up entries by their type and the entity they
+// refer to.
+func diffacl(from ACL, to ACL) *ACLDiff {
+    rv := ACLDiff {
+        Added:      make([]ACLEntry, 0),
+        Removed:    make([]ACLEntry, 0),
+        Changed:    make([]ACLEntryChange, 0),
+    }
+
+    find := func(acl ACL, ent ACLEntry) *ACLEntry {
+        for i := range acl {
+            if acl[i].EntryType == ent.EntryType && acl[i].ID == ent.ID {
+                return &acl[i]
+            }
+        }
+
+        return nil
+    }
+
+    for _, ent := range to {
+        old := find(from, ent)
+        if old == nil {
+            rv.Added = append(rv.Added, ent)
+        } else if old.Permissions != ent.Permissions || old.Deny != ent.Deny {
+            rv.Changed = append(rv.Changed, ACLEntryChange {
+                Old:    *old,
+                New:    ent,
+            })
+        }
+    }
+
+    for _, ent := range from {
+        if find(to, ent) == nil {
+            rv.Removed = append(rv.Removed, ent)
+        }
+    }
+
+    return &rv
+}
+
+func (s *SmartContract) SetBucketMetadataSchema(ctx contractapi.TransactionContextInterface,
+                                                bktname string,
+                                                schema *MetadataSchema) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bktname)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    // An empty schema turns validation back off for the bucket.
+    if schema != nil && len(schema.Required) == 0 && len(schema.Patterns) == 0 {
+        schema = nil
+    }
+
+    // Make sure all the patterns are usable before we store them.
+    if schema != nil {
+        for k, v := range schema.Patterns {
+            _, err := regexp.Compile(v)
+            if err != nil {
+                return false, fmt.Errorf("invalid pattern for key %s: %v", k, err)
+            }
+        }
+    }
+
+    // Update the state in the db
+    bkt.Schema = schema
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bktname})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Have objects in a bucket that haven't been modified in the given number of
+// seconds removed by ApplyLifecycle. Zero turns expiry off again.
+func (s *SmartContract) SetBucketExpiry(ctx contractapi.TransactionContextInterface,
+                                        bktname string,
+                                        seconds int64) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bktname)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    if seconds < 0 {
+        return false, fmt.Errorf("invalid expiry time")
+    }
+
+    // Update the state in the db
+    bkt.ExpireAfter = seconds
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bktname})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Set whether overwriting an object in the bucket keeps the old one around as a
+// version or simply replaces it.
+func (s *SmartContract) SetBucketOverwriteMode(ctx contractapi.TransactionContextInterface,
+                                               bktname string,
+                                               mode uint32) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bktname)
     if err != nil {
         return false, err
     }
 
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    if mode != Bucket_OverwriteMode_Replace &&
+       mode != Bucket_OverwriteMode_Version {
+        return false, fmt.Errorf("invalid overwrite mode")
+    }
+
     // Update the state in the db
-    bkt.Permissions = templatetoacl(tacl)
-    bktJSON, err := json.Marshal(bkt)
+    bkt.OverwriteMode = mode
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bktname})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Replace the metadata on a bucket, keeping the owner's bucket indexes in step
+// with it.
+func (s *SmartContract) UpdateBucketMetadata(ctx contractapi.TransactionContextInterface,
+                                             bktname string,
+                                             metadata map[string]string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bktname)
     if err != nil {
         return false, err
     }
 
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    // Pull the old values out of the indexes before putting the new ones in.
+    s.unindexbucket(ctx, bkt)
+
+    // Update the state in the db
+    bkt.Metadata = metadata
     stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bktname})
-    err = ctx.GetStub().PutState(stateid, bktJSON)
+    err = s.putStateChecked(ctx, stateid, bkt)
     if err != nil {
-        return false, fmt.Errorf("failed to put to world state. %v", err)
+        return false, err
     }
 
+    s.indexbucket(ctx, bkt)
+
     return true, nil
 }
 
-func (s *SmartContract) QueryMyBuckets(ctx contractapi.TransactionContextInterface,
-                                       query map[string]string,
-                                       maxbuckets uint32, includeMeta bool,
-                                       token string) (*BucketListing, error) {
-    // Set a sane default on the maximum number of buckets in one call...
-    if maxbuckets == 0 || maxbuckets > 1000 {
-        maxbuckets = 1000
+// Mark a bucket as being mirrored elsewhere. Objects with data created in a
+// replicated bucket start out pending replication until an external agent marks
+// them otherwise.
+func (s *SmartContract) SetBucketReplication(ctx contractapi.TransactionContextInterface,
+                                             bktname string,
+                                             enabled bool) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
     }
 
+    bkt, err := s.GetBucket(ctx, bktname)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    // Update the state in the db
+    bkt.Replicated = enabled
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bktname})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Let any user list the keys in a bucket, whether or not the bucket's ACL
+// grants them anything. This doesn't give access to the objects themselves.
+func (s *SmartContract) SetBucketAnonymousList(ctx contractapi.TransactionContextInterface,
+                                               bktname string,
+                                               enabled bool) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bktname)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    // Update the state in the db
+    bkt.AnonymousList = enabled
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bktname})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Let objects in a bucket with the same content and owner share one copy of
+// their data on the backing store.
+func (s *SmartContract) SetBucketDedup(ctx contractapi.TransactionContextInterface,
+                                       bktname string,
+                                       enabled bool) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bktname)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    // Update the state in the db
+    bkt.EnableDedup = enabled
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bktname})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Set how long delete records in a bucket are kept around, in seconds. Zero
+// keeps them until they're removed by hand. This only applies to objects
+// deleted after it is set.
+func (s *SmartContract) SetBucketDeleteRecordTTL(ctx contractapi.TransactionContextInterface,
+                                                 bktname string,
+                                                 ttl int64) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bktname)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    if ttl < 0 {
+        return false, fmt.Errorf("invalid ttl")
+    }
+
+    // Update the state in the db
+    bkt.DeleteRecordTTL = ttl
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bktname})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Keep up to the given number of old copies of each object's metadata in a
+// bucket whenever it changes. Zero stops recording new copies, but leaves any
+// that were already saved.
+func (s *SmartContract) SetBucketMetadataHistory(ctx contractapi.TransactionContextInterface,
+                                                 name string,
+                                                 limit uint32) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, name)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    if limit > max_metadata_history {
+        return false, fmt.Errorf("limit too large (max %d)", max_metadata_history)
+    }
+
+    // Update the state in the db
+    bkt.MetaHistory = limit
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{name})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Hand a bucket over to a new owner. This is meant for buckets whose owner has
+// gone away, so it works no matter who (if anyone) owns the bucket now. Only
+// the bucket itself changes hands; the objects in it keep their owners.
+func (s *SmartContract) ReassignBucketOwner(ctx contractapi.TransactionContextInterface,
+                                            name string,
+                                            newOwnerUID string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    if !isadmin(myuser) {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    bkt, err := s.GetBucket(ctx, name)
+    if err != nil {
+        return false, err
+    }
+
+    owner, err := s.GetUserByUID(ctx, newOwnerUID)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.Owner == owner.ID {
+        return true, nil
+    }
+
+    s.unindexbucket(ctx, bkt)
+    bkt.Owner = owner.ID
+    s.indexbucket(ctx, bkt)
+
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{name})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Freeze (or unfreeze) a bucket. Nothing in a read-only bucket can be created,
+// changed or removed, but it can still be read and listed. The bucket's own
+// settings can still be changed by its owner.
+func (s *SmartContract) SetBucketReadOnly(ctx contractapi.TransactionContextInterface,
+                                          name string,
+                                          readonly bool) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, name)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    // Update the state in the db
+    bkt.ReadOnly = readonly
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{name})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Set metadata that every new object in a bucket starts out with. Any keys given
+// when an object is created take precedence over these. Objects that already
+// exist are left alone.
+func (s *SmartContract) SetBucketDefaultMetadata(ctx contractapi.TransactionContextInterface,
+                                                 bktname string,
+                                                 metadata map[string]string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bktname)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    // Update the state in the db
+    bkt.DefaultMetadata = metadata
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bktname})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Set the tag that exempts objects in a bucket from automatic expiry, the same
+// as if they were pinned. An empty tag turns this off.
+func (s *SmartContract) SetBucketRetainTag(ctx contractapi.TransactionContextInterface,
+                                           bktname string,
+                                           tag string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bktname)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    if strings.ContainsRune(tag, 0) {
+        return false, fmt.Errorf("invalid tag: %q", tag)
+    }
+
+    // Update the state in the db
+    bkt.RetainTag = tag
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bktname})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Does an object carry the tag that keeps it safe from automatic expiry in its
+// bucket?
+func hasretaintag(bkt *Bucket, obj *Object) bool {
+    if bkt.RetainTag == "" {
+        return false
+    }
+
+    for _, t := range obj.Tags {
+        if t == bkt.RetainTag {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Store the CORS policy a gateway should apply when serving a bucket's objects
+// to browsers. The chaincode doesn't enforce any of this itself. Passing a nil
+// config clears it.
+func (s *SmartContract) SetBucketCORS(ctx contractapi.TransactionContextInterface,
+                                      bktname string,
+                                      cors *CORSConfig) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bktname)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    if cors != nil {
+        for _, m := range cors.AllowedMethods {
+            switch m {
+            case "GET", "HEAD", "PUT", "POST", "DELETE":
+            default:
+                return false, fmt.Errorf("invalid CORS method: %s", m)
+            }
+        }
+
+        for _, o := range cors.AllowedOrigins {
+            if o == "" {
+                return false, fmt.Errorf("invalid CORS origin")
+            }
+        }
+    }
+
+    // Update the state in the db
+    bkt.CORS = cors
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bktname})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+func (s *SmartContract) GetBucketCORS(ctx contractapi.TransactionContextInterface,
+                                      bktname string) (*CORSConfig, error) {
+    bkt, err := s.GetBucket(ctx, bktname)
+    if err != nil {
+        return nil, err
+    }
+
+    return bkt.CORS, nil
+}
+
+const public_read_perms uint32 = ACL_Perms_ListObjects | ACL_Perms_ReadObject
+
+// Turn on or off read access to a bucket for everyone. This is just a shortcut
+// for adding or removing a public entry on the bucket's ACL.
+func (s *SmartContract) SetBucketPublicRead(ctx contractapi.TransactionContextInterface,
+                                            bktname string,
+                                            public bool) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bktname)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    // Clear out any public entries that are there already.
+    perms := make([]ACLEntry, 0, len(bkt.Permissions) + 1)
+    for _, ent := range bkt.Permissions {
+        if ent.EntryType != ACL_EntryType_Public {
+            perms = append(perms, ent)
+        }
+    }
+
+    if public {
+        perms = append(perms, ACLEntry {
+            ID:             "*",
+            EntryType:      ACL_EntryType_Public,
+            Permissions:    public_read_perms,
+        })
+    }
+
+    // Update the state in the db
+    bkt.Permissions = perms
+    stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bktname})
+    err = s.putStateChecked(ctx, stateid, bkt)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Is a bucket readable by everyone?
+func bucketispublic(bkt *Bucket) bool {
+    for _, ent := range bkt.Permissions {
+        if ent.EntryType == ACL_EntryType_Public && !ent.Deny &&
+           (ent.Permissions & ACL_Perms_ReadObject) != 0 {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Check a set of object metadata against the bucket's schema, if it has one.
+func validatemetadata(bkt *Bucket, metadata map[string]string) error {
+    if bkt.Schema == nil {
+        return nil
+    }
+
+    for _, k := range bkt.Schema.Required {
+        if _, ok := metadata[k]; !ok {
+            return fmt.Errorf("missing required metadata key %s", k)
+        }
+    }
+
+    for k, v := range bkt.Schema.Patterns {
+        val, ok := metadata[k]
+        if !ok {
+            continue
+        }
+
+        matched, err := regexp.MatchString(v, val)
+        if err != nil {
+            return fmt.Errorf("invalid pattern for key %s: %v", k, err)
+        } else if !matched {
+            return fmt.Errorf("invalid value for metadata key %s", k)
+        }
+    }
+
+    return nil
+}
+
+// Check an object's typed metadata against the bucket's schema. The schema
+// sees the typed values alongside the regular ones, with anything that isn't a
+// string compared by its JSON text (so a pattern of ^[0-9]+$ matches 42).
+func validatetypedmetadata(bkt *Bucket, metadata map[string]string,
+                           typed map[string]interface{}) error {
+    if bkt.Schema == nil {
+        return nil
+    }
+
+    merged := make(map[string]string, len(metadata) + len(typed))
+    for k, v := range metadata {
+        merged[k] = v
+    }
+
+    for k, v := range typed {
+        if str, ok := v.(string); ok {
+            merged[k] = str
+            continue
+        }
+
+        js, err := json.Marshal(v)
+        if err != nil {
+            return err
+        }
+
+        merged[k] = string(js)
+    }
+
+    return validatemetadata(bkt, merged)
+}
+
+func (s *SmartContract) QueryBucketsByIndex(ctx contractapi.TransactionContextInterface,
+                                            field string, value string,
+                                            includeMeta bool) (*BucketListing, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    // Look for an appropriate index
+    idx, _ := s.getbucketindex(ctx, myuser.ID, field)
+    if idx == nil {
+        return nil, fmt.Errorf("unknown index key")
+    }
+
+    // Get the iterator
+    iter, err := s.getbucketindexiterator(ctx, idx.ID, value)
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    bkts := make([]ListingBucket, 0)
+
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        _, parts, err := ctx.GetStub().SplitCompositeKey(resp.Key)
+        if err != nil {
+            return nil, err
+        }
+
+        bkt, err := s.GetBucket(ctx, parts[2])
+        if err != nil {
+            return nil, err
+        }
+
+        // Fill in this bucket.
+        lbkt := ListingBucket {
+            Name:       bkt.Name,
+            Owner:      bkt.Owner,
+            CTime:      bkt.CTime,
+            Public:     bucketispublic(bkt),
+        }
+
+        if includeMeta {
+            lbkt.Metadata = bkt.Metadata
+        }
+
+        bkts = append(bkts, lbkt)
+    }
+
+    // Fill in the metadata wrapping the listing
+    rv := BucketListing {
+        Count:          uint64(len(bkts)),
+        Token:          "",
+        Buckets:        bkts,
+    }
+
+    return &rv, nil
+}
+
+func (s *SmartContract) QueryMyBuckets(ctx contractapi.TransactionContextInterface,
+                                       query map[string]string,
+                                       maxbuckets uint32, includeMeta bool,
+                                       token string) (*BucketListing, error) {
+    // Set a sane default on the maximum number of buckets in one call...
+    maxbuckets = s.pagesize(maxbuckets)
+
     myuser, err := s.GetMyUser(ctx)
     if err != nil {
         return nil, err
@@ -260,6 +1204,7 @@ func (s *SmartContract) QueryMyBuckets(ctx contractapi.TransactionContextInterfa
             Name:       bkt.Name,
             Owner:      bkt.Owner,
             CTime:      bkt.CTime,
+            Public:     bucketispublic(&bkt),
         }
 
         if includeMeta {
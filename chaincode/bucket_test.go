@@ -0,0 +1,724 @@
+/*
+    Copyright (C) 2024 Lawrence Sebald
+    All Rights Reserved
+*/
+package chaincode
+
+import (
+    "reflect"
+    "sort"
+    "strings"
+    "testing"
+
+    "github.com/hyperledger/fabric-chaincode-go/v2/shim"
+)
+
+func TestMetadataSchema(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketMetadataSchema(ctx, "bucket-a", &MetadataSchema{
+            Required:   []string{"project"},
+            Patterns:   map[string]string{"year": `^[0-9]{4}$`},
+        })
+    })
+
+    create := func(key string, metadata map[string]string) error {
+        _, err := call(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.CreateObject(ctx, "bucket-a", key, 4, md5hex("data"),
+                                       metadata, nil, "", false)
+        })
+        return err
+    }
+
+    err := create("good.txt", map[string]string{"project": "x", "year": "2024"})
+    if err != nil {
+        t.Errorf("conforming object rejected: %v", err)
+    }
+
+    err = create("missing.txt", map[string]string{"year": "2024"})
+    if err == nil {
+        t.Errorf("object missing a required key accepted")
+    }
+
+    err = create("badyear.txt", map[string]string{"project": "x", "year": "24"})
+    if err == nil {
+        t.Errorf("object with a value not matching its pattern accepted")
+    }
+
+    // Bad patterns never make it into the bucket.
+    _, err = call(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketMetadataSchema(ctx, "bucket-a", &MetadataSchema{
+            Patterns:   map[string]string{"year": `[`},
+        })
+    })
+    if err == nil {
+        t.Errorf("schema with an invalid pattern accepted")
+    }
+
+    // An empty schema turns validation off.
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketMetadataSchema(ctx, "bucket-a", &MetadataSchema{})
+    })
+
+    err = create("missing.txt", nil)
+    if err != nil {
+        t.Errorf("object rejected with validation off: %v", err)
+    }
+}
+
+// Query the caller's buckets by an indexed field, returning the names found.
+func (e *testenv) bucketsbyindex(user string, field string,
+                                 value string) map[string]bool {
+    e.t.Helper()
+
+    l := mustcall(e, user, func(ctx txctx) (*BucketListing, error) {
+        return e.cc.QueryBucketsByIndex(ctx, field, value, false)
+    })
+
+    rv := map[string]bool{}
+    for _, bkt := range l.Buckets {
+        rv[bkt.Name] = true
+    }
+
+    return rv
+}
+
+func TestBucketIndex(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", User_SysPerms_AddBuckets)
+
+    addbucket := func(user string, name string, dept string) {
+        mustcall(env, user, func(ctx txctx) (string, error) {
+            return env.cc.AddBucket(ctx, name, map[string]string{"dept": dept})
+        })
+    }
+
+    // One bucket exists before the index does, the rest come after.
+    addbucket("alice", "eng-a", "eng")
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.CreateBucketIndex(ctx, "dept")
+    })
+    addbucket("alice", "eng-b", "eng")
+    addbucket("alice", "sales-a", "sales")
+    addbucket("bob", "eng-bob", "eng")
+
+    got := env.bucketsbyindex("alice", "dept", "eng")
+    if len(got) != 2 || !got["eng-a"] || !got["eng-b"] {
+        t.Errorf("eng buckets = %v, want eng-a and eng-b", got)
+    }
+
+    // Changing the metadata moves the bucket to its new value.
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.UpdateBucketMetadata(ctx, "eng-b",
+                                           map[string]string{"dept": "sales"})
+    })
+
+    got = env.bucketsbyindex("alice", "dept", "eng")
+    if len(got) != 1 || !got["eng-a"] {
+        t.Errorf("eng buckets after update = %v, want eng-a", got)
+    }
+
+    got = env.bucketsbyindex("alice", "dept", "sales")
+    if len(got) != 2 || !got["sales-a"] || !got["eng-b"] {
+        t.Errorf("sales buckets after update = %v, want sales-a and eng-b", got)
+    }
+
+    // Dropping the field takes the bucket out of the index entirely.
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.UpdateBucketMetadata(ctx, "sales-a", nil)
+    })
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.RemoveBucket(ctx, "eng-a")
+    })
+
+    got = env.bucketsbyindex("alice", "dept", "")
+    if len(got) != 1 || !got["eng-b"] {
+        t.Errorf("indexed buckets = %v, want eng-b", got)
+    }
+
+    sum := mustcall(env, "alice", func(ctx txctx) ([]IndexSummary, error) {
+        return env.cc.GetIndexSummary(ctx)
+    })
+    if len(sum) != 1 || sum[0].Kind != "bucket" || sum[0].Entries != 1 {
+        t.Errorf("index summary = %+v, want one bucket index entry", sum)
+    }
+
+    _, err := call(env, "bob", func(ctx txctx) (bool, error) {
+        return env.cc.UpdateBucketMetadata(ctx, "eng-b", nil)
+    })
+    if err == nil {
+        t.Errorf("someone other than the owner updated bucket metadata")
+    }
+}
+
+func TestBucketNameValidation(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+
+    tests := []struct {
+        name    string
+        ok      bool
+    }{
+        {"bucket-a", true},
+        {"my.data.2024", true},
+        {"abc", true},
+        {"Bucket-A", false},
+        {"ab", false},
+        {strings.Repeat("a", 64), false},
+        {"my_bucket", false},
+        {"bucket a", false},
+        {"bücket", false},
+        {"-bucket", false},
+        {"bucket.", false},
+        {"my..bucket", false},
+        {"192.168.1.10", false},
+        {"xn--bucket", false},
+        {"bucket-s3alias", false},
+    }
+
+    for _, tc := range tests {
+        _, err := call(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddBucket(ctx, tc.name, nil)
+        })
+
+        if tc.ok && err != nil {
+            t.Errorf("valid name %q rejected: %v", tc.name, err)
+        } else if !tc.ok && err == nil {
+            t.Errorf("invalid name %q accepted", tc.name)
+        }
+    }
+}
+
+func TestBucketPublicRead(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+    env.putobject("alice", "bucket-a", "a.txt", "data", nil, false)
+
+    setpublic := func(user string, public bool) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.SetBucketPublicRead(ctx, "bucket-a", public)
+        })
+        return err
+    }
+
+    canread := func() bool {
+        _, err := call(env, "carol", func(ctx txctx) (string, error) {
+            return env.cc.ReadObject(ctx, "bucket-a", "a.txt")
+        })
+        return err == nil
+    }
+
+    canlist := func() bool {
+        _, err := call(env, "carol", func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.ListObjects(ctx, "bucket-a", 0, false, 0, 0, "")
+        })
+        return err == nil
+    }
+
+    ispublic := func() bool {
+        l := mustcall(env, "alice", func(ctx txctx) (*BucketListing, error) {
+            return env.cc.QueryMyBuckets(ctx, nil, 0, false, "")
+        })
+        return len(l.Buckets) == 1 && l.Buckets[0].Public
+    }
+
+    if canread() || canlist() || ispublic() {
+        t.Fatalf("private bucket readable by an unrelated user")
+    }
+
+    if err := setpublic("carol", true); err == nil {
+        t.Errorf("someone other than the owner made the bucket public")
+    }
+
+    // Setting it twice shouldn't stack up entries.
+    for i := 0; i < 2; i++ {
+        if err := setpublic("alice", true); err != nil {
+            t.Fatalf("making bucket public: %v", err)
+        }
+    }
+
+    if !canread() || !canlist() || !ispublic() {
+        t.Errorf("public bucket not readable (read %v, list %v, public %v)",
+                 canread(), canlist(), ispublic())
+    }
+
+    bkt := mustcall(env, "alice", func(ctx txctx) (*Bucket, error) {
+        return env.cc.GetBucket(ctx, "bucket-a")
+    })
+    if len(bkt.Permissions) != 1 {
+        t.Errorf("bucket ACL = %+v, want a single public entry",
+                 bkt.Permissions)
+    }
+
+    // Reading is all that's opened up.
+    _, err := call(env, "carol", func(ctx txctx) (string, error) {
+        return env.cc.RemoveObject(ctx, "bucket-a", "a.txt")
+    })
+    if err == nil {
+        t.Errorf("public bucket let an unrelated user delete")
+    }
+
+    if err := setpublic("alice", false); err != nil {
+        t.Fatalf("making bucket private: %v", err)
+    }
+
+    if canread() || canlist() || ispublic() {
+        t.Errorf("bucket still readable after turning public read off")
+    }
+}
+
+func TestBucketCORS(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    getcors := func() *CORSConfig {
+        return mustcall(env, "alice", func(ctx txctx) (*CORSConfig, error) {
+            return env.cc.GetBucketCORS(ctx, "bucket-a")
+        })
+    }
+
+    setcors := func(user string, cors *CORSConfig) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.SetBucketCORS(ctx, "bucket-a", cors)
+        })
+        return err
+    }
+
+    if cors := getcors(); cors != nil {
+        t.Errorf("new bucket has CORS config %+v", cors)
+    }
+
+    cors := &CORSConfig{
+        AllowedOrigins: []string{"https://app.example.com", "*"},
+        AllowedMethods: []string{"GET", "HEAD"},
+        AllowedHeaders: []string{"Authorization"},
+        ExposeHeaders:  []string{"ETag"},
+        MaxAgeSeconds:  3600,
+    }
+    if err := setcors("alice", cors); err != nil {
+        t.Fatalf("setting CORS config: %v", err)
+    }
+
+    if got := getcors(); !reflect.DeepEqual(got, cors) {
+        t.Errorf("CORS config = %+v, want %+v", got, cors)
+    }
+
+    bad := []*CORSConfig{
+        {AllowedMethods: []string{"PATCH"}},
+        {AllowedMethods: []string{"get"}},
+        {AllowedOrigins: []string{""}},
+    }
+    for _, c := range bad {
+        if err := setcors("alice", c); err == nil {
+            t.Errorf("invalid CORS config %+v accepted", c)
+        }
+    }
+
+    if err := setcors("bob", nil); err == nil {
+        t.Errorf("someone other than the owner changed the CORS config")
+    }
+
+    if got := getcors(); !reflect.DeepEqual(got, cors) {
+        t.Errorf("CORS config after rejected changes = %+v", got)
+    }
+
+    if err := setcors("alice", nil); err != nil || getcors() != nil {
+        t.Errorf("clearing CORS config: %v, left %+v", err, getcors())
+    }
+}
+
+func TestBucketAnonymousList(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+    env.putobject("alice", "bucket-a", "a.txt", "data", nil, false)
+
+    env.createacl("alice", "private", map[string]uint32{
+        "alice":    ACL_Perms_All,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "bucket-a", "hidden.txt", 4,
+                                   md5hex("data"), nil, nil, "private", false)
+    })
+
+    setanon := func(user string, enabled bool) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.SetBucketAnonymousList(ctx, "bucket-a", enabled)
+        })
+        return err
+    }
+
+    list := func() ([]string, error) {
+        l, err := call(env, "carol", func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.ListObjects(ctx, "bucket-a", 0, false, 0, 0, "")
+        })
+        if err != nil {
+            return nil, err
+        }
+
+        keys := []string{}
+        for _, o := range l.Objects {
+            keys = append(keys, o.Key)
+        }
+        return keys, nil
+    }
+
+    if _, err := list(); err == nil {
+        t.Error("carol listed bucket-a before it was opened up")
+    }
+
+    if setanon("carol", true) == nil {
+        t.Error("carol opened up alice's bucket")
+    }
+    if err := setanon("alice", true); err != nil {
+        t.Fatalf("SetBucketAnonymousList: %v", err)
+    }
+
+    // Objects with their own ACL still decide for themselves.
+    keys, err := list()
+    if err != nil || !reflect.DeepEqual(keys, []string{"a.txt"}) {
+        t.Errorf("carol listing bucket-a = %v, %v", keys, err)
+    }
+
+    _, err = call(env, "carol", func(ctx txctx) (*KeyListing, error) {
+        return env.cc.ListObjectKeys(ctx, "bucket-a", "", 0, "")
+    })
+    if err != nil {
+        t.Errorf("carol couldn't list keys: %v", err)
+    }
+
+    // Listing doesn't let anyone at the contents.
+    _, err = call(env, "carol", func(ctx txctx) (string, error) {
+        return env.cc.ReadObject(ctx, "bucket-a", "a.txt")
+    })
+    if err == nil {
+        t.Error("carol read an object in an anonymously listable bucket")
+    }
+
+    _, err = call(env, "carol", func(ctx txctx) (*Object, error) {
+        return env.cc.GetObjectByPath(ctx, "bucket-a", "a.txt")
+    })
+    if err == nil {
+        t.Error("carol got an object in an anonymously listable bucket")
+    }
+
+    if err := setanon("alice", false); err != nil {
+        t.Fatalf("SetBucketAnonymousList: %v", err)
+    }
+    if _, err := list(); err == nil {
+        t.Error("carol listed bucket-a after it was closed again")
+    }
+}
+
+func TestDiffBucketACL(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets | User_SysPerms_AddGroups)
+    ids := map[string]string{}
+    for _, u := range []string{"bob", "carol", "dave"} {
+        ids[u] = env.adduser(u, 0)
+    }
+    env.addbucket("alice", "bucket-a")
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    ids["staff"] = env.getgroup("staff").ID
+
+    env.createacl("alice", "current", map[string]uint32{
+        "bob":      ACL_Perms_ReadObject,
+        "carol":    ACL_Perms_ListObjects,
+    }, map[string]uint32{
+        "staff":    ACL_Perms_ListObjects,
+    })
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "current")
+    })
+
+    env.createacl("alice", "proposed", map[string]uint32{
+        "bob":      ACL_Perms_ReadObject,
+        "carol":    ACL_Perms_ListObjects | ACL_Perms_ReadObject,
+        "dave":     ACL_Perms_ReadObject,
+    }, nil)
+
+    before := env.snapshot()
+    diff := mustcall(env, "alice", func(ctx txctx) (*ACLDiff, error) {
+        return env.cc.DiffBucketACL(ctx, "bucket-a", "proposed")
+    })
+
+    if !reflect.DeepEqual(env.state, before) {
+        t.Error("DiffBucketACL changed the world state")
+    }
+
+    if len(diff.Added) != 1 || diff.Added[0].ID != ids["dave"] {
+        t.Errorf("added = %+v, want just dave", diff.Added)
+    }
+    if len(diff.Removed) != 1 || diff.Removed[0].ID != ids["staff"] ||
+       diff.Removed[0].EntryType != ACL_EntryType_Group {
+        t.Errorf("removed = %+v, want just staff", diff.Removed)
+    }
+    if len(diff.Changed) != 1 || diff.Changed[0].Old.ID != ids["carol"] ||
+       diff.Changed[0].Old.Permissions != ACL_Perms_ListObjects ||
+       diff.Changed[0].New.Permissions != ACL_Perms_ListObjects |
+                                          ACL_Perms_ReadObject {
+        t.Errorf("changed = %+v, want carol gaining read", diff.Changed)
+    }
+
+    // Diffing against what's already there turns up nothing.
+    same := mustcall(env, "alice", func(ctx txctx) (*ACLDiff, error) {
+        return env.cc.DiffBucketACL(ctx, "bucket-a", "current")
+    })
+    if len(same.Added) + len(same.Removed) + len(same.Changed) != 0 {
+        t.Errorf("diff against the applied template = %+v", same)
+    }
+
+    for _, tc := range []struct {
+        user    string
+        acl     string
+    }{
+        { "bob",   "proposed" },
+        { "alice", "missing" },
+    } {
+        _, err := call(env, tc.user, func(ctx txctx) (*ACLDiff, error) {
+            return env.cc.DiffBucketACL(ctx, "bucket-a", tc.acl)
+        })
+        if err == nil {
+            t.Errorf("%s diffing against %s succeeded", tc.user, tc.acl)
+        }
+    }
+}
+
+func TestListBucketsByOwner(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", User_SysPerms_AddBuckets)
+
+    for _, name := range []string{"alice-1", "alice-2", "alice-3"} {
+        env.addbucket("alice", name)
+    }
+    env.addbucket("bob", "bob-1")
+
+    list := func(caller string, uid string) ([]string, error) {
+        names := []string{}
+        token := ""
+        for {
+            l, err := call(env, caller, func(ctx txctx) (*BucketListing, error) {
+                return env.cc.ListBucketsByOwner(ctx, uid, 2, token)
+            })
+            if err != nil {
+                return nil, err
+            }
+            for _, b := range l.Buckets {
+                names = append(names, b.Name)
+            }
+            if l.Count == 0 || l.Token == "" {
+                break
+            }
+            token = l.Token
+        }
+        sort.Strings(names)
+        return names, nil
+    }
+
+    want := []string{"alice-1", "alice-2", "alice-3"}
+    for _, caller := range []string{"alice", "admin"} {
+        got, err := list(caller, uidof("alice"))
+        if err != nil {
+            t.Errorf("%s listing alice's buckets: %v", caller, err)
+        } else if !reflect.DeepEqual(got, want) {
+            t.Errorf("%s listing alice's buckets = %v, want %v", caller,
+                     got, want)
+        }
+    }
+
+    if _, err := list("bob", uidof("alice")); err == nil {
+        t.Error("bob listed alice's buckets")
+    }
+
+    if _, err := list("admin", "nobody"); err == nil {
+        t.Error("listed the buckets of a user that doesn't exist")
+    }
+}
+
+func TestAddBucketWithACL(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", User_SysPerms_AddBuckets)
+    env.adduser("carol", 0)
+
+    env.createacl("alice", "bob-lists", map[string]uint32{
+        "bob":      ACL_Perms_ListObjects,
+    }, nil)
+    env.createacl("bob", "bob-only", map[string]uint32{
+        "bob":      ACL_Perms_All,
+    }, nil)
+
+    addbucket := func(user string, name string, tmpl string) error {
+        _, err := call(env, user, func(ctx txctx) (string, error) {
+            return env.cc.AddBucketWithACL(ctx, name, nil, tmpl)
+        })
+        return err
+    }
+
+    if err := addbucket("alice", "bucket-a", "bob-lists"); err != nil {
+        t.Fatalf("AddBucketWithACL: %v", err)
+    }
+
+    // The bucket's ACL is in force from the start.
+    env.putobject("alice", "bucket-a", "a.txt", "data", nil, false)
+    if !env.access("alice", "bob", "bucket-a", "", ACL_AccessType_List) {
+        t.Error("bob can't list the bucket the template grants listing on")
+    }
+    if env.access("alice", "carol", "bucket-a", "", ACL_AccessType_List) {
+        t.Error("carol can list a bucket the template doesn't cover")
+    }
+
+    // Someone else's template, a missing one, or none at all don't work, and
+    // nothing is left behind when they fail.
+    for _, tmpl := range []string{"bob-only", "no-such-acl", ""} {
+        if addbucket("alice", "bucket-b", tmpl) == nil {
+            t.Errorf("AddBucketWithACL with template %q succeeded", tmpl)
+        }
+    }
+    if _, err := call(env, "alice", func(ctx txctx) (*Bucket, error) {
+        return env.cc.GetBucket(ctx, "bucket-b")
+    }); err == nil {
+        t.Error("failed AddBucketWithACL left a bucket behind")
+    }
+}
+
+func TestBucketReadOnly(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+    env.putobject("alice", "bucket-a", "a.txt", "data", nil, false)
+
+    setro := func(user string, readonly bool) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.SetBucketReadOnly(ctx, "bucket-a", readonly)
+        })
+        return err
+    }
+
+    if setro("bob", true) == nil {
+        t.Error("bob froze a bucket they don't own")
+    }
+    if err := setro("alice", true); err != nil {
+        t.Fatalf("SetBucketReadOnly: %v", err)
+    }
+
+    writes := map[string]func(ctx txctx) error{
+        "CreateObject": func(ctx txctx) error {
+            _, err := env.cc.CreateObject(ctx, "bucket-a", "b.txt", 4,
+                                          md5hex("data"), nil, nil, "", false)
+            return err
+        },
+        "RemoveObject": func(ctx txctx) error {
+            _, err := env.cc.RemoveObject(ctx, "bucket-a", "a.txt")
+            return err
+        },
+        "TouchObject": func(ctx txctx) error {
+            _, err := env.cc.TouchObject(ctx, "bucket-a", "a.txt")
+            return err
+        },
+        "PinObject": func(ctx txctx) error {
+            _, err := env.cc.PinObject(ctx, "bucket-a", "a.txt")
+            return err
+        },
+        "SetObjectClass": func(ctx txctx) error {
+            _, err := env.cc.SetObjectClass(ctx, "bucket-a", "a.txt", "cold")
+            return err
+        },
+        "CreateObjectAlias": func(ctx txctx) error {
+            _, err := env.cc.CreateObjectAlias(ctx, "bucket-a", "a.txt",
+                                               "b.txt")
+            return err
+        },
+        "CommitObjectRequest": func(ctx txctx) error {
+            return env.cc.CommitObjectRequest(ctx, "bucket-a", "a.txt")
+        },
+        "RemoveBucket": func(ctx txctx) error {
+            _, err := env.cc.RemoveBucket(ctx, "bucket-a")
+            return err
+        },
+    }
+    for name, fn := range writes {
+        err := env.tx("alice", fn)
+        if err == nil || !strings.Contains(err.Error(), "read-only") {
+            t.Errorf("%s in a read-only bucket: %v", name, err)
+        }
+    }
+
+    // Reads and listings still work.
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.ReadObject(ctx, "bucket-a", "a.txt")
+    })
+    l := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+        return env.cc.ListObjects(ctx, "bucket-a", 0, false, 0, 0, "")
+    })
+    if len(l.Objects) != 1 {
+        t.Errorf("listed %d objects, want 1", len(l.Objects))
+    }
+
+    if err := setro("alice", false); err != nil {
+        t.Fatalf("SetBucketReadOnly: %v", err)
+    }
+    env.putobject("alice", "bucket-a", "b.txt", "more", nil, false)
+    env.checkdata("bucket-a", "b.txt", "more")
+}
+
+func TestReassignBucketOwner(t *testing.T) {
+    env := newtestenv(t)
+    aliceid := env.adduser("alice", User_SysPerms_AddBuckets)
+    bobid := env.adduser("bob", User_SysPerms_AddBuckets)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+
+    // Alice goes away without the bucket being cleaned up first.
+    key, _ := shim.CreateCompositeKey("User", []string{aliceid})
+    delete(env.state, key)
+
+    reassign := func(user string, uid string) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.ReassignBucketOwner(ctx, "bucket-a", uid)
+        })
+        return err
+    }
+
+    if reassign("bob", uidof("bob")) == nil ||
+       reassign("carol", uidof("bob")) == nil {
+        t.Error("bucket reassigned by someone other than an admin")
+    }
+    if reassign("admin", "no-such-user") == nil {
+        t.Error("bucket reassigned to a user that doesn't exist")
+    }
+    if err := reassign("admin", uidof("bob")); err != nil {
+        t.Fatalf("ReassignBucketOwner: %v", err)
+    }
+
+    bkt := mustcall(env, "bob", func(ctx txctx) (*Bucket, error) {
+        return env.cc.GetBucket(ctx, "bucket-a")
+    })
+    if bkt.Owner != bobid {
+        t.Errorf("bucket owner = %s, want %s", bkt.Owner, bobid)
+    }
+
+    // Bob can manage it now, and it's listed as one of bob's buckets.
+    mustcall(env, "bob", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketReadOnly(ctx, "bucket-a", true)
+    })
+    l := mustcall(env, "bob", func(ctx txctx) (*BucketListing, error) {
+        return env.cc.ListBucketsByOwner(ctx, uidof("bob"), 0, "")
+    })
+    if len(l.Buckets) != 1 || l.Buckets[0].Name != "bucket-a" {
+        t.Errorf("bob's buckets = %+v", l.Buckets)
+    }
+}
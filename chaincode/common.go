@@ -12,6 +12,54 @@ import (
 type SmartContract struct {
     contractapi.Contract
     S3client *minio.Client
+
+    // Listing page sizes. If zero, DefaultListingPageSize is used for both.
+    DefaultPageSize uint32
+    MaxPageSize uint32
+
+    // Largest document we'll try to write to the world state. If zero,
+    // DefaultMaxStateSize is used.
+    MaxStateSize uint32
+
+    // Most tags allowed on a single object. If zero, DefaultMaxObjectTags is
+    // used.
+    MaxObjectTags uint32
+
+    // If set, download URLs point here instead of at the backing store, with
+    // the signed path and query kept as they are. Whatever is at this address
+    // has to pass requests through with the backing store's Host header, or
+    // the signature won't check out.
+    PublicURLRewrite string
+}
+
+const DefaultListingPageSize uint32 = 1000
+const DefaultMaxStateSize uint32 = 1024 * 1024
+const DefaultMaxObjectTags uint32 = 64
+
+// Version of the chaincode, as reported by GetVersion. Release builds can set
+// this with -ldflags "-X github.com/ljsebald/shigure-api/chaincode.Version=...".
+var Version = "devel"
+
+// Work out how many entries to return in one page of a listing, given what
+// the caller asked for.
+func (s *SmartContract) pagesize(requested uint32) uint32 {
+    max := s.MaxPageSize
+    if max == 0 {
+        max = DefaultListingPageSize
+    }
+
+    def := s.DefaultPageSize
+    if def == 0 || def > max {
+        def = max
+    }
+
+    if requested == 0 {
+        return def
+    } else if requested > max {
+        return max
+    }
+
+    return requested
 }
 
 // System Permissions
@@ -19,6 +67,7 @@ const User_SysPerms_AddUsers    uint32 = 0x01
 const User_SysPerms_AddSubUsers uint32 = 0x02
 const User_SysPerms_AddGroups   uint32 = 0x04
 const User_SysPerms_AddBuckets  uint32 = 0x08
+const User_SysPerms_Admin       uint32 = 0x80000000
 
 // ACL/Bucket Permissions
 const ACL_Perms_ListObjects     uint32 = 0x01
@@ -28,6 +77,9 @@ const ACL_Perms_OverwriteObject uint32 = 0x08
 const ACL_Perms_DeleteObject    uint32 = 0x10
 // 0x20+ = Reserved
 
+// All of the permission bits that are currently defined
+const ACL_Perms_All             uint32 = 0x1f
+
 type SubUser struct {
     ID              string              `json:"id"`
     UID             string              `json:"uid"`
@@ -49,6 +101,14 @@ type SubGroup struct {
     Perms           map[string]uint32   `json:"perms"`
 }
 
+type UserTreeNode struct {
+    ID              string              `json:"id"`
+    UID             string              `json:"uid"`
+    Perms           map[string]uint32   `json:"perms"`
+    Truncated       bool                `json:"truncated"`
+    Children        []*UserTreeNode     `json:"children"`
+}
+
 type Group struct {
     Type            string              `json:"type"`
     ID              string              `json:"id"`
@@ -57,17 +117,31 @@ type Group struct {
     Parent          string              `json:"parent"`
     Users           []string            `json:"users"`
     SubGroups       []SubGroup          `json:"subgroups"`
+    CTime           int64               `json:"ctime"`
+}
+
+type GroupTreeNode struct {
+    ID              string              `json:"id"`
+    Name            string              `json:"name"`
+    Owner           string              `json:"owner"`
+    Perms           map[string]uint32   `json:"perms"`
+    Truncated       bool                `json:"truncated"`
+    Children        []*GroupTreeNode    `json:"children"`
 }
 
 // EntryType
-const ACL_EntryType_User    uint32 = 0x00
-const ACL_EntryType_Group   uint32 = 0x01
+const ACL_EntryType_User        uint32 = 0x00
+const ACL_EntryType_Group       uint32 = 0x01
+const ACL_EntryType_UserTree    uint32 = 0x02
+const ACL_EntryType_Public      uint32 = 0x03
 
 type ACLEntry struct {
     ID              string              `json:"id"`
     Entity          string              `json:"entity,omitempty"`
     EntryType       uint32              `json:"enttype"`
     Permissions     uint32              `json:"bits"`
+    Deny            bool                `json:"deny,omitempty"`
+    ExpiresAt       int64               `json:"expires,omitempty"`
 }
 
 type ACL []ACLEntry
@@ -78,6 +152,49 @@ type ACLTemplate struct {
     Owner           string              `json:"owner"`
     Name            string              `json:"name"`
     Permissions     ACL                 `json:"perms"`
+    CTime           int64               `json:"ctime"`
+}
+
+// Portable form of an ACL template, naming users by UID and groups by name
+// rather than by their internal IDs.
+type ExportedACLEntry struct {
+    Name            string              `json:"name"`
+    EntryType       uint32              `json:"enttype"`
+    Permissions     uint32              `json:"bits"`
+    Deny            bool                `json:"deny,omitempty"`
+    ExpiresAt       int64               `json:"expires,omitempty"`
+}
+
+type ExportedACL struct {
+    Name            string              `json:"name"`
+    Entries         []ExportedACLEntry  `json:"entries"`
+}
+
+type ACLEntryChange struct {
+    Old             ACLEntry            `json:"old"`
+    New             ACLEntry            `json:"new"`
+}
+
+type ACLDiff struct {
+    Added           []ACLEntry          `json:"added"`
+    Removed         []ACLEntry          `json:"removed"`
+    Changed         []ACLEntryChange    `json:"changed"`
+}
+
+type ACLGrant struct {
+    Bucket          string              `json:"bucket"`
+    Key             string              `json:"key,omitempty"`
+    Entry           ACLEntry            `json:"entry"`
+}
+
+type UserGrants struct {
+    UID             string              `json:"uid"`
+    Parent          string              `json:"parent,omitempty"`
+    SubUserPerms    map[string]uint32   `json:"subuserperms,omitempty"`
+    Groups          []string            `json:"groups"`
+    Buckets         []ACLGrant          `json:"buckets"`
+    Objects         []ACLGrant          `json:"objects"`
+    Truncated       bool                `json:"truncated"`
 }
 
 const ACL_AccessType_Read       uint32 = 0x00
@@ -92,6 +209,49 @@ type ACLTest struct {
     AccessType      uint32              `json:"access"`
 }
 
+type MetadataSchema struct {
+    Required        []string            `json:"required"`
+    Patterns        map[string]string   `json:"patterns"`
+}
+
+type CORSConfig struct {
+    AllowedOrigins  []string            `json:"origins"`
+    AllowedMethods  []string            `json:"methods"`
+    AllowedHeaders  []string            `json:"headers"`
+    ExposeHeaders   []string            `json:"expose"`
+    MaxAgeSeconds   uint32              `json:"maxage"`
+}
+
+type ObjectAccessTest struct {
+    UID             string              `json:"uid"`
+    Bucket          string              `json:"bucket"`
+    Key             string              `json:"key"`
+    AccessType      uint32              `json:"access"`
+}
+
+type ACLEntryTrace struct {
+    Entry           ACLEntry            `json:"entry"`
+    Held            uint32              `json:"held"`
+    Granted         bool                `json:"granted"`
+}
+
+type AccessTrace struct {
+    UID             string              `json:"uid"`
+    Bucket          string              `json:"bucket"`
+    Key             string              `json:"key"`
+    AccessType      uint32              `json:"access"`
+    Source          string              `json:"source"`
+    UserPerms       map[string]uint32   `json:"userperms"`
+    GroupPerms      map[string]uint32   `json:"groupperms"`
+    Entries         []ACLEntryTrace     `json:"entries"`
+    Granted         bool                `json:"granted"`
+    Decider         *ACLEntry           `json:"decider,omitempty"`
+}
+
+// Bucket Overwrite Modes
+const Bucket_OverwriteMode_Replace  uint32 = 0x00
+const Bucket_OverwriteMode_Version  uint32 = 0x01
+
 type Bucket struct {
     Type            string              `json:"type"`
     Name            string              `json:"name"`
@@ -99,11 +259,29 @@ type Bucket struct {
     Permissions     ACL                 `json:"perms"`
     Metadata        map[string]string   `json:"metadata"`
     CTime           int64               `json:"ctime"`
+    Schema          *MetadataSchema     `json:"schema,omitempty"`
+    OverwriteMode   uint32              `json:"overwritemode"`
+    Replicated      bool                `json:"replicated"`
+    CORS            *CORSConfig         `json:"cors,omitempty"`
+    RetainTag       string              `json:"retaintag,omitempty"`
+    AnonymousList   bool                `json:"anonlist"`
+    EnableDedup     bool                `json:"dedup"`
+    DeleteRecordTTL int64               `json:"drttl"`
+    DefaultMetadata map[string]string   `json:"defmetadata,omitempty"`
+    ReadOnly        bool                `json:"readonly"`
+    MetaHistory     uint32              `json:"metahistory"`
+    ExpireAfter     int64               `json:"expireafter,omitempty"`
 }
 
 // Object Flags:
 const ObjectFlag_IndexOnly      uint64 = 0x01
 const ObjectFlag_Staged         uint64 = 0x02
+const ObjectFlag_Pinned         uint64 = 0x04
+
+// Object Replication Status
+const ObjectReplStatus_Pending  string = "PENDING"
+const ObjectReplStatus_Complete string = "COMPLETE"
+const ObjectReplStatus_Failed   string = "FAILED"
 
 type Object struct {
     Type            string              `json:"type"`
@@ -115,9 +293,48 @@ type Object struct {
     MD5Sum          string              `json:"md5sum"`
     Size            uint64              `json:"size"`
     CTime           int64               `json:"ctime"`
+    MTime           int64               `json:"mtime"`
+    ATime           int64               `json:"atime"`
     Metadata        map[string]string   `json:"metadata"`
+    TypedMetadata   map[string]interface{} `json:"typedmetadata,omitempty"`
     Tags            []string            `json:"tags"`
     Flags           uint64              `json:"flags"`
+    HasData         bool                `json:"hasdata"`
+    DataKey         string              `json:"datakey,omitempty"`
+    DedupOf         string              `json:"dedupof,omitempty"`
+    Class           string              `json:"class,omitempty"`
+    RespHeaders     map[string]string   `json:"respheaders,omitempty"`
+    ReplStatus      string              `json:"replstatus,omitempty"`
+    VersionID       string              `json:"versionid,omitempty"`
+    AvailableFrom   int64               `json:"availfrom,omitempty"`
+    AvailableUntil  int64               `json:"availuntil,omitempty"`
+    StaleData       []string            `json:"staledata,omitempty"`
+}
+
+type ObjectAlias struct {
+    Type            string              `json:"type"`
+    Bucket          string              `json:"bucket"`
+    Alias           string              `json:"alias"`
+    Key             string              `json:"key"`
+    Owner           string              `json:"owner"`
+}
+
+type ObjectBatch struct {
+    Objects         []*Object           `json:"objects"`
+    Errors          []string            `json:"errors"`
+}
+
+type ObjectHead struct {
+    Object          *Object             `json:"object"`
+    DataChecked     bool                `json:"datachecked"`
+    DataPresent     bool                `json:"datapresent"`
+    DataSize        int64               `json:"datasize"`
+}
+
+type ObjectRead struct {
+    URL             string              `json:"url"`
+    MD5Sum          string              `json:"md5sum"`
+    Verified        bool                `json:"verified"`
 }
 
 type DeleteRecord struct {
@@ -132,6 +349,7 @@ type DeleteRecord struct {
     Size            uint64              `json:"size"`
     CTime           int64               `json:"ctime"`
     DTime           int64               `json:"dtime"`
+    ExpiresAt       int64               `json:"expires,omitempty"`
     Metadata        map[string]string   `json:"metadata"`
     Tags            []string            `json:"tags"`
     Flags           uint64              `json:"flags"`
@@ -146,6 +364,23 @@ type ListingObject struct {
     Metadata        map[string]string   `json:"metadata"`
     Tags            []string            `json:"tags"`
     ID              string              `json:"id"`
+    Bucket          string              `json:"bucket,omitempty"`
+    TypedMetadata   map[string]interface{} `json:"typedmetadata,omitempty"`
+    Class           string              `json:"class,omitempty"`
+}
+
+type ManifestEntry struct {
+    Key             string              `json:"key"`
+    Size            uint64              `json:"size"`
+    MD5Sum          string              `json:"md5sum"`
+    Metadata        map[string]string   `json:"metadata"`
+}
+
+type ImportSummary struct {
+    Created         uint64              `json:"created"`
+    Skipped         uint64              `json:"skipped"`
+    Failed          uint64              `json:"failed"`
+    Errors          map[string]string   `json:"errors"`
 }
 
 type ObjectListing struct {
@@ -155,6 +390,54 @@ type ObjectListing struct {
     Objects         []ListingObject     `json:"objects"`
 }
 
+type KeyListing struct {
+    Bucket          string              `json:"bucket"`
+    Count           uint64              `json:"count"`
+    Token           string              `json:"token"`
+    Keys            []string            `json:"keys"`
+}
+
+// One thing that happened to a key in a bucket: an object being created under
+// it, or that object being deleted.
+type KeyTimelineEvent struct {
+    Event           string              `json:"event"`
+    Time            int64               `json:"time"`
+    ID              string              `json:"id"`
+    Owner           string              `json:"owner"`
+    Deleter         string              `json:"deleter,omitempty"`
+    Size            uint64              `json:"size"`
+    MD5Sum          string              `json:"md5sum"`
+}
+
+type KeyTimeline struct {
+    Bucket          string              `json:"bucket"`
+    Key             string              `json:"key"`
+    Exists          bool                `json:"exists"`
+    Truncated       bool                `json:"truncated"`
+    Events          []KeyTimelineEvent  `json:"events"`
+}
+
+// What an object's metadata looked like before a change to it. These are stored
+// as MetaHistory~Bucket~Key~Seq, where Seq sorts the newest snapshots first.
+type MetadataSnapshot struct {
+    Type            string              `json:"type"`
+    Bucket          string              `json:"bucket"`
+    Key             string              `json:"key"`
+    Seq             string              `json:"seq"`
+    TxID            string              `json:"txid"`
+    Time            int64               `json:"time"`
+    Metadata        map[string]string   `json:"metadata"`
+    TypedMetadata   map[string]interface{} `json:"typedmetadata,omitempty"`
+}
+
+type VersionListing struct {
+    Bucket          string              `json:"bucket"`
+    Key             string              `json:"key"`
+    Count           uint64              `json:"count"`
+    Token           string              `json:"token"`
+    Versions        []*Object           `json:"versions"`
+}
+
 type BucketListing struct {
     Count           uint64              `json:"count"`
     Token           string              `json:"token"`
@@ -166,6 +449,33 @@ type ListingBucket struct {
     Owner           string              `json:"owner"`
     CTime           int64               `json:"ctime"`
     Metadata        map[string]string   `json:"metadata"`
+    Public          bool                `json:"public"`
+}
+
+type MoveSummary struct {
+    Moved           uint64              `json:"moved"`
+    Skipped         []string            `json:"skipped"`
+    Token           string              `json:"token"`
+}
+
+type TransferSummary struct {
+    Buckets         uint64              `json:"buckets"`
+    Objects         uint64              `json:"objects"`
+    Groups          uint64              `json:"groups"`
+    ACLs            uint64              `json:"acls"`
+    SkippedACLs     []string            `json:"skippedacls"`
+    Complete        bool                `json:"complete"`
+
+    // The last object moved, if there are more still to go.
+    Token           string              `json:"token,omitempty"`
+}
+
+type LifecycleResult struct {
+    Expired         uint64              `json:"expired"`
+    Pinned          uint64              `json:"pinned"`
+    Retained        uint64              `json:"retained"`
+    Purged          uint64              `json:"purged"`
+    Token           string              `json:"token"`
 }
 
 type UserIndex struct {
@@ -176,6 +486,20 @@ type UserIndex struct {
     Field           string              `json:"field"`
 }
 
+type BucketIndex struct {
+    Type            string              `json:"type"`
+    ID              string              `json:"id"`
+    Owner           string              `json:"owner"`
+    Field           string              `json:"field"`
+}
+
+type IndexSummary struct {
+    Field           string              `json:"field"`
+    Bucket          string              `json:"bucket"`
+    Kind            string              `json:"kind"`
+    Entries         uint64              `json:"entries"`
+}
+
 func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface) error {
     err := s.initusers(ctx)
     if err != nil {
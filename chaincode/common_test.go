@@ -0,0 +1,60 @@
+/*
+    Copyright (C) 2024 Lawrence Sebald
+    All Rights Reserved
+*/
+package chaincode
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestConfiguredPageSize(t *testing.T) {
+    env := newtestenv(t)
+    env.cc.DefaultPageSize = 2
+    env.cc.MaxPageSize = 3
+
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    for i := 0; i < 5; i++ {
+        env.addbucket("alice", fmt.Sprintf("bucket-%d", i))
+        env.putobject("alice", "bucket-0", fmt.Sprintf("%d.txt", i), "data",
+                      nil, false)
+    }
+
+    tests := []struct {
+        requested   uint32
+        want        int
+    }{
+        {0, 2},
+        {1, 1},
+        {3, 3},
+        {100, 3},
+    }
+
+    for _, tc := range tests {
+        objs := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.ListObjects(ctx, "bucket-0", tc.requested, false,
+                                      0, 0, "")
+        })
+        if len(objs.Objects) != tc.want {
+            t.Errorf("ListObjects(%d) returned %d objects, want %d",
+                     tc.requested, len(objs.Objects), tc.want)
+        }
+
+        mine := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.QueryMyObjects(ctx, nil, tc.requested, "")
+        })
+        if len(mine.Objects) != tc.want {
+            t.Errorf("QueryMyObjects(%d) returned %d objects, want %d",
+                     tc.requested, len(mine.Objects), tc.want)
+        }
+
+        bkts := mustcall(env, "alice", func(ctx txctx) (*BucketListing, error) {
+            return env.cc.QueryMyBuckets(ctx, nil, tc.requested, false, "")
+        })
+        if len(bkts.Buckets) != tc.want {
+            t.Errorf("QueryMyBuckets(%d) returned %d buckets, want %d",
+                     tc.requested, len(bkts.Buckets), tc.want)
+        }
+    }
+}
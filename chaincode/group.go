@@ -15,6 +15,11 @@ import (
 
 // Initializer for new blockchains.
 func (s *SmartContract) initgroups(ctx contractapi.TransactionContextInterface) error {
+    ctime, err := gettxtime(ctx)
+    if err != nil {
+        return err
+    }
+
     // Create a "none" group
     grp := Group {
         Type:       "Group",
@@ -24,17 +29,13 @@ func (s *SmartContract) initgroups(ctx contractapi.TransactionContextInterface)
         Parent:     "",
         Users:      make([]string, 0),
         SubGroups:  make([]SubGroup, 0),
-    }
-
-    grpJSON, err := json.Marshal(grp)
-    if err != nil {
-        return err
+        CTime:      ctime,
     }
 
     stateid, _ := ctx.GetStub().CreateCompositeKey("Group", []string{grp.ID})
-    err = ctx.GetStub().PutState(stateid, grpJSON)
+    err = s.putStateChecked(ctx, stateid, grp)
     if err != nil {
-        return fmt.Errorf("failed to put to world state. %v", err)
+        return err
     }
 
     return nil
@@ -101,10 +102,22 @@ func (s *SmartContract) AddGroup(ctx contractapi.TransactionContextInterface,
         return "", fmt.Errorf("permission denied")
     }
 
-    return s.addgroup_int(ctx, name, myuser.ID, "", addme)
+    var batch statebatch
+    newid, err := s.addgroup_int(ctx, &batch, name, myuser.ID, "", addme)
+    if err != nil {
+        return "", err
+    }
+
+    err = s.commitbatch(ctx, &batch)
+    if err != nil {
+        return "", err
+    }
+
+    return newid, nil
 }
 
 func (s *SmartContract) addgroup_int(ctx contractapi.TransactionContextInterface,
+                                     batch *statebatch,
                                      name string, owner string,
                                      parent string,
                                      addowner bool) (string, error) {
@@ -113,6 +126,11 @@ func (s *SmartContract) addgroup_int(ctx contractapi.TransactionContextInterface
         return "", fmt.Errorf("group already exists")
     }
 
+    ctime, err := gettxtime(ctx)
+    if err != nil {
+        return "", err
+    }
+
     grp := Group {
         Type:       "Group",
         ID:         uuid.NewString(),
@@ -120,6 +138,7 @@ func (s *SmartContract) addgroup_int(ctx contractapi.TransactionContextInterface
         Owner:      owner,
         Parent:     parent,
         SubGroups:  make([]SubGroup, 0),
+        CTime:      ctime,
     }
 
     if addowner {
@@ -129,16 +148,8 @@ func (s *SmartContract) addgroup_int(ctx contractapi.TransactionContextInterface
         grp.Users = make([]string, 0)
     }
 
-    grpJSON, err := json.Marshal(grp)
-    if err != nil {
-        return "", err
-    }
-
     stateid, _ := ctx.GetStub().CreateCompositeKey("Group", []string{grp.ID})
-    err = ctx.GetStub().PutState(stateid, grpJSON)
-    if err != nil {
-        return "", fmt.Errorf("failed to put to world state. %v", err)
-    }
+    batch.put(stateid, grp)
 
     return grp.ID, nil
 }
@@ -179,6 +190,11 @@ func (s *SmartContract) AddSubGroup(ctx contractapi.TransactionContextInterface,
         return "", err
     }
 
+    err = validatepermsmap(perms)
+    if err != nil {
+        return "", err
+    }
+
     if (myuser.SysPerms & 0x04) == 0 {
         return "", fmt.Errorf("permission denied")
     }
@@ -194,11 +210,17 @@ func (s *SmartContract) AddSubGroup(ctx contractapi.TransactionContextInterface,
     }
 
     // Add the group
-    newid, err := s.addgroup_int(ctx, name, myuser.ID, pgrp.ID, addme)
+    var batch statebatch
+    newid, err := s.addgroup_int(ctx, &batch, name, myuser.ID, pgrp.ID, addme)
     if err != nil {
         return "", err
     }
 
+    // Make sure we always have a map to work with later on.
+    if perms == nil {
+        perms = make(map[string]uint32)
+    }
+
     // Add the group to the list of sub-groups and update our entry
     sg := SubGroup {
         ID:     newid,
@@ -208,20 +230,13 @@ func (s *SmartContract) AddSubGroup(ctx contractapi.TransactionContextInterface,
 
     pgrp.SubGroups = append(pgrp.SubGroups, sg)
     stateid, _ := ctx.GetStub().CreateCompositeKey("Group", []string{pgrp.ID})
+    batch.put(stateid, pgrp)
 
-    grpJSON, err := json.Marshal(pgrp)
+    err = s.commitbatch(ctx, &batch)
     if err != nil {
         return "", err
     }
 
-    err = ctx.GetStub().PutState(stateid, grpJSON)
-    if err != nil {
-        // uh oh...
-        stateid, _ := ctx.GetStub().CreateCompositeKey("Group", []string{newid})
-        ctx.GetStub().DelState(stateid)
-        return "", fmt.Errorf("failed to put to world state. %v", err)
-    }
-
     return newid, nil
 }
 
@@ -238,6 +253,11 @@ func (s *SmartContract) SetSubGroupPermission(ctx contractapi.TransactionContext
         return false, fmt.Errorf("unknown user")
     }
 
+    err = validateperms(perms)
+    if err != nil {
+        return false, err
+    }
+
     // Look up the parent group and make sure we own it
     pgrp, err := s.GetGroupByName(ctx, pname)
     if err != nil || pgrp == nil {
@@ -249,20 +269,83 @@ func (s *SmartContract) SetSubGroupPermission(ctx contractapi.TransactionContext
     }
 
     // Look for the specified subgroup...
-    for _, ent := range pgrp.SubGroups {
-        if ent.Name == sname {
-            ent.Perms[bucket] = perms
+    for i := range pgrp.SubGroups {
+        if pgrp.SubGroups[i].Name == sname {
+            if pgrp.SubGroups[i].Perms == nil {
+                pgrp.SubGroups[i].Perms = make(map[string]uint32)
+            }
+
+            pgrp.SubGroups[i].Perms[bucket] = perms
 
             // Update our state in the db
-            grpJSON, err := json.Marshal(pgrp)
+            id, _ := ctx.GetStub().CreateCompositeKey("Group", []string{pgrp.ID})
+            err = s.putStateChecked(ctx, id, pgrp)
             if err != nil {
                 return false, err
             }
 
+            return true, nil
+        }
+    }
+
+    return false, fmt.Errorf("unknown subgroup")
+}
+
+// Set bucket permissions to be inherited from the parent group by a specified
+// sub-group for several buckets at once
+func (s *SmartContract) SetSubGroupPermissions(ctx contractapi.TransactionContextInterface,
+                                               pname string, sname string,
+                                               perms map[string]uint32) (bool, error) {
+    user, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    } else if user == nil {
+        return false, fmt.Errorf("unknown user")
+    }
+
+    err = validatepermsmap(perms)
+    if err != nil {
+        return false, err
+    }
+
+    // Look up the parent group and make sure we own it
+    pgrp, err := s.GetGroupByName(ctx, pname)
+    if err != nil || pgrp == nil {
+        return false, fmt.Errorf("group not found")
+    }
+
+    if pgrp.Owner != user.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    // Make sure all the buckets are real before changing anything.
+    for bucket := range perms {
+        if bucket == "*" {
+            continue
+        }
+
+        _, err := s.GetBucket(ctx, bucket)
+        if err != nil {
+            return false, fmt.Errorf("unknown bucket %s", bucket)
+        }
+    }
+
+    // Look for the specified subgroup...
+    for i := range pgrp.SubGroups {
+        if pgrp.SubGroups[i].Name == sname {
+            if pgrp.SubGroups[i].Perms == nil {
+                pgrp.SubGroups[i].Perms = make(map[string]uint32)
+            }
+
+            for bucket, p := range perms {
+                pgrp.SubGroups[i].Perms[bucket] = p
+            }
+
+            // Update our state in the db
             id, _ := ctx.GetStub().CreateCompositeKey("Group", []string{pgrp.ID})
-            err = ctx.GetStub().PutState(id, grpJSON)
+            err = s.putStateChecked(ctx, id, pgrp)
             if err != nil {
-                return false, fmt.Errorf("failed to put to world state. %v", err)
+                return false, err
             }
 
             return true, nil
@@ -294,20 +377,126 @@ func (s *SmartContract) RevokeSubGroupPermission(ctx contractapi.TransactionCont
     }
 
     // Look for the specified subgroup...
-    for _, ent := range pgrp.SubGroups {
-        if ent.Name == sname {
-            delete(ent.Perms, bucket)
+    for i := range pgrp.SubGroups {
+        if pgrp.SubGroups[i].Name == sname {
+            delete(pgrp.SubGroups[i].Perms, bucket)
 
             // Update our state in the db
-            grpJSON, err := json.Marshal(pgrp)
+            id, _ := ctx.GetStub().CreateCompositeKey("Group", []string{pgrp.ID})
+            err = s.putStateChecked(ctx, id, pgrp)
             if err != nil {
                 return false, err
             }
 
+            return true, nil
+        }
+    }
+
+    return false, fmt.Errorf("unknown subgroup")
+}
+
+// How far down the group tree GetGroupTree will go.
+const max_group_tree_depth = 16
+
+// Fetch the whole tree of sub-groups under the specified group
+func (s *SmartContract) GetGroupTree(ctx contractapi.TransactionContextInterface,
+                                     name string) (*GroupTreeNode, error) {
+    grp, err := s.GetGroupByName(ctx, name)
+    if err != nil || grp == nil {
+        return nil, fmt.Errorf("group not found")
+    }
+
+    root := GroupTreeNode {
+        ID:         grp.ID,
+        Name:       grp.Name,
+        Owner:      grp.Owner,
+        Perms:      make(map[string]uint32),
+    }
+
+    seen := map[string]bool{ grp.ID: true }
+    err = s.buildgrouptree(ctx, &root, grp, seen, 0)
+    if err != nil {
+        return nil, err
+    }
+
+    return &root, nil
+}
+
+func (s *SmartContract) buildgrouptree(ctx contractapi.TransactionContextInterface,
+                                       node *GroupTreeNode, grp *Group,
+                                       seen map[string]bool,
+                                       depth int) error {
+    node.Children = make([]*GroupTreeNode, 0, len(grp.SubGroups))
+
+    if depth >= max_group_tree_depth {
+        node.Truncated = len(grp.SubGroups) != 0
+        return nil
+    }
+
+    for _, ent := range grp.SubGroups {
+        // Don't go around in circles if the tree is broken somehow.
+        if seen[ent.ID] {
+            node.Truncated = true
+            continue
+        }
+
+        seen[ent.ID] = true
+
+        sgrp, err := s.GetGroupByID(ctx, ent.ID)
+        if err != nil {
+            return err
+        }
+
+        child := GroupTreeNode {
+            ID:         sgrp.ID,
+            Name:       sgrp.Name,
+            Owner:      sgrp.Owner,
+            Perms:      ent.Perms,
+        }
+
+        err = s.buildgrouptree(ctx, &child, sgrp, seen, depth + 1)
+        if err != nil {
+            return err
+        }
+
+        node.Children = append(node.Children, &child)
+    }
+
+    return nil
+}
+
+// Revoke all inherited permissions from a sub-group, without removing the
+// sub-group itself
+func (s *SmartContract) ClearSubGroupPermissions(ctx contractapi.TransactionContextInterface,
+                                                 pname string,
+                                                 sname string) (bool, error) {
+    user, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    } else if user == nil {
+        return false, fmt.Errorf("unknown user")
+    }
+
+    // Look up the parent group and make sure we own it
+    pgrp, err := s.GetGroupByName(ctx, pname)
+    if err != nil || pgrp == nil {
+        return false, fmt.Errorf("group not found")
+    }
+
+    if pgrp.Owner != user.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    // Look for the specified subgroup...
+    for i := range pgrp.SubGroups {
+        if pgrp.SubGroups[i].Name == sname {
+            pgrp.SubGroups[i].Perms = make(map[string]uint32)
+
+            // Update our state in the db
             id, _ := ctx.GetStub().CreateCompositeKey("Group", []string{pgrp.ID})
-            err = ctx.GetStub().PutState(id, grpJSON)
+            err = s.putStateChecked(ctx, id, pgrp)
             if err != nil {
-                return false, fmt.Errorf("failed to put to world state. %v", err)
+                return false, err
             }
 
             return true, nil
@@ -317,6 +506,273 @@ func (s *SmartContract) RevokeSubGroupPermission(ctx contractapi.TransactionCont
     return false, fmt.Errorf("unknown subgroup")
 }
 
+// Delete a group owned by the caller. A group with sub-groups can only be
+// deleted if recursive is set, in which case the whole tree under it goes too
+// (as long as the caller owns every group in it).
+func (s *SmartContract) DeleteGroup(ctx contractapi.TransactionContextInterface,
+                                    name string, recursive bool) (bool, error) {
+    user, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    } else if user == nil {
+        return false, fmt.Errorf("unknown user")
+    }
+
+    grp, err := s.GetGroupByName(ctx, name)
+    if err != nil || grp == nil {
+        return false, fmt.Errorf("group not found")
+    }
+
+    if grp.Owner != user.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    if len(grp.SubGroups) != 0 && !recursive {
+        return false, fmt.Errorf("group has sub-groups")
+    }
+
+    // Work out everything that's going away before touching anything, so we
+    // don't end up with half of a tree deleted.
+    doomed := []string{ grp.ID }
+    seen := map[string]bool{ grp.ID: true }
+    err = s.collectsubgroups(ctx, user, grp, seen, &doomed, 0)
+    if err != nil {
+        return false, err
+    }
+
+    // Take the group out of its parent's list of sub-groups.
+    if grp.Parent != "" {
+        pgrp, err := s.GetGroupByID(ctx, grp.Parent)
+        if err == nil && pgrp != nil {
+            sgs := make([]SubGroup, 0, len(pgrp.SubGroups))
+            for _, ent := range pgrp.SubGroups {
+                if ent.ID != grp.ID {
+                    sgs = append(sgs, ent)
+                }
+            }
+
+            pgrp.SubGroups = sgs
+            id, _ := ctx.GetStub().CreateCompositeKey("Group", []string{pgrp.ID})
+            err = s.putStateChecked(ctx, id, pgrp)
+            if err != nil {
+                return false, err
+            }
+        }
+    }
+
+    for _, gid := range doomed {
+        id, _ := ctx.GetStub().CreateCompositeKey("Group", []string{gid})
+        err = ctx.GetStub().DelState(id)
+        if err != nil {
+            return false, fmt.Errorf("failed to delete from world state. %v", err)
+        }
+    }
+
+    return true, nil
+}
+
+func (s *SmartContract) collectsubgroups(ctx contractapi.TransactionContextInterface,
+                                         user *User, grp *Group,
+                                         seen map[string]bool, ids *[]string,
+                                         depth int) error {
+    if depth >= max_group_tree_depth && len(grp.SubGroups) != 0 {
+        return fmt.Errorf("group tree too deep")
+    }
+
+    for _, ent := range grp.SubGroups {
+        if seen[ent.ID] {
+            continue
+        }
+
+        seen[ent.ID] = true
+
+        // Nothing to clean up if a sub-group is already gone.
+        sgrp, _ := s.GetGroupByID(ctx, ent.ID)
+        if sgrp == nil {
+            continue
+        }
+
+        if sgrp.Owner != user.ID {
+            return fmt.Errorf("permission denied on sub-group %s", sgrp.Name)
+        }
+
+        *ids = append(*ids, sgrp.ID)
+
+        err := s.collectsubgroups(ctx, user, sgrp, seen, ids, depth + 1)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Move a group owned by the caller underneath another group the caller owns.
+// Any permissions the old parent passed down to the group are dropped, since
+// they were granted by the old parent; use SetSubGroupPermission on the new
+// parent to grant access there.
+func (s *SmartContract) ReparentGroup(ctx contractapi.TransactionContextInterface,
+                                      name string,
+                                      newParentName string) (bool, error) {
+    user, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    } else if user == nil {
+        return false, fmt.Errorf("unknown user")
+    }
+
+    grp, err := s.GetGroupByName(ctx, name)
+    if err != nil || grp == nil {
+        return false, fmt.Errorf("group not found")
+    }
+
+    npgrp, err := s.GetGroupByName(ctx, newParentName)
+    if err != nil || npgrp == nil {
+        return false, fmt.Errorf("group not found")
+    }
+
+    if grp.Owner != user.ID || npgrp.Owner != user.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    if grp.Parent == npgrp.ID {
+        return true, nil
+    }
+
+    // Don't allow the group to end up underneath itself.
+    cycle, err := s.isgroupdescendent(ctx, npgrp, grp.ID)
+    if err != nil {
+        return false, err
+    } else if cycle || npgrp.ID == grp.ID {
+        return false, fmt.Errorf("reparenting would create a cycle")
+    }
+
+    var batch statebatch
+
+    // Take the group out of its old parent's list of sub-groups.
+    if grp.Parent != "" {
+        opgrp, err := s.GetGroupByID(ctx, grp.Parent)
+        if err == nil && opgrp != nil {
+            sgs := make([]SubGroup, 0, len(opgrp.SubGroups))
+            for _, ent := range opgrp.SubGroups {
+                if ent.ID != grp.ID {
+                    sgs = append(sgs, ent)
+                }
+            }
+
+            opgrp.SubGroups = sgs
+            id, _ := ctx.GetStub().CreateCompositeKey("Group", []string{opgrp.ID})
+            batch.put(id, opgrp)
+        }
+    }
+
+    npgrp.SubGroups = append(npgrp.SubGroups, SubGroup {
+        ID:     grp.ID,
+        Name:   grp.Name,
+        Perms:  make(map[string]uint32),
+    })
+    id, _ := ctx.GetStub().CreateCompositeKey("Group", []string{npgrp.ID})
+    batch.put(id, npgrp)
+
+    grp.Parent = npgrp.ID
+    id, _ = ctx.GetStub().CreateCompositeKey("Group", []string{grp.ID})
+    batch.put(id, grp)
+
+    err = s.commitbatch(ctx, &batch)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Walk up the tree from the group to see if we run into the specified ancestor.
+func (s *SmartContract) isgroupdescendent(ctx contractapi.TransactionContextInterface,
+                                          grp *Group, ancestor string) (bool, error) {
+    for depth := 0; grp.Parent != ""; depth++ {
+        if grp.Parent == ancestor {
+            return true, nil
+        }
+
+        if depth >= max_group_tree_depth {
+            return false, fmt.Errorf("group tree too deep")
+        }
+
+        parent, err := s.GetGroupByID(ctx, grp.Parent)
+        if err != nil || parent == nil {
+            return false, nil
+        }
+
+        grp = parent
+    }
+
+    return false, nil
+}
+
+// Get everyone who counts as a member of a group when an ACL entry names it:
+// the group's direct members, plus the members of any sub-groups the group
+// has passed permissions down to (and so on down the tree). A sub-group only
+// counts if it has been given some permission through its parent, so this is
+// everyone who might have access through the group -- what they can actually
+// do on a given bucket may be less than that.
+func (s *SmartContract) GetEffectiveGroupMembers(ctx contractapi.TransactionContextInterface,
+                                                 name string) ([]string, error) {
+    grp, err := s.GetGroupByName(ctx, name)
+    if err != nil || grp == nil {
+        return nil, fmt.Errorf("group not found")
+    }
+
+    rv := make([]string, 0)
+    seen := map[string]bool{}
+    visited := map[string]bool{ grp.ID: true }
+    s.collecteffectivemembers(ctx, grp, visited, seen, &rv, 0)
+
+    return rv, nil
+}
+
+func (s *SmartContract) collecteffectivemembers(ctx contractapi.TransactionContextInterface,
+                                                grp *Group,
+                                                visited map[string]bool,
+                                                seen map[string]bool,
+                                                members *[]string, depth int) {
+    for _, uid := range grp.Users {
+        if !seen[uid] {
+            seen[uid] = true
+            *members = append(*members, uid)
+        }
+    }
+
+    if depth >= max_group_tree_depth {
+        return
+    }
+
+    for _, ent := range grp.SubGroups {
+        if visited[ent.ID] || !subgrouphasperms(&ent) {
+            continue
+        }
+
+        visited[ent.ID] = true
+
+        sgrp, _ := s.GetGroupByID(ctx, ent.ID)
+        if sgrp == nil {
+            continue
+        }
+
+        s.collecteffectivemembers(ctx, sgrp, visited, seen, members, depth + 1)
+    }
+}
+
+// Does the sub-group get anything at all from its parent?
+func subgrouphasperms(sg *SubGroup) bool {
+    for _, v := range sg.Perms {
+        if v != 0 {
+            return true
+        }
+    }
+
+    return false
+}
+
 // Get all groups that the caller is a direct member of
 func (s *SmartContract) GetMyMemberGroups(ctx contractapi.TransactionContextInterface) ([]*Group, error) {
     user, err := s.GetMyUser(ctx)
@@ -344,7 +800,19 @@ func (s *SmartContract) GetMemberGroupsForUID(ctx contractapi.TransactionContext
 
 func (s *SmartContract) getusergroups(ctx contractapi.TransactionContextInterface,
                                       id string) ([]*Group, error) {
-    query := fmt.Sprintf(`{"selector":{"type":"Group","users":{"$elemMatch":{"$eq":"%s"}}`, id)
+    querymap := map[string]interface{} {
+        "type":     "Group",
+        "users":    map[string]interface{} {
+            "$elemMatch": map[string]string { "$eq": id },
+        },
+    }
+
+    js, err := json.Marshal(querymap)
+    if err != nil {
+        return nil, err
+    }
+
+    query := fmt.Sprintf(`{"selector":%s}`, js)
     resultsIterator, err := ctx.GetStub().GetQueryResult(query)
     if err != nil {
         return nil, err
@@ -458,15 +926,10 @@ func (s *SmartContract) AddUserToGroup(ctx contractapi.TransactionContextInterfa
     // Update our state in the db
     grp.Users = append(grp.Users, user.ID)
 
-    grpJSON, err := json.Marshal(grp)
-    if err != nil {
-        return false, err
-    }
-
     id, _ := ctx.GetStub().CreateCompositeKey("Group", []string{grp.ID})
-    err = ctx.GetStub().PutState(id, grpJSON)
+    err = s.putStateChecked(ctx, id, grp)
     if err != nil {
-        return false, fmt.Errorf("failed to put to world state. %v", err)
+        return false, err
     }
 
     return true, nil
@@ -508,18 +971,61 @@ func (s *SmartContract) RemoveUserFromGroup(ctx contractapi.TransactionContextIn
 
     // Update our state in the db
     grp.Users = append(grp.Users[:i], grp.Users[i + 1:]...)
-    grpJSON, err := json.Marshal(grp)
+    id, _ := ctx.GetStub().CreateCompositeKey("Group", []string{grp.ID})
+    err = s.putStateChecked(ctx, id, grp)
     if err != nil {
         return false, err
     }
 
-    id, _ := ctx.GetStub().CreateCompositeKey("Group", []string{grp.ID})
-    err = ctx.GetStub().PutState(id, grpJSON)
+    return true, nil
+}
+
+// Work out what a sub-group inherits from its parent on a bucket. If we don't
+// have a specific match on the bucket, see if we have a wildcard match.
+// Specific matches always override wildcard ones.
+func subgroupbucketperms(sg *SubGroup, bucket string) uint32 {
+    perms, ok := sg.Perms[bucket]
+    if !ok || perms == 0 {
+        perms = sg.Perms["*"]
+    }
+
+    return perms
+}
+
+// Show what a sub-group would inherit from its parent on each of a set of
+// buckets, so an owner can check that a wildcard grant doesn't give away more
+// than intended.
+func (s *SmartContract) PreviewEffectiveSubGroupPerms(ctx contractapi.TransactionContextInterface,
+                                                      pname string, sname string,
+                                                      buckets []string) (map[string]uint32, error) {
+    user, err := s.GetMyUser(ctx)
     if err != nil {
-        return false, fmt.Errorf("failed to put to world state. %v", err)
+        return nil, err
     }
 
-    return true, nil
+    // Look up the parent group and make sure we own it
+    pgrp, err := s.GetGroupByName(ctx, pname)
+    if err != nil || pgrp == nil {
+        return nil, fmt.Errorf("group not found")
+    }
+
+    if pgrp.Owner != user.ID {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    for i := range pgrp.SubGroups {
+        if pgrp.SubGroups[i].Name == sname {
+            rv := make(map[string]uint32)
+
+            for _, b := range buckets {
+                rv[b] = subgroupbucketperms(&pgrp.SubGroups[i], b)
+            }
+
+            return rv, nil
+        }
+    }
+
+    return nil, fmt.Errorf("unknown subgroup")
 }
 
 // Gather the permissions inherited from ancestor groups on the specified bucket
@@ -541,12 +1047,13 @@ func (s *SmartContract) gathergperms(ctx contractapi.TransactionContextInterface
     rv := map[string]uint32{}
     var parent *Group = nil
     var lastperms uint32 = 0x000000ff
+    var err error
 
     // Iterate up the tree of parents until we either run out of permissions or
     // get all the way to the root
     for g := group; g.Parent != "" && lastperms != 0; g = parent {
         // Grab the parent.
-        parent, err := s.GetGroupByID(ctx, g.Parent)
+        parent, err = s.GetGroupByID(ctx, g.Parent)
         if err != nil {
             return nil, err
         } else if parent == nil {
@@ -557,18 +1064,12 @@ func (s *SmartContract) gathergperms(ctx contractapi.TransactionContextInterface
         for _, ent := range parent.SubGroups {
             if ent.ID == g.ID {
                 // Look for the bucket in question
-                perms, ok := ent.Perms[bucket]
-                if !ok || perms == 0 {
-                    // If we didn't match the bucket, see if we have a wildcard
-                    // match. Specific matches always override wildcard ones.
-                    perms, ok = ent.Perms["*"]
-
-                    if !ok || perms == 0 {
-                        // We don't have anything further to do up this path
-                        // since we don't have either a specific or wildcard
-                        // match
-                        return rv, nil
-                    }
+                perms := subgroupbucketperms(&ent, bucket)
+                if perms == 0 {
+                    // We don't have anything further to do up this path
+                    // since we don't have either a specific or wildcard
+                    // match
+                    return rv, nil
                 }
 
                 // Apply the permissions we have here to what we've gotten
@@ -619,6 +1120,7 @@ func (s *SmartContract) gatherallgperms(ctx contractapi.TransactionContextInterf
     rv := map[string]uint32{}
     var parent *Group = nil
     var lastperms uint32 = 0x000000ff
+    var err error
 
     // Run through each group in the array...
     for _, group := range groups {
@@ -631,7 +1133,7 @@ func (s *SmartContract) gatherallgperms(ctx contractapi.TransactionContextInterf
         // or get all the way to the root
         for g := group; g.Parent != "" && lastperms != 0; g = parent {
             // Grab the parent.
-            parent, err := s.GetGroupByID(ctx, g.Parent)
+            parent, err = s.GetGroupByID(ctx, g.Parent)
             if err != nil {
                 return nil, err
             } else if parent == nil {
@@ -642,19 +1144,13 @@ func (s *SmartContract) gatherallgperms(ctx contractapi.TransactionContextInterf
             for _, ent := range parent.SubGroups {
                 if ent.ID == g.ID {
                     // Look for the bucket in question
-                    perms, ok := ent.Perms[bucket]
-                    if !ok || perms == 0 {
-                        // If we didn't match the bucket, see if we have a
-                        // wildcard match. Specific matches always override
-                        //wildcard ones.
-                        perms, ok = ent.Perms["*"]
-
-                        if !ok || perms == 0 {
-                            // We don't have anything further to do up this path
-                            // since we don't have either a specific or wildcard
-                            // match
-                            break
-                        }
+                    perms := subgroupbucketperms(&ent, bucket)
+                    if perms == 0 {
+                        // We don't have anything further to do up this path
+                        // since we don't have either a specific or wildcard
+                        // match
+                        lastperms = 0
+                        break
                     }
 
                     // Apply the permissions we have here to what we've gotten
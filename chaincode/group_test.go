@@ -0,0 +1,736 @@
+/*
+    Copyright (C) 2024 Lawrence Sebald
+    All Rights Reserved
+*/
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "sort"
+    "testing"
+    "time"
+
+    "github.com/hyperledger/fabric-chaincode-go/v2/shim"
+)
+
+// Fetch a group by name straight from the ledger.
+func (e *testenv) getgroup(name string) *Group {
+    e.t.Helper()
+
+    return mustcall(e, "admin", func(ctx txctx) (*Group, error) {
+        return e.cc.GetGroupByName(ctx, name)
+    })
+}
+
+func TestSubGroupWithNilPerms(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups)
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubGroup(ctx, "staff", "team", nil, false)
+    })
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetSubGroupPermission(ctx, "staff", "team", "bucket-a",
+                                            ACL_Perms_ReadObject)
+    })
+
+    staff := env.getgroup("staff")
+    if len(staff.SubGroups) != 1 ||
+       staff.SubGroups[0].Perms["bucket-a"] != ACL_Perms_ReadObject {
+        t.Errorf("sub-groups after setting perms = %+v", staff.SubGroups)
+    }
+}
+
+func TestSubGroupPermsPersist(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups)
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubGroup(ctx, "staff", "team", nil, false)
+    })
+
+    // Sub-groups stored before their maps were initialized have null perms.
+    staff := env.getgroup("staff")
+    staff.SubGroups[0].Perms = nil
+    raw, err := json.Marshal(staff)
+    if err != nil {
+        t.Fatal(err)
+    }
+    key, _ := shim.CreateCompositeKey("Group", []string{staff.ID})
+    env.state[key] = raw
+
+    set := func(bucket string, perms uint32) {
+        mustcall(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.SetSubGroupPermission(ctx, "staff", "team", bucket,
+                                                perms)
+        })
+    }
+
+    set("bucket-a", ACL_Perms_ReadObject)
+    set("bucket-b", ACL_Perms_ListObjects)
+
+    perms := env.getgroup("staff").SubGroups[0].Perms
+    if perms["bucket-a"] != ACL_Perms_ReadObject ||
+       perms["bucket-b"] != ACL_Perms_ListObjects {
+        t.Errorf("perms after setting = %v", perms)
+    }
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.RevokeSubGroupPermission(ctx, "staff", "team", "bucket-a")
+    })
+
+    perms = env.getgroup("staff").SubGroups[0].Perms
+    if _, ok := perms["bucket-a"]; ok || len(perms) != 1 {
+        t.Errorf("perms after revoking = %v", perms)
+    }
+}
+
+func TestGetGroupTree(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups)
+
+    addsub := func(parent string, name string) {
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddSubGroup(ctx, parent, name, map[string]uint32{
+                "bucket-a": ACL_Perms_ReadObject,
+            }, false)
+        })
+    }
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    addsub("staff", "eng")
+    addsub("staff", "sales")
+    addsub("eng", "backend")
+
+    tree := mustcall(env, "alice", func(ctx txctx) (*GroupTreeNode, error) {
+        return env.cc.GetGroupTree(ctx, "staff")
+    })
+
+    names := func(n *GroupTreeNode) []string {
+        rv := []string{}
+        for _, c := range n.Children {
+            rv = append(rv, c.Name)
+        }
+        sort.Strings(rv)
+        return rv
+    }
+
+    if tree.Name != "staff" || !reflect.DeepEqual(names(tree),
+                                                  []string{"eng", "sales"}) {
+        t.Fatalf("top of tree = %s with %v", tree.Name, names(tree))
+    }
+
+    for _, c := range tree.Children {
+        want := []string{}
+        if c.Name == "eng" {
+            want = []string{"backend"}
+        }
+
+        if got := names(c); !reflect.DeepEqual(got, want) {
+            t.Errorf("children of %s = %v, want %v", c.Name, got, want)
+        }
+
+        if c.Perms["bucket-a"] != ACL_Perms_ReadObject || c.Truncated {
+            t.Errorf("node %s = %+v", c.Name, c)
+        }
+    }
+
+    // A chain deeper than the cap gets cut off at the cap.
+    parent := "backend"
+    for i := 0; i < max_group_tree_depth; i++ {
+        name := fmt.Sprintf("level-%d", i)
+        addsub(parent, name)
+        parent = name
+    }
+
+    tree = mustcall(env, "alice", func(ctx txctx) (*GroupTreeNode, error) {
+        return env.cc.GetGroupTree(ctx, "staff")
+    })
+
+    // Follow the long chain, which runs through eng, down to the bottom.
+    depth := 0
+    n := tree
+    for len(n.Children) != 0 {
+        next := n.Children[0]
+        for _, c := range n.Children {
+            if c.Name == "eng" {
+                next = c
+            }
+        }
+
+        n = next
+        depth++
+    }
+
+    if depth != max_group_tree_depth || !n.Truncated {
+        t.Errorf("tree went %d deep (truncated %v), want %d and truncated",
+                 depth, n.Truncated, max_group_tree_depth)
+    }
+
+    // A loop in the tree doesn't send it around forever.
+    backend := env.getgroup("backend")
+    backend.SubGroups = append(backend.SubGroups, SubGroup{
+        ID:     env.getgroup("eng").ID,
+        Name:   "eng",
+    })
+    raw, err := json.Marshal(backend)
+    if err != nil {
+        t.Fatal(err)
+    }
+    key, _ := shim.CreateCompositeKey("Group", []string{backend.ID})
+    env.state[key] = raw
+
+    tree = mustcall(env, "alice", func(ctx txctx) (*GroupTreeNode, error) {
+        return env.cc.GetGroupTree(ctx, "eng")
+    })
+    if len(tree.Children) != 1 || !tree.Children[0].Truncated {
+        t.Errorf("looped tree = %+v, want backend marked truncated", tree)
+    }
+}
+
+func TestSetSubGroupPermissions(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups | User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+    env.addbucket("alice", "bucket-b")
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubGroup(ctx, "staff", "team", map[string]uint32{
+            "bucket-a": ACL_Perms_ListObjects,
+        }, false)
+    })
+
+    setperms := func(user string, perms map[string]uint32) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.SetSubGroupPermissions(ctx, "staff", "team", perms)
+        })
+        return err
+    }
+
+    err := setperms("alice", map[string]uint32{
+        "bucket-a": ACL_Perms_ReadObject,
+        "bucket-b": ACL_Perms_ListObjects | ACL_Perms_ReadObject,
+        "*":        ACL_Perms_ListObjects,
+    })
+    if err != nil {
+        t.Fatalf("setting several permissions: %v", err)
+    }
+
+    want := map[string]uint32{
+        "bucket-a": ACL_Perms_ReadObject,
+        "bucket-b": ACL_Perms_ListObjects | ACL_Perms_ReadObject,
+        "*":        ACL_Perms_ListObjects,
+    }
+    if got := env.getgroup("staff").SubGroups[0].Perms;
+       !reflect.DeepEqual(got, want) {
+        t.Errorf("perms = %v, want %v", got, want)
+    }
+
+    // One bad bucket spoils the whole batch.
+    err = setperms("alice", map[string]uint32{
+        "bucket-a": ACL_Perms_DeleteObject,
+        "nowhere":  ACL_Perms_ReadObject,
+    })
+    if err == nil {
+        t.Errorf("unknown bucket accepted")
+    }
+
+    if got := env.getgroup("staff").SubGroups[0].Perms;
+       !reflect.DeepEqual(got, want) {
+        t.Errorf("perms after failed update = %v, want %v", got, want)
+    }
+
+    if err := setperms("bob", want); err == nil {
+        t.Errorf("someone other than the group owner set permissions")
+    }
+
+    _, err = call(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetSubGroupPermissions(ctx, "staff", "nobody", want)
+    })
+    if err == nil {
+        t.Errorf("permissions set on an unknown sub-group")
+    }
+}
+
+func TestClearSubGroupPermissions(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups | User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    // A chain of groups, each passing reading down to the next: org > staff >
+    // team > interns, with bob at the bottom.
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "org", false)
+    })
+    chain := []string{"org", "staff", "team", "interns"}
+    for i := 1; i < len(chain); i++ {
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddSubGroup(ctx, chain[i - 1], chain[i],
+                                      map[string]uint32{
+                                          "bucket-a":   ACL_Perms_ReadObject,
+                                          "*":          ACL_Perms_ListObjects,
+                                      }, false)
+        })
+    }
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.AddUserToGroup(ctx, "interns", uidof("bob"))
+    })
+
+    env.createacl("alice", "org-reads", nil, map[string]uint32{
+        "org":      ACL_Perms_ReadObject,
+    })
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "org-reads")
+    })
+
+    gather := func() map[string]uint32 {
+        return mustcall(env, "alice", func(ctx txctx) (map[string]uint32, error) {
+            return env.cc.GatherGroupPermsForUser(ctx, uidof("bob"), "bucket-a")
+        })
+    }
+
+    org := env.getgroup("org").ID
+    if gather()[org] != ACL_Perms_ReadObject ||
+       !env.access("alice", "bob", "bucket-a", "", ACL_AccessType_Read) {
+        t.Fatalf("bob doesn't inherit org's access to start with: %v",
+                 gather())
+    }
+
+    _, err := call(env, "bob", func(ctx txctx) (bool, error) {
+        return env.cc.ClearSubGroupPermissions(ctx, "staff", "team")
+    })
+    if err == nil {
+        t.Errorf("someone other than the owner cleared permissions")
+    }
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.ClearSubGroupPermissions(ctx, "staff", "team")
+    })
+
+    staff := env.getgroup("staff")
+    if len(staff.SubGroups) != 1 || len(staff.SubGroups[0].Perms) != 0 {
+        t.Errorf("team entry after clearing = %+v, want it there but empty",
+                 staff.SubGroups)
+    }
+
+    // Nothing flows through team any more, from staff or anything above it.
+    got := gather()
+    want := map[string]uint32{
+        env.getgroup("interns").ID: 0xff,
+        env.getgroup("team").ID:    ACL_Perms_ReadObject,
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("group perms after clearing = %v, want %v", got, want)
+    }
+
+    if env.access("alice", "bob", "bucket-a", "", ACL_AccessType_Read) {
+        t.Errorf("bob still has org's access after clearing team's permissions")
+    }
+}
+
+func TestAddSubGroupFailureLeavesNoWrites(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups)
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    parent, _ := shim.CreateCompositeKey("Group",
+                                         []string{env.getgroup("staff").ID})
+
+    addteam := func() error {
+        _, err := call(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddSubGroup(ctx, "staff", "team", nil, false)
+        })
+        return err
+    }
+
+    // The parent group is written after the new one, so the new group must
+    // not survive the parent's write failing.
+    before := env.snapshot()
+    env.failput = func(key string) bool { return key == parent }
+
+    if err := addteam(); err == nil {
+        t.Fatal("AddSubGroup succeeded with a failed write")
+    }
+
+    if !reflect.DeepEqual(env.state, before) {
+        t.Error("failed AddSubGroup changed the world state")
+    }
+
+    env.failput = nil
+    if err := addteam(); err != nil {
+        t.Fatalf("AddSubGroup after a failure: %v", err)
+    }
+
+    staff := env.getgroup("staff")
+    team := env.getgroup("team")
+    if len(staff.SubGroups) != 1 || staff.SubGroups[0].ID != team.ID {
+        t.Errorf("sub-groups = %+v", staff.SubGroups)
+    }
+}
+
+func TestPreviewEffectiveSubGroupPerms(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups)
+    env.adduser("bob", 0)
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubGroup(ctx, "staff", "team", map[string]uint32{
+                                      "*":          ACL_Perms_ListObjects |
+                                                    ACL_Perms_ReadObject,
+                                      "bucket-a":   ACL_Perms_ListObjects,
+                                  }, false)
+    })
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.AddUserToGroup(ctx, "team", uidof("bob"))
+    })
+
+    buckets := []string{"bucket-a", "bucket-b"}
+    preview := func(user string, sname string) (map[string]uint32, error) {
+        return call(env, user, func(ctx txctx) (map[string]uint32, error) {
+            return env.cc.PreviewEffectiveSubGroupPerms(ctx, "staff", sname,
+                                                        buckets)
+        })
+    }
+
+    // The specific grant on bucket-a wins out over the wider wildcard.
+    want := map[string]uint32{
+        "bucket-a": ACL_Perms_ListObjects,
+        "bucket-b": ACL_Perms_ListObjects | ACL_Perms_ReadObject,
+    }
+    got, err := preview("alice", "team")
+    if err != nil || !reflect.DeepEqual(got, want) {
+        t.Fatalf("preview = %v, %v, want %v", got, err, want)
+    }
+
+    // It matches what a member of the sub-group actually ends up with.
+    staff := env.getgroup("staff").ID
+    for _, b := range buckets {
+        held := mustcall(env, "alice", func(ctx txctx) (map[string]uint32, error) {
+            return env.cc.GatherGroupPermsForUser(ctx, uidof("bob"), b)
+        })
+        if held[staff] != want[b] {
+            t.Errorf("bob holds %#x through staff on %s, preview says %#x",
+                     held[staff], b, want[b])
+        }
+    }
+
+    if _, err := preview("bob", "team"); err == nil {
+        t.Error("someone other than the owner previewed permissions")
+    }
+    if _, err := preview("alice", "nobody"); err == nil {
+        t.Error("previewed an unknown sub-group")
+    }
+}
+
+func TestDeleteGroup(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups)
+    env.adduser("bob", User_SysPerms_AddGroups)
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    for _, g := range [][2]string{{"staff", "team"}, {"team", "squad"},
+                                  {"staff", "interns"}} {
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddSubGroup(ctx, g[0], g[1], nil, false)
+        })
+    }
+
+    del := func(user string, name string, recursive bool) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.DeleteGroup(ctx, name, recursive)
+        })
+        return err
+    }
+
+    exists := func(name string) bool {
+        _, err := call(env, "admin", func(ctx txctx) (*Group, error) {
+            return env.cc.GetGroupByName(ctx, name)
+        })
+        return err == nil
+    }
+
+    if del("alice", "staff", false) == nil {
+        t.Error("deleted a group with sub-groups without recursive")
+    }
+    if del("bob", "squad", false) == nil {
+        t.Error("bob deleted alice's group")
+    }
+
+    // A leaf goes on its own, and its parent forgets about it.
+    if err := del("alice", "squad", false); err != nil {
+        t.Fatalf("deleting a leaf group: %v", err)
+    }
+    if exists("squad") || len(env.getgroup("team").SubGroups) != 0 {
+        t.Error("squad is still around after being deleted")
+    }
+
+    // The whole tree goes with recursive set.
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubGroup(ctx, "team", "squad", nil, false)
+    })
+    if err := del("alice", "staff", true); err != nil {
+        t.Fatalf("recursive delete: %v", err)
+    }
+    for _, g := range []string{"staff", "team", "squad", "interns"} {
+        if exists(g) {
+            t.Errorf("%s survived deleting the tree it was in", g)
+        }
+    }
+}
+
+func TestReparentGroup(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups)
+    env.adduser("bob", User_SysPerms_AddGroups)
+
+    for _, name := range []string{"staff", "ops"} {
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddGroup(ctx, name, false)
+        })
+    }
+    mustcall(env, "bob", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "bobs", false)
+    })
+
+    readall := map[string]uint32{"*": ACL_Perms_ReadObject}
+    for _, g := range [][2]string{{"staff", "team"}, {"team", "squad"}} {
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddSubGroup(ctx, g[0], g[1], readall, false)
+        })
+    }
+
+    reparent := func(user string, name string, parent string) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.ReparentGroup(ctx, name, parent)
+        })
+        return err
+    }
+
+    // Nobody can end up underneath themselves.
+    for _, parent := range []string{"team", "squad"} {
+        if reparent("alice", "team", parent) == nil {
+            t.Errorf("team reparented under %s", parent)
+        }
+    }
+
+    // Both groups have to belong to the caller.
+    if reparent("bob", "team", "bobs") == nil ||
+       reparent("alice", "team", "bobs") == nil {
+        t.Error("reparented a group across owners")
+    }
+
+    if err := reparent("alice", "team", "ops"); err != nil {
+        t.Fatalf("ReparentGroup: %v", err)
+    }
+
+    if staff := env.getgroup("staff"); len(staff.SubGroups) != 0 {
+        t.Errorf("staff still has sub-groups %+v", staff.SubGroups)
+    }
+
+    // What staff passed down stays with staff.
+    ops := env.getgroup("ops")
+    if len(ops.SubGroups) != 1 || ops.SubGroups[0].Name != "team" ||
+       len(ops.SubGroups[0].Perms) != 0 {
+        t.Errorf("ops sub-groups = %+v, want team with no perms",
+                 ops.SubGroups)
+    }
+
+    team := env.getgroup("team")
+    if team.Parent != ops.ID {
+        t.Errorf("team's parent = %q, want ops", team.Parent)
+    }
+    if len(team.SubGroups) != 1 || team.SubGroups[0].Name != "squad" {
+        t.Errorf("team's sub-groups = %+v, want squad", team.SubGroups)
+    }
+}
+
+func TestGroupCTime(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups)
+
+    env.advance(time.Hour)
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    staffctime := env.now()
+
+    env.advance(time.Hour)
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubGroup(ctx, "staff", "team", nil, false)
+    })
+
+    want := map[string]int64{"staff": staffctime, "team": env.now()}
+    grps := mustcall(env, "alice", env.cc.GetMyOwnedGroups)
+    if len(grps) != len(want) {
+        t.Fatalf("alice owns %d groups, want %d", len(grps), len(want))
+    }
+    for _, g := range grps {
+        if g.CTime != want[g.Name] {
+            t.Errorf("%s ctime = %d, want %d", g.Name, g.CTime, want[g.Name])
+        }
+    }
+}
+
+func TestGetEffectiveGroupMembers(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups)
+    ids := map[string]string{}
+    for _, name := range []string{"bob", "carol", "dave", "erin"} {
+        ids[name] = env.adduser(name, 0)
+    }
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+
+    readall := map[string]uint32{"*": ACL_Perms_ReadObject}
+    subs := []struct {
+        parent string
+        name   string
+        perms  map[string]uint32
+    }{
+        {"staff", "team", readall},
+        {"team", "squad", readall},
+        {"staff", "guests", nil},
+    }
+    for _, sg := range subs {
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddSubGroup(ctx, sg.parent, sg.name, sg.perms, false)
+        })
+    }
+
+    members := [][2]string{
+        {"staff", "bob"}, {"team", "carol"}, {"team", "dave"},
+        {"squad", "dave"}, {"guests", "erin"},
+    }
+    for _, m := range members {
+        mustcall(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.AddUserToGroup(ctx, m[0], uidof(m[1]))
+        })
+    }
+
+    check := func(group string, want ...string) {
+        t.Helper()
+        got, err := call(env, "alice", func(ctx txctx) ([]string, error) {
+            return env.cc.GetEffectiveGroupMembers(ctx, group)
+        })
+        if err != nil {
+            t.Fatalf("%s: %v", group, err)
+        }
+
+        wantids := make([]string, 0)
+        for _, name := range want {
+            wantids = append(wantids, ids[name])
+        }
+
+        sort.Strings(got)
+        sort.Strings(wantids)
+        if !reflect.DeepEqual(got, wantids) {
+            t.Errorf("%s: members = %v, want %v", group, got, want)
+        }
+    }
+
+    // Guests get nothing from staff, so erin isn't counted; dave is in two
+    // groups but only shows up once.
+    check("staff", "bob", "carol", "dave")
+    check("team", "carol", "dave")
+    check("squad", "dave")
+    check("guests", "erin")
+
+    _, err := call(env, "alice", func(ctx txctx) ([]string, error) {
+        return env.cc.GetEffectiveGroupMembers(ctx, "nobody")
+    })
+    if err == nil {
+        t.Error("got members of a group that doesn't exist")
+    }
+}
+
+func TestMemberGroupsQuery(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddGroups)
+    env.adduser("bob", 0)
+
+    // User IDs are normally UUIDs, but nothing about the query should depend
+    // on that. Give mallory one that would break a hand-built selector.
+    weird := `x"}},"type":{"$ne":"Group"},"y":{"z":"`
+    user := User {
+        Type:       "User",
+        ID:         weird,
+        UID:        uidof("mallory"),
+        SubUsers:   make([]SubUser, 0),
+    }
+    js, err := json.Marshal(user)
+    if err != nil {
+        t.Fatal(err)
+    }
+    key, _ := shim.CreateCompositeKey("User", []string{weird})
+    env.state[key] = js
+
+    for _, name := range []string{"staff", "ops", "others"} {
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddGroup(ctx, name, false)
+        })
+    }
+
+    for _, m := range [][2]string{
+        {"staff", "mallory"}, {"ops", "mallory"}, {"others", "bob"},
+    } {
+        mustcall(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.AddUserToGroup(ctx, m[0], uidof(m[1]))
+        })
+    }
+
+    names := func(groups []*Group) []string {
+        rv := make([]string, 0)
+        for _, g := range groups {
+            rv = append(rv, g.Name)
+        }
+        sort.Strings(rv)
+        return rv
+    }
+
+    want := []string{"ops", "staff"}
+    got := mustcall(env, "alice", func(ctx txctx) ([]*Group, error) {
+        return env.cc.GetMemberGroupsForUID(ctx, uidof("mallory"))
+    })
+    if !reflect.DeepEqual(names(got), want) {
+        t.Errorf("GetMemberGroupsForUID = %v, want %v", names(got), want)
+    }
+
+    got = mustcall(env, "mallory", func(ctx txctx) ([]*Group, error) {
+        return env.cc.GetMyMemberGroups(ctx)
+    })
+    if !reflect.DeepEqual(names(got), want) {
+        t.Errorf("GetMyMemberGroups = %v, want %v", names(got), want)
+    }
+
+    got = mustcall(env, "bob", func(ctx txctx) ([]*Group, error) {
+        return env.cc.GetMyMemberGroups(ctx)
+    })
+    if !reflect.DeepEqual(names(got), []string{"others"}) {
+        t.Errorf("bob's groups = %v, want [others]", names(got))
+    }
+}
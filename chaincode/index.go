@@ -27,6 +27,15 @@ import (
 // This does *technically* put a bit more of a limitation on the valid set of
 // metadata keys and values, but this isn't a big problem.
 
+// Bucket indexes work the same way, just over the metadata on the buckets a
+// user owns rather than the objects in a bucket.
+// Bucket indexes are stored as BucketIndex~Owner~MetadataKey
+// Entries are stored as BucketIndexEntry~IndexID~MetadataValue~BucketName
+
+// Object classes have an index per bucket that always exists, so there's no
+// index document, just the entries.
+// Entries are stored as ClassEntry~Bucket~Class~ObjectKey
+
 func (s *SmartContract) initindex(ctx contractapi.TransactionContextInterface) error {
     return nil
 }
@@ -51,20 +60,67 @@ func (s *SmartContract) CreateIndex(ctx contractapi.TransactionContextInterface,
         Field:      field,
     }
 
-    idxJSON, err := json.Marshal(idx)
+    sid, _ := ctx.GetStub().CreateCompositeKey("Index", []string{idx.Owner, idx.Bucket, idx.Field})
+    err = s.putStateChecked(ctx, sid, idx)
     if err != nil {
         return false, err
     }
 
-    sid, _ := ctx.GetStub().CreateCompositeKey("Index", []string{idx.Owner, idx.Bucket, idx.Field})
-    err = ctx.GetStub().PutState(sid, idxJSON)
+    // Fill in the index with the objects we already have. Only one page worth
+    // is done here -- if the bucket is bigger than that, PopulateIndex has to
+    // be used to finish the job.
+    _, err = s.populateindex(ctx, &idx, "")
     if err != nil {
-        return false, fmt.Errorf("failed to put to world state. %v", err)
+        return false, err
     }
 
     return true, nil
 }
 
+// Add entries to an index for objects that existed before it did, one page of
+// objects at a time. Pass in the token returned by the last call to continue
+// where it left off. An empty token is returned once the whole bucket has been
+// covered.
+func (s *SmartContract) PopulateIndex(ctx contractapi.TransactionContextInterface,
+                                      field string, bucket string,
+                                      token string) (string, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return "", err
+    }
+
+    idx, err := s.getindex(ctx, myuser.ID, field, bucket)
+    if err != nil {
+        return "", err
+    }
+
+    return s.populateindex(ctx, idx, token)
+}
+
+func (s *SmartContract) populateindex(ctx contractapi.TransactionContextInterface,
+                                      idx *UserIndex,
+                                      token string) (string, error) {
+    // This writes to the world state, so walk the bucket's objects directly
+    // rather than running a paginated query. Objects only go in the indexes of
+    // the user that created them, so that's all we need to look at here.
+    return walkpartialkey(ctx, "Object", []string{idx.Bucket}, token,
+                          s.pagesize(0),
+                          func(key string, value []byte) error {
+        var obj Object
+        err := json.Unmarshal(value, &obj)
+        if err != nil {
+            return err
+        }
+
+        v, ok := obj.Metadata[idx.Field]
+        if !ok || obj.Owner != idx.Owner {
+            return nil
+        }
+
+        return s.addobjecttoindex(ctx, idx.ID, v, obj.Key)
+    })
+}
+
 func (s *SmartContract) RemoveIndex(ctx contractapi.TransactionContextInterface,
                                     field string, bucket string) (bool, error) {
     myuser, err := s.GetMyUser(ctx)
@@ -123,6 +179,264 @@ func (s *SmartContract) GetIndex(ctx contractapi.TransactionContextInterface,
     return s.getindex(ctx, myuser.ID, field, bucket)
 }
 
+// Summarize all of the caller's indexes, including how many entries each one
+// currently has.
+func (s *SmartContract) GetIndexSummary(ctx contractapi.TransactionContextInterface) ([]IndexSummary, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    iter, err := ctx.GetStub().GetStateByPartialCompositeKey("Index",
+            []string{myuser.ID})
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    rv := make([]IndexSummary, 0)
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var idx UserIndex
+        err = json.Unmarshal(resp.Value, &idx)
+        if err != nil {
+            return nil, err
+        }
+
+        count, err := s.countindexentries(ctx, idx.ID)
+        if err != nil {
+            return nil, err
+        }
+
+        rv = append(rv, IndexSummary {
+            Field:      idx.Field,
+            Bucket:     idx.Bucket,
+            Kind:       "metadata",
+            Entries:    count,
+        })
+    }
+
+    biter, err := ctx.GetStub().GetStateByPartialCompositeKey("BucketIndex",
+            []string{myuser.ID})
+    if err != nil {
+        return nil, err
+    }
+    defer biter.Close()
+
+    for biter.HasNext() {
+        resp, err := biter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var idx BucketIndex
+        err = json.Unmarshal(resp.Value, &idx)
+        if err != nil {
+            return nil, err
+        }
+
+        eiter, err := s.getbucketindexiterator(ctx, idx.ID, "")
+        if err != nil {
+            return nil, err
+        }
+
+        var count uint64 = 0
+        for eiter.HasNext() {
+            _, err := eiter.Next()
+            if err != nil {
+                eiter.Close()
+                return nil, err
+            }
+
+            count++
+        }
+
+        eiter.Close()
+
+        rv = append(rv, IndexSummary {
+            Field:      idx.Field,
+            Kind:       "bucket",
+            Entries:    count,
+        })
+    }
+
+    return rv, nil
+}
+
+func (s *SmartContract) CreateBucketIndex(ctx contractapi.TransactionContextInterface,
+                                          field string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    tmp, _ := s.getbucketindex(ctx, myuser.ID, field)
+    if tmp != nil {
+        return false, fmt.Errorf("index exists")
+    }
+
+    idx := BucketIndex {
+        Type:       "BucketIndex",
+        ID:         uuid.NewString(),
+        Owner:      myuser.ID,
+        Field:      field,
+    }
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("BucketIndex", []string{idx.Owner, idx.Field})
+    err = s.putStateChecked(ctx, sid, idx)
+    if err != nil {
+        return false, err
+    }
+
+    // There's not likely to be many buckets, so fill in the index with the
+    // ones we already have.
+    bkts, err := s.getuserbuckets(ctx, myuser.ID)
+    if err != nil {
+        return false, err
+    }
+
+    for _, bkt := range bkts {
+        v, ok := bkt.Metadata[field]
+        if ok {
+            s.addtobucketindex(ctx, idx.ID, v, bkt.Name)
+        }
+    }
+
+    return true, nil
+}
+
+func (s *SmartContract) RemoveBucketIndex(ctx contractapi.TransactionContextInterface,
+                                          field string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    idx, err := s.getbucketindex(ctx, myuser.ID, field)
+    if err != nil {
+        return false, err
+    }
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("BucketIndex", []string{idx.Owner, idx.Field})
+    err = ctx.GetStub().DelState(sid)
+    if err != nil {
+        return false, err
+    }
+
+    iter, err := ctx.GetStub().GetStateByPartialCompositeKey("BucketIndexEntry",
+            []string{idx.ID})
+    if err != nil {
+        return false, err
+    }
+    defer iter.Close()
+
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            // XXX: What to do on error here?
+            continue
+        }
+
+        // XXX: What to do on error here?
+        ctx.GetStub().DelState(resp.Key)
+    }
+
+    return true, nil
+}
+
+func (s *SmartContract) getbucketindex(ctx contractapi.TransactionContextInterface,
+                                       owner string,
+                                       field string) (*BucketIndex, error) {
+    sid, _ := ctx.GetStub().CreateCompositeKey("BucketIndex", []string{owner, field})
+    idxJSON, err := ctx.GetStub().GetState(sid)
+    if err != nil {
+        return nil, err
+    } else if idxJSON == nil {
+        return nil, fmt.Errorf("unknown index")
+    }
+
+    var idx BucketIndex
+    err = json.Unmarshal(idxJSON, &idx)
+    if err != nil {
+        return nil, err
+    }
+
+    return &idx, nil
+}
+
+func (s *SmartContract) addtobucketindex(ctx contractapi.TransactionContextInterface,
+                                         indexid string, value string,
+                                         bucket string) error {
+    sid, _ := ctx.GetStub().CreateCompositeKey("BucketIndexEntry",
+            []string{indexid, value, bucket})
+    return ctx.GetStub().PutState(sid, []byte("{}"))
+}
+
+func (s *SmartContract) removefrombucketindex(ctx contractapi.TransactionContextInterface,
+                                              indexid string, value string,
+                                              bucket string) error {
+    sid, _ := ctx.GetStub().CreateCompositeKey("BucketIndexEntry",
+            []string{indexid, value, bucket})
+    return ctx.GetStub().DelState(sid)
+}
+
+// Add a bucket to all of its owner's bucket indexes that it belongs in.
+func (s *SmartContract) indexbucket(ctx contractapi.TransactionContextInterface,
+                                    bkt *Bucket) {
+    for k, v := range bkt.Metadata {
+        idx, _ := s.getbucketindex(ctx, bkt.Owner, k)
+        if idx != nil {
+            s.addtobucketindex(ctx, idx.ID, v, bkt.Name)
+        }
+    }
+}
+
+// Remove a bucket from all of its owner's bucket indexes.
+func (s *SmartContract) unindexbucket(ctx contractapi.TransactionContextInterface,
+                                      bkt *Bucket) {
+    for k, v := range bkt.Metadata {
+        idx, _ := s.getbucketindex(ctx, bkt.Owner, k)
+        if idx != nil {
+            s.removefrombucketindex(ctx, idx.ID, v, bkt.Name)
+        }
+    }
+}
+
+func (s *SmartContract) getbucketindexiterator(ctx contractapi.TransactionContextInterface,
+                                               indexid string, value string) (shim.StateQueryIteratorInterface, error) {
+    if value != "" {
+        return ctx.GetStub().GetStateByPartialCompositeKey("BucketIndexEntry",
+                []string{indexid, value})
+    } else {
+        return ctx.GetStub().GetStateByPartialCompositeKey("BucketIndexEntry",
+            []string{indexid})
+    }
+}
+
+func (s *SmartContract) countindexentries(ctx contractapi.TransactionContextInterface,
+                                          indexid string) (uint64, error) {
+    iter, err := s.getindexiterator(ctx, indexid, "")
+    if err != nil {
+        return 0, err
+    }
+    defer iter.Close()
+
+    var count uint64 = 0
+    for iter.HasNext() {
+        _, err := iter.Next()
+        if err != nil {
+            return 0, err
+        }
+
+        count++
+    }
+
+    return count, nil
+}
 
 func (s *SmartContract) getindex(ctx contractapi.TransactionContextInterface,
                                  owner string, field string,
@@ -160,6 +474,22 @@ func (s *SmartContract) removeobjectfromindex(ctx contractapi.TransactionContext
     return ctx.GetStub().DelState(sid)
 }
 
+func (s *SmartContract) addobjecttoclass(ctx contractapi.TransactionContextInterface,
+                                         bucket string, class string,
+                                         key string) error {
+    sid, _ := ctx.GetStub().CreateCompositeKey("ClassEntry",
+            []string{bucket, class, key})
+    return ctx.GetStub().PutState(sid, []byte("{}"))
+}
+
+func (s *SmartContract) removeobjectfromclass(ctx contractapi.TransactionContextInterface,
+                                              bucket string, class string,
+                                              key string) error {
+    sid, _ := ctx.GetStub().CreateCompositeKey("ClassEntry",
+            []string{bucket, class, key})
+    return ctx.GetStub().DelState(sid)
+}
+
 func (s *SmartContract) getindexiterator(ctx contractapi.TransactionContextInterface,
                                          indexid string, value string) (shim.StateQueryIteratorInterface, error) {
     if value != "" {
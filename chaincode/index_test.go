@@ -0,0 +1,147 @@
+/*
+    Copyright (C) 2024 Lawrence Sebald
+    All Rights Reserved
+*/
+package chaincode
+
+import (
+    "fmt"
+    "reflect"
+    "sort"
+    "testing"
+)
+
+// Index a metadata field in a bucket on behalf of the given user.
+func (e *testenv) createindex(user string, field string, bucket string) {
+    e.t.Helper()
+
+    mustcall(e, user, func(ctx txctx) (bool, error) {
+        return e.cc.CreateIndex(ctx, field, bucket)
+    })
+}
+
+func TestIndexSummaryCounts(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+    env.addbucket("bob", "bucket-b")
+
+    env.createindex("alice", "project", "bucket-a")
+    env.createindex("alice", "year", "bucket-a")
+    env.createindex("bob", "project", "bucket-b")
+
+    env.putobject("alice", "bucket-a", "1.txt", "one",
+                  map[string]string{"project": "x", "year": "2024"}, false)
+    env.putobject("alice", "bucket-a", "2.txt", "two",
+                  map[string]string{"project": "y"}, false)
+    env.putobject("alice", "bucket-a", "3.txt", "three",
+                  map[string]string{"project": "x"}, false)
+    env.putobject("alice", "bucket-a", "4.txt", "four", nil, false)
+    env.putobject("bob", "bucket-b", "5.txt", "five",
+                  map[string]string{"project": "x"}, false)
+
+    summary := mustcall(env, "alice", func(ctx txctx) ([]IndexSummary, error) {
+        return env.cc.GetIndexSummary(ctx)
+    })
+
+    want := map[string]uint64{"project": 3, "year": 1}
+    if len(summary) != len(want) {
+        t.Fatalf("summary = %+v, want %d indexes", summary, len(want))
+    }
+
+    for _, idx := range summary {
+        if idx.Bucket != "bucket-a" || idx.Entries != want[idx.Field] {
+            t.Errorf("index %+v, want %d entries in bucket-a", idx,
+                     want[idx.Field])
+        }
+    }
+}
+
+func TestCreateIndexPopulatesExistingObjects(t *testing.T) {
+    setup := func() *testenv {
+        env := newtestenv(t)
+        env.adduser("alice", User_SysPerms_AddBuckets)
+        env.adduser("bob", 0)
+        env.addbucket("alice", "bucket-a")
+
+        env.createacl("alice", "bob-creates", map[string]uint32{
+            "bob":      ACL_Perms_All,
+        }, nil)
+        mustcall(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a",
+                                                   "bob-creates")
+        })
+
+        for i, v := range []string{"x", "y", "x", "", "x"} {
+            meta := map[string]string{"project": v}
+            if v == "" {
+                meta = nil
+            }
+
+            env.putobject("alice", "bucket-a", fmt.Sprintf("%d.txt", i),
+                          "data", meta, false)
+        }
+
+        // Only the creator's indexes pick up an object.
+        env.putobject("bob", "bucket-a", "bob.txt", "data",
+                      map[string]string{"project": "x"}, false)
+        return env
+    }
+
+    entries := func(env *testenv) uint64 {
+        sum := mustcall(env, "alice", func(ctx txctx) ([]IndexSummary, error) {
+            return env.cc.GetIndexSummary(ctx)
+        })
+        if len(sum) != 1 {
+            t.Fatalf("summary = %+v, want one index", sum)
+        }
+        return sum[0].Entries
+    }
+
+    // A small bucket is all done by the time the index is created.
+    env := setup()
+    env.createindex("alice", "project", "bucket-a")
+
+    l := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+        return env.cc.QueryObjectsByIndex(ctx, "bucket-a", "project", "x", 0,
+                                          false, "")
+    })
+    keys := []string{}
+    for _, o := range l.Objects {
+        keys = append(keys, o.Key)
+    }
+    sort.Strings(keys)
+
+    want := []string{"0.txt", "2.txt", "4.txt"}
+    if !reflect.DeepEqual(keys, want) {
+        t.Errorf("objects indexed under x = %v, want %v", keys, want)
+    }
+
+    // A bigger one takes a few more calls to get through.
+    env = setup()
+    env.cc.DefaultPageSize = 2
+    env.createindex("alice", "project", "bucket-a")
+
+    if n := entries(env); n == 0 || n >= 4 {
+        t.Errorf("index has %d entries after one page", n)
+    }
+
+    token := ""
+    for calls := 0; ; calls++ {
+        if calls > 10 {
+            t.Fatal("PopulateIndex never finished")
+        }
+
+        token = mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.PopulateIndex(ctx, "project", "bucket-a", token)
+        })
+        if token == "" {
+            break
+        }
+    }
+
+    if n := entries(env); n != 4 {
+        t.Errorf("index has %d entries once populated, want 4", n)
+    }
+}
@@ -0,0 +1,939 @@
+/*
+    Copyright (C) 2024 Lawrence Sebald
+    All Rights Reserved
+*/
+package chaincode
+
+import (
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/md5"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/pem"
+    "fmt"
+    "io"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "reflect"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/hyperledger/fabric-chaincode-go/v2/pkg/attrmgr"
+    "github.com/hyperledger/fabric-chaincode-go/v2/shim"
+    "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+    "github.com/hyperledger/fabric-protos-go-apiv2/ledger/queryresult"
+    "github.com/hyperledger/fabric-protos-go-apiv2/msp"
+    "github.com/hyperledger/fabric-protos-go-apiv2/peer"
+    "github.com/minio/minio-go/v7"
+    "github.com/minio/minio-go/v7/pkg/credentials"
+    "google.golang.org/protobuf/proto"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// All of the test users are in the same MSP, and are told apart by the uid
+// attribute on their certificates.
+const test_mspid = "Org1MSP"
+
+type txctx = contractapi.TransactionContextInterface
+
+// Everything a test needs to run transactions against the chaincode: the
+// committed world state, a clock for transaction timestamps and a fake backing
+// store for the S3 client to talk to.
+type testenv struct {
+    t       *testing.T
+    cc      *SmartContract
+    state   map[string][]byte
+    clock   time.Time
+    ntx     int
+    s3      *fakes3
+    key     *ecdsa.PrivateKey
+    certs   map[string][]byte
+
+    // If set, any PutState for a key it returns true for fails, so tests can
+    // see what's left behind when a write goes wrong part way through.
+    failput func(key string) bool
+
+    // Every GetState goes through here, if set, so tests can count reads.
+    onget   func(key string)
+}
+
+// Set up a fresh ledger with "admin" as its first (admin) user.
+func newtestenv(t *testing.T) *testenv {
+    t.Helper()
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    fs := &fakes3{objs: map[string]*fakes3obj{}}
+    srv := httptest.NewServer(fs)
+    t.Cleanup(srv.Close)
+
+    u, _ := url.Parse(srv.URL)
+    client, err := minio.New(u.Host, &minio.Options{
+        Creds:  credentials.NewStaticV4("test", "testsecret", ""),
+        Region: "us-east-1",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    env := &testenv{
+        t:      t,
+        cc:     &SmartContract{S3client: client},
+        state:  map[string][]byte{},
+        clock:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+        s3:     fs,
+        key:    key,
+        certs:  map[string][]byte{},
+    }
+
+    err = env.tx("admin", env.cc.InitLedger)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return env
+}
+
+func uidof(name string) string {
+    return test_mspid + "##" + name
+}
+
+// Run fn as one transaction submitted by the named user. Like on a real peer,
+// the transaction only sees what was committed before it started, and its
+// writes are only committed if it succeeds.
+func (e *testenv) tx(user string, fn func(ctx txctx) error) error {
+    e.t.Helper()
+
+    e.ntx++
+    sum := sha256.Sum256([]byte(strconv.Itoa(e.ntx)))
+    stub := &mockstub{
+        env:        e,
+        txid:       hex.EncodeToString(sum[:]),
+        ts:         timestamppb.New(e.clock),
+        creator:    e.creator(user),
+        writes:     map[string][]byte{},
+    }
+
+    // Transactions a millisecond apart all land in the same second, which is
+    // what anything ordering by transaction time has to cope with.
+    e.clock = e.clock.Add(time.Millisecond)
+
+    ctx := new(contractapi.TransactionContext)
+    ctx.SetStub(stub)
+
+    err := fn(ctx)
+    if err != nil {
+        return err
+    }
+
+    for k, v := range stub.writes {
+        if v == nil {
+            delete(e.state, k)
+        } else {
+            e.state[k] = v
+        }
+    }
+
+    return nil
+}
+
+// Like tx, for chaincode functions that hand back a value.
+func call[T any](e *testenv, user string,
+                 fn func(ctx txctx) (T, error)) (T, error) {
+    e.t.Helper()
+
+    var rv T
+    err := e.tx(user, func(ctx txctx) error {
+        var err error
+        rv, err = fn(ctx)
+        return err
+    })
+
+    return rv, err
+}
+
+// Like call, but fail the test right away on an error.
+func mustcall[T any](e *testenv, user string,
+                     fn func(ctx txctx) (T, error)) T {
+    e.t.Helper()
+
+    rv, err := call(e, user, fn)
+    if err != nil {
+        e.t.Fatalf("unexpected error: %v", err)
+    }
+
+    return rv
+}
+
+func (e *testenv) advance(d time.Duration) {
+    e.clock = e.clock.Add(d)
+}
+
+func (e *testenv) now() int64 {
+    return e.clock.Unix()
+}
+
+// Take a copy of the committed world state, to compare against later.
+func (e *testenv) snapshot() map[string][]byte {
+    rv := make(map[string][]byte, len(e.state))
+    for k, v := range e.state {
+        rv[k] = v
+    }
+
+    return rv
+}
+
+// Add a top level user with the given system permissions.
+func (e *testenv) adduser(name string, sysperms uint32) string {
+    e.t.Helper()
+
+    return mustcall(e, "admin", func(ctx txctx) (string, error) {
+        return e.cc.AddUser(ctx, uidof(name), sysperms)
+    })
+}
+
+// Add a bucket owned by the named user.
+func (e *testenv) addbucket(user string, name string) {
+    e.t.Helper()
+
+    mustcall(e, user, func(ctx txctx) (string, error) {
+        return e.cc.AddBucket(ctx, name, nil)
+    })
+}
+
+func md5hex(data string) string {
+    sum := md5.Sum([]byte(data))
+    return hex.EncodeToString(sum[:])
+}
+
+// Create an object and upload its data, the way a client would.
+func (e *testenv) putobject(user string, bucket string, key string,
+                            data string, metadata map[string]string,
+                            overwrite bool) *Object {
+    e.t.Helper()
+
+    ps := mustcall(e, user, func(ctx txctx) (string, error) {
+        return e.cc.CreateObject(ctx, bucket, key, uint64(len(data)),
+                                 md5hex(data), metadata, nil, "", overwrite)
+    })
+
+    if ps != "" {
+        e.s3.put(bucket, key, []byte(data))
+    }
+
+    mustcall(e, user, func(ctx txctx) (bool, error) {
+        return true, e.cc.CommitObjectRequest(ctx, bucket, key)
+    })
+
+    return e.getobject(bucket, key)
+}
+
+// Check what's on the fake backing store at a key; an empty want means there
+// should be nothing there at all.
+func (e *testenv) checkdata(bucket string, key string, want string) {
+    e.t.Helper()
+
+    data, ok := e.s3.get(bucket, key)
+    if want == "" && ok {
+        e.t.Errorf("%s/%s still has data %q", bucket, key, data)
+    } else if want != "" && !ok {
+        e.t.Errorf("%s/%s has no data, want %q", bucket, key, want)
+    } else if want != "" && string(data) != want {
+        e.t.Errorf("%s/%s has data %q, want %q", bucket, key, data, want)
+    }
+}
+
+// Read an object straight out of the committed world state.
+func (e *testenv) getobject(bucket string, key string) *Object {
+    e.t.Helper()
+
+    sid, _ := shim.CreateCompositeKey("Object", []string{bucket, key})
+    js, ok := e.state[sid]
+    if !ok {
+        return nil
+    }
+
+    var obj Object
+    err := json.Unmarshal(js, &obj)
+    if err != nil {
+        e.t.Fatal(err)
+    }
+
+    return &obj
+}
+
+// Make up a certificate for the named user, signed by nobody in particular,
+// wrapped up the way the peer hands it to the chaincode.
+func (e *testenv) creator(name string) []byte {
+    if c, ok := e.certs[name]; ok {
+        return c
+    }
+
+    tmpl := &x509.Certificate{
+        SerialNumber:   big.NewInt(int64(len(e.certs) + 1)),
+        Subject:        pkix.Name{CommonName: name},
+        NotBefore:      e.clock.Add(-time.Hour),
+        NotAfter:       e.clock.Add(24 * 365 * time.Hour),
+    }
+
+    attrs := &attrmgr.Attributes{Attrs: map[string]string{"uid": name}}
+    err := attrmgr.New().AddAttributesToCert(attrs, tmpl)
+    if err != nil {
+        e.t.Fatal(err)
+    }
+
+    // The attribute manager adds its extension to the parsed side of the
+    // certificate; it needs to be an extra one to get written out.
+    tmpl.ExtraExtensions = tmpl.Extensions
+
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+                                       &e.key.PublicKey, e.key)
+    if err != nil {
+        e.t.Fatal(err)
+    }
+
+    id := &msp.SerializedIdentity{
+        Mspid:      test_mspid,
+        IdBytes:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+                                                  Bytes: der}),
+    }
+
+    c, err := proto.Marshal(id)
+    if err != nil {
+        e.t.Fatal(err)
+    }
+
+    e.certs[name] = c
+    return c
+}
+
+// Just enough of a chaincode stub to run the contract against. Anything not
+// implemented here panics through the nil embedded interface, so a test
+// touching it fails loudly instead of quietly doing the wrong thing.
+type mockstub struct {
+    shim.ChaincodeStubInterface
+
+    env         *testenv
+    txid        string
+    ts          *timestamppb.Timestamp
+    creator     []byte
+    writes      map[string][]byte
+
+    // The peer won't let a transaction mix paginated queries and writes, so
+    // keep track of which it has done.
+    wrote       bool
+    paged       bool
+}
+
+func (m *mockstub) GetTxID() string {
+    return m.txid
+}
+
+func (m *mockstub) GetTxTimestamp() (*timestamppb.Timestamp, error) {
+    return m.ts, nil
+}
+
+func (m *mockstub) GetCreator() ([]byte, error) {
+    return m.creator, nil
+}
+
+func (m *mockstub) CreateCompositeKey(objectType string,
+                                      attributes []string) (string, error) {
+    return shim.CreateCompositeKey(objectType, attributes)
+}
+
+func (m *mockstub) SplitCompositeKey(key string) (string, []string, error) {
+    parts := strings.Split(key, "\x00")
+    if len(parts) < 3 || parts[0] != "" {
+        return "", nil, fmt.Errorf("not a composite key")
+    }
+
+    return parts[1], parts[2:len(parts) - 1], nil
+}
+
+// Reads only ever see committed state, never this transaction's own writes.
+func (m *mockstub) GetState(key string) ([]byte, error) {
+    if m.env.onget != nil {
+        m.env.onget(key)
+    }
+
+    return m.env.state[key], nil
+}
+
+func (m *mockstub) PutState(key string, value []byte) error {
+    if key == "" {
+        return fmt.Errorf("empty key")
+    } else if m.paged {
+        return fmt.Errorf("tx has already performed a paginated query, " +
+                          "writes are not allowed")
+    } else if m.env.failput != nil && m.env.failput(key) {
+        return fmt.Errorf("injected failure writing %q", key)
+    }
+
+    m.wrote = true
+    m.writes[key] = append([]byte{}, value...)
+    return nil
+}
+
+func (m *mockstub) DelState(key string) error {
+    if m.paged {
+        return fmt.Errorf("tx has already performed a paginated query, " +
+                          "writes are not allowed")
+    }
+
+    m.wrote = true
+    m.writes[key] = nil
+    return nil
+}
+
+// Paginated queries are only allowed in read-only transactions.
+func (m *mockstub) startpaging() error {
+    if m.wrote {
+        return fmt.Errorf("tx has already performed a write, paginated " +
+                          "queries are not supported")
+    }
+
+    m.paged = true
+    return nil
+}
+
+func (m *mockstub) GetStateByPartialCompositeKey(objectType string,
+                                                 keys []string) (shim.StateQueryIteratorInterface, error) {
+    iter, _, err := m.partialkey(objectType, keys, 0, "")
+    return iter, err
+}
+
+func (m *mockstub) GetStateByPartialCompositeKeyWithPagination(objectType string,
+                                                               keys []string,
+                                                               pageSize int32,
+                                                               bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+    err := m.startpaging()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return m.partialkey(objectType, keys, pageSize, bookmark)
+}
+
+func (m *mockstub) partialkey(objectType string, keys []string,
+                              pageSize int32,
+                              bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+    prefix, err := shim.CreateCompositeKey(objectType, keys)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return m.page(pageSize, bookmark, func(k string, v []byte) (bool, error) {
+        return strings.HasPrefix(k, prefix), nil
+    })
+}
+
+func (m *mockstub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+    iter, _, err := m.query(query, 0, "")
+    return iter, err
+}
+
+func (m *mockstub) GetQueryResultWithPagination(query string, pageSize int32,
+                                                bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+    err := m.startpaging()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return m.query(query, pageSize, bookmark)
+}
+
+// Rich queries are run over every JSON document in the world state, the way
+// CouchDB would, using the subset of Mango selectors the chaincode uses.
+func (m *mockstub) query(query string, pageSize int32,
+                         bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+    var q struct {
+        Selector    map[string]interface{}  `json:"selector"`
+        Limit       int32                   `json:"limit"`
+    }
+
+    err := json.Unmarshal([]byte(query), &q)
+    if err != nil {
+        return nil, nil, fmt.Errorf("invalid query %s: %v", query, err)
+    } else if q.Selector == nil {
+        return nil, nil, fmt.Errorf("query has no selector: %s", query)
+    }
+
+    if pageSize == 0 && q.Limit != 0 {
+        pageSize = q.Limit
+    }
+
+    return m.page(pageSize, bookmark, func(k string, v []byte) (bool, error) {
+        var doc map[string]interface{}
+        if json.Unmarshal(v, &doc) != nil {
+            return false, nil
+        }
+
+        return matchselector(doc, q.Selector)
+    })
+}
+
+// Collect one page of the committed state that passes the filter, in key
+// order. Bookmarks are just the last key handed out.
+func (m *mockstub) page(pageSize int32, bookmark string,
+                        filter func(k string, v []byte) (bool, error)) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+    keys := make([]string, 0, len(m.env.state))
+    for k := range m.env.state {
+        if bookmark == "" || k > bookmark {
+            keys = append(keys, k)
+        }
+    }
+    sort.Strings(keys)
+
+    iter := &mockiter{}
+    for _, k := range keys {
+        if pageSize > 0 && len(iter.kvs) >= int(pageSize) {
+            break
+        }
+
+        v := m.env.state[k]
+        ok, err := filter(k, v)
+        if err != nil {
+            return nil, nil, err
+        } else if ok {
+            iter.kvs = append(iter.kvs, &queryresult.KV{Key: k, Value: v})
+        }
+    }
+
+    meta := &peer.QueryResponseMetadata{
+        FetchedRecordsCount: int32(len(iter.kvs)),
+        Bookmark:            bookmark,
+    }
+
+    if len(iter.kvs) != 0 {
+        meta.Bookmark = iter.kvs[len(iter.kvs) - 1].Key
+    }
+
+    return iter, meta, nil
+}
+
+type mockiter struct {
+    kvs     []*queryresult.KV
+    pos     int
+}
+
+func (it *mockiter) HasNext() bool {
+    return it.pos < len(it.kvs)
+}
+
+func (it *mockiter) Next() (*queryresult.KV, error) {
+    if it.pos >= len(it.kvs) {
+        return nil, fmt.Errorf("no more results")
+    }
+
+    it.pos++
+    return it.kvs[it.pos - 1], nil
+}
+
+func (it *mockiter) Close() error {
+    return nil
+}
+
+func matchselector(doc map[string]interface{},
+                   sel map[string]interface{}) (bool, error) {
+    for k, v := range sel {
+        var ok bool
+        var err error
+
+        switch k {
+        case "$and", "$or":
+            subs, isarr := v.([]interface{})
+            if !isarr {
+                return false, fmt.Errorf("%s needs an array", k)
+            }
+
+            ok = k == "$and"
+            for _, sub := range subs {
+                subsel, _ := sub.(map[string]interface{})
+                m, err := matchselector(doc, subsel)
+                if err != nil {
+                    return false, err
+                }
+
+                if k == "$and" {
+                    ok = ok && m
+                } else {
+                    ok = ok || m
+                }
+            }
+        case "$not":
+            subsel, _ := v.(map[string]interface{})
+            ok, err = matchselector(doc, subsel)
+            ok = !ok
+        default:
+            val, present := lookupfield(doc, k)
+            ok, err = matchcond(val, present, v)
+        }
+
+        if err != nil || !ok {
+            return false, err
+        }
+    }
+
+    return true, nil
+}
+
+// Find a possibly dotted field name in a document.
+func lookupfield(doc map[string]interface{}, field string) (interface{}, bool) {
+    var cur interface{} = doc
+
+    for _, part := range strings.Split(field, ".") {
+        m, ok := cur.(map[string]interface{})
+        if !ok {
+            return nil, false
+        }
+
+        cur, ok = m[part]
+        if !ok {
+            return nil, false
+        }
+    }
+
+    return cur, true
+}
+
+func isoperator(cond interface{}) (map[string]interface{}, bool) {
+    m, ok := cond.(map[string]interface{})
+    if !ok || len(m) == 0 {
+        return nil, false
+    }
+
+    for k := range m {
+        if !strings.HasPrefix(k, "$") {
+            return nil, false
+        }
+    }
+
+    return m, true
+}
+
+func matchcond(val interface{}, present bool, cond interface{}) (bool, error) {
+    ops, isop := isoperator(cond)
+    if !isop {
+        // A plain object selects on fields within the value; anything else is
+        // an implicit $eq.
+        if sub, ok := cond.(map[string]interface{}); ok {
+            vm, ok := val.(map[string]interface{})
+            if !present || !ok {
+                return false, nil
+            }
+
+            return matchselector(vm, sub)
+        }
+
+        return present && reflect.DeepEqual(val, cond), nil
+    }
+
+    for op, arg := range ops {
+        var ok bool
+
+        switch op {
+        case "$eq":
+            ok = present && reflect.DeepEqual(val, arg)
+        case "$ne":
+            ok = present && !reflect.DeepEqual(val, arg)
+        case "$gt", "$gte", "$lt", "$lte":
+            if !present {
+                break
+            }
+
+            c, comparable := comparevalues(val, arg)
+            if !comparable {
+                break
+            }
+
+            switch op {
+            case "$gt":
+                ok = c > 0
+            case "$gte":
+                ok = c >= 0
+            case "$lt":
+                ok = c < 0
+            case "$lte":
+                ok = c <= 0
+            }
+        case "$in", "$nin":
+            arr, isarr := arg.([]interface{})
+            if !isarr {
+                return false, fmt.Errorf("%s needs an array", op)
+            }
+
+            found := false
+            for _, a := range arr {
+                if reflect.DeepEqual(val, a) {
+                    found = true
+                }
+            }
+
+            ok = present && (found == (op == "$in"))
+        case "$exists":
+            want, _ := arg.(bool)
+            ok = present == want
+        case "$regex":
+            s, isstr := val.(string)
+            pat, _ := arg.(string)
+            re, err := regexp.Compile(pat)
+            if err != nil {
+                return false, err
+            }
+
+            ok = present && isstr && re.MatchString(s)
+        case "$elemMatch":
+            arr, isarr := val.([]interface{})
+            if !present || !isarr {
+                break
+            }
+
+            for _, elem := range arr {
+                m, err := matchcond(elem, true, arg)
+                if err != nil {
+                    return false, err
+                } else if m {
+                    ok = true
+                    break
+                }
+            }
+        case "$all":
+            arr, isarr := val.([]interface{})
+            want, _ := arg.([]interface{})
+            if !present || !isarr {
+                break
+            }
+
+            ok = true
+            for _, w := range want {
+                found := false
+                for _, a := range arr {
+                    if reflect.DeepEqual(a, w) {
+                        found = true
+                    }
+                }
+
+                ok = ok && found
+            }
+        case "$size":
+            arr, isarr := val.([]interface{})
+            n, _ := arg.(float64)
+            ok = present && isarr && len(arr) == int(n)
+        case "$not":
+            m, err := matchcond(val, present, arg)
+            if err != nil {
+                return false, err
+            }
+
+            ok = !m
+        default:
+            return false, fmt.Errorf("unsupported operator %s", op)
+        }
+
+        if !ok {
+            return false, nil
+        }
+    }
+
+    return true, nil
+}
+
+func comparevalues(a interface{}, b interface{}) (int, bool) {
+    switch av := a.(type) {
+    case float64:
+        bv, ok := b.(float64)
+        if !ok {
+            return 0, false
+        } else if av < bv {
+            return -1, true
+        } else if av > bv {
+            return 1, true
+        }
+
+        return 0, true
+    case string:
+        bv, ok := b.(string)
+        if !ok {
+            return 0, false
+        }
+
+        return strings.Compare(av, bv), true
+    }
+
+    return 0, false
+}
+
+// A backing store that keeps everything in memory and speaks just enough of
+// the S3 API for the calls the chaincode makes. Uploads that would go through
+// presigned URLs are done with put instead.
+type fakes3 struct {
+    mu      sync.Mutex
+    objs    map[string]*fakes3obj
+    deletes int
+}
+
+type fakes3obj struct {
+    data    []byte
+    etag    string
+    mtime   time.Time
+}
+
+func (f *fakes3) put(bucket string, key string, data []byte) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    sum := md5.Sum(data)
+    f.objs[bucket + "/" + key] = &fakes3obj{
+        data:   append([]byte{}, data...),
+        etag:   hex.EncodeToString(sum[:]),
+        mtime:  time.Now().UTC(),
+    }
+}
+
+func (f *fakes3) get(bucket string, key string) ([]byte, bool) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    o, ok := f.objs[bucket + "/" + key]
+    if !ok {
+        return nil, false
+    }
+
+    return o.data, true
+}
+
+func (f *fakes3) remove(bucket string, key string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    delete(f.objs, bucket + "/" + key)
+}
+
+func (f *fakes3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    path := strings.TrimPrefix(r.URL.Path, "/")
+    bucket, key, _ := strings.Cut(path, "/")
+
+    switch r.Method {
+    case http.MethodHead, http.MethodGet:
+        f.mu.Lock()
+        o, ok := f.objs[path]
+        f.mu.Unlock()
+
+        if !ok {
+            f.fail(w, r, http.StatusNotFound, "NoSuchKey", bucket, key)
+            return
+        }
+
+        w.Header().Set("ETag", `"` + o.etag + `"`)
+        w.Header().Set("Last-Modified", o.mtime.Format(http.TimeFormat))
+        w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+        w.Header().Set("Content-Type", "application/octet-stream")
+        w.WriteHeader(http.StatusOK)
+
+        if r.Method == http.MethodGet {
+            w.Write(o.data)
+        }
+    case http.MethodPut:
+        if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+            src, _ = url.PathUnescape(src)
+            src = strings.TrimPrefix(src, "/")
+
+            f.mu.Lock()
+            o, ok := f.objs[src]
+            if ok {
+                cp := *o
+                cp.mtime = time.Now().UTC()
+                f.objs[path] = &cp
+            }
+            f.mu.Unlock()
+
+            if !ok {
+                sb, sk, _ := strings.Cut(src, "/")
+                f.fail(w, r, http.StatusNotFound, "NoSuchKey", sb, sk)
+                return
+            }
+
+            fmt.Fprintf(w, `<CopyObjectResult><LastModified>%s</LastModified>` +
+                        `<ETag>"%s"</ETag></CopyObjectResult>`,
+                        time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+                        o.etag)
+            return
+        }
+
+        data, err := io.ReadAll(r.Body)
+        if err != nil {
+            f.fail(w, r, http.StatusBadRequest, "IncompleteBody", bucket, key)
+            return
+        }
+
+        if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+            data = decodechunked(data)
+        }
+
+        f.put(bucket, key, data)
+        sum := md5.Sum(data)
+        w.Header().Set("ETag", `"` + hex.EncodeToString(sum[:]) + `"`)
+        w.WriteHeader(http.StatusOK)
+    case http.MethodDelete:
+        f.mu.Lock()
+        delete(f.objs, path)
+        f.deletes++
+        f.mu.Unlock()
+
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        f.fail(w, r, http.StatusNotImplemented, "NotImplemented", bucket, key)
+    }
+}
+
+func (f *fakes3) fail(w http.ResponseWriter, r *http.Request, status int,
+                      code string, bucket string, key string) {
+    w.Header().Set("Content-Type", "application/xml")
+    w.WriteHeader(status)
+
+    if r.Method != http.MethodHead {
+        fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message>` +
+                    `<BucketName>%s</BucketName><Key>%s</Key></Error>`,
+                    code, code, bucket, key)
+    }
+}
+
+// Strip the framing off an aws-chunked upload body.
+func decodechunked(body []byte) []byte {
+    var out bytes.Buffer
+
+    for len(body) > 0 {
+        hdr, rest, ok := bytes.Cut(body, []byte("\r\n"))
+        if !ok {
+            break
+        }
+
+        szhex, _, _ := bytes.Cut(hdr, []byte(";"))
+        sz, err := strconv.ParseInt(string(szhex), 16, 64)
+        if err != nil || sz == 0 || int(sz) > len(rest) {
+            break
+        }
+
+        out.Write(rest[:sz])
+        body = bytes.TrimPrefix(rest[sz:], []byte("\r\n"))
+    }
+
+    return out.Bytes()
+}
@@ -5,12 +5,17 @@
 package chaincode
 
 import (
+    "bytes"
     "context"
     "encoding/json"
     "fmt"
+    "math"
     "net/url"
+    "regexp"
+    "sort"
     "strings"
     "time"
+    "unicode/utf8"
 
     "github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
     "github.com/google/uuid"
@@ -24,6 +29,11 @@ func (s *SmartContract) initobjects(ctx contractapi.TransactionContextInterface)
 func (s *SmartContract) GetObjectByPath(ctx contractapi.TransactionContextInterface,
                                         bucket string,
                                         key string) (*Object, error) {
+    err := validateobjectpath(bucket, key)
+    if err != nil {
+        return nil, err
+    }
+
     myuser, err := s.GetMyUser(ctx)
     if err != nil {
         return nil, err
@@ -43,415 +53,3328 @@ func (s *SmartContract) GetObjectByPath(ctx contractapi.TransactionContextInterf
         return nil, err
     }
 
-    bkt, err := s.GetBucket(ctx, bucket)
-    if err != nil {
-        return nil, err
-    }
-
     // Test if the ACL says this is ok if this file isn't owned by the user.
+    // Owners don't need the bucket at all, so don't bother reading it.
     if obj.Owner != myuser.ID {
-        ok := false
-
-        // If the object has an ACL, it controls the access. Otherwise, check
-        // the bucket's ACL.
-        if len(obj.Permissions) != 0 {
-            ok = s.testaclaccess(ctx, obj.Permissions, myuser.UID, bucket,
-                                 ACL_AccessType_Read)
-        } else if len(bkt.Permissions) != 0 {
-            ok = s.testaclaccess(ctx, bkt.Permissions, myuser.UID, bucket,
-                                 ACL_AccessType_Read)
+        bkt, err := s.GetBucket(ctx, bucket)
+        if err != nil {
+            return nil, err
         }
 
+        ok := s.checkObjectAccess(ctx, &obj, bkt, myuser.UID,
+                                  ACL_AccessType_Read)
+
         if !ok {
             return nil, fmt.Errorf("permission denied")
         }
     }
 
+    err = s.checkobjectavailable(ctx, myuser, &obj)
+    if err != nil {
+        return nil, err
+    }
+
+    // Let the caller know if there's anything on the backing store for this
+    // object (i.e, if ReadObject will give them anything useful).
+    obj.HasData = (obj.Flags & ObjectFlag_IndexOnly) == 0
+
     return &obj, nil
 }
 
-func (s *SmartContract) ReadObject(ctx contractapi.TransactionContextInterface,
-                                   bucket string, key string) (string, error) {
+// Fetch several objects from a bucket at once. The objects the caller can see
+// are returned in order, and Errors has an entry for every key asked for, which
+// is empty if that object was returned or says why it wasn't.
+func (s *SmartContract) GetObjects(ctx contractapi.TransactionContextInterface,
+                                   bucket string,
+                                   keys []string) (*ObjectBatch, error) {
+    if uint32(len(keys)) > s.pagesize(0) {
+        return nil, fmt.Errorf("too many keys: %d (max %d)", len(keys),
+                               s.pagesize(0))
+    }
+
+    rv := ObjectBatch {
+        Objects:    make([]*Object, 0, len(keys)),
+        Errors:     make([]string, len(keys)),
+    }
+
+    for i, key := range keys {
+        obj, err := s.GetObjectByPath(ctx, bucket, key)
+        if err != nil {
+            rv.Errors[i] = err.Error()
+            continue
+        }
+
+        rv.Objects = append(rv.Objects, obj)
+    }
+
+    return &rv, nil
+}
+
+// Fetch an object's full record without checking the object or bucket ACLs,
+// for support and migration tooling. Only admins can do this.
+func (s *SmartContract) AdminGetObject(ctx contractapi.TransactionContextInterface,
+                                       bucket string,
+                                       key string) (*Object, error) {
     myuser, err := s.GetMyUser(ctx)
     if err != nil {
-        return "", err
+        return nil, err
     }
 
-    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
-    objJSON, err := ctx.GetStub().GetState(sid)
+    if !isadmin(myuser) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    obj, err := s.getobject(ctx, bucket, key)
     if err != nil {
-        return "", err
-    } else if objJSON == nil {
-        return "", fmt.Errorf("unknown object")
+        return nil, err
     }
 
-    var obj Object
-    err = json.Unmarshal(objJSON, &obj)
+    obj.HasData = (obj.Flags & ObjectFlag_IndexOnly) == 0
+
+    return obj, nil
+}
+
+// Like GetObjectByPath, but can optionally check the backing store to see if
+// the object's data is actually there.
+func (s *SmartContract) HeadObject(ctx contractapi.TransactionContextInterface,
+                                   bucket string, key string,
+                                   checkData bool) (*ObjectHead, error) {
+    obj, err := s.GetObjectByPath(ctx, bucket, key)
     if err != nil {
-        return "", err
+        return nil, err
     }
 
-    // Test if the ACL says this is ok if this file isn't owned by the user.
-    if obj.Owner != myuser.ID {
-        ok := false
+    rv := ObjectHead {
+        Object:         obj,
+    }
 
-        // If the object has an ACL, it controls the access. Otherwise, check
-        // the bucket's ACL.
-        if len(obj.Permissions) != 0 {
-            ok = s.testaclaccess(ctx, obj.Permissions, myuser.UID, bucket,
-                                 ACL_AccessType_Read)
-        }
+    // Index-only objects don't have anything on the backing store to check.
+    if !checkData || !obj.HasData {
+        return &rv, nil
+    }
 
-        if !ok {
-            bkt, err := s.GetBucket(ctx, bucket)
-            if err != nil {
-                return "", err
-            }
+    rv.DataChecked = true
 
-            if len(bkt.Permissions) != 0 {
-                ok = s.testaclaccess(ctx, bkt.Permissions, myuser.UID, bucket,
-                                     ACL_AccessType_Read)
-            }
+    info, err := s.S3client.StatObject(context.TODO(), bucket,
+                                       objectdatakey(obj),
+                                       minio.StatObjectOptions{})
+    if err != nil {
+        if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+            return &rv, nil
         }
 
-        if !ok {
-            return "", fmt.Errorf("permission denied")
-        }
+        return nil, err
     }
 
-    ps, err := s.S3client.PresignedGetObject(context.TODO(), bucket, key,
-                                             time.Duration(10) * time.Second,
-                                             url.Values{})
+    rv.DataPresent = true
+    rv.DataSize = info.Size
+
+    return &rv, nil
+}
+
+// Objects can be set up to only be available during a certain window of time,
+// no matter what their ACL says. This doesn't apply to the object's owner.
+func (s *SmartContract) checkobjectavailable(ctx contractapi.TransactionContextInterface,
+                                             user *User, obj *Object) error {
+    if obj.Owner == user.ID ||
+       (obj.AvailableFrom == 0 && obj.AvailableUntil == 0) {
+        return nil
+    }
+
+    now, err := gettxtime(ctx)
     if err != nil {
-        return "", err
+        return err
     }
 
-    return ps.String(), nil
+    if (obj.AvailableFrom != 0 && now < obj.AvailableFrom) ||
+       (obj.AvailableUntil != 0 && now >= obj.AvailableUntil) {
+        return fmt.Errorf("not available")
+    }
+
+    return nil
 }
 
-func (s *SmartContract) GetDeleteRecord(ctx contractapi.TransactionContextInterface,
-                                        bucket string,
-                                        id string) (*DeleteRecord, error) {
+// Set the window of time during which an object can be read by anyone other
+// than its owner. Zero on either end leaves that end open.
+func (s *SmartContract) SetObjectAvailability(ctx contractapi.TransactionContextInterface,
+                                              bucket string, key string,
+                                              from int64,
+                                              until int64) (bool, error) {
     myuser, err := s.GetMyUser(ctx)
     if err != nil {
-        return nil, err
+        return false, err
     }
 
-    sid, _ := ctx.GetStub().CreateCompositeKey("DeletedObject", []string{bucket, id})
-    objJSON, err := ctx.GetStub().GetState(sid)
+    obj, err := s.getobject(ctx, bucket, key)
     if err != nil {
-        return nil, err
-    } else if objJSON == nil {
-        return nil, fmt.Errorf("unknown delete record")
+        return false, err
     }
 
-    var obj DeleteRecord
-    err = json.Unmarshal(objJSON, &obj)
+    bkt, err := s.GetBucket(ctx, bucket)
     if err != nil {
-        return nil, err
+        return false, err
     }
 
-    // Only allow owners to see delete records
-    if obj.Owner != myuser.ID {
-        return nil, fmt.Errorf("permission denied")
+    if bkt.ReadOnly {
+        return false, fmt.Errorf("bucket is read-only")
     }
 
-    return &obj, nil
+    // Only the object's owner or the bucket's owner can do this.
+    if obj.Owner != myuser.ID && bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    if from < 0 || until < 0 || (from != 0 && until != 0 && until <= from) {
+        return false, fmt.Errorf("invalid availability window")
+    }
+
+    obj.AvailableFrom = from
+    obj.AvailableUntil = until
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    err = s.putStateChecked(ctx, sid, obj)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
 }
 
-func (s *SmartContract) CreateEmptyObject(ctx contractapi.TransactionContextInterface,
-                                          bucket string, key string,
-                                          metadata map[string]string,
-                                          tags []string,
-                                          aclTemplate string,
-                                          overwrite bool) (bool, error) {
-    nullmd5 := "d41d8cd98f00b204e9800998ecf8427e"
-    err := s.createobject(ctx, bucket, key, 0, nullmd5, metadata, tags,
-                          aclTemplate, ObjectFlag_IndexOnly, overwrite)
-    return err == nil, err
+// Places in a bucket's backing store that the chaincode keeps its own data in.
+// Objects can't be created under these, or they could clobber that data.
+var reservedkeyprefixes = []string{
+    ".manifests/",
+    ".versions/",
+    ".blobs/",
 }
 
-func (s *SmartContract) CreateObject(ctx contractapi.TransactionContextInterface,
-                                     bucket string, key string, size uint64,
-                                     md5sum string,
-                                     metadata map[string]string,
-                                     tags []string,
-                                     aclTemplate string,
-                                     overwrite bool) (string, error) {
-    err := s.createobject(ctx, bucket, key, size, md5sum, metadata, tags,
-                          aclTemplate, 0, overwrite)
+// Object keys end up as part of a composite key, which can't hold anything
+// that isn't valid UTF-8 or has a NUL in it. An empty key would be accepted,
+// but nothing good comes of an object without a name.
+func validatekey(key string) error {
+    if key == "" {
+        return fmt.Errorf("object key must not be empty")
+    } else if !utf8.ValidString(key) || strings.ContainsRune(key, 0) {
+        return fmt.Errorf("invalid object key")
+    }
 
-    if err != nil {
-        return "", err
+    for _, pfx := range reservedkeyprefixes {
+        if strings.HasPrefix(key, pfx) {
+            return fmt.Errorf("object key uses reserved prefix %q", pfx)
+        }
     }
 
-    ps, err := s.S3client.PresignedPutObject(context.TODO(), bucket, key,
-                                             time.Duration(10) * time.Second)
+    return nil
+}
+
+func validateobjectpath(bucket string, key string) error {
+    err := validatebucketname(bucket)
     if err != nil {
-        return "", err
+        return err
     }
 
-    return ps.String(), err
+    return validatekey(key)
 }
 
-func (s *SmartContract) createobject(ctx contractapi.TransactionContextInterface,
-                                     bucket string, key string, size uint64,
-                                     md5sum string,
-                                     metadata map[string]string,
-                                     tags []string,
-                                     aclTemplate string, flags uint64,
-                                     overwrite bool) error {
-    myuser, err := s.GetMyUser(ctx)
+// Fetch an object from the world state without any permission checks.
+func (s *SmartContract) getobject(ctx contractapi.TransactionContextInterface,
+                                  bucket string, key string) (*Object, error) {
+    err := validateobjectpath(bucket, key)
     if err != nil {
-        return err
+        return nil, err
     }
 
-    bkt, err := s.GetBucket(ctx, bucket)
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    objJSON, err := ctx.GetStub().GetState(sid)
     if err != nil {
-        return err
+        return nil, err
+    } else if objJSON == nil {
+        return nil, fmt.Errorf("unknown object")
     }
 
-    var acl *ACLTemplate
-    if aclTemplate != "" {
-        acl, err = s.getuseraclbyname(ctx, myuser.ID, aclTemplate)
-        if err != nil {
-            return err
-        }
+    var obj Object
+    err = json.Unmarshal(objJSON, &obj)
+    if err != nil {
+        return nil, err
     }
 
-    // Check if the object exists already.
-    tmp, _ := s.GetObjectByPath(ctx, bucket, key)
-    ok := false
-    if tmp != nil {
-        if !overwrite {
-            return fmt.Errorf("object already exists")
-        }
+    return &obj, nil
+}
 
-        // If someone else owns the object, check the ACL to see if we can
-        // overwrite it or not.
-        if tmp.Owner != myuser.ID {
-            // If the object has an ACL, it controls the access. Otherwise,
-            // check the bucket's ACL.
-            if len(tmp.Permissions) != 0 {
-                ok = s.testaclaccess(ctx, tmp.Permissions, myuser.UID, bucket,
-                                     ACL_AccessType_Overwrite)
-            } else if len(bkt.Permissions) != 0 {
-                ok = s.testaclaccess(ctx, bkt.Permissions, myuser.UID, bucket,
-                                     ACL_AccessType_Overwrite)
-            }
+func (s *SmartContract) ReadObject(ctx contractapi.TransactionContextInterface,
+                                   bucket string, key string) (string, error) {
+    return s.readobject(ctx, bucket, key, "", 10 * time.Second)
+}
 
-            if !ok {
-                return fmt.Errorf("permission denied")
-            }
-        }
+// Like ReadObject, but control whether browsers should show the object inline
+// or download it. The filename is optional, and is what browsers suggest when
+// saving the object.
+func (s *SmartContract) ReadObjectWithDisposition(ctx contractapi.TransactionContextInterface,
+                                                  bucket string, key string,
+                                                  disposition string,
+                                                  filename string) (string, error) {
+    cd, err := contentdisposition(disposition, filename)
+    if err != nil {
+        return "", err
+    }
 
-        // Remove the object from any indexes it is in.
-        for k, v := range tmp.Metadata {
-            idx, _ := s.getindex(ctx, myuser.ID, k, bucket)
-            if idx != nil {
-                s.removeobjectfromindex(ctx, idx.ID, v, key)
-            }
-        }
+    return s.readobject(ctx, bucket, key, cd, 10 * time.Second)
+}
 
-        // XXX: Handle removing old object if needed.
+// S3 won't accept presigned URLs that are good for longer than a week.
+const max_download_url_ttl = 7 * 24 * 3600
+
+// Get a new download URL for an object, good for the given number of seconds,
+// for clients whose last URL ran out before they were done with it.
+func (s *SmartContract) RefreshDownloadURL(ctx contractapi.TransactionContextInterface,
+                                           bucket string, key string,
+                                           ttlSeconds uint32) (string, error) {
+    if ttlSeconds == 0 || ttlSeconds > max_download_url_ttl {
+        return "", fmt.Errorf("invalid ttl")
     }
 
-    // If we don't already have permission from the above check (for
-    // overwriting), check if we have permission to create objects in this
-    // bucket.
-    if !ok && bkt.Owner != myuser.ID {
-        // We only have to check the bucket's acl, because we don't have an
-        // object yet in this case.
-        if len(bkt.Permissions) != 0 {
-            ok = s.testaclaccess(ctx, bkt.Permissions, myuser.UID, bucket,
-                                 ACL_AccessType_Create)
-        }
+    return s.readobject(ctx, bucket, key, "",
+                        time.Duration(ttlSeconds) * time.Second)
+}
 
-        if !ok {
-            return fmt.Errorf("permission denied")
+// Build a Content-Disposition header value. Quotes, backslashes and control
+// characters aren't allowed in the filename so it can't break out of the
+// quoted string; non-ASCII names are also sent in the RFC 5987 form.
+func contentdisposition(disposition string, filename string) (string, error) {
+    if disposition != "inline" && disposition != "attachment" {
+        return "", fmt.Errorf("invalid disposition: %s", disposition)
+    }
+
+    if filename == "" {
+        return disposition, nil
+    }
+
+    ascii := true
+    for _, c := range filename {
+        if c < 0x20 || c == 0x7f || c == '"' || c == '\\' {
+            return "", fmt.Errorf("invalid filename")
+        } else if c > 0x7f {
+            ascii = false
         }
     }
 
-    obj := Object {
-        Type:           "Object",
-        ID:             uuid.NewString(),
-        Bucket:         bucket,
-        Key:            key,
-        Owner:          myuser.ID,
-        MD5Sum:         md5sum,
-        Size:           size,
-        CTime:          time.Now().Unix(),
-        Metadata:       metadata,
-        Flags:          flags,
-        Tags:           tags,
-        Permissions:    templatetoacl(acl),
+    if ascii {
+        return fmt.Sprintf(`%s; filename="%s"`, disposition, filename), nil
     }
 
-    objJSON, err := json.Marshal(obj)
-    if err != nil {
-        return err
+    return fmt.Sprintf(`%s; filename*=UTF-8''%s`, disposition,
+                       url.PathEscape(filename)), nil
+}
+
+// Point a presigned URL at the public gateway, if one is configured. Any path
+// on the gateway's base URL goes in front of the signed path.
+func (s *SmartContract) publicurl(u *url.URL) (string, error) {
+    if s.PublicURLRewrite == "" {
+        return u.String(), nil
     }
 
-    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
-    err = ctx.GetStub().PutState(sid, objJSON)
+    base, err := url.Parse(s.PublicURLRewrite)
     if err != nil {
-        return fmt.Errorf("failed to put to world state. %v", err)
+        return "", fmt.Errorf("invalid public url: %v", err)
     }
 
-    // Add the object to any indexes it belongs in.
-    for k, v := range metadata {
-        idx, _ := s.getindex(ctx, myuser.ID, k, bucket)
-        if idx != nil {
-            s.addobjecttoindex(ctx, idx.ID, v, key)
-        }
+    rv := *u
+    rv.Scheme = base.Scheme
+    rv.Host = base.Host
+    rv.Path = strings.TrimSuffix(base.Path, "/") + u.Path
+    if u.RawPath != "" {
+        rv.RawPath = strings.TrimSuffix(base.EscapedPath(), "/") + u.RawPath
     }
 
-    return nil
+    return rv.String(), nil
 }
 
-func (s *SmartContract) RemoveObject(ctx contractapi.TransactionContextInterface,
-                                     bucket string,
-                                     key string) (string, error) {
+func (s *SmartContract) readobject(ctx contractapi.TransactionContextInterface,
+                                   bucket string, key string,
+                                   disposition string,
+                                   ttl time.Duration) (string, error) {
+    err := validateobjectpath(bucket, key)
+    if err != nil {
+        return "", err
+    }
+
     myuser, err := s.GetMyUser(ctx)
     if err != nil {
         return "", err
     }
 
-    obj, err := s.GetObjectByPath(ctx, bucket, key)
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    objJSON, err := ctx.GetStub().GetState(sid)
     if err != nil {
         return "", err
+    } else if objJSON == nil {
+        return "", fmt.Errorf("unknown object")
     }
 
-    bkt, err := s.GetBucket(ctx, bucket)
+    var obj Object
+    err = json.Unmarshal(objJSON, &obj)
     if err != nil {
         return "", err
     }
 
     // Test if the ACL says this is ok if this file isn't owned by the user.
     if obj.Owner != myuser.ID {
-        ok := false
-
-        // If the object has an ACL, it controls the access. Otherwise, check
-        // the bucket's ACL.
-        if len(obj.Permissions) != 0 {
-            ok = s.testaclaccess(ctx, obj.Permissions, myuser.UID, bucket,
-                                 ACL_AccessType_Delete)
-        } else if len(bkt.Permissions) != 0 {
-            ok = s.testaclaccess(ctx, bkt.Permissions, myuser.UID, bucket,
-                                 ACL_AccessType_Delete)
+        bkt, err := s.GetBucket(ctx, bucket)
+        if err != nil {
+            return "", err
         }
 
+        ok := s.checkObjectAccess(ctx, &obj, bkt, myuser.UID,
+                                  ACL_AccessType_Read)
+
         if !ok {
             return "", fmt.Errorf("permission denied")
         }
     }
 
-    indexFile := (obj.Flags & ObjectFlag_IndexOnly) != 0
+    err = s.checkobjectavailable(ctx, myuser, &obj)
+    if err != nil {
+        return "", err
+    }
 
-    // Create a delete record and save it to world state.
-    dr := DeleteRecord {
-        Type:           "DeletedObject",
-        ID:             obj.ID,
-        Bucket:         obj.Bucket,
-        Key:            obj.Key,
-        Owner:          obj.Owner,
-        Deleter:        myuser.ID,
-        Permissions:    obj.Permissions,
+    // Apply any response headers stored on the object.
+    params := url.Values{}
+    for k, v := range obj.RespHeaders {
+        params.Set("response-" + strings.ToLower(k), v)
+    }
+
+    if disposition != "" {
+        params.Set("response-content-disposition", disposition)
+    }
+
+    ps, err := s.S3client.PresignedGetObject(context.TODO(), bucket,
+                                             objectdatakey(&obj), ttl,
+                                             params)
+    if err != nil {
+        return "", err
+    }
+
+    return s.publicurl(ps)
+}
+
+// Headers that S3 allows to be overridden on a GET.
+var response_headers = [...]string {
+    "Content-Type",
+    "Content-Language",
+    "Expires",
+    "Cache-Control",
+    "Content-Disposition",
+    "Content-Encoding",
+}
+
+// Set the headers that downloads of an object get served with. These are
+// applied to every URL that ReadObject hands out for the object.
+func (s *SmartContract) SetObjectResponseHeaders(ctx contractapi.TransactionContextInterface,
+                                                 bucket string, key string,
+                                                 headers map[string]string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    obj, err := s.getobject(ctx, bucket, key)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.ReadOnly {
+        return false, fmt.Errorf("bucket is read-only")
+    }
+
+    // Test if the ACL says this is ok if this file isn't owned by the user.
+    if obj.Owner != myuser.ID {
+        ok := s.checkObjectAccess(ctx, obj, bkt, myuser.UID,
+                                  ACL_AccessType_Overwrite)
+
+        if !ok {
+            return false, fmt.Errorf("permission denied")
+        }
+    }
+
+    // Only keep the headers S3 will actually let us set.
+    hdrs := make(map[string]string)
+    for k, v := range headers {
+        found := false
+        for _, h := range response_headers {
+            if strings.EqualFold(k, h) {
+                hdrs[h] = v
+                found = true
+                break
+            }
+        }
+
+        if !found {
+            return false, fmt.Errorf("unsupported response header %s", k)
+        }
+    }
+
+    obj.RespHeaders = hdrs
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    err = s.putStateChecked(ctx, sid, obj)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Like ReadObject, but also hands back the checksum the client should expect.
+// If verifyFirst is set, the data on the backing store is checked against the
+// ledger before the URL is handed out, the same way imports check it.
+func (s *SmartContract) ReadObjectVerified(ctx contractapi.TransactionContextInterface,
+                                           bucket string, key string,
+                                           verifyFirst bool) (*ObjectRead, error) {
+    ps, err := s.ReadObject(ctx, bucket, key)
+    if err != nil {
+        return nil, err
+    }
+
+    obj, err := s.getobject(ctx, bucket, key)
+    if err != nil {
+        return nil, err
+    }
+
+    rv := ObjectRead {
         MD5Sum:         obj.MD5Sum,
-        Size:           obj.Size,
-        CTime:          obj.CTime,
-        DTime:          time.Now().Unix(),
-        Metadata:       obj.Metadata,
-        Tags:           obj.Tags,
-        Flags:          obj.Flags,
     }
 
-    drJSON, err := json.Marshal(dr)
-    if err != nil {
-        return "", err
+    if verifyFirst {
+        ok, err := s.s3dataintact(bucket, objectdatakey(obj), obj.MD5Sum,
+                                  obj.Size)
+        if err != nil {
+            return nil, err
+        } else if !ok {
+            return nil, fmt.Errorf("checksum mismatch on backing store")
+        }
+
+        rv.Verified = true
+    }
+
+    rv.URL = ps
+    return &rv, nil
+}
+
+func (s *SmartContract) GetDeleteRecord(ctx contractapi.TransactionContextInterface,
+                                        bucket string,
+                                        id string) (*DeleteRecord, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("DeletedObject", []string{bucket, id})
+    objJSON, err := ctx.GetStub().GetState(sid)
+    if err != nil {
+        return nil, err
+    } else if objJSON == nil {
+        return nil, fmt.Errorf("unknown delete record")
+    }
+
+    var obj DeleteRecord
+    err = json.Unmarshal(objJSON, &obj)
+    if err != nil {
+        return nil, err
+    }
+
+    // Only allow owners to see delete records
+    if obj.Owner != myuser.ID {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    return &obj, nil
+}
+
+func (s *SmartContract) CreateEmptyObject(ctx contractapi.TransactionContextInterface,
+                                          bucket string, key string,
+                                          metadata map[string]string,
+                                          tags []string,
+                                          aclTemplate string,
+                                          overwrite bool) (bool, error) {
+    nullmd5 := "d41d8cd98f00b204e9800998ecf8427e"
+    _, err := s.createobject(ctx, bucket, key, 0, nullmd5, metadata, tags,
+                             aclTemplate, ObjectFlag_IndexOnly, false,
+                             overwrite)
+    return err == nil, err
+}
+
+func (s *SmartContract) CreateObject(ctx contractapi.TransactionContextInterface,
+                                     bucket string, key string, size uint64,
+                                     md5sum string,
+                                     metadata map[string]string,
+                                     tags []string,
+                                     aclTemplate string,
+                                     overwrite bool) (string, error) {
+    obj, err := s.createobject(ctx, bucket, key, size, md5sum, metadata, tags,
+                               aclTemplate, 0, true, overwrite)
+
+    if err != nil {
+        return "", err
+    }
+
+    // If the data is already on the backing store from another object, there's
+    // nothing for the caller to upload. Other objects pointing at it doesn't
+    // prove that, since their uploads may never have happened.
+    if obj.DedupOf != "" {
+        ok, _ := s.s3dataintact(bucket, obj.DedupOf, obj.MD5Sum, obj.Size)
+        if ok {
+            return "", nil
+        }
+    }
+
+    ps, err := s.S3client.PresignedPutObject(context.TODO(), bucket,
+                                             objectdatakey(obj),
+                                             time.Duration(10) * time.Second)
+    if err != nil {
+        return "", err
+    }
+
+    return ps.String(), err
+}
+
+// Like CreateObject, but keep a creation time from somewhere else, such as when
+// migrating objects from another system. Only the bucket's owner or an admin
+// can do this, and the time can't be in the future.
+func (s *SmartContract) CreateObjectWithCTime(ctx contractapi.TransactionContextInterface,
+                                              bucket string, key string,
+                                              size uint64, md5sum string,
+                                              metadata map[string]string,
+                                              tags []string,
+                                              aclTemplate string,
+                                              overwrite bool,
+                                              ctimeOverride int64) (string, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return "", err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return "", err
+    }
+
+    if bkt.Owner != myuser.ID && !isadmin(myuser) {
+        return "", fmt.Errorf("permission denied")
+    }
+
+    now, err := gettxtime(ctx)
+    if err != nil {
+        return "", err
+    }
+
+    if ctimeOverride <= 0 || ctimeOverride > now {
+        return "", fmt.Errorf("invalid creation time")
+    }
+
+    obj, err := s.createobject(ctx, bucket, key, size, md5sum, metadata, tags,
+                               aclTemplate, 0, true, overwrite)
+    if err != nil {
+        return "", err
+    }
+
+    obj.CTime = ctimeOverride
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    err = s.putStateChecked(ctx, sid, obj)
+    if err != nil {
+        return "", err
+    }
+
+    if obj.DedupOf != "" {
+        ok, _ := s.s3dataintact(bucket, obj.DedupOf, obj.MD5Sum, obj.Size)
+        if ok {
+            return "", nil
+        }
+    }
+
+    ps, err := s.S3client.PresignedPutObject(context.TODO(), bucket,
+                                             objectdatakey(obj),
+                                             time.Duration(10) * time.Second)
+    if err != nil {
+        return "", err
+    }
+
+    return ps.String(), err
+}
+
+// Clean up a set of tags for an object, dropping duplicates and rejecting
+// anything that can't be stored or indexed sanely.
+func (s *SmartContract) validatetags(tags []string) ([]string, error) {
+    max := s.MaxObjectTags
+    if max == 0 {
+        max = DefaultMaxObjectTags
+    }
+
+    rv := make([]string, 0, len(tags))
+    seen := make(map[string]bool)
+
+    for _, t := range tags {
+        if t == "" {
+            return nil, fmt.Errorf("empty tag")
+        } else if strings.ContainsRune(t, 0) {
+            return nil, fmt.Errorf("invalid tag: %q", t)
+        }
+
+        if seen[t] {
+            continue
+        }
+
+        seen[t] = true
+        rv = append(rv, t)
+    }
+
+    if uint32(len(rv)) > max {
+        return nil, fmt.Errorf("too many tags: %d (max %d)", len(rv), max)
+    }
+
+    return rv, nil
+}
+
+func (s *SmartContract) createobject(ctx contractapi.TransactionContextInterface,
+                                     bucket string, key string, size uint64,
+                                     md5sum string,
+                                     metadata map[string]string,
+                                     tags []string,
+                                     aclTemplate string, flags uint64,
+                                     dedup bool,
+                                     overwrite bool) (*Object, error) {
+    err := validateobjectpath(bucket, key)
+    if err != nil {
+        return nil, err
+    }
+
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    if bkt.ReadOnly {
+        return nil, fmt.Errorf("bucket is read-only")
+    }
+
+    // Fill in any of the bucket's default metadata the caller didn't set.
+    if len(bkt.DefaultMetadata) != 0 {
+        merged := make(map[string]string, len(bkt.DefaultMetadata) + len(metadata))
+        for k, v := range bkt.DefaultMetadata {
+            merged[k] = v
+        }
+
+        for k, v := range metadata {
+            merged[k] = v
+        }
+
+        metadata = merged
+    }
+
+    err = validatemetadata(bkt, metadata)
+    if err != nil {
+        return nil, err
+    }
+
+    tags, err = s.validatetags(tags)
+    if err != nil {
+        return nil, err
+    }
+
+    acl, err := s.resolveacltemplate(ctx, myuser, aclTemplate)
+    if err != nil {
+        return nil, err
+    }
+
+    // Objects with the same content from the same owner can share their data
+    // on the backing store if the bucket allows it.
+    dedupkey := ""
+    if dedup && bkt.EnableDedup && size > 0 && md5sum != "" &&
+       (flags & ObjectFlag_IndexOnly) == 0 {
+        dedupkey = blobkey(myuser.ID, md5sum)
+    }
+
+    // Check if the object exists already.
+    tmp, _ := s.getobject(ctx, bucket, key)
+    ok := false
+    stale := make([]string, 0)
+    if tmp != nil {
+        if !overwrite {
+            return nil, fmt.Errorf("object already exists")
+        }
+
+        // If someone else owns the object, check the ACL to see if we can
+        // overwrite it or not.
+        if tmp.Owner != myuser.ID {
+            ok = s.checkObjectAccess(ctx, tmp, bkt, myuser.UID,
+                                     ACL_AccessType_Overwrite)
+
+            if !ok {
+                return nil, fmt.Errorf("permission denied")
+            }
+        }
+
+        // Remove the object from any indexes it is in.
+        for k, v := range tmp.Metadata {
+            idx, _ := s.getindex(ctx, myuser.ID, k, bucket)
+            if idx != nil {
+                s.removeobjectfromindex(ctx, idx.ID, v, key)
+            }
+        }
+
+        if tmp.Class != "" {
+            s.removeobjectfromclass(ctx, bucket, tmp.Class, key)
+        }
+
+        // Keep the old object around as a version if the bucket wants us to.
+        if bkt.OverwriteMode == Bucket_OverwriteMode_Version {
+            err = s.archiveobject(ctx, tmp)
+            if err != nil {
+                return nil, err
+            }
+        }
+
+        err = s.recordmetadatahistory(ctx, bkt, tmp)
+        if err != nil {
+            return nil, err
+        }
+
+        // Data at the same key just gets replaced by the upload. If the old
+        // object's data lives somewhere else, or there won't be any new data,
+        // the old data is left for CommitObjectRequest to clear out once the
+        // new record is on the ledger (if we archived it above, there's a copy
+        // of it off to the side). Anything the old object was still waiting to
+        // clean up carries over.
+        stale = append(stale, tmp.StaleData...)
+        if (tmp.Flags & ObjectFlag_IndexOnly) == 0 {
+            newdata := ""
+            if dedupkey != "" {
+                newdata = dedupkey
+            } else if (flags & ObjectFlag_IndexOnly) == 0 {
+                newdata = key
+            }
+
+            if objectdatakey(tmp) != newdata {
+                stale = append(stale, objectdatakey(tmp))
+            }
+        }
+    }
+
+    // If we don't already have permission from the above check (for
+    // overwriting), check if we have permission to create objects in this
+    // bucket.
+    if !ok && bkt.Owner != myuser.ID {
+        // We only have to check the bucket's acl, because we don't have an
+        // object yet in this case.
+        ok = s.checkObjectAccess(ctx, nil, bkt, myuser.UID,
+                                 ACL_AccessType_Create)
+
+        if !ok {
+            return nil, fmt.Errorf("permission denied")
+        }
+    }
+
+    now, err := gettxtime(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    obj := Object {
+        Type:           "Object",
+        ID:             uuid.NewString(),
+        Bucket:         bucket,
+        Key:            key,
+        Owner:          myuser.ID,
+        MD5Sum:         md5sum,
+        Size:           size,
+        CTime:          now,
+        MTime:          now,
+        ATime:          now,
+        Metadata:       metadata,
+        Flags:          flags,
+        Tags:           tags,
+        Permissions:    acl,
+        HasData:        (flags & ObjectFlag_IndexOnly) == 0,
+        DedupOf:        dedupkey,
+    }
+
+    if len(stale) != 0 {
+        obj.StaleData = stale
+    }
+
+    if bkt.Replicated && obj.HasData {
+        obj.ReplStatus = ObjectReplStatus_Pending
+    }
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    err = s.putStateChecked(ctx, sid, obj)
+    if err != nil {
+        return nil, err
+    }
+
+    // Add the object to any indexes it belongs in.
+    for k, v := range metadata {
+        idx, _ := s.getindex(ctx, myuser.ID, k, bucket)
+        if idx != nil {
+            s.addobjecttoindex(ctx, idx.ID, v, key)
+        }
+    }
+
+    return &obj, nil
+}
+
+// Bump an object's modification and access times to the current transaction's
+// time without touching anything else about it.
+func (s *SmartContract) TouchObject(ctx contractapi.TransactionContextInterface,
+                                    bucket string, key string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    obj, err := s.getobject(ctx, bucket, key)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.ReadOnly {
+        return false, fmt.Errorf("bucket is read-only")
+    }
+
+    // Test if the ACL says this is ok if this file isn't owned by the user.
+    if obj.Owner != myuser.ID {
+        ok := s.checkObjectAccess(ctx, obj, bkt, myuser.UID,
+                                  ACL_AccessType_Overwrite)
+
+        if !ok {
+            return false, fmt.Errorf("permission denied")
+        }
+    }
+
+    now, err := gettxtime(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    obj.MTime = now
+    obj.ATime = now
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    err = s.putStateChecked(ctx, sid, obj)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Set the typed metadata on an object. Unlike the regular metadata, the values
+// here keep their JSON types, so numbers and booleans compare properly in
+// QueryObjectsAdvanced.
+func (s *SmartContract) SetObjectTypedMetadata(ctx contractapi.TransactionContextInterface,
+                                               bucket string, key string,
+                                               metadata map[string]interface{}) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    obj, err := s.getobject(ctx, bucket, key)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.ReadOnly {
+        return false, fmt.Errorf("bucket is read-only")
+    }
+
+    // Test if the ACL says this is ok if this file isn't owned by the user.
+    if obj.Owner != myuser.ID {
+        ok := s.checkObjectAccess(ctx, obj, bkt, myuser.UID,
+                                  ACL_AccessType_Overwrite)
+
+        if !ok {
+            return false, fmt.Errorf("permission denied")
+        }
+    }
+
+    for k := range metadata {
+        if strings.Contains(k, "\"") || strings.Contains(k, ".") {
+            return false, fmt.Errorf("invalid metadata key %s", k)
+        }
+    }
+
+    err = validatetypedmetadata(bkt, obj.Metadata, metadata)
+    if err != nil {
+        return false, err
+    }
+
+    err = s.recordmetadatahistory(ctx, bkt, obj)
+    if err != nil {
+        return false, err
+    }
+
+    obj.TypedMetadata = metadata
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    err = s.putStateChecked(ctx, sid, obj)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Rename a metadata key on every object in a bucket that has it. Only so many
+// objects are looked at per call; pass the returned token back in to carry on,
+// until an empty token comes back. Index entries move from the old key's index
+// to the new key's index for each object's owner, where those indexes exist.
+func (s *SmartContract) RenameMetadataKey(ctx contractapi.TransactionContextInterface,
+                                          bucket string, oldKey string,
+                                          newKey string, maxobjs uint32,
+                                          token string) (string, error) {
+    maxobjs = s.pagesize(maxobjs)
+
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return "", err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return "", err
+    }
+
+    if bkt.ReadOnly {
+        return "", fmt.Errorf("bucket is read-only")
+    }
+
+    if bkt.Owner != myuser.ID {
+        return "", fmt.Errorf("permission denied")
+    }
+
+    for _, k := range []string{ oldKey, newKey } {
+        if k == "" || strings.Contains(k, "\"") || strings.Contains(k, ".") {
+            return "", fmt.Errorf("invalid metadata key %s", k)
+        }
+    }
+
+    if oldKey == newKey {
+        return "", nil
+    }
+
+    return walkpartialkey(ctx, "Object", []string{bucket}, token, maxobjs,
+                          func(key string, value []byte) error {
+        var obj Object
+        err := json.Unmarshal(value, &obj)
+        if err != nil {
+            return err
+        }
+
+        v, ok := obj.Metadata[oldKey]
+        if !ok {
+            return nil
+        }
+
+        if _, ok := obj.Metadata[newKey]; ok {
+            return fmt.Errorf("object %s already has metadata key %s",
+                              obj.Key, newKey)
+        }
+
+        err = s.recordmetadatahistory(ctx, bkt, &obj)
+        if err != nil {
+            return err
+        }
+
+        delete(obj.Metadata, oldKey)
+        obj.Metadata[newKey] = v
+
+        // The bucket's schema might not allow the new key.
+        err = validatemetadata(bkt, obj.Metadata)
+        if err != nil {
+            return fmt.Errorf("object %s: %v", obj.Key, err)
+        }
+
+        idx, _ := s.getindex(ctx, obj.Owner, oldKey, bucket)
+        if idx != nil {
+            s.removeobjectfromindex(ctx, idx.ID, v, obj.Key)
+        }
+
+        idx, _ = s.getindex(ctx, obj.Owner, newKey, bucket)
+        if idx != nil {
+            s.addobjecttoindex(ctx, idx.ID, v, obj.Key)
+        }
+
+        return s.putStateChecked(ctx, key, obj)
+    })
+}
+
+// Most metadata snapshots a bucket can be set to keep for each object.
+const max_metadata_history = 100
+
+// Save a copy of an object's metadata before it gets changed, if the bucket is
+// keeping track of that, and trim off the oldest copies past the bucket's limit.
+func (s *SmartContract) recordmetadatahistory(ctx contractapi.TransactionContextInterface,
+                                              bkt *Bucket, obj *Object) error {
+    if bkt.MetaHistory == 0 {
+        return nil
+    }
+
+    ts, err := ctx.GetStub().GetTxTimestamp()
+    if err != nil {
+        return fmt.Errorf("failed to read transaction timestamp: %v", err)
+    }
+
+    // Like version IDs, snapshots are keyed by the time counting down so the
+    // newest come first, but down to the nanosecond so that changes made within
+    // the same second still come out in order.
+    nanos := ts.GetSeconds() * 1000000000 + int64(ts.GetNanos())
+    txid := ctx.GetStub().GetTxID()
+
+    snap := MetadataSnapshot {
+        Type:           "MetaHistory",
+        Bucket:         obj.Bucket,
+        Key:            obj.Key,
+        Seq:            fmt.Sprintf("%019d-%s", math.MaxInt64 - nanos, txid),
+        TxID:           txid,
+        Time:           ts.GetSeconds(),
+        Metadata:       obj.Metadata,
+        TypedMetadata:  obj.TypedMetadata,
+    }
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("MetaHistory",
+            []string{obj.Bucket, obj.Key, snap.Seq})
+    err = s.putStateChecked(ctx, sid, snap)
+    if err != nil {
+        return err
+    }
+
+    // The snapshot we just wrote isn't visible yet, so it takes up one of the
+    // slots on top of whatever's already there.
+    old, err := s.getmetadatahistory(ctx, obj.Bucket, obj.Key)
+    if err != nil {
+        return err
+    }
+
+    for i := int(bkt.MetaHistory) - 1; i < len(old); i++ {
+        sid, _ := ctx.GetStub().CreateCompositeKey("MetaHistory",
+                []string{obj.Bucket, obj.Key, old[i].Seq})
+        err = ctx.GetStub().DelState(sid)
+        if err != nil {
+            return fmt.Errorf("failed to delete from world state. %v", err)
+        }
+    }
+
+    return nil
+}
+
+// Read back all of the saved metadata snapshots for an object, newest first.
+func (s *SmartContract) getmetadatahistory(ctx contractapi.TransactionContextInterface,
+                                           bucket string,
+                                           key string) ([]*MetadataSnapshot, error) {
+    iter, err := ctx.GetStub().GetStateByPartialCompositeKey("MetaHistory",
+            []string{bucket, key})
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    rv := make([]*MetadataSnapshot, 0)
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var snap MetadataSnapshot
+        err = json.Unmarshal(resp.Value, &snap)
+        if err != nil {
+            return nil, err
+        }
+
+        rv = append(rv, &snap)
+    }
+
+    sort.Slice(rv, func(i, j int) bool {
+        return rv[i].Seq < rv[j].Seq
+    })
+
+    return rv, nil
+}
+
+// Get the previous versions of an object's metadata, newest first. This needs
+// the same access as reading the object itself.
+func (s *SmartContract) GetObjectMetadataHistory(ctx contractapi.TransactionContextInterface,
+                                                 bucket string,
+                                                 key string) ([]*MetadataSnapshot, error) {
+    _, err := s.GetObjectByPath(ctx, bucket, key)
+    if err != nil {
+        return nil, err
+    }
+
+    return s.getmetadatahistory(ctx, bucket, key)
+}
+
+// Pin an object so that it is never removed by any automatic expiry. Pinned
+// objects can still be removed explicitly.
+func (s *SmartContract) PinObject(ctx contractapi.TransactionContextInterface,
+                                  bucket string, key string) (bool, error) {
+    return s.setobjectpinned(ctx, bucket, key, true)
+}
+
+func (s *SmartContract) UnpinObject(ctx contractapi.TransactionContextInterface,
+                                    bucket string, key string) (bool, error) {
+    return s.setobjectpinned(ctx, bucket, key, false)
+}
+
+func (s *SmartContract) setobjectpinned(ctx contractapi.TransactionContextInterface,
+                                        bucket string, key string,
+                                        pinned bool) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    obj, err := s.getobject(ctx, bucket, key)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.ReadOnly {
+        return false, fmt.Errorf("bucket is read-only")
+    }
+
+    // Only the object's owner or the bucket's owner can do this.
+    if obj.Owner != myuser.ID && bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    if pinned {
+        obj.Flags |= ObjectFlag_Pinned
+    } else {
+        obj.Flags &= ^ObjectFlag_Pinned
+    }
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    err = s.putStateChecked(ctx, sid, obj)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Sweep through a bucket, removing objects that have gone longer than the
+// bucket's expiry time without being modified. Pinned objects are left alone,
+// as are any carrying the bucket's retain tag. Delete records past the bucket's
+// delete record TTL are purged along the way. Only so many objects are looked
+// at in one call, so this should be called again with the returned token until
+// it comes back empty.
+func (s *SmartContract) ApplyLifecycle(ctx contractapi.TransactionContextInterface,
+                                       bucket string,
+                                       token string) (*LifecycleResult, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    if bkt.Owner != myuser.ID && !isadmin(myuser) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    rv := LifecycleResult{}
+    rv.Purged, err = s.purgedeleterecords(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    if bkt.ExpireAfter == 0 {
+        return &rv, nil
+    }
+
+    now, err := gettxtime(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    rv.Token, err = walkpartialkey(ctx, "Object", []string{bucket}, token,
+                                   s.pagesize(0),
+                                   func(key string, value []byte) error {
+        var obj Object
+        err := json.Unmarshal(value, &obj)
+        if err != nil {
+            return err
+        }
+
+        if obj.MTime + bkt.ExpireAfter > now {
+            return nil
+        }
+
+        if (obj.Flags & ObjectFlag_Pinned) != 0 {
+            rv.Pinned++
+            return nil
+        } else if hasretaintag(bkt, &obj) {
+            rv.Retained++
+            return nil
+        }
+
+        rv.Expired++
+        return s.deleteobject(ctx, myuser, bkt, &obj, false)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return &rv, nil
+}
+
+// Save a copy of an object (and its data, if it has any) as an old version.
+// Versions are stored as ObjectVersion~Bucket~Key~VersionID, with the data
+// copied off to the side in the backing store.
+func (s *SmartContract) archiveobject(ctx contractapi.TransactionContextInterface,
+                                      obj *Object) error {
+    var err error
+    ver := *obj
+    ver.Type = "ObjectVersion"
+    ver.DataKey = ""
+
+    if (obj.Flags & ObjectFlag_IndexOnly) == 0 {
+        dkey := fmt.Sprintf(".versions/%s/%s", obj.Key, obj.ID)
+        _, err = s.S3client.CopyObject(context.TODO(),
+                                        minio.CopyDestOptions{
+                                            Bucket: obj.Bucket,
+                                            Object: dkey,
+                                        },
+                                        minio.CopySrcOptions{
+                                            Bucket: obj.Bucket,
+                                            Object: objectdatakey(obj),
+                                        })
+        if err == nil {
+            ver.DataKey = dkey
+        } else if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+            return err
+        }
+    }
+
+    ver.HasData = ver.DataKey != ""
+
+    // Version IDs start with the time the version was made, counting down, so
+    // that the newest versions sort first.
+    now, err := gettxtime(ctx)
+    if err != nil {
+        return err
+    }
+
+    ver.VersionID = fmt.Sprintf("%019d-%s", math.MaxInt64 - now, obj.ID)
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("ObjectVersion",
+            []string{obj.Bucket, obj.Key, ver.VersionID})
+    return s.putStateChecked(ctx, sid, ver)
+}
+
+// If an object's data is missing or damaged on the backing store, put back the
+// data from the most recent old version that is still intact. Returns false if
+// nothing needed to be fixed.
+func (s *SmartContract) RepairObject(ctx contractapi.TransactionContextInterface,
+                                     bucket string, key string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.ReadOnly {
+        return false, fmt.Errorf("bucket is read-only")
+    }
+
+    obj, err := s.getobject(ctx, bucket, key)
+    if err != nil {
+        return false, err
+    }
+
+    if obj.Owner != myuser.ID && bkt.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    if (obj.Flags & ObjectFlag_IndexOnly) != 0 {
+        return false, nil
+    }
+
+    ok, err := s.s3dataintact(bucket, objectdatakey(obj), obj.MD5Sum,
+                              obj.Size)
+    if err != nil {
+        return false, err
+    } else if ok {
+        return false, nil
+    }
+
+    iter, err := ctx.GetStub().GetStateByPartialCompositeKey("ObjectVersion",
+            []string{bucket, key})
+    if err != nil {
+        return false, err
+    }
+    defer iter.Close()
+
+    // Find the newest version that still has good data.
+    var best *Object
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return false, err
+        }
+
+        var ver Object
+        err = json.Unmarshal(resp.Value, &ver)
+        if err != nil {
+            return false, err
+        }
+
+        if ver.DataKey == "" || (best != nil && ver.MTime <= best.MTime) {
+            continue
+        }
+
+        ok, err = s.s3dataintact(bucket, ver.DataKey, ver.MD5Sum,
+                                  ver.Size)
+        if err != nil {
+            return false, err
+        } else if ok {
+            best = &ver
+        }
+    }
+
+    if best == nil {
+        return false, fmt.Errorf("no intact version to repair from")
+    }
+
+    _, err = s.S3client.CopyObject(context.TODO(),
+                                   minio.CopyDestOptions{
+                                       Bucket: bucket,
+                                       Object: objectdatakey(obj),
+                                   },
+                                   minio.CopySrcOptions{
+                                       Bucket: bucket,
+                                       Object: best.DataKey,
+                                   })
+    if err != nil {
+        return false, err
+    }
+
+    now, err := gettxtime(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    // The ledger needs to describe the data that's there now.
+    obj.MD5Sum = best.MD5Sum
+    obj.Size = best.Size
+    obj.MTime = now
+    obj.Flags &= ^ObjectFlag_Staged
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    err = s.putStateChecked(ctx, sid, obj)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Make one of an object's old versions the current object again. The version
+// itself is left where it is, and if the bucket keeps versions, whatever was
+// current before gets archived like any other overwrite. Returns the ID of the
+// new current object.
+func (s *SmartContract) RestoreObjectVersion(ctx contractapi.TransactionContextInterface,
+                                             bucket string, key string,
+                                             versionID string) (string, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return "", err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return "", err
+    }
+
+    vsid, _ := ctx.GetStub().CreateCompositeKey("ObjectVersion",
+            []string{bucket, key, versionID})
+    verJSON, err := ctx.GetStub().GetState(vsid)
+    if err != nil {
+        return "", err
+    } else if verJSON == nil {
+        return "", fmt.Errorf("unknown version")
+    }
+
+    var ver Object
+    err = json.Unmarshal(verJSON, &ver)
+    if err != nil {
+        return "", err
+    }
+
+    // Whoever's restoring it needs to be able to read the old version. The
+    // rest of the checks happen when the object gets written.
+    if ver.Owner != myuser.ID && bkt.Owner != myuser.ID {
+        ok := s.checkObjectAccess(ctx, &ver, bkt, myuser.UID,
+                                  ACL_AccessType_Read)
+
+        if !ok {
+            return "", fmt.Errorf("permission denied")
+        }
+    }
+
+    indexFile := (ver.Flags & ObjectFlag_IndexOnly) != 0
+    if !indexFile && ver.DataKey == "" {
+        return "", fmt.Errorf("version has no data")
+    }
+
+    obj, err := s.createobject(ctx, bucket, key, ver.Size, ver.MD5Sum,
+                               ver.Metadata, ver.Tags, "",
+                               ver.Flags & ^ObjectFlag_Staged, false, true)
+    if err != nil {
+        return "", err
+    }
+
+    if !indexFile {
+        _, err = s.S3client.CopyObject(context.TODO(),
+                                       minio.CopyDestOptions{
+                                           Bucket: bucket,
+                                           Object: objectdatakey(obj),
+                                       },
+                                       minio.CopySrcOptions{
+                                           Bucket: bucket,
+                                           Object: ver.DataKey,
+                                       })
+        if err != nil {
+            return "", err
+        }
+    }
+
+    // Put back the parts of the old version that creating a new object
+    // doesn't carry over.
+    obj.Permissions = ver.Permissions
+    obj.CTime = ver.CTime
+    obj.TypedMetadata = ver.TypedMetadata
+    obj.RespHeaders = ver.RespHeaders
+    obj.Class = ver.Class
+
+    if obj.Class != "" {
+        err = s.addobjecttoclass(ctx, bucket, obj.Class, key)
+        if err != nil {
+            return "", err
+        }
+    }
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    err = s.putStateChecked(ctx, sid, obj)
+    if err != nil {
+        return "", err
+    }
+
+    return obj.ID, nil
+}
+
+// List the old versions of an object that have been kept around, newest first.
+func (s *SmartContract) ListObjectVersions(ctx contractapi.TransactionContextInterface,
+                                           bucket string, key string,
+                                           maxvers uint32,
+                                           token string) (*VersionListing, error) {
+    // Set a sane default on the maximum number of versions.
+    maxvers = s.pagesize(maxvers)
+
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    // Make sure the user is allowed to list the contents of the bucket.
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    iter, meta, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination("ObjectVersion",
+            []string{bucket, key}, int32(maxvers), token)
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    if meta.FetchedRecordsCount < 0 {
+        return nil, fmt.Errorf("Invalid response for version listing")
+    }
+
+    vers := make([]*Object, 0, meta.FetchedRecordsCount)
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var ver Object
+        err = json.Unmarshal(resp.Value, &ver)
+        if err != nil {
+            return nil, err
+        }
+
+        if !s.canlistobject(ctx, myuser, bkt, &ver) {
+            continue
+        }
+
+        vers = append(vers, &ver)
+    }
+
+    rv := VersionListing {
+        Bucket:         bucket,
+        Key:            key,
+        Count:          uint64(len(vers)),
+        Token:          meta.Bookmark,
+        Versions:       vers,
+    }
+
+    return &rv, nil
+}
+
+func (s *SmartContract) MarkReplicationComplete(ctx contractapi.TransactionContextInterface,
+                                                bucket string,
+                                                key string) (bool, error) {
+    return s.setreplstatus(ctx, bucket, key, ObjectReplStatus_Complete)
+}
+
+func (s *SmartContract) MarkReplicationFailed(ctx contractapi.TransactionContextInterface,
+                                              bucket string,
+                                              key string) (bool, error) {
+    return s.setreplstatus(ctx, bucket, key, ObjectReplStatus_Failed)
+}
+
+func (s *SmartContract) setreplstatus(ctx contractapi.TransactionContextInterface,
+                                      bucket string, key string,
+                                      status string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.ReadOnly {
+        return false, fmt.Errorf("bucket is read-only")
+    }
+
+    // Only the bucket's owner (or an admin) manages replication.
+    if bkt.Owner != myuser.ID && !isadmin(myuser) {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    obj, err := s.getobject(ctx, bucket, key)
+    if err != nil {
+        return false, err
+    }
+
+    if obj.ReplStatus == "" {
+        return false, fmt.Errorf("object not being replicated")
+    }
+
+    obj.ReplStatus = status
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    err = s.putStateChecked(ctx, sid, obj)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+func (s *SmartContract) ListObjectsPendingReplication(ctx contractapi.TransactionContextInterface,
+                                                      bucket string,
+                                                      maxobjs uint32,
+                                                      token string) (*ObjectListing, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    // Only the bucket's owner (or an admin) manages replication.
+    if bkt.Owner != myuser.ID && !isadmin(myuser) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    querymap := make(map[string]interface{})
+    querymap["type"] = "Object"
+    querymap["bucket"] = bucket
+    querymap["replstatus"] = ObjectReplStatus_Pending
+
+    return s.listobjectsbyselector(ctx, myuser, bkt, querymap, maxobjs, true,
+                                   token)
+}
+
+func (s *SmartContract) RemoveObject(ctx contractapi.TransactionContextInterface,
+                                     bucket string,
+                                     key string) (string, error) {
+    return s.removeobject(ctx, bucket, key, false)
+}
+
+// Remove an object from the ledger, but leave its data alone on the backing
+// store (for instance, if it is managed somewhere else).
+func (s *SmartContract) DetachObject(ctx contractapi.TransactionContextInterface,
+                                     bucket string,
+                                     key string) (bool, error) {
+    _, err := s.removeobject(ctx, bucket, key, true)
+    return err == nil, err
+}
+
+func (s *SmartContract) removeobject(ctx contractapi.TransactionContextInterface,
+                                     bucket string, key string,
+                                     keepdata bool) (string, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return "", err
+    }
+
+    obj, err := s.GetObjectByPath(ctx, bucket, key)
+    if err != nil {
+        return "", err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return "", err
+    }
+
+    if bkt.ReadOnly {
+        return "", fmt.Errorf("bucket is read-only")
+    }
+
+    // Test if the ACL says this is ok if this file isn't owned by the user.
+    if obj.Owner != myuser.ID {
+        ok := s.checkObjectAccess(ctx, obj, bkt, myuser.UID,
+                                  ACL_AccessType_Delete)
+
+        if !ok {
+            return "", fmt.Errorf("permission denied")
+        }
+    }
+
+    err = s.deleteobject(ctx, myuser, bkt, obj, keepdata)
+    if err != nil {
+        return "", err
+    }
+
+    return "true", nil
+}
+
+// Remove an object on behalf of a user who has already been cleared to do so,
+// leaving a delete record behind. The data on the backing store is removed too,
+// unless keepdata is set.
+func (s *SmartContract) deleteobject(ctx contractapi.TransactionContextInterface,
+                                     myuser *User, bkt *Bucket,
+                                     obj *Object, keepdata bool) error {
+    // If we're keeping the data, treat it like an index file for cleanup.
+    indexFile := (obj.Flags & ObjectFlag_IndexOnly) != 0 || keepdata
+
+    now, err := gettxtime(ctx)
+    if err != nil {
+        return err
+    }
+
+    // Create a delete record and save it to world state.
+    dr := DeleteRecord {
+        Type:           "DeletedObject",
+        ID:             obj.ID,
+        Bucket:         obj.Bucket,
+        Key:            obj.Key,
+        Owner:          obj.Owner,
+        Deleter:        myuser.ID,
+        Permissions:    obj.Permissions,
+        MD5Sum:         obj.MD5Sum,
+        Size:           obj.Size,
+        CTime:          obj.CTime,
+        DTime:          now,
+        Metadata:       obj.Metadata,
+        Tags:           obj.Tags,
+        Flags:          obj.Flags,
+    }
+
+    // Delete records in buckets with a TTL on them get purged once they're old
+    // enough.
+    if bkt.DeleteRecordTTL > 0 {
+        dr.ExpiresAt = dr.DTime + bkt.DeleteRecordTTL
+    }
+
+    sidDr, _ := ctx.GetStub().CreateCompositeKey("DeletedObject", []string{obj.Bucket, obj.ID})
+    err = s.putStateChecked(ctx, sidDr, dr)
+    if err != nil {
+        return err
+    }
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{obj.Bucket, obj.Key})
+    err = ctx.GetStub().DelState(sid)
+    if err != nil {
+        ctx.GetStub().DelState(sidDr)
+        return fmt.Errorf("failed to delete from world state. %v", err)
+    }
+
+    err = s.removeobjectaliases(ctx, obj.Bucket, obj.Key)
+    if err != nil {
+        return err
+    }
+
+    // Remove the object from any indexes it is in.
+    for k, v := range obj.Metadata {
+        idx, _ := s.getindex(ctx, myuser.ID, k, obj.Bucket)
+        if idx != nil {
+            s.removeobjectfromindex(ctx, idx.ID, v, obj.Key)
+        }
+    }
+
+    if obj.Class != "" {
+        s.removeobjectfromclass(ctx, obj.Bucket, obj.Class, obj.Key)
+    }
+
+    // Anything the object was still waiting on CommitObjectRequest to clean up
+    // goes along with it.
+    if !keepdata {
+        s.removestaledata(ctx, obj)
+    }
+
+    // If the Index File flag is set, there was no data for this file on the
+    // backing store, so we're done already.
+    if indexFile {
+        return nil
+    }
+
+    // The object is gone from the ledger either way, so a failure here just
+    // leaves some stray data behind.
+    s.removeobjectdata(ctx, obj)
+    return nil
+}
+
+// Where an object's data lives on the backing store.
+func objectdatakey(obj *Object) string {
+    if obj.DedupOf != "" {
+        return obj.DedupOf
+    }
+
+    return obj.Key
+}
+
+// Shared data is kept off to the side, keyed by its owner and checksum.
+func blobkey(owner string, md5sum string) string {
+    return fmt.Sprintf(".blobs/%s/%s", owner, strings.ToLower(md5sum))
+}
+
+// Is any object other than the one at the given key using a shared blob? This
+// counts references by looking at the objects themselves rather than keeping a
+// separate count that has to be kept in sync.
+func (s *SmartContract) blobinuse(ctx contractapi.TransactionContextInterface,
+                                  bucket string, blob string,
+                                  except string) bool {
+    querymap := map[string]interface{} {
+        "type":     "Object",
+        "bucket":   bucket,
+        "dedupof":  blob,
+    }
+
+    if except != "" {
+        querymap["key"] = map[string]string { "$ne": except }
+    }
+
+    js, err := json.Marshal(querymap)
+    if err != nil {
+        return true
+    }
+
+    iter, err := ctx.GetStub().GetQueryResult(fmt.Sprintf(`{"selector":%s}`, js))
+    if err != nil {
+        // Err on the side of keeping the data around.
+        return true
+    }
+    defer iter.Close()
+
+    return iter.HasNext()
+}
+
+// Remove an object's data from the backing store, unless it's shared with
+// other objects that still need it.
+func (s *SmartContract) removeobjectdata(ctx contractapi.TransactionContextInterface,
+                                         obj *Object) error {
+    if obj.DedupOf != "" && s.blobinuse(ctx, obj.Bucket, obj.DedupOf, obj.Key) {
+        return nil
+    }
+
+    err := s.S3client.RemoveObject(context.TODO(), obj.Bucket,
+                                   objectdatakey(obj),
+                                   minio.RemoveObjectOptions{})
+    if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+        return err
+    }
+
+    return nil
+}
+
+// Clear out data on the backing store that an object has replaced, unless
+// something else has come to use it since.
+func (s *SmartContract) removestaledata(ctx contractapi.TransactionContextInterface,
+                                        obj *Object) error {
+    for _, dkey := range obj.StaleData {
+        if strings.HasPrefix(dkey, ".blobs/") {
+            if s.blobinuse(ctx, obj.Bucket, dkey, obj.Key) {
+                continue
+            }
+        } else {
+            tmp, _ := s.getobject(ctx, obj.Bucket, dkey)
+            if tmp != nil && (tmp.Flags & ObjectFlag_IndexOnly) == 0 &&
+               objectdatakey(tmp) == dkey {
+                continue
+            }
+        }
+
+        err := s.S3client.RemoveObject(context.TODO(), obj.Bucket, dkey,
+                                       minio.RemoveObjectOptions{})
+        if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+            return err
+        }
+    }
+
+    obj.StaleData = nil
+    return nil
+}
+
+func (s *SmartContract) RemoveDeleteRecord(ctx contractapi.TransactionContextInterface,
+                                           bucket string, id string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    obj, err := s.GetDeleteRecord(ctx, bucket, id)
+    if err != nil {
+        return false, err
+    }
+
+    // Only allow an owner to clear a delete record
+    if obj.Owner != myuser.ID {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return false, err
+    }
+
+    if bkt.ReadOnly {
+        return false, fmt.Errorf("bucket is read-only")
+    }
+
+    sidDr, _ := ctx.GetStub().CreateCompositeKey("DeletedObject", []string{bucket, id})
+    err = ctx.GetStub().DelState(sidDr)
+    if err != nil {
+        return false, fmt.Errorf("failed to remove delete record from world state. %v", err)
+    }
+
+    return true, nil
+}
+
+// Remove the delete records in a bucket that have outlived the bucket's delete
+// record TTL, returning how many were removed. At most one page of records is
+// handled in each call. ApplyLifecycle does this too.
+func (s *SmartContract) PurgeExpiredDeleteRecords(ctx contractapi.TransactionContextInterface,
+                                                  bucket string) (uint64, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return 0, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return 0, err
+    }
+
+    if bkt.ReadOnly {
+        return 0, fmt.Errorf("bucket is read-only")
+    }
+
+    if bkt.Owner != myuser.ID && !isadmin(myuser) {
+        return 0, fmt.Errorf("permission denied")
+    }
+
+    return s.purgedeleterecords(ctx, bucket)
+}
+
+func (s *SmartContract) purgedeleterecords(ctx contractapi.TransactionContextInterface,
+                                           bucket string) (uint64, error) {
+    now, err := gettxtime(ctx)
+    if err != nil {
+        return 0, err
+    }
+
+    querymap := map[string]interface{} {
+        "type":     "DeletedObject",
+        "bucket":   bucket,
+        "expires":  map[string]int64 { "$gt": 0, "$lte": now },
+    }
+
+    js, err := json.Marshal(querymap)
+    if err != nil {
+        return 0, err
+    }
+
+    // This runs alongside other writes in ApplyLifecycle, so it can't use a
+    // paginated query. Just stop once a page's worth is gone.
+    dbquery := fmt.Sprintf(`{"selector":%s}`, js)
+    iter, err := ctx.GetStub().GetQueryResult(dbquery)
+    if err != nil {
+        return 0, err
+    }
+    defer iter.Close()
+
+    max := uint64(s.pagesize(0))
+    var count uint64 = 0
+    for count < max && iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return count, err
+        }
+
+        err = ctx.GetStub().DelState(resp.Key)
+        if err != nil {
+            return count, fmt.Errorf("failed to remove delete record from world state. %v", err)
+        }
+
+        count++
+    }
+
+    return count, nil
+}
+
+// Bring back a deleted object from its delete record, under a new key if
+// desired. If the object had data on the backing store, it is restored as
+// staged and a URL is returned for the data to be uploaded again.
+func (s *SmartContract) RestoreObjectAs(ctx contractapi.TransactionContextInterface,
+                                        bucket string, id string,
+                                        key string,
+                                        overwrite bool) (string, error) {
+    dr, err := s.GetDeleteRecord(ctx, bucket, id)
+    if err != nil {
+        return "", err
+    }
+
+    if key == "" {
+        key = dr.Key
+    }
+
+    flags := dr.Flags
+    indexFile := (flags & ObjectFlag_IndexOnly) != 0
+    if !indexFile {
+        flags |= ObjectFlag_Staged
+    }
+
+    obj, err := s.createobject(ctx, bucket, key, dr.Size, dr.MD5Sum,
+                               dr.Metadata, dr.Tags, "", flags, false,
+                               overwrite)
+    if err != nil {
+        return "", err
+    }
+
+    // Put back the parts of the original object that creating a new one
+    // doesn't carry over.
+    obj.Permissions = dr.Permissions
+    obj.CTime = dr.CTime
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    err = s.putStateChecked(ctx, sid, obj)
+    if err != nil {
+        return "", err
+    }
+
+    sidDr, _ := ctx.GetStub().CreateCompositeKey("DeletedObject", []string{bucket, id})
+    err = ctx.GetStub().DelState(sidDr)
+    if err != nil {
+        return "", fmt.Errorf("failed to remove delete record from world state. %v", err)
+    }
+
+    if indexFile {
+        return "", nil
+    }
+
+    ps, err := s.S3client.PresignedPutObject(context.TODO(), bucket, key,
+                                             time.Duration(10) * time.Second)
+    if err != nil {
+        return "", err
+    }
+
+    return ps.String(), nil
+}
+
+func (s *SmartContract) isbucketempty(ctx contractapi.TransactionContextInterface,
+                                      bucket string) (bool, error) {
+    iter, err := ctx.GetStub().GetStateByPartialCompositeKey("Object",
+            []string{bucket})
+    if err != nil {
+        return false, err
+    }
+    defer iter.Close()
+
+    return !iter.HasNext(), nil
+}
+
+func (s *SmartContract) userownsobjects(ctx contractapi.TransactionContextInterface,
+                                        id string) (bool, error) {
+    query := fmt.Sprintf(`{"selector":{"type":"Object","owner":"%s"}}`, id)
+    iter, err := ctx.GetStub().GetQueryResult(query)
+    if err != nil {
+        return false, err
+    }
+    defer iter.Close()
+
+    return iter.HasNext(), nil
+}
+
+// Can the given user list the contents of a bucket at all? The owner always
+// can, as can anyone if the owner has turned on anonymous listing. Otherwise,
+// the bucket's ACL has to allow it (which a public read entry does).
+func (s *SmartContract) canlistbucket(ctx contractapi.TransactionContextInterface,
+                                      user *User, bkt *Bucket) bool {
+    if bkt.Owner == user.ID || bkt.AnonymousList {
+        return true
+    }
+
+    if len(bkt.Permissions) == 0 {
+        return false
+    }
+
+    return s.testaclaccess(ctx, bkt.Permissions, user.UID, bkt.Name,
+                           ACL_AccessType_List)
+}
+
+// Should an object show up in a listing of its bucket for the given user? The
+// bucket's owner sees everything, as does the object's owner. Otherwise, an
+// object with its own ACL is only shown if that ACL allows listing.
+func (s *SmartContract) canlistobject(ctx contractapi.TransactionContextInterface,
+                                      user *User, bkt *Bucket,
+                                      obj *Object) bool {
+    if bkt.Owner == user.ID || obj.Owner == user.ID {
+        return true
+    }
+
+    if len(obj.Permissions) == 0 {
+        return true
+    }
+
+    return s.testaclaccess(ctx, obj.Permissions, user.UID, bkt.Name,
+                           ACL_AccessType_List)
+}
+
+// List the objects in a bucket. If flagsMask is non-zero, only objects whose
+// flags under the mask equal flagsMatch are included (so a mask and match of
+// ObjectFlag_Staged lists only staged objects, while a mask of ObjectFlag_Staged
+// and a match of zero skips them).
+func (s *SmartContract) ListObjects(ctx contractapi.TransactionContextInterface,
+                                    bucket string, maxobjs uint32,
+                                    includeMeta bool,
+                                    flagsMask uint64, flagsMatch uint64,
+                                    token string) (*ObjectListing, error) {
+    // Set a sane default on the maximum number of objects.
+    maxobjs = s.pagesize(maxobjs)
+
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    // Make sure the user is allowed to list the contents of the bucket.
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    iter, meta, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination("Object",
+            []string{bucket}, int32(maxobjs), token)
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    if meta.FetchedRecordsCount < 0 {
+        return nil, fmt.Errorf("Invalid response for object listing")
+    }
+
+    objs := make([]ListingObject, 0, meta.FetchedRecordsCount)
+
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var obj Object
+        err = json.Unmarshal(resp.Value, &obj)
+        if err != nil {
+            return nil, err
+        }
+
+        // Skip over anything the object's own ACL hides from us.
+        if !s.canlistobject(ctx, myuser, bkt, &obj) {
+            continue
+        }
+
+        if flagsMask != 0 && (obj.Flags & flagsMask) != flagsMatch {
+            continue
+        }
+
+        // Fill in this object.
+        lobj := ListingObject {
+            Key:        obj.Key,
+            Owner:      obj.Owner,
+            Size:       obj.Size,
+            CTime:      obj.CTime,
+            MD5Sum:     obj.MD5Sum,
+        }
+
+        if includeMeta {
+            lobj.Metadata = obj.Metadata
+            lobj.Tags = obj.Tags
+            lobj.ID = obj.ID
+        }
+
+        objs = append(objs, lobj)
+    }
+
+    // Fill in the metadata wrapping the listing
+    rv := ObjectListing {
+        Bucket:         bucket,
+        Count:          uint64(len(objs)),
+        Token:          meta.Bookmark,
+        Objects:        objs,
+    }
+
+    return &rv, nil
+}
+
+// Count the objects in a bucket. This walks the bucket's object keys without
+// decoding any of them, so per-object ACLs are not consulted -- permission to
+// list the bucket is enough to get the total.
+func (s *SmartContract) CountObjects(ctx contractapi.TransactionContextInterface,
+                                     bucket string) (uint64, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return 0, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return 0, err
+    }
+
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return 0, fmt.Errorf("permission denied")
+    }
+
+    iter, err := ctx.GetStub().GetStateByPartialCompositeKey("Object",
+            []string{bucket})
+    if err != nil {
+        return 0, err
+    }
+    defer iter.Close()
+
+    var count uint64 = 0
+    for iter.HasNext() {
+        _, err := iter.Next()
+        if err != nil {
+            return 0, err
+        }
+
+        count++
+    }
+
+    return count, nil
+}
+
+// Count the delete records in a bucket, without decoding any of them.
+func (s *SmartContract) CountDeleteRecords(ctx contractapi.TransactionContextInterface,
+                                           bucket string) (uint64, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return 0, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return 0, err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return 0, fmt.Errorf("permission denied")
+    }
+
+    iter, err := ctx.GetStub().GetStateByPartialCompositeKey("DeletedObject",
+            []string{bucket})
+    if err != nil {
+        return 0, err
+    }
+    defer iter.Close()
+
+    var count uint64 = 0
+    for iter.HasNext() {
+        _, err := iter.Next()
+        if err != nil {
+            return 0, err
+        }
+
+        count++
+    }
+
+    return count, nil
+}
+
+// Count how many objects carry each tag in a bucket. Only the first page of
+// objects is looked at (at most maxObjectsToScan), and objects the caller
+// can't list are left out.
+func (s *SmartContract) GetTagStats(ctx contractapi.TransactionContextInterface,
+                                    bucket string,
+                                    maxObjectsToScan uint32) (map[string]uint64, error) {
+    maxObjectsToScan = s.pagesize(maxObjectsToScan)
+
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    // Make sure the user is allowed to list the contents of the bucket.
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    iter, _, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination("Object",
+            []string{bucket}, int32(maxObjectsToScan), "")
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    rv := make(map[string]uint64)
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var obj Object
+        err = json.Unmarshal(resp.Value, &obj)
+        if err != nil {
+            return nil, err
+        }
+
+        if !s.canlistobject(ctx, myuser, bkt, &obj) {
+            continue
+        }
+
+        for _, tag := range obj.Tags {
+            rv[tag]++
+        }
+    }
+
+    return rv, nil
+}
+
+// Move every object whose key starts with one prefix over to another prefix,
+// keeping the rest of the key the same. Data on the backing store, indexes,
+// classes and aliases all follow the objects; old versions and metadata history
+// stay under the old keys. The old copies of the data are removed once
+// CommitObjectRequest is called on each new key. Objects the caller can't both
+// overwrite and delete are left where they are and reported as skipped. Only
+// one page of the bucket is looked at per call; pass the returned token back in
+// to carry on, until an empty token comes back.
+func (s *SmartContract) MovePrefix(ctx contractapi.TransactionContextInterface,
+                                   bucket string, oldPrefix string,
+                                   newPrefix string, maxobjs uint32,
+                                   token string) (*MoveSummary, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    if bkt.ReadOnly {
+        return nil, fmt.Errorf("bucket is read-only")
+    }
+
+    // Moving things somewhere underneath where they already are would have us
+    // running into the same objects again on later pages.
+    if oldPrefix == "" || strings.HasPrefix(newPrefix, oldPrefix) {
+        return nil, fmt.Errorf("invalid prefix")
+    }
+
+    rv := MoveSummary{ Skipped: make([]string, 0) }
+    rv.Token, err = walkpartialkey(ctx, "Object", []string{bucket}, token,
+                                   s.pagesize(maxobjs),
+                                   func(key string, value []byte) error {
+        var obj Object
+        err := json.Unmarshal(value, &obj)
+        if err != nil {
+            return err
+        }
+
+        if !strings.HasPrefix(obj.Key, oldPrefix) {
+            return nil
+        }
+
+        // Moving an object is overwriting it and deleting the old one, so the
+        // ACL has to allow both.
+        if obj.Owner != myuser.ID && bkt.Owner != myuser.ID {
+            if !s.checkObjectAccess(ctx, &obj, bkt, myuser.UID,
+                                    ACL_AccessType_Overwrite) ||
+               !s.checkObjectAccess(ctx, &obj, bkt, myuser.UID,
+                                    ACL_AccessType_Delete) {
+                rv.Skipped = append(rv.Skipped, obj.Key)
+                return nil
+            }
+        }
+
+        err = s.moveobject(ctx, &obj, newPrefix + obj.Key[len(oldPrefix):])
+        if err != nil {
+            return err
+        }
+
+        rv.Moved++
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return &rv, nil
+}
+
+// Give an object a new key in the same bucket. The data at the old key is left
+// for CommitObjectRequest on the new key to remove.
+func (s *SmartContract) moveobject(ctx contractapi.TransactionContextInterface,
+                                   obj *Object, newkey string) error {
+    err := validatekey(newkey)
+    if err != nil {
+        return err
+    }
+
+    tmp, _ := s.getobject(ctx, obj.Bucket, newkey)
+    if tmp != nil {
+        return fmt.Errorf("object %s already exists", newkey)
+    }
+
+    oldkey := obj.Key
+
+    // Shared data stays where it is, since it isn't named after the object.
+    if (obj.Flags & ObjectFlag_IndexOnly) == 0 && obj.DedupOf == "" {
+        _, err = s.S3client.CopyObject(context.TODO(),
+                                       minio.CopyDestOptions{
+                                           Bucket: obj.Bucket,
+                                           Object: newkey,
+                                       },
+                                       minio.CopySrcOptions{
+                                           Bucket: obj.Bucket,
+                                           Object: oldkey,
+                                       })
+        if err == nil {
+            obj.StaleData = append(obj.StaleData, oldkey)
+        } else if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+            return err
+        }
+    }
+
+    for k, v := range obj.Metadata {
+        idx, _ := s.getindex(ctx, obj.Owner, k, obj.Bucket)
+        if idx != nil {
+            s.removeobjectfromindex(ctx, idx.ID, v, oldkey)
+            s.addobjecttoindex(ctx, idx.ID, v, newkey)
+        }
+    }
+
+    if obj.Class != "" {
+        s.removeobjectfromclass(ctx, obj.Bucket, obj.Class, oldkey)
+        s.addobjecttoclass(ctx, obj.Bucket, obj.Class, newkey)
+    }
+
+    err = s.retargetobjectaliases(ctx, obj.Bucket, oldkey, newkey)
+    if err != nil {
+        return err
+    }
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{obj.Bucket, oldkey})
+    err = ctx.GetStub().DelState(sid)
+    if err != nil {
+        return fmt.Errorf("failed to delete from world state. %v", err)
+    }
+
+    obj.Key = newkey
+    sid, _ = ctx.GetStub().CreateCompositeKey("Object", []string{obj.Bucket, newkey})
+    return s.putStateChecked(ctx, sid, obj)
+}
+
+// List just the keys of the objects in a bucket, optionally only those starting
+// with a given prefix.
+func (s *SmartContract) ListObjectKeys(ctx contractapi.TransactionContextInterface,
+                                       bucket string, prefix string,
+                                       maxobjs uint32,
+                                       token string) (*KeyListing, error) {
+    // Set a sane default on the maximum number of objects.
+    maxobjs = s.pagesize(maxobjs)
+
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    // Make sure the user is allowed to list the contents of the bucket.
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    querymap := make(map[string]interface{})
+    querymap["type"] = "Object"
+    querymap["bucket"] = bucket
+
+    if prefix != "" {
+        querymap["key"] = map[string]string{
+            "$regex": "^" + regexp.QuoteMeta(prefix),
+        }
+    }
+
+    js, err := json.Marshal(querymap)
+    if err != nil {
+        return nil, err
+    }
+
+    dbquery := fmt.Sprintf(`{"selector":%s}`, js)
+    iter, meta, err := ctx.GetStub().GetQueryResultWithPagination(dbquery,
+            int32(maxobjs), token)
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    if meta.FetchedRecordsCount < 0 {
+        return nil, fmt.Errorf("Invalid response for object listing")
+    }
+
+    // We only need enough of the object to filter on its ACL.
+    type keyonly struct {
+        Key             string              `json:"key"`
+        Owner           string              `json:"owner"`
+        Permissions     ACL                 `json:"perms"`
+    }
+
+    keys := make([]string, 0, meta.FetchedRecordsCount)
+
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var ko keyonly
+        err = json.Unmarshal(resp.Value, &ko)
+        if err != nil {
+            return nil, err
+        }
+
+        obj := Object {
+            Key:            ko.Key,
+            Owner:          ko.Owner,
+            Permissions:    ko.Permissions,
+        }
+
+        // Skip over anything the object's own ACL hides from us.
+        if !s.canlistobject(ctx, myuser, bkt, &obj) {
+            continue
+        }
+
+        keys = append(keys, ko.Key)
+    }
+
+    rv := KeyListing {
+        Bucket:         bucket,
+        Count:          uint64(len(keys)),
+        Token:          meta.Bookmark,
+        Keys:           keys,
+    }
+
+    return &rv, nil
+}
+
+func (s *SmartContract) QueryObjects(ctx contractapi.TransactionContextInterface,
+                                     bucket string, query map[string]string,
+                                     maxobjs uint32, includeMeta bool,
+                                     token string) (*ObjectListing, error) {
+    // Set a sane default on the maximum number of objects.
+    maxobjs = s.pagesize(maxobjs)
+
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    // Make sure the user is allowed to list the contents of the bucket.
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    // Build up the metadata portion of the query...
+    querymap := make(map[string]string)
+    querymap["type"] = "Object"
+    querymap["bucket"] = bucket
+
+    if len(query) > 0 {
+        for k, v := range query {
+            // Prevent naughty queries....
+            if strings.Contains(k, "\"") {
+                return nil, fmt.Errorf("invalid query")
+            }
+
+            querymap["metadata." + k] = v
+        }
+    }
+
+    js, err := json.Marshal(querymap)
+    if err != nil {
+        return nil, err
+    }
+
+    dbquery := fmt.Sprintf(`{"selector":%s}`, js)
+    iter, meta, err := ctx.GetStub().GetQueryResultWithPagination(dbquery,
+            int32(maxobjs), token)
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    if meta.FetchedRecordsCount < 0 {
+        return nil, fmt.Errorf("Invalid response for object listing")
+    }
+
+    objs := make([]ListingObject, 0, meta.FetchedRecordsCount)
+
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var obj Object
+        err = json.Unmarshal(resp.Value, &obj)
+        if err != nil {
+            return nil, err
+        }
+
+        // Skip over anything the object's own ACL hides from us.
+        if !s.canlistobject(ctx, myuser, bkt, &obj) {
+            continue
+        }
+
+        // Fill in this object.
+        lobj := ListingObject {
+            Key:        obj.Key,
+            Owner:      obj.Owner,
+            Size:       obj.Size,
+            CTime:      obj.CTime,
+            MD5Sum:     obj.MD5Sum,
+        }
+
+        if includeMeta {
+            lobj.Metadata = obj.Metadata
+            lobj.Tags = obj.Tags
+            lobj.ID = obj.ID
+        }
+
+        objs = append(objs, lobj)
+    }
+
+    // Fill in the metadata wrapping the listing
+    rv := ObjectListing {
+        Bucket:         bucket,
+        Count:          uint64(len(objs)),
+        Token:          meta.Bookmark,
+        Objects:        objs,
+    }
+
+    return &rv, nil
+}
+
+// Search the caller's own objects in every bucket by metadata. Each object in
+// the listing has its bucket filled in, since they can come from anywhere.
+func (s *SmartContract) QueryMyObjects(ctx contractapi.TransactionContextInterface,
+                                       query map[string]string, maxobjs uint32,
+                                       token string) (*ObjectListing, error) {
+    // Set a sane default on the maximum number of objects.
+    maxobjs = s.pagesize(maxobjs)
+
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    // Build up the metadata portion of the query...
+    querymap := make(map[string]string)
+    querymap["type"] = "Object"
+    querymap["owner"] = myuser.ID
+
+    if len(query) > 0 {
+        for k, v := range query {
+            // Prevent naughty queries....
+            if strings.Contains(k, "\"") {
+                return nil, fmt.Errorf("invalid query")
+            }
+
+            querymap["metadata." + k] = v
+        }
+    }
+
+    js, err := json.Marshal(querymap)
+    if err != nil {
+        return nil, err
+    }
+
+    dbquery := fmt.Sprintf(`{"selector":%s}`, js)
+    iter, meta, err := ctx.GetStub().GetQueryResultWithPagination(dbquery,
+            int32(maxobjs), token)
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    if meta.FetchedRecordsCount < 0 {
+        return nil, fmt.Errorf("Invalid response for object listing")
+    }
+
+    objs := make([]ListingObject, meta.FetchedRecordsCount)
+    i := 0
+
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var obj Object
+        err = json.Unmarshal(resp.Value, &obj)
+        if err != nil {
+            return nil, err
+        }
+
+        // Fill in this object.
+        objs[i] = ListingObject {
+            Key:        obj.Key,
+            Owner:      obj.Owner,
+            Size:       obj.Size,
+            CTime:      obj.CTime,
+            MD5Sum:     obj.MD5Sum,
+            Metadata:   obj.Metadata,
+            Tags:       obj.Tags,
+            ID:         obj.ID,
+            Bucket:     obj.Bucket,
+        }
+
+        i++
+    }
+
+    // Fill in the metadata wrapping the listing
+    rv := ObjectListing {
+        Bucket:         "",
+        Count:          uint64(meta.FetchedRecordsCount),
+        Token:          meta.Bookmark,
+        Objects:        objs,
+    }
+
+    return &rv, nil
+}
+
+// Most buckets SearchMyObjects will look through in one call.
+const search_max_buckets = 100
+
+// Search the metadata of objects across every bucket the caller can list, not
+// just their own objects. Only the first search_max_buckets such buckets are
+// searched.
+func (s *SmartContract) SearchMyObjects(ctx contractapi.TransactionContextInterface,
+                                        query map[string]string, maxobjs uint32,
+                                        token string) (*ObjectListing, error) {
+    // Set a sane default on the maximum number of objects.
+    maxobjs = s.pagesize(maxobjs)
+
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkts, err := s.listablebuckets(ctx, myuser, search_max_buckets)
+    if err != nil {
+        return nil, err
+    }
+
+    names := make([]string, 0, len(bkts))
+    for k := range bkts {
+        names = append(names, k)
+    }
+
+    sort.Strings(names)
+
+    // Build up the metadata portion of the query...
+    querymap := make(map[string]interface{})
+    querymap["type"] = "Object"
+    querymap["bucket"] = map[string]interface{} { "$in": names }
+
+    for k, v := range query {
+        // Prevent naughty queries....
+        if strings.Contains(k, "\"") {
+            return nil, fmt.Errorf("invalid query")
+        }
+
+        querymap["metadata." + k] = v
+    }
+
+    js, err := json.Marshal(querymap)
+    if err != nil {
+        return nil, err
+    }
+
+    dbquery := fmt.Sprintf(`{"selector":%s}`, js)
+    iter, meta, err := ctx.GetStub().GetQueryResultWithPagination(dbquery,
+            int32(maxobjs), token)
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    if meta.FetchedRecordsCount < 0 {
+        return nil, fmt.Errorf("Invalid response for object listing")
+    }
+
+    objs := make([]ListingObject, 0, meta.FetchedRecordsCount)
+
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var obj Object
+        err = json.Unmarshal(resp.Value, &obj)
+        if err != nil {
+            return nil, err
+        }
+
+        bkt := bkts[obj.Bucket]
+        if bkt == nil || !s.canlistobject(ctx, myuser, bkt, &obj) {
+            continue
+        }
+
+        objs = append(objs, ListingObject {
+            Key:        obj.Key,
+            Owner:      obj.Owner,
+            Size:       obj.Size,
+            CTime:      obj.CTime,
+            MD5Sum:     obj.MD5Sum,
+            Metadata:   obj.Metadata,
+            Tags:       obj.Tags,
+            ID:         obj.ID,
+            Bucket:     obj.Bucket,
+        })
+    }
+
+    // Fill in the metadata wrapping the listing
+    rv := ObjectListing {
+        Bucket:         "",
+        Count:          uint64(len(objs)),
+        Token:          meta.Bookmark,
+        Objects:        objs,
+    }
+
+    return &rv, nil
+}
+
+// Find up to max buckets the user is allowed to list the contents of, keyed by
+// name.
+func (s *SmartContract) listablebuckets(ctx contractapi.TransactionContextInterface,
+                                        user *User,
+                                        max int) (map[string]*Bucket, error) {
+    iter, err := ctx.GetStub().GetStateByPartialCompositeKey("Bucket",
+            []string{})
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    rv := make(map[string]*Bucket)
+
+    for iter.HasNext() && len(rv) < max {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var bkt Bucket
+        err = json.Unmarshal(resp.Value, &bkt)
+        if err != nil {
+            return nil, err
+        }
+
+        if !s.canlistbucket(ctx, user, &bkt) {
+            continue
+        }
+
+        rv[bkt.Name] = &bkt
+    }
+
+    return rv, nil
+}
+
+// Query objects in a bucket by their typed metadata. Each entry in the query
+// is a CouchDB condition on the typed metadata key, so things like
+// {"count":{"$gt":5}} work as expected.
+func (s *SmartContract) QueryObjectsAdvanced(ctx contractapi.TransactionContextInterface,
+                                             bucket string,
+                                             query map[string]interface{},
+                                             maxobjs uint32, includeMeta bool,
+                                             token string) (*ObjectListing, error) {
+    // Set a sane default on the maximum number of objects.
+    maxobjs = s.pagesize(maxobjs)
+
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    // Make sure the user is allowed to list the contents of the bucket.
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    // Build up the metadata portion of the query...
+    querymap := make(map[string]interface{})
+    querymap["type"] = "Object"
+    querymap["bucket"] = bucket
+
+    for k, v := range query {
+        // Prevent naughty queries....
+        if strings.Contains(k, "\"") || strings.HasPrefix(k, "$") {
+            return nil, fmt.Errorf("invalid query")
+        }
+
+        querymap["typedmetadata." + k] = v
+    }
+
+    js, err := json.Marshal(querymap)
+    if err != nil {
+        return nil, err
+    }
+
+    dbquery := fmt.Sprintf(`{"selector":%s}`, js)
+    iter, meta, err := ctx.GetStub().GetQueryResultWithPagination(dbquery,
+            int32(maxobjs), token)
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    if meta.FetchedRecordsCount < 0 {
+        return nil, fmt.Errorf("Invalid response for object listing")
+    }
+
+    objs := make([]ListingObject, 0, meta.FetchedRecordsCount)
+
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var obj Object
+        err = json.Unmarshal(resp.Value, &obj)
+        if err != nil {
+            return nil, err
+        }
+
+        // Skip over anything the object's own ACL hides from us.
+        if !s.canlistobject(ctx, myuser, bkt, &obj) {
+            continue
+        }
+
+        // Fill in this object.
+        lobj := ListingObject {
+            Key:        obj.Key,
+            Owner:      obj.Owner,
+            Size:       obj.Size,
+            CTime:      obj.CTime,
+            MD5Sum:     obj.MD5Sum,
+        }
+
+        if includeMeta {
+            lobj.Metadata = obj.Metadata
+            lobj.TypedMetadata = obj.TypedMetadata
+            lobj.Tags = obj.Tags
+            lobj.ID = obj.ID
+        }
+
+        objs = append(objs, lobj)
+    }
+
+    // Fill in the metadata wrapping the listing
+    rv := ObjectListing {
+        Bucket:         bucket,
+        Count:          uint64(len(objs)),
+        Token:          meta.Bookmark,
+        Objects:        objs,
+    }
+
+    return &rv, nil
+}
+
+// List the objects in a bucket owned by a particular user. Only the bucket's
+// owner (or an admin) can look at objects owned by someone else.
+func (s *SmartContract) ListObjectsByOwner(ctx contractapi.TransactionContextInterface,
+                                           bucket string, ownerUID string,
+                                           maxobjs uint32,
+                                           token string) (*ObjectListing, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    owner, err := s.GetUserByUID(ctx, ownerUID)
+    if err != nil {
+        return nil, err
+    }
+
+    if owner.ID != myuser.ID && bkt.Owner != myuser.ID && !isadmin(myuser) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    // Even looking at our own objects requires being able to list the bucket.
+    if !isadmin(myuser) && !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    querymap := make(map[string]interface{})
+    querymap["type"] = "Object"
+    querymap["bucket"] = bucket
+    querymap["owner"] = owner.ID
+
+    return s.listobjectsbyselector(ctx, myuser, bkt, querymap, maxobjs, true,
+                                   token)
+}
+
+// List the caller's own objects in a bucket. Since these are all objects the
+// caller owns, this doesn't need permission to list the bucket as a whole.
+func (s *SmartContract) ListMyObjectsInBucket(ctx contractapi.TransactionContextInterface,
+                                              bucket string, maxobjs uint32,
+                                              token string) (*ObjectListing, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    querymap := make(map[string]interface{})
+    querymap["type"] = "Object"
+    querymap["bucket"] = bucket
+    querymap["owner"] = myuser.ID
+
+    return s.listobjectsbyselector(ctx, myuser, bkt, querymap, maxobjs, true,
+                                   token)
+}
+
+// Run a CouchDB selector over the objects in a bucket and build a listing out
+// of the results, leaving out anything the caller can't see. The caller is
+// expected to have checked that they can list the bucket at all.
+func (s *SmartContract) listobjectsbyselector(ctx contractapi.TransactionContextInterface,
+                                              user *User, bkt *Bucket,
+                                              querymap map[string]interface{},
+                                              maxobjs uint32, includeMeta bool,
+                                              token string) (*ObjectListing, error) {
+    // Set a sane default on the maximum number of objects.
+    maxobjs = s.pagesize(maxobjs)
+
+    js, err := json.Marshal(querymap)
+    if err != nil {
+        return nil, err
+    }
+
+    dbquery := fmt.Sprintf(`{"selector":%s}`, js)
+    iter, meta, err := ctx.GetStub().GetQueryResultWithPagination(dbquery,
+            int32(maxobjs), token)
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    if meta.FetchedRecordsCount < 0 {
+        return nil, fmt.Errorf("Invalid response for object listing")
+    }
+
+    objs := make([]ListingObject, 0, meta.FetchedRecordsCount)
+
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var obj Object
+        err = json.Unmarshal(resp.Value, &obj)
+        if err != nil {
+            return nil, err
+        }
+
+        // Skip over anything the object's own ACL hides from us.
+        if !s.canlistobject(ctx, user, bkt, &obj) {
+            continue
+        }
+
+        // Fill in this object.
+        lobj := ListingObject {
+            Key:        obj.Key,
+            Owner:      obj.Owner,
+            Size:       obj.Size,
+            CTime:      obj.CTime,
+            MD5Sum:     obj.MD5Sum,
+        }
+
+        if includeMeta {
+            lobj.Metadata = obj.Metadata
+            lobj.TypedMetadata = obj.TypedMetadata
+            lobj.Tags = obj.Tags
+            lobj.ID = obj.ID
+        }
+
+        objs = append(objs, lobj)
     }
 
-    sidDr, _ := ctx.GetStub().CreateCompositeKey("DeletedObject", []string{bucket, obj.ID})
-    err = ctx.GetStub().PutState(sidDr, drJSON)
+    // Fill in the metadata wrapping the listing
+    rv := ObjectListing {
+        Bucket:         bkt.Name,
+        Count:          uint64(len(objs)),
+        Token:          meta.Bookmark,
+        Objects:        objs,
+    }
+
+    return &rv, nil
+}
+
+// List the objects in a bucket whose size falls between minSize and maxSize
+// (inclusive). A maxSize of zero leaves the top of the range open. On larger
+// buckets this wants a CouchDB index on ["type", "bucket", "size"], otherwise
+// every query ends up scanning the whole database.
+func (s *SmartContract) QueryObjectsBySize(ctx contractapi.TransactionContextInterface,
+                                           bucket string, minSize uint64,
+                                           maxSize uint64, maxobjs uint32,
+                                           token string) (*ObjectListing, error) {
+    myuser, err := s.GetMyUser(ctx)
     if err != nil {
-        return "", fmt.Errorf("failed to put delete record to world state. %v", err)
+        return nil, err
     }
 
-    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
-    err = ctx.GetStub().DelState(sid)
+    bkt, err := s.GetBucket(ctx, bucket)
     if err != nil {
-        ctx.GetStub().DelState(sidDr)
-        return "", fmt.Errorf("failed to delete from world state. %v", err)
+        return nil, err
     }
 
-    // Remove the object from any indexes it is in.
-    for k, v := range obj.Metadata {
-        idx, _ := s.getindex(ctx, myuser.ID, k, bucket)
-        if idx != nil {
-            s.removeobjectfromindex(ctx, idx.ID, v, key)
-        }
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
     }
 
-    // If the Index File flag is set, there was no data for this file on the
-    // backing store, so we're done already.
-    if indexFile {
-        return "true", nil
+    if maxSize != 0 && maxSize < minSize {
+        return nil, fmt.Errorf("invalid size range")
     }
 
-    err = s.S3client.RemoveObject(context.TODO(), bucket, key, minio.RemoveObjectOptions{})
-    if err != nil {
-        return "", nil
+    sizerange := map[string]uint64 { "$gte": minSize }
+    if maxSize != 0 {
+        sizerange["$lte"] = maxSize
     }
 
-    return "true", nil
+    querymap := make(map[string]interface{})
+    querymap["type"] = "Object"
+    querymap["bucket"] = bucket
+    querymap["size"] = sizerange
+
+    return s.listobjectsbyselector(ctx, myuser, bkt, querymap, maxobjs, true,
+                                   token)
 }
 
-func (s *SmartContract) RemoveDeleteRecord(ctx contractapi.TransactionContextInterface,
-                                           bucket string, id string) (bool, error) {
+// Find the objects in a bucket that don't have a given metadata key, so that
+// it can be filled in. This walks the bucket's objects directly rather than
+// asking CouchDB (which can't use an index for a missing field anyway), so
+// each call looks at up to maxobjs objects and returns the ones among them that
+// are missing the key -- a page may come back short or even empty while there
+// are still more to look at. Keep going until the returned token is empty.
+func (s *SmartContract) FindObjectsMissingField(ctx contractapi.TransactionContextInterface,
+                                                bucket string, field string,
+                                                maxobjs uint32,
+                                                token string) (*ObjectListing, error) {
+    // Set a sane default on the maximum number of objects.
+    maxobjs = s.pagesize(maxobjs)
+
     myuser, err := s.GetMyUser(ctx)
     if err != nil {
-        return false, err
+        return nil, err
     }
 
-    obj, err := s.GetDeleteRecord(ctx, bucket, id)
+    bkt, err := s.GetBucket(ctx, bucket)
     if err != nil {
-        return false, err
+        return nil, err
     }
 
-    // Only allow an owner to clear a delete record
-    if obj.Owner != myuser.ID {
-        return false, fmt.Errorf("permission denied")
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
     }
 
-    sidDr, _ := ctx.GetStub().CreateCompositeKey("DeletedObject", []string{bucket, id})
-    err = ctx.GetStub().DelState(sidDr)
-    if err != nil {
-        return false, fmt.Errorf("failed to remove delete record from world state. %v", err)
+    if field == "" {
+        return nil, fmt.Errorf("invalid metadata key")
     }
 
-    return true, nil
-}
-
-func (s *SmartContract) isbucketempty(ctx contractapi.TransactionContextInterface,
-                                      bucket string) (bool, error) {
-    iter, err := ctx.GetStub().GetStateByPartialCompositeKey("Object",
-            []string{bucket})
+    iter, meta, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination("Object",
+            []string{bucket}, int32(maxobjs), token)
     if err != nil {
-        return false, err
+        return nil, err
     }
     defer iter.Close()
 
-    return !iter.HasNext(), nil
+    objs := make([]ListingObject, 0)
+    count := 0
+
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        count++
+
+        var obj Object
+        err = json.Unmarshal(resp.Value, &obj)
+        if err != nil {
+            return nil, err
+        }
+
+        if _, ok := obj.Metadata[field]; ok {
+            continue
+        }
+
+        // Skip over anything the object's own ACL hides from us.
+        if !s.canlistobject(ctx, myuser, bkt, &obj) {
+            continue
+        }
+
+        objs = append(objs, ListingObject {
+            Key:        obj.Key,
+            Owner:      obj.Owner,
+            Size:       obj.Size,
+            CTime:      obj.CTime,
+            MD5Sum:     obj.MD5Sum,
+            Metadata:   obj.Metadata,
+        })
+    }
+
+    rv := ObjectListing {
+        Bucket:         bucket,
+        Count:          uint64(len(objs)),
+        Objects:        objs,
+    }
+
+    // A short page means there's nothing left.
+    if count >= int(maxobjs) {
+        rv.Token = meta.Bookmark
+    }
+
+    return &rv, nil
 }
 
-func (s *SmartContract) ListObjects(ctx contractapi.TransactionContextInterface,
-                                    bucket string, maxobjs uint32,
-                                    includeMeta bool,
-                                    token string) (*ObjectListing, error) {
+func (s *SmartContract) QueryObjectsByIndex(ctx contractapi.TransactionContextInterface,
+                                            bucket string, key string,
+                                            value string,
+                                            maxobjs uint32, includeMeta bool,
+                                            token string) (*ObjectListing, error) {
     // Set a sane default on the maximum number of objects.
-    if maxobjs == 0 || maxobjs > 1000 {
-        maxobjs = 1000
-    }
+    maxobjs = s.pagesize(maxobjs)
 
     myuser, err := s.GetMyUser(ctx)
     if err != nil {
@@ -463,33 +3386,24 @@ func (s *SmartContract) ListObjects(ctx contractapi.TransactionContextInterface,
         return nil, err
     }
 
-    // Test if the ACL says this is ok if this bucket isn't owned by the user.
-    if bkt.Owner != myuser.ID {
-        ok := false
-
-        if len(bkt.Permissions) != 0 {
-            ok = s.testaclaccess(ctx, bkt.Permissions, myuser.UID, bucket,
-                                 ACL_AccessType_List)
-        }
+    // Make sure the user is allowed to list the contents of the bucket.
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
+    }
 
-        if !ok {
-            return nil, fmt.Errorf("permission denied")
-        }
+    // Look for an appropriate index
+    idx, _ := s.getindex(ctx, myuser.ID, key, bucket)
+    if idx == nil {
+        return nil, fmt.Errorf("unknown index key")
     }
 
-    iter, meta, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination("Object",
-            []string{bucket}, int32(maxobjs), token)
+    // Get the iterator
+    iter, err := s.getindexiterator(ctx, idx.ID, value)
     if err != nil {
         return nil, err
     }
-    defer iter.Close()
-
-    if meta.FetchedRecordsCount < 0 {
-        return nil, fmt.Errorf("Invalid response for object listing")
-    }
 
-    objs := make([]ListingObject, meta.FetchedRecordsCount)
-    i := 0
+    objs := make([]ListingObject, 0)
 
     for iter.HasNext() {
         resp, err := iter.Next()
@@ -497,14 +3411,18 @@ func (s *SmartContract) ListObjects(ctx contractapi.TransactionContextInterface,
             return nil, err
         }
 
-        var obj Object
-        err = json.Unmarshal(resp.Value, &obj)
+        _, parts, err := ctx.GetStub().SplitCompositeKey(resp.Key)
+        if err != nil {
+            return nil, err
+        }
+
+        obj, err := s.GetObjectByPath(ctx, bucket, parts[2])
         if err != nil {
             return nil, err
         }
 
         // Fill in this object.
-        objs[i] = ListingObject {
+        lobj := ListingObject {
             Key:        obj.Key,
             Owner:      obj.Owner,
             Size:       obj.Size,
@@ -513,93 +3431,124 @@ func (s *SmartContract) ListObjects(ctx contractapi.TransactionContextInterface,
         }
 
         if includeMeta {
-            objs[i].Metadata = obj.Metadata
-            objs[i].Tags = obj.Tags
-            objs[i].ID = obj.ID
+            lobj.Metadata = obj.Metadata
+            lobj.Tags = obj.Tags
+            lobj.ID = obj.ID
         }
 
-        i++
+        objs = append(objs, lobj)
     }
 
     // Fill in the metadata wrapping the listing
     rv := ObjectListing {
         Bucket:         bucket,
-        Count:          uint64(meta.FetchedRecordsCount),
-        Token:          meta.Bookmark,
+        Count:          uint64(len(objs)),
+        Token:          "",
         Objects:        objs,
     }
 
     return &rv, nil
 }
 
-func (s *SmartContract) QueryObjects(ctx contractapi.TransactionContextInterface,
-                                     bucket string, query map[string]string,
-                                     maxobjs uint32, includeMeta bool,
-                                     token string) (*ObjectListing, error) {
-    // Set a sane default on the maximum number of objects.
-    if maxobjs == 0 || maxobjs > 1000 {
-        maxobjs = 1000
+// Set the class of an object (e.g, "document" or "image"). Classes are always
+// indexed, so objects can be looked up by class with QueryObjectsByClass. An
+// empty class clears it.
+func (s *SmartContract) SetObjectClass(ctx contractapi.TransactionContextInterface,
+                                       bucket string, key string,
+                                       class string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
     }
 
-    myuser, err := s.GetMyUser(ctx)
+    if strings.ContainsRune(class, 0) {
+        return false, fmt.Errorf("invalid class")
+    }
+
+    obj, err := s.getobject(ctx, bucket, key)
     if err != nil {
-        return nil, err
+        return false, err
     }
 
     bkt, err := s.GetBucket(ctx, bucket)
     if err != nil {
-        return nil, err
+        return false, err
     }
 
-    // Test if the ACL says this is ok if this bucket isn't owned by the user.
-    if bkt.Owner != myuser.ID {
-        ok := false
+    if bkt.ReadOnly {
+        return false, fmt.Errorf("bucket is read-only")
+    }
 
-        if len(bkt.Permissions) != 0 {
-            ok = s.testaclaccess(ctx, bkt.Permissions, myuser.UID, bucket,
-                                 ACL_AccessType_List)
-        }
+    // Test if the ACL says this is ok if this file isn't owned by the user.
+    if obj.Owner != myuser.ID {
+        ok := s.checkObjectAccess(ctx, obj, bkt, myuser.UID,
+                                  ACL_AccessType_Overwrite)
 
         if !ok {
-            return nil, fmt.Errorf("permission denied")
+            return false, fmt.Errorf("permission denied")
         }
     }
 
-    // Build up the metadata portion of the query...
-    querymap := make(map[string]string)
-    querymap["type"] = "Object"
-    querymap["bucket"] = bucket
+    if obj.Class == class {
+        return true, nil
+    }
 
-    if len(query) > 0 {
-        for k, v := range query {
-            // Prevent naughty queries....
-            if strings.Contains(k, "\"") {
-                return nil, fmt.Errorf("invalid query")
-            }
+    if obj.Class != "" {
+        err = s.removeobjectfromclass(ctx, bucket, obj.Class, key)
+        if err != nil {
+            return false, err
+        }
+    }
 
-            querymap["metadata." + k] = v
+    if class != "" {
+        err = s.addobjecttoclass(ctx, bucket, class, key)
+        if err != nil {
+            return false, err
         }
     }
 
-    js, err := json.Marshal(querymap)
+    obj.Class = class
+
+    sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
+    err = s.putStateChecked(ctx, sid, obj)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// List the objects in a bucket with the given class.
+func (s *SmartContract) QueryObjectsByClass(ctx contractapi.TransactionContextInterface,
+                                            bucket string, class string,
+                                            maxobjs uint32, includeMeta bool,
+                                            token string) (*ObjectListing, error) {
+    // Set a sane default on the maximum number of objects.
+    maxobjs = s.pagesize(maxobjs)
+
+    myuser, err := s.GetMyUser(ctx)
     if err != nil {
         return nil, err
     }
 
-    dbquery := fmt.Sprintf(`{"selector":%s}`, js)
-    iter, meta, err := ctx.GetStub().GetQueryResultWithPagination(dbquery,
-            int32(maxobjs), token)
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    // Make sure the user is allowed to list the contents of the bucket.
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    iter, meta, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination("ClassEntry",
+            []string{bucket, class}, int32(maxobjs), token)
     if err != nil {
         return nil, err
     }
     defer iter.Close()
 
-    if meta.FetchedRecordsCount < 0 {
-        return nil, fmt.Errorf("Invalid response for object listing")
-    }
-
-    objs := make([]ListingObject, meta.FetchedRecordsCount)
-    i := 0
+    objs := make([]ListingObject, 0)
 
     for iter.HasNext() {
         resp, err := iter.Next()
@@ -607,34 +3556,46 @@ func (s *SmartContract) QueryObjects(ctx contractapi.TransactionContextInterface
             return nil, err
         }
 
-        var obj Object
-        err = json.Unmarshal(resp.Value, &obj)
+        _, parts, err := ctx.GetStub().SplitCompositeKey(resp.Key)
         if err != nil {
             return nil, err
         }
 
+        obj, err := s.getobject(ctx, bucket, parts[2])
+        if err != nil {
+            // Skip over anything that's gone away without being cleaned up.
+            continue
+        }
+
+        // Skip over anything the object's own ACL hides from us.
+        if !s.canlistobject(ctx, myuser, bkt, obj) {
+            continue
+        }
+
         // Fill in this object.
-        objs[i] = ListingObject {
+        lobj := ListingObject {
             Key:        obj.Key,
             Owner:      obj.Owner,
             Size:       obj.Size,
             CTime:      obj.CTime,
             MD5Sum:     obj.MD5Sum,
+            Class:      obj.Class,
         }
 
         if includeMeta {
-            objs[i].Metadata = obj.Metadata
-            objs[i].Tags = obj.Tags
-            objs[i].ID = obj.ID
+            lobj.Metadata = obj.Metadata
+            lobj.TypedMetadata = obj.TypedMetadata
+            lobj.Tags = obj.Tags
+            lobj.ID = obj.ID
         }
 
-        i++
+        objs = append(objs, lobj)
     }
 
     // Fill in the metadata wrapping the listing
     rv := ObjectListing {
         Bucket:         bucket,
-        Count:          uint64(meta.FetchedRecordsCount),
+        Count:          uint64(len(objs)),
         Token:          meta.Bookmark,
         Objects:        objs,
     }
@@ -642,16 +3603,13 @@ func (s *SmartContract) QueryObjects(ctx contractapi.TransactionContextInterface
     return &rv, nil
 }
 
-func (s *SmartContract) QueryObjectsByIndex(ctx contractapi.TransactionContextInterface,
-                                            bucket string, key string,
-                                            value string,
-                                            maxobjs uint32, includeMeta bool,
-                                            token string) (*ObjectListing, error) {
-    // Set a sane default on the maximum number of objects.
-    if maxobjs == 0 || maxobjs > 1000 {
-        maxobjs = 1000
-    }
-
+// Put together everything that's happened to a key in a bucket, oldest first,
+// from the current object (if there is one) and the delete records left behind
+// by earlier objects under the same key. At most one page of delete records is
+// looked at.
+func (s *SmartContract) GetKeyTimeline(ctx contractapi.TransactionContextInterface,
+                                       bucket string,
+                                       key string) (*KeyTimeline, error) {
     myuser, err := s.GetMyUser(ctx)
     if err != nil {
         return nil, err
@@ -662,75 +3620,95 @@ func (s *SmartContract) QueryObjectsByIndex(ctx contractapi.TransactionContextIn
         return nil, err
     }
 
-    // Test if the ACL says this is ok if this bucket isn't owned by the user.
-    if bkt.Owner != myuser.ID {
-        ok := false
+    // Make sure the user is allowed to list the contents of the bucket.
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
+    }
 
-        if len(bkt.Permissions) != 0 {
-            ok = s.testaclaccess(ctx, bkt.Permissions, myuser.UID, bucket,
-                                 ACL_AccessType_List)
-        }
+    rv := KeyTimeline {
+        Bucket:     bucket,
+        Key:        key,
+        Events:     make([]KeyTimelineEvent, 0),
+    }
 
-        if !ok {
-            return nil, fmt.Errorf("permission denied")
-        }
+    // Leave out the current object if its own ACL hides it from us.
+    obj, _ := s.getobject(ctx, bucket, key)
+    if obj != nil && s.canlistobject(ctx, myuser, bkt, obj) {
+        rv.Exists = true
+        rv.Events = append(rv.Events, KeyTimelineEvent {
+            Event:      "created",
+            Time:       obj.CTime,
+            ID:         obj.ID,
+            Owner:      obj.Owner,
+            Size:       obj.Size,
+            MD5Sum:     obj.MD5Sum,
+        })
     }
 
-    // Look for an appropriate index
-    idx, _ := s.getindex(ctx, myuser.ID, key, bucket)
-    if idx == nil {
-        return nil, fmt.Errorf("unknown index key")
+    querymap := map[string]interface{} {
+        "type":     "DeletedObject",
+        "bucket":   bucket,
+        "key":      key,
     }
 
-    // Get the iterator
-    iter, err := s.getindexiterator(ctx, idx.ID, value)
+    js, err := json.Marshal(querymap)
     if err != nil {
         return nil, err
     }
 
-    objs := make([]ListingObject, 0)
+    pagesize := s.pagesize(0)
+    dbquery := fmt.Sprintf(`{"selector":%s}`, js)
+    iter, _, err := ctx.GetStub().GetQueryResultWithPagination(dbquery,
+            int32(pagesize), "")
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
 
+    count := uint32(0)
     for iter.HasNext() {
         resp, err := iter.Next()
         if err != nil {
             return nil, err
         }
 
-        _, parts, err := ctx.GetStub().SplitCompositeKey(resp.Key)
+        var dr DeleteRecord
+        err = json.Unmarshal(resp.Value, &dr)
         if err != nil {
             return nil, err
         }
 
-        obj, err := s.GetObjectByPath(ctx, bucket, parts[2])
-        if err != nil {
-            return nil, err
-        }
+        rv.Events = append(rv.Events, KeyTimelineEvent {
+            Event:      "created",
+            Time:       dr.CTime,
+            ID:         dr.ID,
+            Owner:      dr.Owner,
+            Size:       dr.Size,
+            MD5Sum:     dr.MD5Sum,
+        }, KeyTimelineEvent {
+            Event:      "deleted",
+            Time:       dr.DTime,
+            ID:         dr.ID,
+            Owner:      dr.Owner,
+            Deleter:    dr.Deleter,
+            Size:       dr.Size,
+            MD5Sum:     dr.MD5Sum,
+        })
+
+        count++
+    }
 
-        // Fill in this object.
-        lobj := ListingObject {
-            Key:        obj.Key,
-            Owner:      obj.Owner,
-            Size:       obj.Size,
-            CTime:      obj.CTime,
-            MD5Sum:     obj.MD5Sum,
-        }
+    rv.Truncated = count >= pagesize
 
-        if includeMeta {
-            lobj.Metadata = obj.Metadata
-            lobj.Tags = obj.Tags
-            lobj.ID = obj.ID
+    // Creations sort ahead of deletions that happen in the same second.
+    sort.SliceStable(rv.Events, func(i, j int) bool {
+        a, b := rv.Events[i], rv.Events[j]
+        if a.Time != b.Time {
+            return a.Time < b.Time
         }
 
-        objs = append(objs, lobj)
-    }
-
-    // Fill in the metadata wrapping the listing
-    rv := ObjectListing {
-        Bucket:         bucket,
-        Count:          uint64(len(objs)),
-        Token:          "",
-        Objects:        objs,
-    }
+        return a.Event == "created" && b.Event == "deleted"
+    })
 
     return &rv, nil
 }
@@ -740,9 +3718,7 @@ func (s *SmartContract) ListDeletedObjects(ctx contractapi.TransactionContextInt
                                            includeMeta bool,
                                            token string) (*ObjectListing, error) {
     // Set a sane default on the maximum number of objects.
-    if maxobjs == 0 || maxobjs > 1000 {
-        maxobjs = 1000
-    }
+    maxobjs = s.pagesize(maxobjs)
 
     myuser, err := s.GetMyUser(ctx)
     if err != nil {
@@ -754,18 +3730,9 @@ func (s *SmartContract) ListDeletedObjects(ctx contractapi.TransactionContextInt
         return nil, err
     }
 
-    // Test if the ACL says this is ok if this bucket isn't owned by the user.
-    if bkt.Owner != myuser.ID {
-        ok := false
-
-        if len(bkt.Permissions) != 0 {
-            ok = s.testaclaccess(ctx, bkt.Permissions, myuser.UID, bucket,
-                                 ACL_AccessType_List)
-        }
-
-        if !ok {
-            return nil, fmt.Errorf("permission denied")
-        }
+    // Make sure the user is allowed to list the contents of the bucket.
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
     }
 
     iter, meta, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination("DeletedObject",
@@ -825,12 +3792,11 @@ func (s *SmartContract) ListDeletedObjects(ctx contractapi.TransactionContextInt
 
 func (s *SmartContract) QueryDeleteRecords(ctx contractapi.TransactionContextInterface,
                                            bucket string, query map[string]string,
-                                           maxobjs uint32, includeMeta bool,
+                                           deleter string, maxobjs uint32,
+                                           includeMeta bool,
                                            token string) (*ObjectListing, error) {
     // Set a sane default on the maximum number of objects.
-    if maxobjs == 0 || maxobjs > 1000 {
-        maxobjs = 1000
-    }
+    maxobjs = s.pagesize(maxobjs)
 
     myuser, err := s.GetMyUser(ctx)
     if err != nil {
@@ -842,18 +3808,9 @@ func (s *SmartContract) QueryDeleteRecords(ctx contractapi.TransactionContextInt
         return nil, err
     }
 
-    // Test if the ACL says this is ok if this bucket isn't owned by the user.
-    if bkt.Owner != myuser.ID {
-        ok := false
-
-        if len(bkt.Permissions) != 0 {
-            ok = s.testaclaccess(ctx, bkt.Permissions, myuser.UID, bucket,
-                                 ACL_AccessType_List)
-        }
-
-        if !ok {
-            return nil, fmt.Errorf("permission denied")
-        }
+    // Make sure the user is allowed to list the contents of the bucket.
+    if !s.canlistbucket(ctx, myuser, bkt) {
+        return nil, fmt.Errorf("permission denied")
     }
 
     // Build up the metadata portion of the query...
@@ -861,6 +3818,16 @@ func (s *SmartContract) QueryDeleteRecords(ctx contractapi.TransactionContextInt
     querymap["type"] = "DeletedObject"
     querymap["bucket"] = bucket
 
+    // Narrow it down to one user's deletions, if asked.
+    if deleter != "" {
+        duser, err := s.GetUserByUID(ctx, deleter)
+        if err != nil {
+            return nil, err
+        }
+
+        querymap["deleter"] = duser.ID
+    }
+
     if len(query) > 0 {
         for k, v := range query {
             // Prevent naughty queries....
@@ -933,10 +3900,255 @@ func (s *SmartContract) QueryDeleteRecords(ctx contractapi.TransactionContextInt
     return &rv, nil
 }
 
+// Write out a manifest of every object in a bucket to the backing store and
+// hand back a URL to download it from. The manifest always goes in the same
+// place, so each export replaces the last one rather than piling up.
+func (s *SmartContract) ExportBucketManifest(ctx contractapi.TransactionContextInterface,
+                                             bucket string) (string, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return "", err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return "", err
+    }
+
+    if bkt.Owner != myuser.ID {
+        return "", fmt.Errorf("permission denied")
+    }
+
+    iter, err := ctx.GetStub().GetStateByPartialCompositeKey("Object",
+            []string{bucket})
+    if err != nil {
+        return "", err
+    }
+    defer iter.Close()
+
+    manifest := make([]ManifestEntry, 0)
+    for iter.HasNext() {
+        resp, err := iter.Next()
+        if err != nil {
+            return "", err
+        }
+
+        var obj Object
+        err = json.Unmarshal(resp.Value, &obj)
+        if err != nil {
+            return "", err
+        }
+
+        manifest = append(manifest, ManifestEntry {
+            Key:        obj.Key,
+            Size:       obj.Size,
+            MD5Sum:     obj.MD5Sum,
+            Metadata:   obj.Metadata,
+        })
+    }
+
+    js, err := json.Marshal(manifest)
+    if err != nil {
+        return "", err
+    }
+
+    key := ".manifests/manifest.json"
+    _, err = s.S3client.PutObject(context.TODO(), bucket, key,
+                                  bytes.NewReader(js), int64(len(js)),
+                                  minio.PutObjectOptions{
+                                      ContentType: "application/json",
+                                  })
+    if err != nil {
+        return "", err
+    }
+
+    ps, err := s.S3client.PresignedGetObject(context.TODO(), bucket, key,
+                                             time.Duration(10) * time.Second,
+                                             url.Values{})
+    if err != nil {
+        return "", err
+    }
+
+    return s.publicurl(ps)
+}
+
+// Does the data on the backing store at the given key match the size and
+// checksum we have for it? The checksum of multipart uploads can't be checked,
+// so only their size is.
+func (s *SmartContract) s3dataintact(bucket string, key string,
+                                     md5sum string, size uint64) (bool, error) {
+    info, err := s.S3client.StatObject(context.TODO(), bucket, key,
+                                       minio.StatObjectOptions{})
+    if err != nil {
+        if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+            return false, nil
+        }
+
+        return false, err
+    }
+
+    if uint64(info.Size) != size {
+        return false, nil
+    }
+
+    etag := strings.Trim(info.ETag, "\"")
+    if strings.Contains(etag, "-") {
+        return true, nil
+    }
+
+    return strings.EqualFold(etag, md5sum), nil
+}
+
+// Register objects that were uploaded to the backing store out-of-band from a
+// manifest (in the same format ExportBucketManifest writes) stored in the
+// bucket.
+func (s *SmartContract) ImportBucketManifest(ctx contractapi.TransactionContextInterface,
+                                             bucket string, manifestKey string,
+                                             overwrite bool) (*ImportSummary, error) {
+    _, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return nil, err
+    }
+
+    mobj, err := s.S3client.GetObject(context.TODO(), bucket, manifestKey,
+                                      minio.GetObjectOptions{})
+    if err != nil {
+        return nil, err
+    }
+    defer mobj.Close()
+
+    var manifest []ManifestEntry
+    err = json.NewDecoder(mobj).Decode(&manifest)
+    if err != nil {
+        return nil, fmt.Errorf("invalid manifest: %v", err)
+    }
+
+    rv := ImportSummary {
+        Errors:         make(map[string]string),
+    }
+
+    // We won't see our own writes in this transaction, so keep track of what
+    // we've done ourselves.
+    seen := map[string]bool{}
+
+    for _, ent := range manifest {
+        if ent.Key == "" {
+            rv.Failed++
+            continue
+        } else if ent.MD5Sum == "" {
+            rv.Failed++
+            rv.Errors[ent.Key] = "missing md5sum"
+            continue
+        }
+
+        if seen[ent.Key] {
+            rv.Skipped++
+            continue
+        }
+
+        seen[ent.Key] = true
+
+        if !overwrite {
+            tmp, _ := s.getobject(ctx, bucket, ent.Key)
+            if tmp != nil {
+                rv.Skipped++
+                continue
+            }
+        }
+
+        // Only register objects whose data really is there, as described.
+        ok, err := s.s3dataintact(bucket, ent.Key, ent.MD5Sum, ent.Size)
+        if err != nil {
+            rv.Failed++
+            rv.Errors[ent.Key] = err.Error()
+            continue
+        } else if !ok {
+            rv.Failed++
+            rv.Errors[ent.Key] = "data missing or doesn't match manifest"
+            continue
+        }
+
+        _, err = s.createobject(ctx, bucket, ent.Key, ent.Size, ent.MD5Sum,
+                                ent.Metadata, make([]string, 0), "", 0, false,
+                                overwrite)
+        if err != nil {
+            rv.Failed++
+            rv.Errors[ent.Key] = err.Error()
+            continue
+        }
+
+        rv.Created++
+    }
+
+    return &rv, nil
+}
+
+// Check a client's report of a finished upload against what the object's record
+// says should have been uploaded, and against the backing store when there is
+// one. Returns whether it is fine to go ahead and commit the object.
+func (s *SmartContract) ValidateUploadCompletion(ctx contractapi.TransactionContextInterface,
+                                                 bucket string, key string,
+                                                 declaredMD5 string,
+                                                 declaredSize uint64) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    obj, err := s.getobject(ctx, bucket, key)
+    if err != nil {
+        return false, err
+    }
+
+    if obj.Owner != myuser.ID {
+        bkt, err := s.GetBucket(ctx, bucket)
+        if err != nil {
+            return false, err
+        }
+
+        ok := s.checkObjectAccess(ctx, obj, bkt, myuser.UID,
+                                  ACL_AccessType_Overwrite)
+
+        if !ok {
+            return false, fmt.Errorf("permission denied")
+        }
+    }
+
+    if (obj.Flags & ObjectFlag_IndexOnly) != 0 {
+        return false, fmt.Errorf("object has no data")
+    }
+
+    if declaredSize != obj.Size || !strings.EqualFold(declaredMD5, obj.MD5Sum) {
+        return false, nil
+    }
+
+    if s.S3client == nil {
+        return true, nil
+    }
+
+    return s.s3dataintact(bucket, objectdatakey(obj), obj.MD5Sum, obj.Size)
+}
+
+// Call this once a CreateObject's upload is done, or straight away if there
+// was nothing to upload. Any data the object replaced is only removed here.
 func (s *SmartContract) CommitObjectRequest(ctx contractapi.TransactionContextInterface,
                                             bucket string, key string) error {
     // XXX: permission check
 
+    err := validateobjectpath(bucket, key)
+    if err != nil {
+        return err
+    }
+
+    bkt, err := s.GetBucket(ctx, bucket)
+    if err != nil {
+        return err
+    }
+
+    if bkt.ReadOnly {
+        return fmt.Errorf("bucket is read-only")
+    }
+
     sid, _ := ctx.GetStub().CreateCompositeKey("Object", []string{bucket, key})
     objJSON, err := ctx.GetStub().GetState(sid)
     if err != nil {
@@ -951,17 +4163,17 @@ func (s *SmartContract) CommitObjectRequest(ctx contractapi.TransactionContextIn
         return err
     }
 
-    // Remove the staged flag if it is set.
-    if (obj.Flags & ObjectFlag_Staged) != 0 {
-        obj.Flags &= ^ObjectFlag_Staged
-        objJSON, err = json.Marshal(obj)
-        if err != nil {
-            return err
-        }
+    if (obj.Flags & ObjectFlag_Staged) == 0 && len(obj.StaleData) == 0 {
+        return nil
+    }
 
-        err = ctx.GetStub().PutState(sid, objJSON)
+    // Now that the new record is in place, anything it replaced can go.
+    err = s.removestaledata(ctx, &obj)
+    if err != nil {
+        return err
     }
 
-    return err
+    // Remove the staged flag if it is set.
+    obj.Flags &= ^ObjectFlag_Staged
+    return s.putStateChecked(ctx, sid, obj)
 }
-
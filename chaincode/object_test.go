@@ -0,0 +1,3212 @@
+/*
+    Copyright (C) 2024 Lawrence Sebald
+    All Rights Reserved
+*/
+package chaincode
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "reflect"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/hyperledger/fabric-chaincode-go/v2/shim"
+)
+
+func TestGetObjectByPathHasData(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+
+    env.putobject("alice", "bucket-a", "data.txt", "hello", nil, false)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.CreateEmptyObject(ctx, "bucket-a", "index.txt", nil, nil,
+                                        "", false)
+    })
+
+    tests := []struct {
+        key     string
+        want    bool
+    }{
+        {"data.txt", true},
+        {"index.txt", false},
+    }
+
+    for _, tc := range tests {
+        obj := mustcall(env, "alice", func(ctx txctx) (*Object, error) {
+            return env.cc.GetObjectByPath(ctx, "bucket-a", tc.key)
+        })
+
+        if obj.HasData != tc.want {
+            t.Errorf("%s: HasData = %v, want %v", tc.key, obj.HasData, tc.want)
+        }
+    }
+}
+
+func TestQueryMyObjectsAcrossBuckets(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+    env.addbucket("alice", "bucket-b")
+    env.addbucket("bob", "bucket-c")
+
+    x := map[string]string{"project": "x"}
+    env.putobject("alice", "bucket-a", "1.txt", "one", x, false)
+    env.putobject("alice", "bucket-b", "2.txt", "two", x, false)
+    env.putobject("alice", "bucket-b", "3.txt", "three",
+                  map[string]string{"project": "y"}, false)
+    env.putobject("bob", "bucket-c", "4.txt", "four", x, false)
+
+    rv := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+        return env.cc.QueryMyObjects(ctx, x, 0, "")
+    })
+
+    got := map[string]string{}
+    for _, o := range rv.Objects {
+        got[o.Key] = o.Bucket
+    }
+
+    want := map[string]string{"1.txt": "bucket-a", "2.txt": "bucket-b"}
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("QueryMyObjects found %v, want %v", got, want)
+    }
+}
+
+func TestTouchObject(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    before := env.putobject("alice", "bucket-a", "a.txt", "hello", nil, false)
+    env.advance(time.Hour)
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.TouchObject(ctx, "bucket-a", "a.txt")
+    })
+
+    after := env.getobject("bucket-a", "a.txt")
+    if after.MTime != env.now() || after.ATime != env.now() {
+        t.Errorf("times after touch = %d/%d, want %d", after.MTime, after.ATime,
+                 env.now())
+    } else if after.MTime <= before.MTime {
+        t.Errorf("mtime didn't advance")
+    }
+
+    if after.CTime != before.CTime || after.MD5Sum != before.MD5Sum ||
+       after.Size != before.Size || after.ID != before.ID {
+        t.Errorf("touch changed more than the times: %+v -> %+v", before, after)
+    }
+
+    env.checkdata("bucket-a", "a.txt", "hello")
+
+    _, err := call(env, "bob", func(ctx txctx) (bool, error) {
+        return env.cc.TouchObject(ctx, "bucket-a", "a.txt")
+    })
+    if err == nil {
+        t.Errorf("user without overwrite access touched the object")
+    }
+}
+
+func TestRestoreObjectAs(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+
+    old := env.putobject("alice", "bucket-a", "a.txt", "old", nil, false)
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.RemoveObject(ctx, "bucket-a", "a.txt")
+    })
+    env.advance(time.Hour)
+    cur := env.putobject("alice", "bucket-a", "a.txt", "new", nil, false)
+
+    restore := func(id string, key string, overwrite bool) (string, error) {
+        return call(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.RestoreObjectAs(ctx, "bucket-a", id, key, overwrite)
+        })
+    }
+
+    // The original key is taken now, so it can't be restored there blindly.
+    _, err := restore(old.ID, "", false)
+    if err == nil {
+        t.Errorf("restore over an existing object without overwrite succeeded")
+    }
+
+    if obj := env.getobject("bucket-a", "a.txt"); obj.ID != cur.ID {
+        t.Errorf("failed restore replaced the current object")
+    }
+
+    ps, err := restore(old.ID, "b.txt", false)
+    if err != nil {
+        t.Fatalf("restore to a fresh key failed: %v", err)
+    } else if ps == "" {
+        t.Fatalf("restore of an object with data didn't return an upload URL")
+    }
+
+    env.s3.put("bucket-a", "b.txt", []byte("old"))
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return true, env.cc.CommitObjectRequest(ctx, "bucket-a", "b.txt")
+    })
+
+    obj := env.getobject("bucket-a", "b.txt")
+    if obj.MD5Sum != old.MD5Sum || obj.CTime != old.CTime {
+        t.Errorf("restored object = %+v, want to match %+v", obj, old)
+    }
+
+    _, err = call(env, "alice", func(ctx txctx) (*DeleteRecord, error) {
+        return env.cc.GetDeleteRecord(ctx, "bucket-a", old.ID)
+    })
+    if err == nil {
+        t.Errorf("delete record still around after restoring")
+    }
+
+    // With overwrite set, restoring over an occupied key is fine.
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.RemoveObject(ctx, "bucket-a", "b.txt")
+    })
+
+    _, err = restore(obj.ID, "a.txt", true)
+    if err != nil {
+        t.Errorf("restore with overwrite failed: %v", err)
+    } else if got := env.getobject("bucket-a", "a.txt"); got.MD5Sum != old.MD5Sum {
+        t.Errorf("overwriting restore left %+v in place", got)
+    }
+}
+
+func TestOwnerListingIgnoresObjectACLs(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+
+    env.createacl("alice", "shared", map[string]uint32{
+        "bob":      ACL_Perms_ListObjects | ACL_Perms_ReadObject,
+        "carol":    ACL_Perms_ListObjects | ACL_Perms_CreateObject,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "shared")
+    })
+
+    // Nobody but carol is listed on the ACL of carol's object.
+    env.createacl("carol", "private", map[string]uint32{
+        "carol":    ACL_Perms_ListObjects | ACL_Perms_ReadObject,
+    }, nil)
+    mustcall(env, "carol", func(ctx txctx) (bool, error) {
+        return env.cc.CreateEmptyObject(ctx, "bucket-a", "carol.txt",
+                                        map[string]string{"k": "v"}, nil,
+                                        "private", false)
+    })
+    env.putobject("alice", "bucket-a", "open.txt", "data",
+                  map[string]string{"k": "v"}, false)
+
+    keys := func(l *ObjectListing) map[string]bool {
+        rv := map[string]bool{}
+        for _, o := range l.Objects {
+            rv[o.Key] = true
+        }
+        return rv
+    }
+
+    tests := []struct {
+        user    string
+        want    map[string]bool
+    }{
+        {"alice", map[string]bool{"carol.txt": true, "open.txt": true}},
+        {"carol", map[string]bool{"carol.txt": true, "open.txt": true}},
+        {"bob", map[string]bool{"open.txt": true}},
+    }
+
+    for _, tc := range tests {
+        l := mustcall(env, tc.user, func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.ListObjects(ctx, "bucket-a", 0, false, 0, 0, "")
+        })
+        if got := keys(l); !reflect.DeepEqual(got, tc.want) ||
+           l.Count != uint64(len(tc.want)) {
+            t.Errorf("ListObjects as %s = %v (count %d), want %v", tc.user,
+                     got, l.Count, tc.want)
+        }
+
+        q := mustcall(env, tc.user, func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.QueryObjects(ctx, "bucket-a",
+                                       map[string]string{"k": "v"}, 0, false,
+                                       "")
+        })
+        if got := keys(q); !reflect.DeepEqual(got, tc.want) {
+            t.Errorf("QueryObjects as %s = %v, want %v", tc.user, got, tc.want)
+        }
+    }
+}
+
+func TestQueryObjectsAdvancedNumeric(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+
+    // As strings, "10" sorts before "9", so this only works with real numbers.
+    counts := map[string]interface{}{"a.txt": 3, "b.txt": 9, "c.txt": 10,
+                                     "d.txt": 25.5}
+    for k, v := range counts {
+        env.putobject("alice", "bucket-a", k, "data", nil, false)
+        mustcall(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.SetObjectTypedMetadata(ctx, "bucket-a", k,
+                    map[string]interface{}{"count": v, "ok": true})
+        })
+    }
+
+    rv := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+        return env.cc.QueryObjectsAdvanced(ctx, "bucket-a",
+                map[string]interface{}{
+                    "count":    map[string]interface{}{"$gt": 5},
+                    "ok":       true,
+                }, 0, true, "")
+    })
+
+    got := map[string]bool{}
+    for _, o := range rv.Objects {
+        got[o.Key] = true
+    }
+
+    want := map[string]bool{"b.txt": true, "c.txt": true, "d.txt": true}
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("count > 5 matched %v, want %v", got, want)
+    }
+}
+
+func TestTypedMetadataFollowsSchema(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+    env.putobject("alice", "bucket-a", "a.txt", "data",
+                  map[string]string{"project": "x"}, false)
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketMetadataSchema(ctx, "bucket-a", &MetadataSchema{
+            Required:   []string{"project"},
+            Patterns:   map[string]string{"year": `^[0-9]{4}$`},
+        })
+    })
+
+    set := func(md map[string]interface{}) error {
+        _, err := call(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.SetObjectTypedMetadata(ctx, "bucket-a", "a.txt", md)
+        })
+        return err
+    }
+
+    if err := set(map[string]interface{}{"year": 2024}); err != nil {
+        t.Errorf("conforming typed metadata rejected: %v", err)
+    }
+
+    if err := set(map[string]interface{}{"year": 24}); err == nil {
+        t.Errorf("typed value not matching its pattern accepted")
+    }
+
+    if err := set(map[string]interface{}{"year": "twenty"}); err == nil {
+        t.Errorf("typed string not matching its pattern accepted")
+    }
+
+    obj := env.getobject("bucket-a", "a.txt")
+    if obj.TypedMetadata["year"] != float64(2024) {
+        t.Errorf("typed metadata = %v after rejected updates",
+                 obj.TypedMetadata)
+    }
+}
+
+// Run lifecycle sweeps over a bucket until they've covered all of it.
+func (e *testenv) sweep(user string, bucket string) LifecycleResult {
+    e.t.Helper()
+
+    var total LifecycleResult
+    token := ""
+    for {
+        rv := mustcall(e, user, func(ctx txctx) (*LifecycleResult, error) {
+            return e.cc.ApplyLifecycle(ctx, bucket, token)
+        })
+
+        total.Expired += rv.Expired
+        total.Pinned += rv.Pinned
+        total.Retained += rv.Retained
+        total.Purged += rv.Purged
+
+        if rv.Token == "" {
+            return total
+        }
+
+        token = rv.Token
+    }
+}
+
+func TestPinnedObjectSurvivesLifecycle(t *testing.T) {
+    env := newtestenv(t)
+    env.cc.DefaultPageSize = 2
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketExpiry(ctx, "bucket-a", 86400)
+    })
+
+    env.putobject("alice", "bucket-a", "a.txt", "pinned", nil, false)
+    env.putobject("alice", "bucket-a", "b.txt", "unpinned", nil, false)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.PinObject(ctx, "bucket-a", "a.txt")
+    })
+
+    _, err := call(env, "bob", func(ctx txctx) (bool, error) {
+        return env.cc.UnpinObject(ctx, "bucket-a", "a.txt")
+    })
+    if err == nil {
+        t.Errorf("unrelated user unpinned an object")
+    }
+
+    env.advance(48 * time.Hour)
+    env.putobject("alice", "bucket-a", "c.txt", "fresh", nil, false)
+
+    // The first sweep only gets through two of the three objects.
+    first := mustcall(env, "alice", func(ctx txctx) (*LifecycleResult, error) {
+        return env.cc.ApplyLifecycle(ctx, "bucket-a", "")
+    })
+    if first.Token == "" || first.Expired != 1 || first.Pinned != 1 {
+        t.Errorf("first sweep = %+v, want one expired, one pinned and a token",
+                 first)
+    }
+
+    if rest := env.sweep("alice", "bucket-a"); rest.Expired != 0 {
+        t.Errorf("later sweep expired %d more objects", rest.Expired)
+    }
+
+    if env.getobject("bucket-a", "a.txt") == nil {
+        t.Errorf("pinned object removed by the sweep")
+    }
+    env.checkdata("bucket-a", "a.txt", "pinned")
+
+    if env.getobject("bucket-a", "b.txt") != nil {
+        t.Errorf("expired object survived the sweep")
+    }
+    env.checkdata("bucket-a", "b.txt", "")
+
+    if env.getobject("bucket-a", "c.txt") == nil {
+        t.Errorf("recently modified object removed by the sweep")
+    }
+
+    // Pinning only holds off the sweep; the object can still be removed.
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.RemoveObject(ctx, "bucket-a", "a.txt")
+    })
+    if env.getobject("bucket-a", "a.txt") != nil {
+        t.Errorf("pinned object couldn't be removed explicitly")
+    }
+}
+
+func TestRetainTagSurvivesLifecycle(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketExpiry(ctx, "bucket-a", 86400)
+    })
+
+    settag := func(user string, tag string) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.SetBucketRetainTag(ctx, "bucket-a", tag)
+        })
+        return err
+    }
+
+    if err := settag("alice", "retain"); err != nil {
+        t.Fatalf("SetBucketRetainTag: %v", err)
+    }
+    if settag("bob", "") == nil {
+        t.Error("bob changed the retain tag on alice's bucket")
+    }
+    if settag("alice", "bad\x00tag") == nil {
+        t.Error("retain tag with the key separator accepted")
+    }
+
+    for key, tags := range map[string][]string{
+        "keep.txt":     {"report", "retain"},
+        "drop.txt":     {"report"},
+    } {
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.CreateObject(ctx, "bucket-a", key, 4, md5hex("data"),
+                                       nil, tags, "", false)
+        })
+        env.s3.put("bucket-a", key, []byte("data"))
+        mustcall(env, "alice", func(ctx txctx) (bool, error) {
+            return true, env.cc.CommitObjectRequest(ctx, "bucket-a", key)
+        })
+    }
+
+    env.advance(48 * time.Hour)
+
+    rv := env.sweep("alice", "bucket-a")
+    if rv.Expired != 1 || rv.Retained != 1 {
+        t.Errorf("sweep = %+v, want one expired and one retained", rv)
+    }
+
+    if env.getobject("bucket-a", "keep.txt") == nil {
+        t.Error("object with the retain tag removed by the sweep")
+    }
+    env.checkdata("bucket-a", "keep.txt", "data")
+
+    if env.getobject("bucket-a", "drop.txt") != nil {
+        t.Error("object without the retain tag survived the sweep")
+    }
+
+    // The tag only means something while the bucket says it does.
+    if err := settag("alice", ""); err != nil {
+        t.Fatalf("clearing the retain tag: %v", err)
+    }
+
+    rv = env.sweep("alice", "bucket-a")
+    if rv.Expired != 1 || env.getobject("bucket-a", "keep.txt") != nil {
+        t.Errorf("sweep after clearing the retain tag = %+v", rv)
+    }
+}
+func TestExportBucketManifest(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    env.putobject("alice", "bucket-a", "a.txt", "hello",
+                  map[string]string{"project": "x"}, false)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.CreateEmptyObject(ctx, "bucket-a", "dir/", nil, nil, "",
+                                        false)
+    })
+
+    _, err := call(env, "bob", func(ctx txctx) (string, error) {
+        return env.cc.ExportBucketManifest(ctx, "bucket-a")
+    })
+    if err == nil {
+        t.Errorf("non-owner exported a bucket manifest")
+    }
+
+    ps := mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.ExportBucketManifest(ctx, "bucket-a")
+    })
+
+    u, err := url.Parse(ps)
+    if err != nil {
+        t.Fatalf("bad manifest URL %q: %v", ps, err)
+    } else if u.Path != "/bucket-a/.manifests/manifest.json" ||
+              u.Query().Get("X-Amz-Expires") == "" {
+        t.Errorf("manifest URL %q isn't a presigned link to the manifest", ps)
+    }
+
+    resp, err := http.Get(ps)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+
+    var manifest []ManifestEntry
+    err = json.NewDecoder(resp.Body).Decode(&manifest)
+    if err != nil {
+        t.Fatalf("couldn't decode the manifest: %v", err)
+    }
+
+    want := []ManifestEntry{
+        {"a.txt", 5, md5hex("hello"), map[string]string{"project": "x"}},
+        {"dir/", 0, md5hex(""), nil},
+    }
+    if !reflect.DeepEqual(manifest, want) {
+        t.Errorf("manifest = %+v, want %+v", manifest, want)
+    }
+
+    // A later export replaces the manifest rather than adding another one.
+    env.putobject("alice", "bucket-a", "b.txt", "world", nil, false)
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.ExportBucketManifest(ctx, "bucket-a")
+    })
+
+    n := 0
+    for k := range env.s3.objs {
+        if strings.HasPrefix(k, "bucket-a/.manifests/") {
+            n++
+        }
+    }
+    if n != 1 {
+        t.Errorf("%d manifests on the backing store, want 1", n)
+    }
+
+    data, _ := env.s3.get("bucket-a", ".manifests/manifest.json")
+    if !strings.Contains(string(data), `"b.txt"`) {
+        t.Errorf("latest manifest doesn't include the new object: %s", data)
+    }
+
+    // Nothing else is allowed to land where the manifests go.
+    _, err = call(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "bucket-a", ".manifests/manifest.json",
+                                   4, md5hex("data"), nil, nil, "", true)
+    })
+    if err == nil {
+        t.Errorf("object created under the reserved manifest prefix")
+    }
+}
+
+func TestImportBucketManifest(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+    env.createindex("alice", "project", "bucket-a")
+
+    env.putobject("alice", "bucket-a", "old.txt", "old", nil, false)
+
+    // Everything but missing.txt and short.txt was uploaded as described.
+    env.s3.put("bucket-a", "a.txt", []byte("hello"))
+    env.s3.put("bucket-a", "short.txt", []byte("hell"))
+
+    x := map[string]string{"project": "x"}
+    manifest, _ := json.Marshal([]ManifestEntry{
+        {"a.txt", 5, md5hex("hello"), x},
+        {"missing.txt", 5, md5hex("hello"), nil},
+        {"short.txt", 5, md5hex("hello"), nil},
+        {"old.txt", 3, md5hex("old"), nil},
+        {"nosum.txt", 5, "", nil},
+        {"", 5, md5hex("hello"), nil},
+    })
+    env.s3.put("bucket-a", "import.json", manifest)
+
+    rv := mustcall(env, "alice", func(ctx txctx) (*ImportSummary, error) {
+        return env.cc.ImportBucketManifest(ctx, "bucket-a", "import.json",
+                                           false)
+    })
+
+    if rv.Created != 1 || rv.Skipped != 1 || rv.Failed != 4 {
+        t.Errorf("import summary = %+v", rv)
+    }
+
+    for _, key := range []string{"missing.txt", "short.txt", "nosum.txt"} {
+        if rv.Errors[key] == "" {
+            t.Errorf("no error reported for %s", key)
+        }
+
+        if env.getobject("bucket-a", key) != nil {
+            t.Errorf("%s registered despite failing", key)
+        }
+    }
+
+    obj := env.getobject("bucket-a", "a.txt")
+    if obj == nil {
+        t.Fatalf("a.txt wasn't registered")
+    } else if obj.MD5Sum != md5hex("hello") || obj.Size != 5 ||
+              (obj.Flags & ObjectFlag_Staged) != 0 ||
+              !reflect.DeepEqual(obj.Metadata, x) {
+        t.Errorf("registered object = %+v", obj)
+    }
+
+    found := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+        return env.cc.QueryObjectsByIndex(ctx, "bucket-a", "project", "x", 0,
+                                          false, "")
+    })
+    if len(found.Objects) != 1 || found.Objects[0].Key != "a.txt" {
+        t.Errorf("index lookup after import = %+v", found.Objects)
+    }
+}
+
+func TestHeadObjectChecksData(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+
+    env.putobject("alice", "bucket-a", "present.txt", "hello", nil, false)
+    env.putobject("alice", "bucket-a", "lost.txt", "hello", nil, false)
+    env.s3.remove("bucket-a", "lost.txt")
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.CreateEmptyObject(ctx, "bucket-a", "index.txt", nil, nil,
+                                        "", false)
+    })
+
+    tests := []struct {
+        key         string
+        check       bool
+        want        ObjectHead
+    }{
+        {"present.txt", true, ObjectHead{DataChecked: true, DataPresent: true,
+                                         DataSize: 5}},
+        {"lost.txt", true, ObjectHead{DataChecked: true}},
+        {"lost.txt", false, ObjectHead{}},
+        {"index.txt", true, ObjectHead{}},
+    }
+
+    for _, tc := range tests {
+        rv := mustcall(env, "alice", func(ctx txctx) (*ObjectHead, error) {
+            return env.cc.HeadObject(ctx, "bucket-a", tc.key, tc.check)
+        })
+
+        if rv.Object == nil || rv.Object.Key != tc.key {
+            t.Errorf("%s: head returned object %+v", tc.key, rv.Object)
+        }
+
+        rv.Object = nil
+        if *rv != tc.want {
+            t.Errorf("%s (check %v) = %+v, want %+v", tc.key, tc.check, *rv,
+                     tc.want)
+        }
+    }
+}
+
+func TestOverwriteModes(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "replace")
+    env.addbucket("alice", "version")
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketOverwriteMode(ctx, "version",
+                                             Bucket_OverwriteMode_Version)
+    })
+
+    _, err := call(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketOverwriteMode(ctx, "replace", 42)
+    })
+    if err == nil {
+        t.Errorf("invalid overwrite mode accepted")
+    }
+
+    versions := func(bucket string) []*Object {
+        l := mustcall(env, "alice", func(ctx txctx) (*VersionListing, error) {
+            return env.cc.ListObjectVersions(ctx, bucket, "a.txt", 0, "")
+        })
+        return l.Versions
+    }
+
+    for _, bucket := range []string{"replace", "version"} {
+        env.putobject("alice", bucket, "a.txt", "one", nil, false)
+        env.putobject("alice", bucket, "a.txt", "two", nil, true)
+        env.checkdata(bucket, "a.txt", "two")
+    }
+
+    if vers := versions("replace"); len(vers) != 0 {
+        t.Errorf("replace mode kept %d versions", len(vers))
+    }
+
+    vers := versions("version")
+    if len(vers) != 1 {
+        t.Fatalf("version mode kept %d versions, want 1", len(vers))
+    } else if vers[0].MD5Sum != md5hex("one") || !vers[0].HasData ||
+              !strings.HasPrefix(vers[0].DataKey, ".versions/a.txt/") {
+        t.Errorf("version = %+v", vers[0])
+    }
+    env.checkdata("version", vers[0].DataKey, "one")
+
+    for k := range env.s3.objs {
+        if strings.HasPrefix(k, "replace/.versions/") {
+            t.Errorf("replace mode left old data at %s", k)
+        }
+    }
+
+    _, err = call(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "version", vers[0].DataKey, 4,
+                                   md5hex("data"), nil, nil, "", true)
+    })
+    if err == nil {
+        t.Errorf("object created over archived version data")
+    }
+}
+
+func TestOverwriteCleansUpOldData(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+    env.addbucket("alice", "bucket-v")
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketOverwriteMode(ctx, "bucket-v",
+                                             Bucket_OverwriteMode_Version)
+    })
+
+    // Until the new data shows up, the old data stays put.
+    env.putobject("alice", "bucket-a", "a.txt", "old", nil, false)
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "bucket-a", "a.txt", 3, md5hex("new"),
+                                   nil, nil, "", true)
+    })
+    env.checkdata("bucket-a", "a.txt", "old")
+
+    env.s3.put("bucket-a", "a.txt", []byte("new"))
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return true, env.cc.CommitObjectRequest(ctx, "bucket-a", "a.txt")
+    })
+    env.checkdata("bucket-a", "a.txt", "new")
+
+    // Replacing an object with one that has no data leaves nothing behind
+    // once the new record is committed.
+    for _, bucket := range []string{"bucket-a", "bucket-v"} {
+        env.putobject("alice", bucket, "b.txt", "data", nil, false)
+        mustcall(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.CreateEmptyObject(ctx, bucket, "b.txt", nil, nil, "",
+                                            true)
+        })
+        env.checkdata(bucket, "b.txt", "data")
+
+        mustcall(env, "alice", func(ctx txctx) (bool, error) {
+            return true, env.cc.CommitObjectRequest(ctx, bucket, "b.txt")
+        })
+        env.checkdata(bucket, "b.txt", "")
+    }
+
+    // ... other than the archived copy in a versioned bucket.
+    vers := mustcall(env, "alice", func(ctx txctx) (*VersionListing, error) {
+        return env.cc.ListObjectVersions(ctx, "bucket-v", "b.txt", 0, "")
+    }).Versions
+    if len(vers) != 1 {
+        t.Fatalf("%d versions of b.txt, want 1", len(vers))
+    }
+    env.checkdata("bucket-v", vers[0].DataKey, "data")
+
+    // Nor is there anything to clean up replacing an object without data.
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.CreateEmptyObject(ctx, "bucket-a", "b.txt", nil, nil, "",
+                                        true)
+    })
+
+    // Data that's still waiting to be cleaned up is left alone if a new
+    // object has put its own data there in the meantime...
+    env.putobject("alice", "bucket-a", "c.txt", "one", nil, false)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.CreateEmptyObject(ctx, "bucket-a", "c.txt", nil, nil, "",
+                                        true)
+    })
+    env.putobject("alice", "bucket-a", "c.txt", "two", nil, true)
+    env.checkdata("bucket-a", "c.txt", "two")
+
+    // ... and goes if the object is removed before it's committed.
+    env.putobject("alice", "bucket-a", "d.txt", "data", nil, false)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.CreateEmptyObject(ctx, "bucket-a", "d.txt", nil, nil, "",
+                                        true)
+    })
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.RemoveObject(ctx, "bucket-a", "d.txt")
+    })
+    env.checkdata("bucket-a", "d.txt", "")
+}
+
+func TestReadObjectVerified(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+
+    for _, key := range []string{"good.txt", "bad.txt", "multi.txt"} {
+        env.putobject("alice", "bucket-a", key, "hello", nil, false)
+    }
+
+    // Someone changes bad.txt behind the ledger's back, and multi.txt looks
+    // like it came from a multipart upload.
+    env.s3.put("bucket-a", "bad.txt", []byte("jello"))
+    env.s3.objs["bucket-a/multi.txt"].etag = "0123456789abcdef-2"
+
+    read := func(key string, verify bool) (*ObjectRead, error) {
+        return call(env, "alice", func(ctx txctx) (*ObjectRead, error) {
+            return env.cc.ReadObjectVerified(ctx, "bucket-a", key, verify)
+        })
+    }
+
+    tests := []struct {
+        key         string
+        verify      bool
+        ok          bool
+    }{
+        {"good.txt", true, true},
+        {"bad.txt", true, false},
+        {"bad.txt", false, true},
+        {"multi.txt", true, true},
+    }
+
+    for _, tc := range tests {
+        rv, err := read(tc.key, tc.verify)
+        if !tc.ok {
+            if err == nil {
+                t.Errorf("%s: diverged data passed verification", tc.key)
+            }
+            continue
+        } else if err != nil {
+            t.Errorf("%s (verify %v) failed: %v", tc.key, tc.verify, err)
+            continue
+        }
+
+        if rv.URL == "" || rv.MD5Sum != md5hex("hello") ||
+           rv.Verified != tc.verify {
+            t.Errorf("%s (verify %v) = %+v", tc.key, tc.verify, rv)
+        }
+    }
+}
+
+func TestListObjectKeys(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    env.createacl("alice", "bob-lists", map[string]uint32{
+        "bob":      ACL_Perms_ListObjects,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "bob-lists")
+    })
+
+    for _, k := range []string{"docs/a.txt", "docs/b.txt", "docs.txt",
+                               "img/c.png"} {
+        env.putobject("alice", "bucket-a", k, "data", nil, false)
+    }
+
+    // Hidden from bob by its own ACL.
+    env.createacl("alice", "private", map[string]uint32{
+        "alice":    ACL_Perms_ListObjects,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "bucket-a", "docs/secret.txt", 4,
+                                   md5hex("data"), nil, nil, "private", false)
+    })
+
+    listkeys := func(user string, prefix string) []string {
+        l := mustcall(env, user, func(ctx txctx) (*KeyListing, error) {
+            return env.cc.ListObjectKeys(ctx, "bucket-a", prefix, 0, "")
+        })
+        if l.Count != uint64(len(l.Keys)) {
+            t.Errorf("count %d doesn't match %d keys", l.Count, len(l.Keys))
+        }
+        sort.Strings(l.Keys)
+        return l.Keys
+    }
+
+    for _, user := range []string{"alice", "bob"} {
+        full := mustcall(env, user, func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.ListObjects(ctx, "bucket-a", 0, false, 0, 0, "")
+        })
+
+        want := []string{}
+        for _, o := range full.Objects {
+            want = append(want, o.Key)
+        }
+        sort.Strings(want)
+
+        if got := listkeys(user, ""); !reflect.DeepEqual(got, want) {
+            t.Errorf("ListObjectKeys as %s = %v, ListObjects has %v", user,
+                     got, want)
+        }
+    }
+
+    // The prefix is taken literally, not as a pattern.
+    got := listkeys("bob", "docs/")
+    want := []string{"docs/a.txt", "docs/b.txt"}
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("keys under docs/ = %v, want %v", got, want)
+    }
+
+    if got := listkeys("alice", "docs."); !reflect.DeepEqual(got,
+                                                          []string{"docs.txt"}) {
+        t.Errorf("keys under docs. = %v, want [docs.txt]", got)
+    }
+
+    // Paging through covers every key exactly once.
+    seen := []string{}
+    token := ""
+    for {
+        l := mustcall(env, "alice", func(ctx txctx) (*KeyListing, error) {
+            return env.cc.ListObjectKeys(ctx, "bucket-a", "", 2, token)
+        })
+        seen = append(seen, l.Keys...)
+        if l.Count == 0 || l.Token == "" {
+            break
+        }
+        token = l.Token
+    }
+    sort.Strings(seen)
+    if len(seen) != 5 || seen[0] != "docs.txt" || seen[4] != "img/c.png" {
+        t.Errorf("paged keys = %v, want all five", seen)
+    }
+
+    env.adduser("carol", 0)
+    _, err := call(env, "carol", func(ctx txctx) (*KeyListing, error) {
+        return env.cc.ListObjectKeys(ctx, "bucket-a", "", 0, "")
+    })
+    if err == nil {
+        t.Errorf("user without list access got a key listing")
+    }
+}
+
+func TestListObjectsByOwner(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+
+    env.createacl("alice", "shared", map[string]uint32{
+        "bob":      ACL_Perms_ListObjects | ACL_Perms_CreateObject,
+        "carol":    ACL_Perms_ListObjects | ACL_Perms_CreateObject,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "shared")
+    })
+
+    env.putobject("alice", "bucket-a", "a1.txt", "data", nil, false)
+    env.putobject("bob", "bucket-a", "b1.txt", "data", nil, false)
+    env.putobject("bob", "bucket-a", "b2.txt", "data", nil, false)
+    env.putobject("carol", "bucket-a", "c1.txt", "data", nil, false)
+
+    byowner := func(caller string, owner string) ([]string, error) {
+        l, err := call(env, caller, func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.ListObjectsByOwner(ctx, "bucket-a", uidof(owner), 0,
+                                             "")
+        })
+        if err != nil {
+            return nil, err
+        }
+
+        keys := []string{}
+        for _, o := range l.Objects {
+            keys = append(keys, o.Key)
+        }
+        sort.Strings(keys)
+        return keys, nil
+    }
+
+    tests := []struct {
+        caller  string
+        owner   string
+        want    []string
+    }{
+        {"alice", "bob", []string{"b1.txt", "b2.txt"}},
+        {"alice", "carol", []string{"c1.txt"}},
+        {"alice", "alice", []string{"a1.txt"}},
+        {"admin", "bob", []string{"b1.txt", "b2.txt"}},
+        {"bob", "bob", []string{"b1.txt", "b2.txt"}},
+    }
+
+    for _, tc := range tests {
+        got, err := byowner(tc.caller, tc.owner)
+        if err != nil {
+            t.Errorf("%s listing %s's objects: %v", tc.caller, tc.owner, err)
+        } else if !reflect.DeepEqual(got, tc.want) {
+            t.Errorf("%s listing %s's objects = %v, want %v", tc.caller,
+                     tc.owner, got, tc.want)
+        }
+    }
+
+    if _, err := byowner("bob", "carol"); err == nil {
+        t.Errorf("user listed someone else's objects in a bucket they don't own")
+    }
+}
+
+func TestDetachObjectKeepsData(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+    env.putobject("alice", "bucket-a", "kept.txt", "kept", nil, false)
+    env.putobject("alice", "bucket-a", "gone.txt", "gone", nil, false)
+
+    obj := env.getobject("bucket-a", "kept.txt")
+
+    _, err := call(env, "bob", func(ctx txctx) (bool, error) {
+        return env.cc.DetachObject(ctx, "bucket-a", "kept.txt")
+    })
+    if err == nil {
+        t.Errorf("user without delete access detached an object")
+    }
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.DetachObject(ctx, "bucket-a", "kept.txt")
+    })
+
+    if env.s3.deletes != 0 {
+        t.Errorf("detaching made %d delete calls to the backing store",
+                 env.s3.deletes)
+    }
+
+    if env.getobject("bucket-a", "kept.txt") != nil {
+        t.Errorf("detached object still on the ledger")
+    }
+    env.checkdata("bucket-a", "kept.txt", "kept")
+
+    dr := mustcall(env, "alice", func(ctx txctx) (*DeleteRecord, error) {
+        return env.cc.GetDeleteRecord(ctx, "bucket-a", obj.ID)
+    })
+    if dr.Key != "kept.txt" {
+        t.Errorf("delete record = %+v, want one for kept.txt", dr)
+    }
+
+    // A plain remove still cleans up after itself.
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.RemoveObject(ctx, "bucket-a", "gone.txt")
+    })
+    if env.s3.deletes != 1 {
+        t.Errorf("removing made %d delete calls, want 1", env.s3.deletes)
+    }
+    env.checkdata("bucket-a", "gone.txt", "")
+}
+
+func TestObjectResponseHeaders(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+    env.putobject("alice", "bucket-a", "report.pdf", "data", nil, false)
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetObjectResponseHeaders(ctx, "bucket-a", "report.pdf",
+                map[string]string{
+                    "content-disposition":  `attachment; filename="q3.pdf"`,
+                    "Cache-Control":        "no-cache",
+                })
+    })
+
+    ps := mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.ReadObject(ctx, "bucket-a", "report.pdf")
+    })
+
+    u, err := url.Parse(ps)
+    if err != nil {
+        t.Fatalf("bad presigned URL %q: %v", ps, err)
+    }
+
+    q := u.Query()
+    if got := q.Get("response-content-disposition");
+       got != `attachment; filename="q3.pdf"` {
+        t.Errorf("response-content-disposition = %q", got)
+    }
+    if got := q.Get("response-cache-control"); got != "no-cache" {
+        t.Errorf("response-cache-control = %q", got)
+    }
+
+    _, err = call(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetObjectResponseHeaders(ctx, "bucket-a", "report.pdf",
+                map[string]string{"X-Custom": "nope"})
+    })
+    if err == nil {
+        t.Errorf("header S3 can't override accepted")
+    }
+
+    _, err = call(env, "bob", func(ctx txctx) (bool, error) {
+        return env.cc.SetObjectResponseHeaders(ctx, "bucket-a", "report.pdf",
+                map[string]string{"Cache-Control": "max-age=60"})
+    })
+    if err == nil {
+        t.Errorf("user without overwrite access changed response headers")
+    }
+
+    // Clearing them leaves a plain URL.
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetObjectResponseHeaders(ctx, "bucket-a", "report.pdf",
+                                               nil)
+    })
+    ps = mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.ReadObject(ctx, "bucket-a", "report.pdf")
+    })
+    if strings.Contains(ps, "response-") {
+        t.Errorf("cleared headers still in URL %q", ps)
+    }
+}
+
+func TestReplicationStatus(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    // Objects from before replication was turned on aren't tracked.
+    env.putobject("alice", "bucket-a", "old.txt", "data", nil, false)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketReplication(ctx, "bucket-a", true)
+    })
+    for _, k := range []string{"a.txt", "b.txt", "c.txt"} {
+        env.putobject("alice", "bucket-a", k, "data", nil, false)
+    }
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.CreateEmptyObject(ctx, "bucket-a", "index.txt", nil, nil,
+                                        "", false)
+    })
+
+    pending := func() []string {
+        l := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.ListObjectsPendingReplication(ctx, "bucket-a", 0, "")
+        })
+
+        keys := []string{}
+        for _, o := range l.Objects {
+            keys = append(keys, o.Key)
+        }
+        sort.Strings(keys)
+        return keys
+    }
+
+    if got := pending(); !reflect.DeepEqual(got,
+                                            []string{"a.txt", "b.txt", "c.txt"}) {
+        t.Errorf("pending = %v, want a.txt, b.txt and c.txt", got)
+    }
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.MarkReplicationComplete(ctx, "bucket-a", "a.txt")
+    })
+    mustcall(env, "admin", func(ctx txctx) (bool, error) {
+        return env.cc.MarkReplicationFailed(ctx, "bucket-a", "b.txt")
+    })
+
+    if got := pending(); !reflect.DeepEqual(got, []string{"c.txt"}) {
+        t.Errorf("pending after marking = %v, want c.txt", got)
+    }
+
+    want := map[string]string{
+        "a.txt":        ObjectReplStatus_Complete,
+        "b.txt":        ObjectReplStatus_Failed,
+        "c.txt":        ObjectReplStatus_Pending,
+        "old.txt":      "",
+        "index.txt":    "",
+    }
+    for k, v := range want {
+        if got := env.getobject("bucket-a", k).ReplStatus; got != v {
+            t.Errorf("status of %s = %q, want %q", k, got, v)
+        }
+    }
+
+    // A failed copy goes back to pending once the data is uploaded again.
+    env.putobject("alice", "bucket-a", "b.txt", "new data", nil, true)
+    if got := pending(); !reflect.DeepEqual(got, []string{"b.txt", "c.txt"}) {
+        t.Errorf("pending after overwrite = %v, want b.txt and c.txt", got)
+    }
+
+    _, err := call(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.MarkReplicationComplete(ctx, "bucket-a", "old.txt")
+    })
+    if err == nil {
+        t.Errorf("untracked object marked as replicated")
+    }
+
+    _, err = call(env, "bob", func(ctx txctx) (bool, error) {
+        return env.cc.MarkReplicationComplete(ctx, "bucket-a", "c.txt")
+    })
+    if err == nil {
+        t.Errorf("someone other than the bucket owner marked replication")
+    }
+}
+
+func TestRepairObjectFromVersion(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketOverwriteMode(ctx, "bucket-a",
+                                             Bucket_OverwriteMode_Version)
+    })
+
+    env.putobject("alice", "bucket-a", "a.txt", "one", nil, false)
+    env.putobject("alice", "bucket-a", "a.txt", "two", nil, true)
+
+    repair := func(user string) (bool, error) {
+        return call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.RepairObject(ctx, "bucket-a", "a.txt")
+        })
+    }
+
+    // Nothing to do while the data is fine.
+    if fixed, err := repair("alice"); fixed || err != nil {
+        t.Errorf("repairing intact object = %v, %v", fixed, err)
+    }
+
+    env.s3.put("bucket-a", "a.txt", []byte("garbage"))
+
+    if _, err := repair("bob"); err == nil {
+        t.Errorf("unrelated user repaired an object")
+    }
+
+    if fixed, err := repair("alice"); !fixed || err != nil {
+        t.Fatalf("repairing damaged object = %v, %v", fixed, err)
+    }
+
+    env.checkdata("bucket-a", "a.txt", "one")
+    obj := env.getobject("bucket-a", "a.txt")
+    if obj.MD5Sum != md5hex("one") || obj.Size != 3 {
+        t.Errorf("repaired object = %+v, want it to describe the old data",
+                 obj)
+    }
+
+    // With no good version left, there's nothing to repair from.
+    vers := mustcall(env, "alice", func(ctx txctx) (*VersionListing, error) {
+        return env.cc.ListObjectVersions(ctx, "bucket-a", "a.txt", 0, "")
+    }).Versions
+    env.s3.remove("bucket-a", vers[0].DataKey)
+    env.s3.remove("bucket-a", "a.txt")
+
+    if fixed, err := repair("alice"); fixed || err == nil {
+        t.Errorf("repair with no intact version = %v, %v", fixed, err)
+    }
+}
+
+func TestListObjectVersionsPages(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketOverwriteMode(ctx, "bucket-a",
+                                             Bucket_OverwriteMode_Version)
+    })
+
+    // Five writes leave four old versions behind, "v0" through "v3".
+    for i := 0; i < 5; i++ {
+        env.putobject("alice", "bucket-a", "a.txt", fmt.Sprintf("v%d", i), nil,
+                      i != 0)
+        env.advance(time.Minute)
+    }
+
+    seen := []string{}
+    tokens := map[string]bool{}
+    token := ""
+    for pages := 0; pages < 10; pages++ {
+        l := mustcall(env, "alice", func(ctx txctx) (*VersionListing, error) {
+            return env.cc.ListObjectVersions(ctx, "bucket-a", "a.txt", 3, token)
+        })
+
+        if l.Count > 3 || l.Count != uint64(len(l.Versions)) {
+            t.Fatalf("page of %d versions (count %d), want at most 3",
+                     len(l.Versions), l.Count)
+        }
+
+        for _, v := range l.Versions {
+            seen = append(seen, v.MD5Sum)
+        }
+
+        if l.Count == 0 || l.Token == "" {
+            break
+        }
+
+        if tokens[l.Token] {
+            t.Fatalf("token %q didn't advance", l.Token)
+        }
+        tokens[l.Token] = true
+        token = l.Token
+    }
+
+    want := []string{md5hex("v3"), md5hex("v2"), md5hex("v1"), md5hex("v0")}
+    if !reflect.DeepEqual(seen, want) {
+        t.Errorf("versions came back as %v, want newest first %v", seen, want)
+    }
+
+    if len(tokens) == 0 {
+        t.Errorf("all versions fit on one page of 3")
+    }
+}
+
+func TestCountObjects(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+    env.addbucket("alice", "bucket-ab")
+
+    for i := 0; i < 5; i++ {
+        env.putobject("alice", "bucket-a", fmt.Sprintf("%d.txt", i), "data",
+                      nil, false)
+    }
+    env.putobject("alice", "bucket-ab", "other.txt", "data", nil, false)
+
+    count := func(user string, bucket string) (uint64, error) {
+        return call(env, user, func(ctx txctx) (uint64, error) {
+            return env.cc.CountObjects(ctx, bucket)
+        })
+    }
+
+    // A bucket whose name starts with another's doesn't bleed into its count.
+    if n, err := count("alice", "bucket-a"); n != 5 || err != nil {
+        t.Errorf("count = %d, %v, want 5", n, err)
+    }
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.RemoveObject(ctx, "bucket-a", "0.txt")
+    })
+    if n, _ := count("alice", "bucket-a"); n != 4 {
+        t.Errorf("count after removing one = %d, want 4", n)
+    }
+
+    env.createacl("alice", "bob-lists", map[string]uint32{
+        "bob":      ACL_Perms_ListObjects,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "bob-lists")
+    })
+
+    if n, err := count("bob", "bucket-a"); n != 4 || err != nil {
+        t.Errorf("count with list access = %d, %v, want 4", n, err)
+    }
+
+    if _, err := count("carol", "bucket-a"); err == nil {
+        t.Errorf("user without list access counted objects")
+    }
+}
+
+func TestObjectTagValidation(t *testing.T) {
+    env := newtestenv(t)
+    env.cc.MaxObjectTags = 3
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+
+    create := func(key string, tags []string) error {
+        _, err := call(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.CreateEmptyObject(ctx, "bucket-a", key, nil, tags,
+                                            "", false)
+        })
+        return err
+    }
+
+    // Duplicates are dropped, and don't count against the limit.
+    err := create("dups.txt", []string{"red", "blue", "red", "green", "blue"})
+    if err != nil {
+        t.Fatalf("tags with duplicates rejected: %v", err)
+    }
+
+    want := []string{"red", "blue", "green"}
+    got := env.getobject("bucket-a", "dups.txt").Tags
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("tags = %v, want %v", got, want)
+    }
+
+    bad := map[string][]string{
+        "empty":     {"red", ""},
+        "separator": {"red\x00blue"},
+        "overlimit": {"a", "b", "c", "d"},
+    }
+    for name, tags := range bad {
+        if err := create(name + ".txt", tags); err == nil {
+            t.Errorf("%s tag set %q accepted", name, tags)
+        }
+    }
+
+    if err := create("none.txt", nil); err != nil {
+        t.Errorf("object with no tags rejected: %v", err)
+    }
+}
+
+func TestQueryDeleteRecordsByDeleter(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+
+    env.createacl("alice", "bob-edits", map[string]uint32{
+        "bob":      ACL_Perms_All,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "bob-edits")
+    })
+
+    env.putobject("alice", "bucket-a", "a.txt", "data", nil, false)
+    env.putobject("alice", "bucket-a", "b.txt", "data", nil, false)
+    env.putobject("bob", "bucket-a", "c.txt", "data", nil, false)
+    env.putobject("bob", "bucket-a", "d.txt", "data", nil, false)
+
+    // The bucket ACL lets bob delete alice's objects, but not the other way.
+    for user, keys := range map[string][]string{
+        "alice":    {"a.txt"},
+        "bob":      {"b.txt", "c.txt", "d.txt"},
+    } {
+        for _, k := range keys {
+            mustcall(env, user, func(ctx txctx) (string, error) {
+                return env.cc.RemoveObject(ctx, "bucket-a", k)
+            })
+        }
+    }
+
+    query := func(caller string, deleter string) ([]string, error) {
+        l, err := call(env, caller, func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.QueryDeleteRecords(ctx, "bucket-a", nil, deleter,
+                                             0, false, "")
+        })
+        if err != nil {
+            return nil, err
+        }
+
+        keys := []string{}
+        for _, o := range l.Objects {
+            keys = append(keys, o.Key)
+        }
+        sort.Strings(keys)
+        return keys, nil
+    }
+
+    for _, tc := range []struct {
+        caller  string
+        deleter string
+        want    []string
+    }{
+        { "alice", "",              []string{"a.txt", "b.txt", "c.txt", "d.txt"} },
+        { "alice", uidof("alice"),  []string{"a.txt"} },
+        { "alice", uidof("bob"),    []string{"b.txt", "c.txt", "d.txt"} },
+        { "bob",   uidof("alice"),  []string{"a.txt"} },
+        { "alice", uidof("carol"),  []string{} },
+    } {
+        got, err := query(tc.caller, tc.deleter)
+        if err != nil {
+            t.Errorf("%s querying deleter %q: %v", tc.caller, tc.deleter, err)
+        } else if !reflect.DeepEqual(got, tc.want) {
+            t.Errorf("%s querying deleter %q = %v, want %v", tc.caller,
+                     tc.deleter, got, tc.want)
+        }
+    }
+
+    if _, err := query("alice", uidof("nobody")); err == nil {
+        t.Error("query by unknown deleter succeeded")
+    }
+
+    // Filtering doesn't get around the bucket's ACL.
+    if _, err := query("carol", uidof("alice")); err == nil {
+        t.Error("carol queried bucket-a's delete records")
+    }
+}
+
+func TestSearchMyObjectsAcrossBuckets(t *testing.T) {
+    env := newtestenv(t)
+    for _, u := range []string{"alice", "bob", "carol", "dave"} {
+        env.adduser(u, User_SysPerms_AddBuckets)
+        env.addbucket(u, u + "-bucket")
+    }
+
+    eng := map[string]string{"dept": "eng"}
+    for _, u := range []string{"alice", "bob", "carol", "dave"} {
+        env.putobject(u, u + "-bucket", "eng.txt", "data", eng, false)
+        env.putobject(u, u + "-bucket", "ops.txt", "data",
+                      map[string]string{"dept": "ops"}, false)
+    }
+
+    // Bob shares bob-bucket with alice, but keeps one object in it private.
+    // Dave's bucket is open to everyone, and carol's isn't shared at all.
+    env.createacl("bob", "alice-lists", map[string]uint32{
+        "alice":    ACL_Perms_ListObjects,
+    }, nil)
+    mustcall(env, "bob", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bob-bucket", "alice-lists")
+    })
+    env.createacl("bob", "private", map[string]uint32{
+        "bob":      ACL_Perms_All,
+    }, nil)
+    mustcall(env, "bob", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "bob-bucket", "secret.txt", 4,
+                                   md5hex("data"), eng, nil, "private", false)
+    })
+    mustcall(env, "dave", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketPublicRead(ctx, "dave-bucket", true)
+    })
+
+    search := func(user string) []string {
+        l := mustcall(env, user, func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.SearchMyObjects(ctx, eng, 0, "")
+        })
+
+        rv := []string{}
+        for _, o := range l.Objects {
+            rv = append(rv, o.Bucket + "/" + o.Key)
+        }
+        sort.Strings(rv)
+        return rv
+    }
+
+    for user, want := range map[string][]string{
+        "alice":    {"alice-bucket/eng.txt", "bob-bucket/eng.txt",
+                     "dave-bucket/eng.txt"},
+        "bob":      {"bob-bucket/eng.txt", "bob-bucket/secret.txt",
+                     "dave-bucket/eng.txt"},
+        "carol":    {"carol-bucket/eng.txt", "dave-bucket/eng.txt"},
+    } {
+        if got := search(user); !reflect.DeepEqual(got, want) {
+            t.Errorf("%s searching = %v, want %v", user, got, want)
+        }
+    }
+
+    // Someone with no buckets of their own still sees the public one.
+    env.adduser("erin", 0)
+    want := []string{"dave-bucket/eng.txt"}
+    if got := search("erin"); !reflect.DeepEqual(got, want) {
+        t.Errorf("erin searching = %v, want %v", got, want)
+    }
+}
+
+func TestCreateObjectWithCTime(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    env.createacl("alice", "bob-creates", map[string]uint32{
+        "bob":      ACL_Perms_All,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "bob-creates")
+    })
+
+    create := func(user string, key string, ctime int64) error {
+        _, err := call(env, user, func(ctx txctx) (string, error) {
+            return env.cc.CreateObjectWithCTime(ctx, "bucket-a", key, 4,
+                                                md5hex("data"), nil, nil, "",
+                                                false, ctime)
+        })
+        return err
+    }
+
+    old := env.now() - 365 * 24 * 60 * 60
+    if err := create("alice", "old.txt", old); err != nil {
+        t.Fatalf("CreateObjectWithCTime: %v", err)
+    }
+
+    obj := env.getobject("bucket-a", "old.txt")
+    if obj == nil || obj.CTime != old {
+        t.Errorf("imported object = %+v, want ctime %d", obj, old)
+    }
+
+    for _, ctime := range []int64{env.now() + 3600, 0, -1} {
+        if create("alice", "bad.txt", ctime) == nil {
+            t.Errorf("creation time %d accepted", ctime)
+        }
+    }
+
+    if env.getobject("bucket-a", "bad.txt") != nil {
+        t.Error("object created with a rejected creation time")
+    }
+
+    // Being able to create objects isn't enough to backdate them.
+    if create("bob", "bob.txt", old) == nil {
+        t.Error("bob set a creation time in alice's bucket")
+    }
+}
+
+func TestAdminGetObject(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", User_SysPerms_AddUsers | User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+
+    env.createacl("alice", "private", map[string]uint32{
+        "alice":    ACL_Perms_All,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "bucket-a", "secret.txt", 4,
+                                   md5hex("data"), nil, nil, "private", false)
+    })
+
+    get := func(user string) (*Object, error) {
+        return call(env, user, func(ctx txctx) (*Object, error) {
+            return env.cc.AdminGetObject(ctx, "bucket-a", "secret.txt")
+        })
+    }
+
+    // The admin isn't on any ACL, but gets the whole record anyway.
+    obj, err := get("admin")
+    if err != nil {
+        t.Fatalf("AdminGetObject as admin: %v", err)
+    }
+    if obj.Key != "secret.txt" || len(obj.Permissions) != 1 {
+        t.Errorf("AdminGetObject = %+v", obj)
+    }
+
+    _, err = call(env, "admin", func(ctx txctx) (*Object, error) {
+        return env.cc.GetObjectByPath(ctx, "bucket-a", "secret.txt")
+    })
+    if err == nil {
+        t.Error("admin got past the ACL through GetObjectByPath")
+    }
+
+    // Not even the object's owner, or other powerful users, can use it.
+    for _, user := range []string{"alice", "bob"} {
+        if _, err := get(user); err == nil {
+            t.Errorf("%s used AdminGetObject", user)
+        }
+    }
+
+    _, err = call(env, "admin", func(ctx txctx) (*Object, error) {
+        return env.cc.AdminGetObject(ctx, "bucket-a", "missing.txt")
+    })
+    if err == nil {
+        t.Error("AdminGetObject found an object that isn't there")
+    }
+}
+
+func TestListingNeedsBucketListAccess(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+    env.putobject("alice", "bucket-a", "a.txt", "data", nil, false)
+
+    listings := map[string]func(ctx txctx) error{
+        "ListObjects": func(ctx txctx) error {
+            _, err := env.cc.ListObjects(ctx, "bucket-a", 0, false, 0, 0,
+                                         "")
+            return err
+        },
+        "CountObjects": func(ctx txctx) error {
+            _, err := env.cc.CountObjects(ctx, "bucket-a")
+            return err
+        },
+        "ListObjectKeys": func(ctx txctx) error {
+            _, err := env.cc.ListObjectKeys(ctx, "bucket-a", "", 0, "")
+            return err
+        },
+        "QueryObjects": func(ctx txctx) error {
+            _, err := env.cc.QueryObjects(ctx, "bucket-a", nil, 0, false, "")
+            return err
+        },
+        "QueryObjectsAdvanced": func(ctx txctx) error {
+            _, err := env.cc.QueryObjectsAdvanced(ctx, "bucket-a", nil, 0,
+                                                  false, "")
+            return err
+        },
+        "ListObjectVersions": func(ctx txctx) error {
+            _, err := env.cc.ListObjectVersions(ctx, "bucket-a", "a.txt", 0,
+                                                "")
+            return err
+        },
+        "ListObjectsByOwner": func(ctx txctx) error {
+            _, err := env.cc.ListObjectsByOwner(ctx, "bucket-a",
+                                                uidof("carol"), 0, "")
+            return err
+        },
+        "ListDeletedObjects": func(ctx txctx) error {
+            _, err := env.cc.ListDeletedObjects(ctx, "bucket-a", 0, false, "")
+            return err
+        },
+        "QueryDeleteRecords": func(ctx txctx) error {
+            _, err := env.cc.QueryDeleteRecords(ctx, "bucket-a", nil, "", 0,
+                                                false, "")
+            return err
+        },
+    }
+
+    try := func(public bool) {
+        for name, fn := range listings {
+            err := env.tx("carol", fn)
+            if (err == nil) != public {
+                t.Errorf("%s as carol with public read %v: %v", name, public,
+                         err)
+            }
+        }
+    }
+
+    try(false)
+
+    // Public read lets anyone list, through the same check.
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketPublicRead(ctx, "bucket-a", true)
+    })
+    try(true)
+}
+
+func TestListObjectsByFlags(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+
+    env.putobject("alice", "bucket-a", "plain.txt", "data", nil, false)
+    env.putobject("alice", "bucket-a", "pinned.txt", "data", nil, false)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.PinObject(ctx, "bucket-a", "pinned.txt")
+    })
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.CreateEmptyObject(ctx, "bucket-a", "index.txt", nil, nil,
+                                        "", false)
+    })
+
+    // Restored objects are staged until their data is uploaded again.
+    gone := env.putobject("alice", "bucket-a", "staged.txt", "data", nil, false)
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.RemoveObject(ctx, "bucket-a", "staged.txt")
+    })
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.RestoreObjectAs(ctx, "bucket-a", gone.ID, "", false)
+    })
+
+    list := func(mask uint64, match uint64) []string {
+        l := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.ListObjects(ctx, "bucket-a", 0, false, mask, match,
+                                      "")
+        })
+
+        rv := []string{}
+        for _, o := range l.Objects {
+            rv = append(rv, o.Key)
+        }
+        sort.Strings(rv)
+        return rv
+    }
+
+    for _, tc := range []struct {
+        mask    uint64
+        match   uint64
+        want    []string
+    }{
+        { 0, 0, []string{"index.txt", "pinned.txt", "plain.txt", "staged.txt"} },
+
+        { ObjectFlag_IndexOnly, ObjectFlag_IndexOnly, []string{"index.txt"} },
+        { ObjectFlag_Staged,    ObjectFlag_Staged,    []string{"staged.txt"} },
+        { ObjectFlag_Pinned,    ObjectFlag_Pinned,    []string{"pinned.txt"} },
+
+        { ObjectFlag_IndexOnly, 0,
+          []string{"pinned.txt", "plain.txt", "staged.txt"} },
+        { ObjectFlag_Staged, 0,
+          []string{"index.txt", "pinned.txt", "plain.txt"} },
+
+        // Everything with data that's there and not pinned.
+        { ObjectFlag_IndexOnly | ObjectFlag_Staged | ObjectFlag_Pinned, 0,
+          []string{"plain.txt"} },
+    } {
+        if got := list(tc.mask, tc.match); !reflect.DeepEqual(got, tc.want) {
+            t.Errorf("mask %#x match %#x = %v, want %v", tc.mask, tc.match,
+                     got, tc.want)
+        }
+    }
+}
+
+func TestGetObjectByPathSkipsBucketForOwner(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    env.createacl("alice", "bob-reads", map[string]uint32{
+        "bob":      ACL_Perms_ReadObject | ACL_Perms_CreateObject,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "bob-reads")
+    })
+    env.putobject("bob", "bucket-a", "bobs.txt", "data", nil, false)
+    env.putobject("alice", "bucket-a", "alices.txt", "data", nil, false)
+
+    bktkey, _ := shim.CreateCompositeKey("Bucket", []string{"bucket-a"})
+    reads := 0
+    env.onget = func(key string) {
+        if key == bktkey {
+            reads++
+        }
+    }
+
+    for _, tc := range []struct {
+        user    string
+        key     string
+        reads   int
+    }{
+        // Bob owns this one, even though the bucket is alice's.
+        { "bob", "bobs.txt", 0 },
+
+        // Anyone else has to go through the ACL fallback.
+        { "bob", "alices.txt", 1 },
+    } {
+        reads = 0
+        obj := mustcall(env, tc.user, func(ctx txctx) (*Object, error) {
+            return env.cc.GetObjectByPath(ctx, "bucket-a", tc.key)
+        })
+        if obj.Key != tc.key {
+            t.Errorf("GetObjectByPath(%s) = %+v", tc.key, obj)
+        }
+        if reads != tc.reads {
+            t.Errorf("%s getting %s read the bucket %d times, want %d",
+                     tc.user, tc.key, reads, tc.reads)
+        }
+    }
+}
+
+func TestDedupSharesObjectData(t *testing.T) {
+    env := newtestenv(t)
+    alice := env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketDedup(ctx, "bucket-a", true)
+    })
+
+    create := func(key string) string {
+        t.Helper()
+        ps := mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.CreateObject(ctx, "bucket-a", key, 6,
+                                       md5hex("shared"), nil, nil, "", false)
+        })
+        mustcall(env, "alice", func(ctx txctx) (bool, error) {
+            return true, env.cc.CommitObjectRequest(ctx, "bucket-a", key)
+        })
+        return ps
+    }
+
+    remove := func(key string) {
+        t.Helper()
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.RemoveObject(ctx, "bucket-a", key)
+        })
+    }
+
+    blob := blobkey(alice, md5hex("shared"))
+
+    // Nothing is on the backing store yet, so both objects need an upload even
+    // though they'll share the same data.
+    if create("a.txt") == "" || create("b.txt") == "" {
+        t.Fatal("no upload url before the shared data was uploaded")
+    }
+    env.s3.put("bucket-a", blob, []byte("shared"))
+
+    if ps := create("c.txt"); ps != "" {
+        t.Errorf("CreateObject = %q, want no upload for shared data", ps)
+    }
+
+    for _, key := range []string{"a.txt", "b.txt", "c.txt"} {
+        if obj := env.getobject("bucket-a", key); obj.DedupOf != blob {
+            t.Errorf("%s shares %q, want %q", key, obj.DedupOf, blob)
+        }
+        env.checkdata("bucket-a", key, "")
+    }
+
+    // The shared data stays until the last object using it is gone.
+    remove("a.txt")
+    remove("b.txt")
+    env.checkdata("bucket-a", blob, "shared")
+
+    remove("c.txt")
+    env.checkdata("bucket-a", blob, "")
+
+    // Overwriting the only object using some shared data with new content
+    // cleans the old data up once the new data is committed.
+    create("d.txt")
+    env.s3.put("bucket-a", blob, []byte("shared"))
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "bucket-a", "d.txt", 5,
+                                   md5hex("fresh"), nil, nil, "", true)
+    })
+    env.checkdata("bucket-a", blob, "shared")
+
+    env.s3.put("bucket-a", "d.txt", []byte("fresh"))
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return true, env.cc.CommitObjectRequest(ctx, "bucket-a", "d.txt")
+    })
+    env.checkdata("bucket-a", blob, "")
+    env.checkdata("bucket-a", "d.txt", "fresh")
+
+    // Nobody gets to write into the shared data directly.
+    _, err := call(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "bucket-a", blob, 6, md5hex("shared"),
+                                   nil, nil, "", false)
+    })
+    if err == nil {
+        t.Error("created an object under the .blobs/ prefix")
+    }
+}
+
+func TestQueryObjectsByClass(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    for _, key := range []string{"a.png", "b.png", "c.txt", "d.jpg"} {
+        env.putobject("alice", "bucket-a", key, "data", nil, false)
+    }
+
+    setclass := func(user string, key string, class string) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.SetObjectClass(ctx, "bucket-a", key, class)
+        })
+        return err
+    }
+
+    query := func(user string, class string) ([]string, error) {
+        l, err := call(env, user, func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.QueryObjectsByClass(ctx, "bucket-a", class, 0,
+                                              false, "")
+        })
+        if err != nil {
+            return nil, err
+        }
+        keys := []string{}
+        for _, o := range l.Objects {
+            if o.Class != class {
+                t.Errorf("%s listed with class %q, want %q", o.Key, o.Class,
+                         class)
+            }
+            keys = append(keys, o.Key)
+        }
+        sort.Strings(keys)
+        return keys, nil
+    }
+
+    for key, class := range map[string]string{
+        "a.png":    "image",
+        "b.png":    "image",
+        "c.txt":    "document",
+        "d.jpg":    "document",
+    } {
+        if err := setclass("alice", key, class); err != nil {
+            t.Fatalf("SetObjectClass(%s): %v", key, err)
+        }
+    }
+
+    // Moving an object to a new class takes it out of the old one.
+    if err := setclass("alice", "d.jpg", "image"); err != nil {
+        t.Fatalf("SetObjectClass(d.jpg): %v", err)
+    }
+    if setclass("bob", "c.txt", "image") == nil {
+        t.Error("bob changed the class of alice's object")
+    }
+    if setclass("alice", "c.txt", "bad\x00class") == nil {
+        t.Error("class with the key separator accepted")
+    }
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.RemoveObject(ctx, "bucket-a", "b.png")
+    })
+
+    for class, want := range map[string][]string{
+        "image":    {"a.png", "d.jpg"},
+        "document": {"c.txt"},
+        "archive":  {},
+    } {
+        got, err := query("alice", class)
+        if err != nil {
+            t.Errorf("QueryObjectsByClass(%s): %v", class, err)
+        } else if !reflect.DeepEqual(got, want) {
+            t.Errorf("QueryObjectsByClass(%s) = %v, want %v", class, got,
+                     want)
+        }
+    }
+
+    if _, err := query("bob", "image"); err == nil {
+        t.Error("bob queried a bucket without list access")
+    }
+}
+
+func TestListMyObjectsInBucket(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+
+    // Bob can add objects to the bucket, but not list what's in it.
+    env.createacl("alice", "bob-writes", map[string]uint32{
+        "bob":      ACL_Perms_CreateObject,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "bob-writes")
+    })
+
+    env.putobject("alice", "bucket-a", "alice-1.txt", "data", nil, false)
+    env.putobject("alice", "bucket-a", "alice-2.txt", "data", nil, false)
+    env.putobject("bob", "bucket-a", "bob-1.txt", "data", nil, false)
+    env.putobject("bob", "bucket-a", "bob-2.txt", "data", nil, false)
+    env.putobject("bob", "bucket-a", "bob-3.txt", "data", nil, false)
+
+    list := func(user string) []string {
+        t.Helper()
+        keys := []string{}
+        token := ""
+        for {
+            l := mustcall(env, user, func(ctx txctx) (*ObjectListing, error) {
+                return env.cc.ListMyObjectsInBucket(ctx, "bucket-a", 2, token)
+            })
+            for _, o := range l.Objects {
+                keys = append(keys, o.Key)
+            }
+            if l.Count == 0 || l.Token == "" {
+                break
+            }
+            token = l.Token
+        }
+        sort.Strings(keys)
+        return keys
+    }
+
+    for user, want := range map[string][]string{
+        "alice":    {"alice-1.txt", "alice-2.txt"},
+        "bob":      {"bob-1.txt", "bob-2.txt", "bob-3.txt"},
+        "carol":    {},
+    } {
+        if got := list(user); !reflect.DeepEqual(got, want) {
+            t.Errorf("ListMyObjectsInBucket as %s = %v, want %v", user, got,
+                     want)
+        }
+    }
+}
+
+func TestGetObjects(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    env.createacl("alice", "bob-reads", map[string]uint32{
+        "bob":      ACL_Perms_ReadObject,
+    }, nil)
+
+    for key, tmpl := range map[string]string{
+        "open-1.txt":   "bob-reads",
+        "open-2.txt":   "bob-reads",
+        "closed.txt":   "",
+    } {
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.CreateObject(ctx, "bucket-a", key, 4,
+                                       md5hex("data"), nil, nil, tmpl, false)
+        })
+    }
+
+    keys := []string{"open-2.txt", "closed.txt", "missing.txt", "open-1.txt"}
+    rv := mustcall(env, "bob", func(ctx txctx) (*ObjectBatch, error) {
+        return env.cc.GetObjects(ctx, "bucket-a", keys)
+    })
+
+    got := []string{}
+    for _, obj := range rv.Objects {
+        got = append(got, obj.Key)
+    }
+    want := []string{"open-2.txt", "open-1.txt"}
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("GetObjects returned %v, want %v", got, want)
+    }
+
+    want = []string{"", "permission denied", "unknown object", ""}
+    if !reflect.DeepEqual(rv.Errors, want) {
+        t.Errorf("GetObjects errors = %q, want %q", rv.Errors, want)
+    }
+
+    // The batch size is capped like a listing page.
+    env.cc.MaxPageSize = 3
+    _, err := call(env, "bob", func(ctx txctx) (*ObjectBatch, error) {
+        return env.cc.GetObjects(ctx, "bucket-a", keys)
+    })
+    if err == nil {
+        t.Error("GetObjects took more keys than a page holds")
+    }
+}
+
+func TestDeleteRecordTTL(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    setttl := func(user string, ttl int64) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.SetBucketDeleteRecordTTL(ctx, "bucket-a", ttl)
+        })
+        return err
+    }
+
+    // Delete an object, giving back the ID of its delete record.
+    remove := func(key string) string {
+        t.Helper()
+        obj := env.putobject("alice", "bucket-a", key, "data", nil, false)
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.RemoveObject(ctx, "bucket-a", key)
+        })
+        return obj.ID
+    }
+
+    record := func(id string) *DeleteRecord {
+        dr, _ := call(env, "alice", func(ctx txctx) (*DeleteRecord, error) {
+            return env.cc.GetDeleteRecord(ctx, "bucket-a", id)
+        })
+        return dr
+    }
+
+    purge := func(user string) (uint64, error) {
+        return call(env, user, func(ctx txctx) (uint64, error) {
+            return env.cc.PurgeExpiredDeleteRecords(ctx, "bucket-a")
+        })
+    }
+
+    if err := setttl("alice", 3600); err != nil {
+        t.Fatalf("SetBucketDeleteRecordTTL: %v", err)
+    }
+    if setttl("bob", 0) == nil {
+        t.Error("bob changed the delete record TTL on alice's bucket")
+    }
+    if setttl("alice", -1) == nil {
+        t.Error("negative delete record TTL accepted")
+    }
+
+    // The expiry comes from the transaction's time, not the peer's clock.
+    old := remove("old.txt")
+    if dr := record(old); dr == nil || dr.DTime != env.now() ||
+       dr.ExpiresAt != env.now() + 3600 {
+        t.Errorf("delete record = %+v, want deleted at %d expiring an hour "+
+                 "later", dr, env.now())
+    }
+
+    env.advance(30 * time.Minute)
+    recent := remove("recent.txt")
+
+    env.advance(31 * time.Minute)
+    if _, err := purge("bob"); err == nil {
+        t.Error("bob purged delete records in alice's bucket")
+    }
+    if n, err := purge("alice"); err != nil || n != 1 {
+        t.Errorf("PurgeExpiredDeleteRecords = %d, %v, want 1", n, err)
+    }
+    if record(old) != nil || record(recent) == nil {
+        t.Error("purge didn't remove exactly the expired delete record")
+    }
+
+    // Turning the TTL off keeps records from then on, and the lifecycle sweep
+    // purges the ones that already have an expiry even without object expiry
+    // turned on for the bucket.
+    if err := setttl("alice", 0); err != nil {
+        t.Fatalf("SetBucketDeleteRecordTTL: %v", err)
+    }
+    kept := remove("kept.txt")
+
+    // Both kinds of cleanup can happen in the same sweep.
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketExpiry(ctx, "bucket-a", 3600)
+    })
+    env.putobject("alice", "bucket-a", "stale.txt", "data", nil, false)
+
+    env.advance(24 * time.Hour)
+    if rv := env.sweep("alice", "bucket-a"); rv.Purged != 1 || rv.Expired != 1 {
+        t.Errorf("sweep = %+v, want one purged and one expired", rv)
+    }
+    if record(recent) != nil || record(kept) == nil {
+        t.Error("sweep didn't remove exactly the expired delete record")
+    }
+}
+
+func TestReadObjectWithDisposition(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+    env.putobject("alice", "bucket-a", "report.pdf", "data", nil, false)
+
+    // A disposition passed in wins over one stored on the object.
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetObjectResponseHeaders(ctx, "bucket-a", "report.pdf",
+                map[string]string{"Content-Disposition": "inline"})
+    })
+
+    read := func(disposition string, filename string) (string, error) {
+        ps, err := call(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.ReadObjectWithDisposition(ctx, "bucket-a",
+                                                    "report.pdf", disposition,
+                                                    filename)
+        })
+        if err != nil {
+            return "", err
+        }
+
+        u, err := url.Parse(ps)
+        if err != nil {
+            t.Fatalf("bad presigned URL %q: %v", ps, err)
+        }
+        return u.Query().Get("response-content-disposition"), nil
+    }
+
+    for _, tc := range []struct {
+        disposition string
+        filename    string
+        want        string
+    }{
+        {"attachment", "", "attachment"},
+        {"inline", "", "inline"},
+        {"attachment", "q3.pdf", `attachment; filename="q3.pdf"`},
+        {"inline", "q3.pdf", `inline; filename="q3.pdf"`},
+        {"attachment", "résumé.pdf",
+         `attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+    } {
+        got, err := read(tc.disposition, tc.filename)
+        if err != nil {
+            t.Errorf("%s/%q: %v", tc.disposition, tc.filename, err)
+        } else if got != tc.want {
+            t.Errorf("%s/%q: disposition = %q, want %q", tc.disposition,
+                     tc.filename, got, tc.want)
+        }
+    }
+
+    for _, tc := range [][2]string{
+        {"download", ""},
+        {"", ""},
+        {"attachment", `q3".pdf`},
+        {"attachment", "q3\\.pdf"},
+        {"attachment", "q3\r\n.pdf"},
+    } {
+        if _, err := read(tc[0], tc[1]); err == nil {
+            t.Errorf("disposition %q with filename %q accepted", tc[0], tc[1])
+        }
+    }
+}
+
+func TestCountDeleteRecords(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+    env.addbucket("alice", "bucket-b")
+
+    ids := []string{}
+    for _, key := range []string{"a.txt", "b.txt", "c.txt"} {
+        for _, bucket := range []string{"bucket-a", "bucket-b"} {
+            obj := env.putobject("alice", bucket, key, "data", nil, false)
+            mustcall(env, "alice", func(ctx txctx) (string, error) {
+                return env.cc.RemoveObject(ctx, bucket, key)
+            })
+            if bucket == "bucket-a" {
+                ids = append(ids, obj.ID)
+            }
+        }
+    }
+    env.putobject("alice", "bucket-a", "live.txt", "data", nil, false)
+
+    count := func(user string) (uint64, error) {
+        return call(env, user, func(ctx txctx) (uint64, error) {
+            return env.cc.CountDeleteRecords(ctx, "bucket-a")
+        })
+    }
+
+    if n, err := count("alice"); err != nil || n != 3 {
+        t.Errorf("CountDeleteRecords = %d, %v, want 3", n, err)
+    }
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.RemoveDeleteRecord(ctx, "bucket-a", ids[0])
+    })
+    if n, err := count("alice"); err != nil || n != 2 {
+        t.Errorf("CountDeleteRecords after removing one = %d, %v, want 2",
+                 n, err)
+    }
+
+    if _, err := count("bob"); err == nil {
+        t.Error("bob counted the delete records in alice's bucket")
+    }
+}
+
+func TestRenameMetadataKey(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    env.createindex("alice", "dept", "bucket-a")
+    env.createindex("alice", "team", "bucket-a")
+
+    for key, dept := range map[string]string{
+        "1.txt":    "eng",
+        "2.txt":    "eng",
+        "3.txt":    "ops",
+        "4.txt":    "",
+        "5.txt":    "ops",
+    } {
+        var meta map[string]string
+        if dept != "" {
+            meta = map[string]string{"dept": dept}
+        }
+        env.putobject("alice", "bucket-a", key, "data", meta, false)
+    }
+
+    rename := func(user string, from string, to string) error {
+        token := ""
+        for {
+            next, err := call(env, user, func(ctx txctx) (string, error) {
+                return env.cc.RenameMetadataKey(ctx, "bucket-a", from, to, 2,
+                                                token)
+            })
+            if err != nil || next == "" {
+                return err
+            }
+            token = next
+        }
+    }
+
+    byindex := func(field string, value string) []string {
+        l := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.QueryObjectsByIndex(ctx, "bucket-a", field, value,
+                                              0, false, "")
+        })
+        keys := []string{}
+        for _, o := range l.Objects {
+            keys = append(keys, o.Key)
+        }
+        sort.Strings(keys)
+        return keys
+    }
+
+    if rename("bob", "dept", "team") == nil {
+        t.Error("bob renamed metadata in alice's bucket")
+    }
+
+    if err := rename("alice", "dept", "team"); err != nil {
+        t.Fatalf("RenameMetadataKey: %v", err)
+    }
+
+    for key, want := range map[string]string{
+        "1.txt":    "eng",
+        "3.txt":    "ops",
+        "4.txt":    "",
+    } {
+        obj := env.getobject("bucket-a", key)
+        if _, ok := obj.Metadata["dept"]; ok || obj.Metadata["team"] != want {
+            t.Errorf("%s metadata = %v, want team %q", key, obj.Metadata, want)
+        }
+    }
+
+    if got := byindex("dept", "eng"); len(got) != 0 {
+        t.Errorf("dept index still has %v", got)
+    }
+    if got, want := byindex("team", "ops"), []string{"3.txt", "5.txt"};
+       !reflect.DeepEqual(got, want) {
+        t.Errorf("team index for ops = %v, want %v", got, want)
+    }
+
+    // Renamed metadata still has to satisfy the bucket's schema.
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketMetadataSchema(ctx, "bucket-a",
+                &MetadataSchema{
+                    Patterns:   map[string]string{"group": "^[0-9]+$"},
+                })
+    })
+    if rename("alice", "team", "group") == nil {
+        t.Error("renamed metadata to values the schema doesn't allow")
+    }
+    obj := env.getobject("bucket-a", "1.txt")
+    if obj.Metadata["team"] != "eng" {
+        t.Errorf("failed rename changed 1.txt metadata to %v", obj.Metadata)
+    }
+}
+
+func TestGetTagStats(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    for key, tags := range map[string][]string{
+        "1.txt":    {"red", "big"},
+        "2.txt":    {"red"},
+        "3.txt":    {"red", "blue", "big"},
+        "4.txt":    nil,
+    } {
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.CreateObject(ctx, "bucket-a", key, 4, md5hex("data"),
+                                       nil, tags, "", false)
+        })
+    }
+
+    stats := func(user string, max uint32) (map[string]uint64, error) {
+        return call(env, user, func(ctx txctx) (map[string]uint64, error) {
+            return env.cc.GetTagStats(ctx, "bucket-a", max)
+        })
+    }
+
+    got, err := stats("alice", 0)
+    want := map[string]uint64{"red": 3, "big": 2, "blue": 1}
+    if err != nil || !reflect.DeepEqual(got, want) {
+        t.Errorf("GetTagStats = %v, %v, want %v", got, err, want)
+    }
+
+    // Only as many objects as asked for are looked at, in key order.
+    got, err = stats("alice", 2)
+    want = map[string]uint64{"red": 2, "big": 1}
+    if err != nil || !reflect.DeepEqual(got, want) {
+        t.Errorf("GetTagStats over two objects = %v, %v, want %v", got, err,
+                 want)
+    }
+
+    if _, err := stats("bob", 0); err == nil {
+        t.Error("bob got tag stats for a bucket without list access")
+    }
+}
+
+func TestValidateUploadCompletion(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.CreateObject(ctx, "bucket-a", "a.txt", 5, md5hex("hello"),
+                                   nil, nil, "", false)
+    })
+
+    validate := func(user string, md5sum string, size uint64) (bool, error) {
+        return call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.ValidateUploadCompletion(ctx, "bucket-a", "a.txt",
+                                                   md5sum, size)
+        })
+    }
+
+    check := func(what string, md5sum string, size uint64, want bool) {
+        t.Helper()
+        got, err := validate("alice", md5sum, size)
+        if err != nil {
+            t.Errorf("%s: %v", what, err)
+        } else if got != want {
+            t.Errorf("%s: ValidateUploadCompletion = %v, want %v", what, got,
+                     want)
+        }
+    }
+
+    check("nothing uploaded", md5hex("hello"), 5, false)
+
+    // The right size but the wrong content.
+    env.s3.put("bucket-a", "a.txt", []byte("jello"))
+    check("wrong data", md5hex("hello"), 5, false)
+
+    env.s3.put("bucket-a", "a.txt", []byte("hello"))
+    check("matching upload", strings.ToUpper(md5hex("hello")), 5, true)
+    check("wrong checksum", md5hex("jello"), 5, false)
+    check("wrong size", md5hex("hello"), 4, false)
+
+    if _, err := validate("bob", md5hex("hello"), 5); err == nil {
+        t.Error("bob validated an upload to alice's object")
+    }
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.CreateEmptyObject(ctx, "bucket-a", "empty.txt", nil, nil,
+                                        "", false)
+    })
+    _, err := call(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.ValidateUploadCompletion(ctx, "bucket-a", "empty.txt",
+                                               md5hex(""), 0)
+    })
+    if err == nil {
+        t.Error("validated an upload to an object with no data")
+    }
+}
+
+func TestBucketDefaultMetadata(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+    env.createindex("alice", "department", "bucket-a")
+
+    env.putobject("alice", "bucket-a", "before.txt", "data", nil, false)
+
+    defaults := map[string]string{"department": "eng", "region": "us"}
+    setdefaults := func(user string) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.SetBucketDefaultMetadata(ctx, "bucket-a", defaults)
+        })
+        return err
+    }
+
+    if setdefaults("bob") == nil {
+        t.Error("bob set default metadata on alice's bucket")
+    }
+    if err := setdefaults("alice"); err != nil {
+        t.Fatalf("SetBucketDefaultMetadata: %v", err)
+    }
+
+    // What the object is created with wins over the defaults.
+    env.putobject("alice", "bucket-a", "plain.txt", "data", nil, false)
+    env.putobject("alice", "bucket-a", "eu.txt", "data",
+                  map[string]string{"region": "eu"}, false)
+
+    for key, want := range map[string]map[string]string{
+        "before.txt":   nil,
+        "plain.txt":    {"department": "eng", "region": "us"},
+        "eu.txt":       {"department": "eng", "region": "eu"},
+    } {
+        // Printing the maps treats nil and empty the same.
+        got := env.getobject("bucket-a", key).Metadata
+        if fmt.Sprint(got) != fmt.Sprint(want) {
+            t.Errorf("%s metadata = %v, want %v", key, got, want)
+        }
+    }
+
+    // Defaults are indexed like any other metadata.
+    l := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+        return env.cc.QueryObjectsByIndex(ctx, "bucket-a", "department", "eng",
+                                          0, false, "")
+    })
+    keys := []string{}
+    for _, o := range l.Objects {
+        keys = append(keys, o.Key)
+    }
+    sort.Strings(keys)
+    if want := []string{"eu.txt", "plain.txt"}; !reflect.DeepEqual(keys, want) {
+        t.Errorf("department index = %v, want %v", keys, want)
+    }
+}
+
+func TestGetKeyTimeline(t *testing.T) {
+    env := newtestenv(t)
+    alice := env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    type event struct {
+        event   string
+        time    int64
+        md5sum  string
+    }
+    want := []event{}
+
+    // Create, delete and recreate the same key a couple of times, with
+    // something else going on in the bucket alongside.
+    for i, data := range []string{"one", "two", "three"} {
+        env.advance(time.Hour)
+        env.putobject("alice", "bucket-a", "k.txt", data, nil, false)
+        env.putobject("alice", "bucket-a", "other.txt", data, nil, true)
+        want = append(want, event{"created", env.now(), md5hex(data)})
+
+        if i == 2 {
+            break
+        }
+
+        env.advance(time.Hour)
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.RemoveObject(ctx, "bucket-a", "k.txt")
+        })
+        want = append(want, event{"deleted", env.now(), md5hex(data)})
+    }
+
+    tl := mustcall(env, "alice", func(ctx txctx) (*KeyTimeline, error) {
+        return env.cc.GetKeyTimeline(ctx, "bucket-a", "k.txt")
+    })
+    if !tl.Exists || tl.Truncated {
+        t.Errorf("timeline exists = %v, truncated = %v, want true, false",
+                 tl.Exists, tl.Truncated)
+    }
+
+    got := []event{}
+    for _, ev := range tl.Events {
+        got = append(got, event{ev.Event, ev.Time, ev.MD5Sum})
+        if ev.Owner != alice ||
+           (ev.Event == "deleted" && ev.Deleter != alice) {
+            t.Errorf("event %+v, want owned and deleted by alice", ev)
+        }
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("timeline = %+v, want %+v", got, want)
+    }
+
+    _, err := call(env, "bob", func(ctx txctx) (*KeyTimeline, error) {
+        return env.cc.GetKeyTimeline(ctx, "bucket-a", "k.txt")
+    })
+    if err == nil {
+        t.Error("bob got a key timeline without list access")
+    }
+}
+
+func TestEmptyNamesRejected(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+
+    expect := func(what string, want string, fn func(ctx txctx) error) {
+        t.Helper()
+        err := env.tx("alice", fn)
+        if err == nil || !strings.Contains(err.Error(), want) {
+            t.Errorf("%s: got %v, want error containing %q", what, err, want)
+        }
+    }
+
+    expect("GetBucket", "bucket name", func(ctx txctx) error {
+        _, err := env.cc.GetBucket(ctx, "")
+        return err
+    })
+    expect("GetObjectByPath bucket", "bucket name", func(ctx txctx) error {
+        _, err := env.cc.GetObjectByPath(ctx, "", "a.txt")
+        return err
+    })
+    expect("GetObjectByPath key", "must not be empty",
+           func(ctx txctx) error {
+        _, err := env.cc.GetObjectByPath(ctx, "bucket-a", "")
+        return err
+    })
+    expect("CreateObject", "must not be empty", func(ctx txctx) error {
+        _, err := env.cc.CreateObject(ctx, "bucket-a", "", 5, md5hex("hello"),
+                                      nil, nil, "", false)
+        return err
+    })
+    expect("ReadObject", "must not be empty", func(ctx txctx) error {
+        _, err := env.cc.ReadObject(ctx, "bucket-a", "")
+        return err
+    })
+    expect("RemoveObject", "must not be empty", func(ctx txctx) error {
+        _, err := env.cc.RemoveObject(ctx, "bucket-a", "")
+        return err
+    })
+    expect("CommitObjectRequest", "must not be empty",
+           func(ctx txctx) error {
+        return env.cc.CommitObjectRequest(ctx, "bucket-a", "")
+    })
+    expect("NUL in key", "invalid object key", func(ctx txctx) error {
+        _, err := env.cc.CreateObject(ctx, "bucket-a", "a\x00b", 5,
+                                      md5hex("hello"), nil, nil, "", false)
+        return err
+    })
+}
+
+func TestPublicURLRewrite(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+    env.putobject("alice", "bucket-a", "a b.txt", "data", nil, false)
+
+    read := func() *url.URL {
+        t.Helper()
+        ps := mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.ReadObject(ctx, "bucket-a", "a b.txt")
+        })
+
+        u, err := url.Parse(ps)
+        if err != nil {
+            t.Fatalf("bad presigned URL %q: %v", ps, err)
+        }
+        return u
+    }
+
+    orig := read()
+
+    env.cc.PublicURLRewrite = "https://gw.example.com/s3/"
+    got := read()
+    if got.Scheme != "https" || got.Host != "gw.example.com" {
+        t.Errorf("URL not pointed at the gateway: %s", got)
+    }
+    if got.EscapedPath() != "/s3" + orig.EscapedPath() {
+        t.Errorf("path = %q, want %q", got.EscapedPath(),
+                 "/s3" + orig.EscapedPath())
+    }
+    if got.Query().Get("X-Amz-Signature") == "" {
+        t.Errorf("signature missing from %s", got)
+    }
+
+    // Rewriting a URL only touches where it points; the signed query is
+    // carried over byte for byte.
+    u, _ := url.Parse("http://s3.local:9000/bucket-a/a%20b.txt?X-Amz-Signature=abc%2Fd&b=1")
+    rv, err := env.cc.publicurl(u)
+    if err != nil {
+        t.Fatal(err)
+    } else if rv != "https://gw.example.com/s3/bucket-a/a%20b.txt?X-Amz-Signature=abc%2Fd&b=1" {
+        t.Errorf("publicurl = %q", rv)
+    }
+
+    env.cc.PublicURLRewrite = "://bad"
+    if _, err := env.cc.publicurl(u); err == nil {
+        t.Error("bad public URL accepted")
+    }
+}
+
+func TestRestoreObjectVersion(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketOverwriteMode(ctx, "bucket-a",
+                                             Bucket_OverwriteMode_Version)
+    })
+
+    env.putobject("alice", "bucket-a", "a.txt", "one",
+                  map[string]string{"rev": "1"}, false)
+    env.advance(time.Minute)
+    env.putobject("alice", "bucket-a", "a.txt", "two",
+                  map[string]string{"rev": "2"}, true)
+
+    versions := func() []*Object {
+        l := mustcall(env, "alice", func(ctx txctx) (*VersionListing, error) {
+            return env.cc.ListObjectVersions(ctx, "bucket-a", "a.txt", 0, "")
+        })
+        return l.Versions
+    }
+
+    vers := versions()
+    if len(vers) != 1 {
+        t.Fatalf("%d versions kept, want 1", len(vers))
+    }
+    old := vers[0]
+
+    restore := func(user string, vid string) error {
+        _, err := call(env, user, func(ctx txctx) (string, error) {
+            return env.cc.RestoreObjectVersion(ctx, "bucket-a", "a.txt", vid)
+        })
+        return err
+    }
+
+    if restore("bob", old.VersionID) == nil {
+        t.Error("bob restored a version they can't read")
+    }
+    if restore("alice", "no-such-version") == nil {
+        t.Error("restored a version that doesn't exist")
+    }
+
+    if err := restore("alice", old.VersionID); err != nil {
+        t.Fatalf("RestoreObjectVersion: %v", err)
+    }
+
+    env.checkdata("bucket-a", "a.txt", "one")
+    obj := env.getobject("bucket-a", "a.txt")
+    if obj.Metadata["rev"] != "1" || obj.MD5Sum != md5hex("one") {
+        t.Errorf("restored object = %+v", obj)
+    }
+
+    // The restored version is still there, and what was current before has
+    // been kept as a version too.
+    sums := map[string]bool{}
+    for _, v := range versions() {
+        sums[v.MD5Sum] = true
+    }
+    if len(sums) != 2 || !sums[md5hex("one")] || !sums[md5hex("two")] {
+        t.Errorf("versions after restore = %v", sums)
+    }
+}
+
+func TestObjectAvailability(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+    env.createacl("alice", "bob-reads", map[string]uint32{
+        "bob":      ACL_Perms_ReadObject,
+    }, nil)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetBucketACLFromTemplate(ctx, "bucket-a", "bob-reads")
+    })
+    env.putobject("alice", "bucket-a", "a.txt", "data", nil, false)
+
+    setwindow := func(user string, from int64, until int64) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.SetObjectAvailability(ctx, "bucket-a", "a.txt", from,
+                                                until)
+        })
+        return err
+    }
+
+    check := func(what string, user string, want string) {
+        t.Helper()
+        _, err := call(env, user, func(ctx txctx) (*Object, error) {
+            return env.cc.GetObjectByPath(ctx, "bucket-a", "a.txt")
+        })
+        _, rerr := call(env, user, func(ctx txctx) (string, error) {
+            return env.cc.ReadObject(ctx, "bucket-a", "a.txt")
+        })
+
+        for _, e := range []error{err, rerr} {
+            if want == "" && e != nil {
+                t.Errorf("%s: %v", what, e)
+            } else if want != "" && (e == nil || e.Error() != want) {
+                t.Errorf("%s: got %v, want %q", what, e, want)
+            }
+        }
+    }
+
+    now := env.now()
+    if setwindow("bob", now + 3600, 0) == nil {
+        t.Error("bob set the availability of alice's object")
+    }
+    if setwindow("alice", now + 7200, now + 3600) == nil {
+        t.Error("window that ends before it starts accepted")
+    }
+    if err := setwindow("alice", now + 3600, now + 7200); err != nil {
+        t.Fatalf("SetObjectAvailability: %v", err)
+    }
+
+    check("before the window", "bob", "not available")
+    check("owner before the window", "alice", "")
+
+    env.advance(90 * time.Minute)
+    check("in the window", "bob", "")
+
+    env.advance(time.Hour)
+    check("after the window", "bob", "not available")
+    check("owner after the window", "alice", "")
+
+    // Opening the window back up makes it readable again.
+    if err := setwindow("alice", 0, 0); err != nil {
+        t.Fatalf("SetObjectAvailability: %v", err)
+    }
+    check("no window", "bob", "")
+}
+
+func TestRefreshDownloadURL(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+    env.putobject("alice", "bucket-a", "a.txt", "data", nil, false)
+
+    refresh := func(user string, ttl uint32) (string, error) {
+        return call(env, user, func(ctx txctx) (string, error) {
+            return env.cc.RefreshDownloadURL(ctx, "bucket-a", "a.txt", ttl)
+        })
+    }
+
+    for _, ttl := range []uint32{60, 3600, 7 * 24 * 3600} {
+        ps, err := refresh("alice", ttl)
+        if err != nil {
+            t.Errorf("ttl %d: %v", ttl, err)
+            continue
+        }
+
+        u, err := url.Parse(ps)
+        if err != nil {
+            t.Fatalf("bad presigned URL %q: %v", ps, err)
+        }
+
+        if got := u.Query().Get("X-Amz-Expires"); got != fmt.Sprint(ttl) {
+            t.Errorf("ttl %d: URL expires in %s", ttl, got)
+        }
+        if u.Query().Get("X-Amz-Signature") == "" {
+            t.Errorf("ttl %d: URL isn't signed", ttl)
+        }
+    }
+
+    for _, ttl := range []uint32{0, 7 * 24 * 3600 + 1} {
+        if _, err := refresh("alice", ttl); err == nil {
+            t.Errorf("ttl %d accepted", ttl)
+        }
+    }
+
+    // The read check still applies.
+    if _, err := refresh("bob", 60); err == nil {
+        t.Error("bob got a URL for an object they can't read")
+    }
+}
+
+func TestObjectMetadataHistory(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    sethistory := func(user string, limit uint32) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.SetBucketMetadataHistory(ctx, "bucket-a", limit)
+        })
+        return err
+    }
+
+    history := func() []string {
+        t.Helper()
+        snaps := mustcall(env, "alice",
+                          func(ctx txctx) ([]*MetadataSnapshot, error) {
+            return env.cc.GetObjectMetadataHistory(ctx, "bucket-a", "a.txt")
+        })
+
+        revs := make([]string, 0)
+        for _, snap := range snaps {
+            revs = append(revs, snap.Metadata["rev"])
+        }
+        return revs
+    }
+
+    write := func(rev int) {
+        t.Helper()
+        env.advance(time.Minute)
+        env.putobject("alice", "bucket-a", "a.txt", "data",
+                      map[string]string{"rev": fmt.Sprint(rev)}, rev != 0)
+    }
+
+    // Nothing is kept until the bucket asks for it.
+    write(0)
+    write(1)
+    if revs := history(); len(revs) != 0 {
+        t.Errorf("history kept without being enabled: %v", revs)
+    }
+
+    if sethistory("bob", 3) == nil {
+        t.Error("bob changed the history setting on alice's bucket")
+    }
+    if sethistory("alice", max_metadata_history + 1) == nil {
+        t.Error("history limit over the maximum accepted")
+    }
+    if err := sethistory("alice", 3); err != nil {
+        t.Fatalf("SetBucketMetadataHistory: %v", err)
+    }
+
+    write(2)
+    if revs := history(); !reflect.DeepEqual(revs, []string{"1"}) {
+        t.Errorf("history after one update = %v, want [1]", revs)
+    }
+
+    write(3)
+    write(4)
+    write(5)
+    if revs := history(); !reflect.DeepEqual(revs, []string{"4", "3", "2"}) {
+        t.Errorf("history after four updates = %v, want [4 3 2]", revs)
+    }
+
+    // Typed metadata changes are tracked too.
+    env.advance(time.Minute)
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetObjectTypedMetadata(ctx, "bucket-a", "a.txt",
+                                             map[string]interface{}{"n": 1})
+    })
+    if revs := history(); !reflect.DeepEqual(revs, []string{"5", "4", "3"}) {
+        t.Errorf("history after typed update = %v, want [5 4 3]", revs)
+    }
+
+    _, err := call(env, "bob", func(ctx txctx) ([]*MetadataSnapshot, error) {
+        return env.cc.GetObjectMetadataHistory(ctx, "bucket-a", "a.txt")
+    })
+    if err == nil {
+        t.Error("bob read the history of an object they can't read")
+    }
+}
+
+func TestMovePrefix(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+    env.createindex("alice", "project", "bucket-a")
+
+    proj := map[string]string{"project": "x"}
+    keys := []string{
+        "docs/2024/a.txt", "docs/2024/sub/b.txt", "docs/2024/sub/c.txt",
+        "docs/2025/d.txt", "notes.txt",
+    }
+    for _, key := range keys {
+        env.putobject("alice", "bucket-a", key, "data:" + key, proj, false)
+    }
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetObjectClass(ctx, "bucket-a", "docs/2024/a.txt", "cold")
+    })
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.CreateObjectAlias(ctx, "bucket-a", "docs/2024/sub/b.txt",
+                                        "latest")
+    })
+
+    move := func(user string, from string, to string, max uint32,
+                 token string) (*MoveSummary, error) {
+        return call(env, user, func(ctx txctx) (*MoveSummary, error) {
+            return env.cc.MovePrefix(ctx, "bucket-a", from, to, max, token)
+        })
+    }
+
+    for _, p := range [][2]string{{"", "x/"}, {"docs/", "docs/old/"}} {
+        if _, err := move("alice", p[0], p[1], 0, ""); err == nil {
+            t.Errorf("move from %q to %q accepted", p[0], p[1])
+        }
+    }
+
+    // Bob can't overwrite or delete anything here, so nothing moves.
+    sum, err := move("bob", "docs/2024/", "archive/2024/", 0, "")
+    if err != nil {
+        t.Fatalf("MovePrefix: %v", err)
+    } else if sum.Moved != 0 || len(sum.Skipped) != 3 {
+        t.Errorf("bob's move = %+v, want 3 skipped", sum)
+    }
+
+    // Two entries at a time, so this takes a few calls.
+    var moved uint64
+    token := ""
+    for calls := 0; calls < 10; calls++ {
+        sum, err := move("alice", "docs/2024/", "archive/2024/", 2, token)
+        if err != nil {
+            t.Fatalf("MovePrefix: %v", err)
+        }
+
+        moved += sum.Moved
+        token = sum.Token
+        if token == "" {
+            break
+        }
+    }
+    if moved != 3 || token != "" {
+        t.Fatalf("moved %d objects (token %q), want 3", moved, token)
+    }
+
+    for _, key := range keys {
+        newkey := key
+        if strings.HasPrefix(key, "docs/2024/") {
+            newkey = "archive/2024/" + key[len("docs/2024/"):]
+            if env.getobject("bucket-a", key) != nil {
+                t.Errorf("%s is still there", key)
+            }
+
+            // The old copy stays until the move is committed.
+            env.checkdata("bucket-a", key, "data:" + key)
+            mustcall(env, "alice", func(ctx txctx) (bool, error) {
+                return true, env.cc.CommitObjectRequest(ctx, "bucket-a",
+                                                        newkey)
+            })
+            env.checkdata("bucket-a", key, "")
+        }
+
+        if obj := env.getobject("bucket-a", newkey); obj == nil {
+            t.Errorf("%s is missing", newkey)
+        } else if obj.Key != newkey {
+            t.Errorf("%s has key %s", newkey, obj.Key)
+        }
+        env.checkdata("bucket-a", newkey, "data:" + key)
+    }
+
+    found := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+        return env.cc.QueryObjectsByIndex(ctx, "bucket-a", "project", "x", 0,
+                                          false, "")
+    })
+    got := make([]string, 0)
+    for _, obj := range found.Objects {
+        got = append(got, obj.Key)
+    }
+    sort.Strings(got)
+    want := []string{
+        "archive/2024/a.txt", "archive/2024/sub/b.txt",
+        "archive/2024/sub/c.txt", "docs/2025/d.txt", "notes.txt",
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("index after move = %v, want %v", got, want)
+    }
+
+    cold := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+        return env.cc.QueryObjectsByClass(ctx, "bucket-a", "cold", 0, false,
+                                          "")
+    })
+    if len(cold.Objects) != 1 || cold.Objects[0].Key != "archive/2024/a.txt" {
+        t.Errorf("class after move = %+v", cold.Objects)
+    }
+
+    obj := mustcall(env, "alice", func(ctx txctx) (*Object, error) {
+        return env.cc.GetObjectByAlias(ctx, "bucket-a", "latest")
+    })
+    if obj.Key != "archive/2024/sub/b.txt" {
+        t.Errorf("alias points at %s after move", obj.Key)
+    }
+
+    // Moving up to the top level is fine, so long as nothing is already
+    // there under the same name.
+    if _, err := move("alice", "docs/2025/", "", 0, ""); err != nil {
+        t.Errorf("MovePrefix: %v", err)
+    }
+    env.putobject("alice", "bucket-a", "docs/2025/notes.txt", "x", nil, false)
+    if _, err := move("alice", "docs/2025/", "", 0, ""); err == nil {
+        t.Error("moved an object on top of another")
+    }
+}
+
+func TestQueryObjectsBySize(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    for _, data := range []string{"a", "bbb", "ccccc", "ddddddd"} {
+        env.putobject("alice", "bucket-a", fmt.Sprintf("%d.txt", len(data)),
+                      data, nil, false)
+    }
+
+    query := func(user string, min uint64, max uint64) ([]string, error) {
+        l, err := call(env, user, func(ctx txctx) (*ObjectListing, error) {
+            return env.cc.QueryObjectsBySize(ctx, "bucket-a", min, max, 0, "")
+        })
+        if err != nil {
+            return nil, err
+        }
+
+        keys := make([]string, 0)
+        for _, obj := range l.Objects {
+            keys = append(keys, obj.Key)
+        }
+        sort.Strings(keys)
+        return keys, nil
+    }
+
+    for _, tc := range []struct {
+        min     uint64
+        max     uint64
+        want    []string
+    }{
+        {0, 0, []string{"1.txt", "3.txt", "5.txt", "7.txt"}},
+        {3, 5, []string{"3.txt", "5.txt"}},
+        {2, 4, []string{"3.txt"}},
+        {5, 0, []string{"5.txt", "7.txt"}},
+        {7, 7, []string{"7.txt"}},
+        {8, 0, []string{}},
+        {0, 1, []string{"1.txt"}},
+    } {
+        got, err := query("alice", tc.min, tc.max)
+        if err != nil {
+            t.Errorf("%d-%d: %v", tc.min, tc.max, err)
+        } else if !reflect.DeepEqual(got, tc.want) {
+            t.Errorf("%d-%d: got %v, want %v", tc.min, tc.max, got, tc.want)
+        }
+    }
+
+    if _, err := query("alice", 5, 3); err == nil {
+        t.Error("backwards size range accepted")
+    }
+    if _, err := query("bob", 0, 0); err == nil {
+        t.Error("bob listed a bucket they can't list")
+    }
+}
+
+func TestFindObjectsMissingField(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.adduser("bob", 0)
+    env.addbucket("alice", "bucket-a")
+
+    team := map[string]string{"team": "x"}
+    other := map[string]string{"other": "y"}
+    objs := []struct {
+        key     string
+        meta    map[string]string
+    }{
+        {"a.txt", team}, {"b.txt", nil}, {"c.txt", other}, {"d.txt", team},
+        {"e.txt", nil},
+    }
+    for _, o := range objs {
+        env.putobject("alice", "bucket-a", o.key, "data", o.meta, false)
+    }
+
+    find := func(user string, field string, max uint32) ([]string, error) {
+        keys := make([]string, 0)
+        token := ""
+        for calls := 0; calls < 10; calls++ {
+            l, err := call(env, user, func(ctx txctx) (*ObjectListing, error) {
+                return env.cc.FindObjectsMissingField(ctx, "bucket-a", field,
+                                                      max, token)
+            })
+            if err != nil {
+                return nil, err
+            }
+
+            if l.Count > uint64(max) || l.Count != uint64(len(l.Objects)) {
+                t.Fatalf("page of %d objects (count %d), want at most %d",
+                         len(l.Objects), l.Count, max)
+            }
+
+            for _, obj := range l.Objects {
+                keys = append(keys, obj.Key)
+            }
+
+            token = l.Token
+            if token == "" {
+                break
+            }
+        }
+
+        sort.Strings(keys)
+        return keys, nil
+    }
+
+    for _, max := range []uint32{2, 10} {
+        got, err := find("alice", "team", max)
+        want := []string{"b.txt", "c.txt", "e.txt"}
+        if err != nil {
+            t.Errorf("max %d: %v", max, err)
+        } else if !reflect.DeepEqual(got, want) {
+            t.Errorf("max %d: missing team = %v, want %v", max, got, want)
+        }
+    }
+
+    got, err := find("alice", "nobody-has-this", 10)
+    if err != nil || len(got) != len(objs) {
+        t.Errorf("missing unused field = %v (%v), want every object", got, err)
+    }
+
+    if _, err := find("alice", "", 10); err == nil {
+        t.Error("empty metadata key accepted")
+    }
+    if _, err := find("bob", "team", 10); err == nil {
+        t.Error("bob searched a bucket they can't list")
+    }
+}
@@ -20,12 +20,13 @@ func (s *SmartContract) initusers(ctx contractapi.TransactionContextInterface) e
         return err
     }
 
-    _, err = s.adduser_int(ctx, myuid, "", 0xffffffff)
+    var batch statebatch
+    _, err = s.adduser_int(ctx, &batch, myuid, "", 0xffffffff)
     if err != nil {
         return err
     }
 
-    return nil
+    return s.commitbatch(ctx, &batch)
 }
 
 func (s *SmartContract) GetMyUser(ctx contractapi.TransactionContextInterface) (*User, error) {
@@ -95,10 +96,32 @@ func (s *SmartContract) AddUser(ctx contractapi.TransactionContextInterface,
         return "", fmt.Errorf("permission denied")
     }
 
-    return s.adduser_int(ctx, uid, "", sysperms)
+    // Nobody can hand out system permissions they don't have themselves, and
+    // only admins can make new admins.
+    if (sysperms & ^myuser.SysPerms) != 0 {
+        return "", fmt.Errorf("invalid system permissions")
+    }
+
+    if (sysperms & User_SysPerms_Admin) != 0 && !isadmin(myuser) {
+        return "", fmt.Errorf("permission denied")
+    }
+
+    var batch statebatch
+    newid, err := s.adduser_int(ctx, &batch, uid, "", sysperms)
+    if err != nil {
+        return "", err
+    }
+
+    err = s.commitbatch(ctx, &batch)
+    if err != nil {
+        return "", err
+    }
+
+    return newid, nil
 }
 
 func (s *SmartContract) adduser_int(ctx contractapi.TransactionContextInterface,
+                                    batch *statebatch,
                                     uid string, parent string,
                                     sysperms uint32) (string, error) {
     tmp, _ := s.GetUserByUID(ctx, uid)
@@ -115,16 +138,8 @@ func (s *SmartContract) adduser_int(ctx contractapi.TransactionContextInterface,
         SubUsers:   make([]SubUser, 0),
     }
 
-    usrJSON, err := json.Marshal(newuser)
-    if err != nil {
-        return "", err
-    }
-
     stateid, _ := ctx.GetStub().CreateCompositeKey("User", []string{newuser.ID})
-    err = ctx.GetStub().PutState(stateid, usrJSON)
-    if err != nil {
-        return "", fmt.Errorf("failed to put to world state. %v", err)
-    }
+    batch.put(stateid, newuser)
 
     return newuser.ID, nil
 }
@@ -163,6 +178,11 @@ func (s *SmartContract) AddSubUser(ctx contractapi.TransactionContextInterface,
         return "", fmt.Errorf("invalid system permissions")
     }
 
+    err := validatepermsmap(perms)
+    if err != nil {
+        return "", err
+    }
+
     // Make sure we're allowed to do this...
     myuser, err := s.GetMyUser(ctx)
     if err != nil {
@@ -173,12 +193,33 @@ func (s *SmartContract) AddSubUser(ctx contractapi.TransactionContextInterface,
         return "", fmt.Errorf("permission denied")
     }
 
+    // Nor can they be given any system permissions we don't have ourselves.
+    if (sysperms & ^myuser.SysPerms) != 0 {
+        return "", fmt.Errorf("invalid system permissions")
+    }
+
+    // Sub-users can't be given more on a bucket than we were given ourselves.
+    for k, v := range perms {
+        max, err := s.conferrableperms(ctx, myuser, k)
+        if err != nil {
+            return "", err
+        }
+
+        perms[k] = v & max
+    }
+
     // Add the user account
-    newid, err := s.adduser_int(ctx, uid, myuser.ID, sysperms)
+    var batch statebatch
+    newid, err := s.adduser_int(ctx, &batch, uid, myuser.ID, sysperms)
     if err != nil {
         return "", err
     }
 
+    // Make sure we always have a map to work with later on.
+    if perms == nil {
+        perms = make(map[string]uint32)
+    }
+
     // Add the user to our list of sub-users and update our entry
     su := SubUser {
         ID:     newid,
@@ -188,21 +229,450 @@ func (s *SmartContract) AddSubUser(ctx contractapi.TransactionContextInterface,
 
     myuser.SubUsers = append(myuser.SubUsers, su)
     stateid, _ := ctx.GetStub().CreateCompositeKey("User", []string{myuser.ID})
+    batch.put(stateid, myuser)
 
-    usrJSON, err := json.Marshal(myuser)
+    err = s.commitbatch(ctx, &batch)
     if err != nil {
         return "", err
     }
 
-    err = ctx.GetStub().PutState(stateid, usrJSON)
+    return newid, nil
+}
+
+// Does the user have administrative access to the system?
+func isadmin(user *User) bool {
+    return (user.SysPerms & User_SysPerms_Admin) != 0
+}
+
+func (s *SmartContract) AmIAdmin(ctx contractapi.TransactionContextInterface) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
     if err != nil {
-        // uh oh...
-        stateid, _ := ctx.GetStub().CreateCompositeKey("User", []string{newid})
-        ctx.GetStub().DelState(stateid)
-        return "", fmt.Errorf("failed to put to world state. %v", err)
+        return false, err
     }
 
-    return newid, nil
+    return isadmin(myuser), nil
+}
+
+func (s *SmartContract) GetMySysPerms(ctx contractapi.TransactionContextInterface) (uint32, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return 0, err
+    }
+
+    return myuser.SysPerms, nil
+}
+
+func (s *SmartContract) GetMySubUsers(ctx contractapi.TransactionContextInterface) ([]SubUser, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    return s.getsubusers(ctx, myuser)
+}
+
+func (s *SmartContract) GetSubUsersForUID(ctx contractapi.TransactionContextInterface,
+                                          uid string) ([]SubUser, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    // Only admins can look at someone else's sub-users.
+    if myuser.UID != uid && !isadmin(myuser) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    user, err := s.GetUserByUID(ctx, uid)
+    if err != nil {
+        return nil, err
+    }
+
+    return s.getsubusers(ctx, user)
+}
+
+func (s *SmartContract) getsubusers(ctx contractapi.TransactionContextInterface,
+                                    user *User) ([]SubUser, error) {
+    rv := make([]SubUser, len(user.SubUsers))
+
+    // Make sure the UIDs we hand back are current.
+    for i, ent := range user.SubUsers {
+        rv[i] = ent
+
+        su, _ := s.GetUserByID(ctx, ent.ID)
+        if su != nil {
+            rv[i].UID = su.UID
+        }
+    }
+
+    return rv, nil
+}
+
+// Remove one of the caller's sub-users from the system. This is only allowed if
+// the sub-user doesn't own anything.
+func (s *SmartContract) RemoveSubUser(ctx contractapi.TransactionContextInterface,
+                                      uid string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    // Look for the specified subuser...
+    idx := -1
+    for i, ent := range myuser.SubUsers {
+        if ent.UID == uid {
+            idx = i
+            break
+        }
+    }
+
+    if idx == -1 {
+        return false, fmt.Errorf("unknown subuser")
+    }
+
+    su, err := s.GetUserByID(ctx, myuser.SubUsers[idx].ID)
+    if err != nil {
+        return false, err
+    }
+
+    // Make sure we're not going to leave anything dangling.
+    if len(su.SubUsers) != 0 {
+        return false, fmt.Errorf("subuser has subusers")
+    }
+
+    bkts, err := s.getuserbuckets(ctx, su.ID)
+    if err != nil {
+        return false, err
+    } else if len(bkts) != 0 {
+        return false, fmt.Errorf("subuser owns buckets")
+    }
+
+    owns, err := s.userownsobjects(ctx, su.ID)
+    if err != nil {
+        return false, err
+    } else if owns {
+        return false, fmt.Errorf("subuser owns objects")
+    }
+
+    // Update our entry in the db, then remove the sub-user itself.
+    myuser.SubUsers = append(myuser.SubUsers[:idx], myuser.SubUsers[idx + 1:]...)
+    id, _ := ctx.GetStub().CreateCompositeKey("User", []string{myuser.ID})
+    err = s.putStateChecked(ctx, id, myuser)
+    if err != nil {
+        return false, err
+    }
+
+    id, _ = ctx.GetStub().CreateCompositeKey("User", []string{su.ID})
+    err = ctx.GetStub().DelState(id)
+    if err != nil {
+        return false, fmt.Errorf("failed to delete from world state. %v", err)
+    }
+
+    return true, nil
+}
+
+// Move a sub-user (along with everything under it) to a new parent. The
+// permissions the old parent had granted the sub-user come along with it.
+func (s *SmartContract) ReparentSubUser(ctx contractapi.TransactionContextInterface,
+                                       subUID string,
+                                       newParentUID string) (bool, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return false, err
+    }
+
+    if !isadmin(myuser) {
+        return false, fmt.Errorf("permission denied")
+    }
+
+    su, err := s.GetUserByUID(ctx, subUID)
+    if err != nil {
+        return false, err
+    } else if su.Parent == "" {
+        return false, fmt.Errorf("user is not a subuser")
+    }
+
+    newparent, err := s.GetUserByUID(ctx, newParentUID)
+    if err != nil {
+        return false, err
+    }
+
+    if newparent.ID == su.Parent {
+        return true, nil
+    }
+
+    // Don't allow the sub-user to end up underneath itself.
+    if newparent.ID == su.ID || s.isuserdescendent(ctx, newparent, su.ID) {
+        return false, fmt.Errorf("reparenting would create a cycle")
+    }
+
+    oldparent, err := s.GetUserByID(ctx, su.Parent)
+    if err != nil {
+        return false, err
+    }
+
+    idx := -1
+    for i, ent := range oldparent.SubUsers {
+        if ent.ID == su.ID {
+            idx = i
+            break
+        }
+    }
+
+    if idx == -1 {
+        return false, fmt.Errorf("subuser missing from parent")
+    }
+
+    ent := oldparent.SubUsers[idx]
+    oldparent.SubUsers = append(oldparent.SubUsers[:idx],
+                                oldparent.SubUsers[idx + 1:]...)
+    newparent.SubUsers = append(newparent.SubUsers, ent)
+    su.Parent = newparent.ID
+
+    var batch statebatch
+    for _, u := range []*User{ oldparent, newparent, su } {
+        id, _ := ctx.GetStub().CreateCompositeKey("User", []string{u.ID})
+        batch.put(id, u)
+    }
+
+    err = s.commitbatch(ctx, &batch)
+    if err != nil {
+        return false, err
+    }
+
+    return true, nil
+}
+
+// Hand everything one user owns over to another user. Only so many objects are
+// moved in one call to keep the transaction to a reasonable size, so this
+// should be called repeatedly until the summary says it is complete.
+func (s *SmartContract) TransferAllUserResources(ctx contractapi.TransactionContextInterface,
+                                                 fromUID string,
+                                                 toUID string) (*TransferSummary, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    if !isadmin(myuser) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    from, err := s.GetUserByUID(ctx, fromUID)
+    if err != nil {
+        return nil, err
+    }
+
+    to, err := s.GetUserByUID(ctx, toUID)
+    if err != nil {
+        return nil, err
+    }
+
+    if from.ID == to.ID {
+        return nil, fmt.Errorf("cannot transfer to the same user")
+    }
+
+    rv := TransferSummary {
+        SkippedACLs:    make([]string, 0),
+    }
+
+    // Start with the objects, since there's potentially a lot of them. This
+    // can't use a paginated query, since those aren't allowed in a transaction
+    // that writes. Anything moved here won't match the query next time around,
+    // so a repeat call naturally picks up where this one left off.
+    max := uint64(s.pagesize(0))
+    query := fmt.Sprintf(`{"selector":{"type":"Object","owner":"%s"}}`, from.ID)
+    iter, err := ctx.GetStub().GetQueryResult(query)
+    if err != nil {
+        return nil, err
+    }
+    defer iter.Close()
+
+    for iter.HasNext() {
+        // If there's more than we can do in one go, let the caller know to
+        // come back for the rest.
+        if rv.Objects == max {
+            return &rv, nil
+        }
+
+        resp, err := iter.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var obj Object
+        err = json.Unmarshal(resp.Value, &obj)
+        if err != nil {
+            return nil, err
+        }
+
+        // Move the object over to the new owner's indexes.
+        for k, v := range obj.Metadata {
+            idx, _ := s.getindex(ctx, from.ID, k, obj.Bucket)
+            if idx != nil {
+                s.removeobjectfromindex(ctx, idx.ID, v, obj.Key)
+            }
+
+            idx, _ = s.getindex(ctx, to.ID, k, obj.Bucket)
+            if idx != nil {
+                s.addobjecttoindex(ctx, idx.ID, v, obj.Key)
+            }
+        }
+
+        obj.Owner = to.ID
+        err = s.putStateChecked(ctx, resp.Key, obj)
+        if err != nil {
+            return nil, err
+        }
+
+        rv.Objects++
+        rv.Token = resp.Key
+    }
+
+    rv.Token = ""
+
+    bkts, err := s.getuserbuckets(ctx, from.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, bkt := range bkts {
+        s.unindexbucket(ctx, bkt)
+        bkt.Owner = to.ID
+        s.indexbucket(ctx, bkt)
+
+        stateid, _ := ctx.GetStub().CreateCompositeKey("Bucket", []string{bkt.Name})
+        err = s.putStateChecked(ctx, stateid, bkt)
+        if err != nil {
+            return nil, err
+        }
+
+        rv.Buckets++
+    }
+
+    grps, err := s.getuserownedgroups(ctx, from.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, grp := range grps {
+        grp.Owner = to.ID
+
+        stateid, _ := ctx.GetStub().CreateCompositeKey("Group", []string{grp.ID})
+        err = s.putStateChecked(ctx, stateid, grp)
+        if err != nil {
+            return nil, err
+        }
+
+        rv.Groups++
+    }
+
+    acls, err := s.getuseracls(ctx, from.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, acl := range acls {
+        // ACL names are unique per user, so don't clobber one the new owner
+        // already has.
+        tmp, _ := s.getuseraclbyname(ctx, to.ID, acl.Name)
+        if tmp != nil {
+            rv.SkippedACLs = append(rv.SkippedACLs, acl.Name)
+            continue
+        }
+
+        acl.Owner = to.ID
+
+        stateid, _ := ctx.GetStub().CreateCompositeKey("ACL", []string{acl.ID})
+        err = s.putStateChecked(ctx, stateid, acl)
+        if err != nil {
+            return nil, err
+        }
+
+        rv.ACLs++
+    }
+
+    rv.Complete = true
+    return &rv, nil
+}
+
+// How far down the user tree GetUserTree will go.
+const max_user_tree_depth = 16
+
+// Fetch the whole tree of sub-users under the specified user. Only admins can
+// look at trees other than their own (or those of their descendents).
+func (s *SmartContract) GetUserTree(ctx contractapi.TransactionContextInterface,
+                                    uid string) (*UserTreeNode, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    user, err := s.GetUserByUID(ctx, uid)
+    if err != nil {
+        return nil, err
+    }
+
+    if user.ID != myuser.ID && !isadmin(myuser) &&
+       !s.isuserdescendent(ctx, user, myuser.ID) {
+        return nil, fmt.Errorf("permission denied")
+    }
+
+    root := UserTreeNode {
+        ID:         user.ID,
+        UID:        user.UID,
+        Perms:      make(map[string]uint32),
+    }
+
+    seen := map[string]bool{ user.ID: true }
+    err = s.buildusertree(ctx, &root, user, seen, 0)
+    if err != nil {
+        return nil, err
+    }
+
+    return &root, nil
+}
+
+func (s *SmartContract) buildusertree(ctx contractapi.TransactionContextInterface,
+                                      node *UserTreeNode, user *User,
+                                      seen map[string]bool,
+                                      depth int) error {
+    node.Children = make([]*UserTreeNode, 0, len(user.SubUsers))
+
+    if depth >= max_user_tree_depth {
+        node.Truncated = len(user.SubUsers) != 0
+        return nil
+    }
+
+    for _, ent := range user.SubUsers {
+        // Don't go around in circles if the tree is broken somehow.
+        if seen[ent.ID] {
+            node.Truncated = true
+            continue
+        }
+
+        seen[ent.ID] = true
+
+        su, err := s.GetUserByID(ctx, ent.ID)
+        if err != nil {
+            return err
+        }
+
+        child := UserTreeNode {
+            ID:         su.ID,
+            UID:        su.UID,
+            Perms:      ent.Perms,
+        }
+
+        err = s.buildusertree(ctx, &child, su, seen, depth + 1)
+        if err != nil {
+            return err
+        }
+
+        node.Children = append(node.Children, &child)
+    }
+
+    return nil
 }
 
 func (s *SmartContract) SetSubUserPermission(ctx contractapi.TransactionContextInterface,
@@ -215,21 +685,29 @@ func (s *SmartContract) SetSubUserPermission(ctx contractapi.TransactionContextI
         return false, fmt.Errorf("unknown user")
     }
 
+    err = validateperms(perms)
+    if err != nil {
+        return false, err
+    }
+
+    // As in AddSubUser, don't hand out more than we were given.
+    max, err := s.conferrableperms(ctx, user, bucket)
+    if err != nil {
+        return false, err
+    }
+
+    perms &= max
+
     // Look for the specified subuser...
     for _, ent := range user.SubUsers {
         if ent.UID == uid {
             ent.Perms[bucket] = perms
 
             // Update our state in the db
-            usrJSON, err := json.Marshal(user)
-            if err != nil {
-                return false, err
-            }
-
             id, _ := ctx.GetStub().CreateCompositeKey("User", []string{user.ID})
-            err = ctx.GetStub().PutState(id, usrJSON)
+            err = s.putStateChecked(ctx, id, user)
             if err != nil {
-                return false, fmt.Errorf("failed to put to world state. %v", err)
+                return false, err
             }
 
             return true, nil
@@ -255,15 +733,10 @@ func (s *SmartContract) RevokeSubUserPermission(ctx contractapi.TransactionConte
             delete(ent.Perms, bucket)
 
             // Update our state in the db
-            usrJSON, err := json.Marshal(user)
-            if err != nil {
-                return false, err
-            }
-
             id, _ := ctx.GetStub().CreateCompositeKey("User", []string{user.ID})
-            err = ctx.GetStub().PutState(id, usrJSON)
+            err = s.putStateChecked(ctx, id, user)
             if err != nil {
-                return false, fmt.Errorf("failed to put to world state. %v", err)
+                return false, err
             }
 
             return true, nil
@@ -290,22 +763,27 @@ func (s *SmartContract) IsUserMyDescendent(ctx contractapi.TransactionContextInt
         return false, fmt.Errorf("unknown user")
     }
 
-    for {
-        if user.Parent == "" {
-            return false, nil
-        }
+    return s.isuserdescendent(ctx, user, me.ID), nil
+}
 
-        if user.Parent == me.ID {
-            return true, nil
+// Walk up the tree from the user to see if we run into the specified ancestor.
+// The depth is capped so that a broken hierarchy can't loop forever.
+func (s *SmartContract) isuserdescendent(ctx contractapi.TransactionContextInterface,
+                                         user *User, ancestor string) bool {
+    for depth := 0; user.Parent != "" && depth < 64; depth++ {
+        if user.Parent == ancestor {
+            return true
         }
 
-        user, err := s.GetUserByID(ctx, user.Parent)
-        if err != nil {
-            return false, err
-        } else if user == nil {
-            return false, fmt.Errorf("unknown user")
+        parent, err := s.GetUserByID(ctx, user.Parent)
+        if err != nil || parent == nil {
+            return false
         }
+
+        user = parent
     }
+
+    return false
 }
 
 func (s *SmartContract) GatherMyInheritedPerms(ctx contractapi.TransactionContextInterface,
@@ -333,11 +811,29 @@ func (s *SmartContract) GatherUserInheritedPerms(ctx contractapi.TransactionCont
     return s.gatheruperms(ctx, user, bucket)
 }
 
+// Work out the most a user can pass on to their sub-users for a bucket. Users
+// at the top of the tree can pass on anything; everyone else is limited to what
+// their own parent gave them.
+func (s *SmartContract) conferrableperms(ctx contractapi.TransactionContextInterface,
+                                         user *User, bucket string) (uint32, error) {
+    if user.Parent == "" {
+        return ACL_Perms_All, nil
+    }
+
+    perms, err := s.gatheruperms(ctx, user, bucket)
+    if err != nil {
+        return 0, err
+    }
+
+    return perms[user.Parent], nil
+}
+
 func (s *SmartContract) gatheruperms(ctx contractapi.TransactionContextInterface,
                                      user *User, bucket string) (map[string]uint32, error) {
     rv := map[string]uint32{}
     var parent *User = nil
     var lastperms uint32 = 0x000000ff
+    var err error
 
     // The user has full permissions for anything they have direct access to.
     rv[user.ID] = lastperms
@@ -346,7 +842,7 @@ func (s *SmartContract) gatheruperms(ctx contractapi.TransactionContextInterface
     // get all the way to the root
     for u := user; u.Parent != "" && lastperms != 0; u = parent {
         // Grab the parent.
-        parent, err := s.GetUserByID(ctx, u.Parent)
+        parent, err = s.GetUserByID(ctx, u.Parent)
         if err != nil {
             return nil, err
         } else if parent == nil {
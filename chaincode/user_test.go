@@ -0,0 +1,549 @@
+/*
+    Copyright (C) 2024 Lawrence Sebald
+    All Rights Reserved
+*/
+package chaincode
+
+import (
+    "reflect"
+    "testing"
+
+    "github.com/hyperledger/fabric-chaincode-go/v2/shim"
+)
+
+func TestAddUserCantGrantMissingSysPerms(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddUsers | User_SysPerms_AddBuckets)
+
+    // Anything alice holds can be handed on...
+    _, err := call(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddUser(ctx, uidof("bob"), User_SysPerms_AddBuckets)
+    })
+    if err != nil {
+        t.Fatalf("AddUser with held permissions failed: %v", err)
+    }
+
+    // ...but nothing else, and especially not admin.
+    for _, perms := range []uint32{User_SysPerms_AddGroups,
+                                   User_SysPerms_Admin,
+                                   0xffffffff} {
+        _, err = call(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddUser(ctx, uidof("mallory"), perms)
+        })
+        if err == nil {
+            t.Errorf("AddUser granted sysperms %#x the caller lacks", perms)
+        }
+    }
+
+    // Admins can still make other admins.
+    _, err = call(env, "admin", func(ctx txctx) (string, error) {
+        return env.cc.AddUser(ctx, uidof("carol"), User_SysPerms_Admin)
+    })
+    if err != nil {
+        t.Fatalf("admin couldn't add an admin: %v", err)
+    }
+}
+
+func TestGetSubUsers(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddSubUsers)
+    env.adduser("bob", 0)
+
+    for _, name := range []string{"carol", "dave"} {
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddSubUser(ctx, uidof(name),
+                                     map[string]uint32{"*": ACL_Perms_ReadObject},
+                                     0)
+        })
+    }
+
+    subs := mustcall(env, "alice", env.cc.GetMySubUsers)
+    if len(subs) != 2 || subs[0].UID != uidof("carol") ||
+       subs[1].UID != uidof("dave") {
+        t.Fatalf("alice's sub-users = %+v, want carol and dave", subs)
+    }
+
+    if subs[0].Perms["*"] != ACL_Perms_ReadObject {
+        t.Errorf("sub-user perms = %v, want read on everything", subs[0].Perms)
+    }
+
+    // Admins can look at anyone's sub-users, but nobody else can.
+    subs = mustcall(env, "admin", func(ctx txctx) ([]SubUser, error) {
+        return env.cc.GetSubUsersForUID(ctx, uidof("alice"))
+    })
+    if len(subs) != 2 {
+        t.Errorf("admin sees %d of alice's sub-users, want 2", len(subs))
+    }
+
+    _, err := call(env, "bob", func(ctx txctx) ([]SubUser, error) {
+        return env.cc.GetSubUsersForUID(ctx, uidof("alice"))
+    })
+    if err == nil {
+        t.Errorf("non-admin listed someone else's sub-users")
+    }
+
+    subs = mustcall(env, "bob", env.cc.GetMySubUsers)
+    if len(subs) != 0 {
+        t.Errorf("bob has sub-users %+v, want none", subs)
+    }
+}
+
+func TestRemoveSubUser(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddSubUsers | User_SysPerms_AddBuckets)
+
+    all := map[string]uint32{"*": ACL_Perms_ReadObject}
+    for _, name := range []string{"bob", "carol", "dave"} {
+        mustcall(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddSubUser(ctx, uidof(name), all,
+                                     User_SysPerms_AddBuckets)
+        })
+    }
+
+    // Bob owns an empty bucket and dave owns a bucket with an object in it.
+    env.addbucket("bob", "bucket-b")
+    env.addbucket("dave", "bucket-d")
+    env.putobject("dave", "bucket-d", "a.txt", "data", nil, false)
+
+    for _, name := range []string{"bob", "dave"} {
+        _, err := call(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.RemoveSubUser(ctx, uidof(name))
+        })
+        if err == nil {
+            t.Errorf("removed %s, who still owns things", name)
+        }
+    }
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.RemoveSubUser(ctx, uidof("carol"))
+    })
+
+    subs := mustcall(env, "alice", env.cc.GetMySubUsers)
+    if len(subs) != 2 || subs[0].UID != uidof("bob") ||
+       subs[1].UID != uidof("dave") {
+        t.Errorf("sub-users left = %+v, want bob and dave", subs)
+    }
+
+    _, err := call(env, "admin", func(ctx txctx) (*User, error) {
+        return env.cc.GetUserByUID(ctx, uidof("carol"))
+    })
+    if err == nil {
+        t.Errorf("removed sub-user still exists")
+    }
+
+    // Only the parent can remove a sub-user.
+    _, err = call(env, "admin", func(ctx txctx) (bool, error) {
+        return env.cc.RemoveSubUser(ctx, uidof("bob"))
+    })
+    if err == nil {
+        t.Errorf("someone other than the parent removed a sub-user")
+    }
+}
+
+func TestSubUserWithNilPerms(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddSubUsers)
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubUser(ctx, uidof("bob"), nil, 0)
+    })
+
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetSubUserPermission(ctx, uidof("bob"), "bucket-a",
+                                           ACL_Perms_ReadObject)
+    })
+
+    subs := mustcall(env, "alice", env.cc.GetMySubUsers)
+    if len(subs) != 1 || subs[0].Perms["bucket-a"] != ACL_Perms_ReadObject {
+        t.Errorf("sub-users after setting perms = %+v", subs)
+    }
+}
+
+func TestTransferAllUserResources(t *testing.T) {
+    env := newtestenv(t)
+    env.cc.DefaultPageSize = 2
+    env.adduser("alice", User_SysPerms_AddBuckets | User_SysPerms_AddGroups)
+    bob := env.adduser("bob", User_SysPerms_AddBuckets)
+    carol := env.adduser("carol", 0)
+    env.addbucket("alice", "bucket-a")
+    env.addbucket("bob", "bucket-b")
+
+    env.createindex("alice", "project", "bucket-a")
+    env.createindex("carol", "project", "bucket-a")
+
+    x := map[string]string{"project": "x"}
+    env.putobject("alice", "bucket-a", "1.txt", "one", x, false)
+    env.putobject("alice", "bucket-a", "2.txt", "two", nil, false)
+    env.putobject("alice", "bucket-a", "3.txt", "three", x, false)
+    env.putobject("bob", "bucket-b", "4.txt", "four", nil, false)
+
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddGroup(ctx, "staff", false)
+    })
+    env.createacl("alice", "mine", nil, nil)
+    env.createacl("alice", "shared", nil, nil)
+    env.createacl("carol", "shared", nil, nil)
+
+    transfer := func(caller string) (*TransferSummary, error) {
+        return call(env, caller, func(ctx txctx) (*TransferSummary, error) {
+            return env.cc.TransferAllUserResources(ctx, uidof("alice"),
+                                                   uidof("carol"))
+        })
+    }
+
+    if _, err := transfer("bob"); err == nil {
+        t.Fatalf("non-admin transferred someone else's resources")
+    }
+
+    // Only two objects fit in a call, so the first one stops partway.
+    first, err := transfer("admin")
+    if err != nil {
+        t.Fatalf("first transfer failed: %v", err)
+    } else if first.Complete || first.Objects != 2 || first.Token == "" {
+        t.Fatalf("first transfer = %+v, want two objects and a token", first)
+    }
+
+    second, err := transfer("admin")
+    if err != nil {
+        t.Fatalf("second transfer failed: %v", err)
+    }
+
+    want := TransferSummary {
+        Buckets:        1,
+        Objects:        1,
+        Groups:         1,
+        ACLs:           1,
+        SkippedACLs:    []string{"shared"},
+        Complete:       true,
+    }
+    if !reflect.DeepEqual(*second, want) {
+        t.Errorf("second transfer = %+v, want %+v", *second, want)
+    }
+
+    for _, key := range []string{"1.txt", "2.txt", "3.txt"} {
+        if obj := env.getobject("bucket-a", key); obj.Owner != carol {
+            t.Errorf("%s owned by %s after transfer", key, obj.Owner)
+        }
+    }
+
+    if obj := env.getobject("bucket-b", "4.txt"); obj.Owner != bob {
+        t.Errorf("bob's object changed hands")
+    }
+
+    // Alice's index entries should now be in carol's index.
+    counts := func(user string) uint64 {
+        summary := mustcall(env, user, func(ctx txctx) ([]IndexSummary, error) {
+            return env.cc.GetIndexSummary(ctx)
+        })
+        return summary[0].Entries
+    }
+
+    if a, c := counts("alice"), counts("carol"); a != 0 || c != 2 {
+        t.Errorf("index entries after transfer: alice %d, carol %d", a, c)
+    }
+
+    // Alice is left with nothing except the ACL that would have collided.
+    objs := mustcall(env, "alice", func(ctx txctx) (*ObjectListing, error) {
+        return env.cc.QueryMyObjects(ctx, nil, 0, "")
+    })
+    bkts := mustcall(env, "alice", func(ctx txctx) (*BucketListing, error) {
+        return env.cc.QueryMyBuckets(ctx, nil, 0, false, "")
+    })
+    grps := mustcall(env, "alice", func(ctx txctx) ([]*Group, error) {
+        return env.cc.GetMyOwnedGroups(ctx)
+    })
+    acls := mustcall(env, "alice", func(ctx txctx) ([]*ACLTemplate, error) {
+        return env.cc.GetAllMyACLs(ctx)
+    })
+
+    if len(objs.Objects) != 0 || len(bkts.Buckets) != 0 || len(grps) != 0 ||
+       len(acls) != 1 {
+        t.Errorf("alice still owns %d objects, %d buckets, %d groups, %d ACLs",
+                 len(objs.Objects), len(bkts.Buckets), len(grps), len(acls))
+    }
+}
+
+func TestGetUserTree(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddSubUsers)
+    env.adduser("carol", 0)
+
+    addsub := func(parent string, name string, sysperms uint32) {
+        mustcall(env, parent, func(ctx txctx) (string, error) {
+            return env.cc.AddSubUser(ctx, uidof(name), map[string]uint32{
+                "bucket-a": ACL_Perms_ReadObject,
+            }, sysperms)
+        })
+    }
+
+    addsub("alice", "bob", User_SysPerms_AddSubUsers)
+    addsub("alice", "erin", 0)
+    addsub("bob", "dave", 0)
+
+    tree := func(caller string, root string) (*UserTreeNode, error) {
+        return call(env, caller, func(ctx txctx) (*UserTreeNode, error) {
+            return env.cc.GetUserTree(ctx, uidof(root))
+        })
+    }
+
+    // Flatten the tree out into child -> parent, by UID.
+    parents := func(n *UserTreeNode) map[string]string {
+        rv := map[string]string{}
+        var walk func(n *UserTreeNode)
+        walk = func(n *UserTreeNode) {
+            for _, c := range n.Children {
+                rv[c.UID] = n.UID
+                walk(c)
+            }
+        }
+        walk(n)
+        return rv
+    }
+
+    full, err := tree("alice", "alice")
+    if err != nil {
+        t.Fatalf("fetching own tree: %v", err)
+    }
+
+    want := map[string]string{
+        uidof("bob"):   uidof("alice"),
+        uidof("erin"):  uidof("alice"),
+        uidof("dave"):  uidof("bob"),
+    }
+    if got := parents(full); !reflect.DeepEqual(got, want) {
+        t.Errorf("alice's tree = %v, want %v", got, want)
+    }
+
+    for _, c := range full.Children {
+        if c.Perms["bucket-a"] != ACL_Perms_ReadObject {
+            t.Errorf("perms for %s = %v", c.UID, c.Perms)
+        }
+    }
+
+    tests := []struct {
+        caller  string
+        root    string
+        ok      bool
+    }{
+        {"alice", "bob", true},
+        {"bob", "bob", true},
+        {"admin", "bob", true},
+        {"dave", "bob", false},
+        {"carol", "alice", false},
+    }
+
+    for _, tc := range tests {
+        sub, err := tree(tc.caller, tc.root)
+        if tc.ok && err != nil {
+            t.Errorf("%s fetching %s's tree: %v", tc.caller, tc.root, err)
+        } else if !tc.ok && err == nil {
+            t.Errorf("%s allowed to fetch %s's tree", tc.caller, tc.root)
+        } else if tc.ok && (len(sub.Children) != 1 ||
+                            sub.Children[0].UID != uidof("dave")) {
+            t.Errorf("%s's tree = %+v, want just dave", tc.root, sub)
+        }
+    }
+}
+
+func TestAmIAdmin(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets | User_SysPerms_AddGroups)
+
+    check := func(user string) (bool, uint32) {
+        admin := mustcall(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.AmIAdmin(ctx)
+        })
+        perms := mustcall(env, user, func(ctx txctx) (uint32, error) {
+            return env.cc.GetMySysPerms(ctx)
+        })
+        return admin, perms
+    }
+
+    admin, perms := check("alice")
+    if admin || perms != User_SysPerms_AddBuckets | User_SysPerms_AddGroups {
+        t.Errorf("alice: admin %v, perms 0x%x", admin, perms)
+    }
+
+    admin, perms = check("admin")
+    if !admin || (perms & User_SysPerms_Admin) == 0 {
+        t.Errorf("admin: admin %v, perms 0x%x", admin, perms)
+    }
+
+    // Someone who hasn't been set up as a user gets an error, not a no.
+    _, err := call(env, "nobody", func(ctx txctx) (bool, error) {
+        return env.cc.AmIAdmin(ctx)
+    })
+    if err == nil {
+        t.Errorf("unknown caller got an answer")
+    }
+}
+
+func TestAddSubUserFailureLeavesNoWrites(t *testing.T) {
+    env := newtestenv(t)
+    aliceid := env.adduser("alice", User_SysPerms_AddSubUsers)
+    parent, _ := shim.CreateCompositeKey("User", []string{aliceid})
+
+    addcarol := func() error {
+        _, err := call(env, "alice", func(ctx txctx) (string, error) {
+            return env.cc.AddSubUser(ctx, uidof("carol"),
+                                     map[string]uint32{"*": ACL_Perms_ReadObject},
+                                     0)
+        })
+        return err
+    }
+
+    // Updating alice's list of sub-users is the last write in the operation,
+    // so everything before it has to go too.
+    before := env.snapshot()
+    env.failput = func(key string) bool { return key == parent }
+
+    if err := addcarol(); err == nil {
+        t.Fatal("AddSubUser succeeded with a failed write")
+    }
+
+    if !reflect.DeepEqual(env.state, before) {
+        t.Error("failed AddSubUser changed the world state")
+    }
+
+    // Nothing left over gets in the way of trying again.
+    env.failput = nil
+    if err := addcarol(); err != nil {
+        t.Fatalf("AddSubUser after a failure: %v", err)
+    }
+
+    subs := mustcall(env, "alice", env.cc.GetMySubUsers)
+    if len(subs) != 1 || subs[0].UID != uidof("carol") {
+        t.Errorf("sub-users = %+v", subs)
+    }
+}
+
+func TestReparentSubUser(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddSubUsers)
+    dave := env.adduser("dave", 0)
+
+    perms := map[string]uint32{"*": ACL_Perms_ReadObject}
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubUser(ctx, uidof("bob"), perms,
+                                 User_SysPerms_AddSubUsers)
+    })
+    mustcall(env, "bob", func(ctx txctx) (string, error) {
+        return env.cc.AddSubUser(ctx, uidof("carol"), perms, 0)
+    })
+
+    reparent := func(user string, sub string, parent string) error {
+        _, err := call(env, user, func(ctx txctx) (bool, error) {
+            return env.cc.ReparentSubUser(ctx, uidof(sub), uidof(parent))
+        })
+        return err
+    }
+
+    subsof := func(user string) []SubUser {
+        return mustcall(env, "admin", func(ctx txctx) ([]SubUser, error) {
+            return env.cc.GetSubUsersForUID(ctx, uidof(user))
+        })
+    }
+
+    if reparent("alice", "bob", "dave") == nil {
+        t.Error("non-admin reparented a sub-user")
+    }
+
+    // Nobody can end up underneath themselves.
+    for _, parent := range []string{"bob", "carol"} {
+        if reparent("admin", "bob", parent) == nil {
+            t.Errorf("bob reparented under %s", parent)
+        }
+    }
+
+    if reparent("admin", "dave", "alice") == nil {
+        t.Error("reparented a user that isn't a sub-user")
+    }
+
+    if err := reparent("admin", "bob", "dave"); err != nil {
+        t.Fatalf("ReparentSubUser: %v", err)
+    }
+
+    if subs := subsof("alice"); len(subs) != 0 {
+        t.Errorf("alice still has sub-users %+v", subs)
+    }
+
+    subs := subsof("dave")
+    if len(subs) != 1 || subs[0].UID != uidof("bob") ||
+       !reflect.DeepEqual(subs[0].Perms, perms) {
+        t.Errorf("dave's sub-users = %+v, want bob with %v", subs, perms)
+    }
+
+    // Bob's own sub-users come along.
+    bob := mustcall(env, "admin", func(ctx txctx) (*User, error) {
+        return env.cc.GetUserByUID(ctx, uidof("bob"))
+    })
+    if bob.Parent != dave {
+        t.Errorf("bob's parent = %q, want dave", bob.Parent)
+    }
+    if subs := subsof("bob"); len(subs) != 1 || subs[0].UID != uidof("carol") {
+        t.Errorf("bob's sub-users = %+v, want carol", subs)
+    }
+}
+
+func TestSubUserPermsClampedToParent(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddSubUsers | User_SysPerms_AddBuckets)
+
+    // Alice can hand out anything, but bob only gets some of it.
+    mustcall(env, "alice", func(ctx txctx) (string, error) {
+        return env.cc.AddSubUser(ctx, uidof("bob"), map[string]uint32{
+            "bucket-a": ACL_Perms_ReadObject | ACL_Perms_ListObjects,
+            "*":        ACL_Perms_ReadObject,
+        }, User_SysPerms_AddSubUsers)
+    })
+
+    _, err := call(env, "bob", func(ctx txctx) (string, error) {
+        return env.cc.AddSubUser(ctx, uidof("carol"), nil,
+                                 User_SysPerms_AddBuckets)
+    })
+    if err == nil {
+        t.Error("bob gave carol system permissions bob doesn't have")
+    }
+
+    mustcall(env, "bob", func(ctx txctx) (string, error) {
+        return env.cc.AddSubUser(ctx, uidof("carol"), map[string]uint32{
+            "bucket-a": ACL_Perms_All,
+            "bucket-z": ACL_Perms_All,
+        }, 0)
+    })
+
+    carolperms := func() map[string]uint32 {
+        subs := mustcall(env, "bob", env.cc.GetMySubUsers)
+        if len(subs) != 1 {
+            t.Fatalf("bob's sub-users = %+v, want just carol", subs)
+        }
+        return subs[0].Perms
+    }
+
+    want := map[string]uint32{
+        "bucket-a": ACL_Perms_ReadObject | ACL_Perms_ListObjects,
+        "bucket-z": ACL_Perms_ReadObject,
+    }
+    if got := carolperms(); !reflect.DeepEqual(got, want) {
+        t.Errorf("carol's perms = %v, want %v", got, want)
+    }
+
+    mustcall(env, "bob", func(ctx txctx) (bool, error) {
+        return env.cc.SetSubUserPermission(ctx, uidof("carol"), "bucket-z",
+                                           ACL_Perms_All)
+    })
+    if got := carolperms()["bucket-z"]; got != ACL_Perms_ReadObject {
+        t.Errorf("carol's bucket-z perms = %#x, want read only", got)
+    }
+
+    // Top-level users aren't limited.
+    mustcall(env, "alice", func(ctx txctx) (bool, error) {
+        return env.cc.SetSubUserPermission(ctx, uidof("bob"), "bucket-z",
+                                           ACL_Perms_All)
+    })
+    subs := mustcall(env, "alice", env.cc.GetMySubUsers)
+    if subs[0].Perms["bucket-z"] != ACL_Perms_All {
+        t.Errorf("bob's bucket-z perms = %#x, want everything",
+                 subs[0].Perms["bucket-z"])
+    }
+}
@@ -1,7 +1,9 @@
 package chaincode
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
 	"github.com/hyperledger/fabric-chaincode-go/v2/pkg/cid"
@@ -28,3 +30,174 @@ func (s *SmartContract) GetMyUID(ctx contractapi.TransactionContextInterface) (s
     return mspid + "##" + uid, nil
 }
 
+
+// Dump the raw document stored at a composite key. This is only meant as a
+// debugging aid for admins.
+func (s *SmartContract) GetRawState(ctx contractapi.TransactionContextInterface,
+                                    objectType string,
+                                    keyParts []string) (string, error) {
+    myuser, err := s.GetMyUser(ctx)
+    if err != nil {
+        return "", err
+    }
+
+    if !isadmin(myuser) {
+        return "", fmt.Errorf("permission denied")
+    }
+
+    sid, err := ctx.GetStub().CreateCompositeKey(objectType, keyParts)
+    if err != nil {
+        return "", err
+    }
+
+    js, err := ctx.GetStub().GetState(sid)
+    if err != nil {
+        return "", fmt.Errorf("failed to read from world state: %v", err)
+    } else if js == nil {
+        return "", fmt.Errorf("no such key")
+    }
+
+    return string(js), nil
+}
+
+// Grab the transaction's timestamp, which is the same on every endorser.
+func gettxtime(ctx contractapi.TransactionContextInterface) (int64, error) {
+    ts, err := ctx.GetStub().GetTxTimestamp()
+    if err != nil {
+        return 0, fmt.Errorf("failed to read transaction timestamp: %v", err)
+    }
+
+    return ts.GetSeconds(), nil
+}
+
+// Marshal a document for the world state, making sure it isn't too big for the
+// ledger to accept.
+func (s *SmartContract) marshalChecked(ctx contractapi.TransactionContextInterface,
+                                       key string, v interface{}) ([]byte, error) {
+    js, err := json.Marshal(v)
+    if err != nil {
+        return nil, err
+    }
+
+    max := s.MaxStateSize
+    if max == 0 {
+        max = DefaultMaxStateSize
+    }
+
+    if uint32(len(js)) > max {
+        kind, parts, _ := ctx.GetStub().SplitCompositeKey(key)
+        return nil, fmt.Errorf("object too large: %s %s is %d bytes (max %d)",
+                               kind, strings.Join(parts, "/"), len(js), max)
+    }
+
+    return js, nil
+}
+
+// Marshal a document and write it to the world state, making sure it isn't too
+// big for the ledger to accept first.
+func (s *SmartContract) putStateChecked(ctx contractapi.TransactionContextInterface,
+                                        key string, v interface{}) error {
+    js, err := s.marshalChecked(ctx, key, v)
+    if err != nil {
+        return err
+    }
+
+    err = ctx.GetStub().PutState(key, js)
+    if err != nil {
+        return fmt.Errorf("failed to put to world state. %v", err)
+    }
+
+    return nil
+}
+
+// Walk through the entries under a partial composite key in key order, picking
+// up just after the given token (or at the start, if it's empty) and stopping
+// once max entries have been looked at. Unlike the paginated queries, this is
+// fine to use in a transaction that writes to the world state. The returned
+// token is where the next call should pick up, or empty once the whole range
+// has been covered.
+func walkpartialkey(ctx contractapi.TransactionContextInterface,
+                    objtype string, attrs []string, token string, max uint32,
+                    fn func(key string, value []byte) error) (string, error) {
+    iter, err := ctx.GetStub().GetStateByPartialCompositeKey(objtype, attrs)
+    if err != nil {
+        return "", err
+    }
+    defer iter.Close()
+
+    var seen uint32 = 0
+    last := ""
+
+    for iter.HasNext() {
+        if seen == max {
+            return last, nil
+        }
+
+        resp, err := iter.Next()
+        if err != nil {
+            return "", err
+        }
+
+        // Skip over anything an earlier call already dealt with.
+        if token != "" && resp.Key <= token {
+            continue
+        }
+
+        err = fn(resp.Key, resp.Value)
+        if err != nil {
+            return "", err
+        }
+
+        seen++
+        last = resp.Key
+    }
+
+    return "", nil
+}
+
+// A set of documents to be written to the world state together. Nothing is
+// written until commitbatch is called, and then only if every document in the
+// batch can be written, so a failure part way through an operation doesn't
+// leave stray writes behind that need to be cleaned up by hand.
+type statebatch struct {
+    keys    []string
+    docs    []interface{}
+}
+
+func (b *statebatch) put(key string, v interface{}) {
+    b.keys = append(b.keys, key)
+    b.docs = append(b.docs, v)
+}
+
+func (s *SmartContract) commitbatch(ctx contractapi.TransactionContextInterface,
+                                    b *statebatch) error {
+    encoded := make([][]byte, len(b.docs))
+
+    for i := range b.docs {
+        js, err := s.marshalChecked(ctx, b.keys[i], b.docs[i])
+        if err != nil {
+            return err
+        }
+
+        encoded[i] = js
+    }
+
+    for i := range encoded {
+        err := ctx.GetStub().PutState(b.keys[i], encoded[i])
+        if err != nil {
+            return fmt.Errorf("failed to put to world state. %v", err)
+        }
+    }
+
+    return nil
+}
+
+// Cheap liveness check for clients and operators. This doesn't look at the
+// world state at all.
+func (s *SmartContract) Ping(ctx contractapi.TransactionContextInterface) (string, error) {
+    return "pong", nil
+}
+
+func (s *SmartContract) GetVersion(ctx contractapi.TransactionContextInterface) (string, error) {
+    return Version, nil
+}
@@ -0,0 +1,130 @@
+/*
+    Copyright (C) 2024 Lawrence Sebald
+    All Rights Reserved
+*/
+package chaincode
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+
+    "github.com/hyperledger/fabric-chaincode-go/v2/shim"
+)
+
+func TestPutStateCheckedBoundary(t *testing.T) {
+    env := newtestenv(t)
+    env.cc.MaxStateSize = 64
+
+    // A JSON string is its contents plus the two quotes around it.
+    put := func(n int) error {
+        return env.tx("admin", func(ctx txctx) error {
+            key, _ := ctx.GetStub().CreateCompositeKey("Test", []string{"doc"})
+            return env.cc.putStateChecked(ctx, key, strings.Repeat("x", n - 2))
+        })
+    }
+
+    if err := put(63); err != nil {
+        t.Errorf("document just under the limit rejected: %v", err)
+    }
+
+    if err := put(64); err != nil {
+        t.Errorf("document at the limit rejected: %v", err)
+    }
+
+    err := put(65)
+    if err == nil {
+        t.Fatalf("document just over the limit accepted")
+    } else if !strings.Contains(err.Error(), "object too large: Test doc") {
+        t.Errorf("unhelpful error for an oversized document: %v", err)
+    }
+}
+
+func TestOversizedMetadataRejected(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+    env.cc.MaxStateSize = 4096
+
+    create := func(key string, n int) error {
+        md := map[string]string{"blob": strings.Repeat("x", n)}
+        _, err := call(env, "alice", func(ctx txctx) (bool, error) {
+            return env.cc.CreateEmptyObject(ctx, "bucket-a", key, md, nil, "",
+                                            false)
+        })
+        return err
+    }
+
+    if err := create("small.txt", 1024); err != nil {
+        t.Errorf("object with modest metadata rejected: %v", err)
+    }
+
+    err := create("big.txt", 4096)
+    if err == nil || !strings.Contains(err.Error(), "object too large") {
+        t.Errorf("object with oversized metadata: err = %v", err)
+    }
+
+    key, _ := shim.CreateCompositeKey("Object", []string{"bucket-a", "big.txt"})
+    if _, ok := env.state[key]; ok {
+        t.Errorf("oversized object written anyway")
+    }
+}
+
+func TestGetRawState(t *testing.T) {
+    env := newtestenv(t)
+    env.adduser("alice", User_SysPerms_AddBuckets)
+    env.addbucket("alice", "bucket-a")
+    env.putobject("alice", "bucket-a", "a.txt", "data", nil, false)
+
+    raw := func(caller string, parts ...string) (string, error) {
+        return call(env, caller, func(ctx txctx) (string, error) {
+            return env.cc.GetRawState(ctx, "Object", parts)
+        })
+    }
+
+    js, err := raw("admin", "bucket-a", "a.txt")
+    if err != nil {
+        t.Fatalf("admin couldn't read raw state: %v", err)
+    }
+
+    key, _ := shim.CreateCompositeKey("Object", []string{"bucket-a", "a.txt"})
+    if js != string(env.state[key]) {
+        t.Errorf("raw state = %s, want %s", js, env.state[key])
+    }
+
+    if _, err := raw("admin", "bucket-a", "missing.txt"); err == nil {
+        t.Errorf("reading a missing key succeeded")
+    }
+
+    if _, err := raw("alice", "bucket-a", "a.txt"); err == nil {
+        t.Errorf("non-admin read raw state")
+    }
+}
+
+func TestPingAndVersion(t *testing.T) {
+    env := newtestenv(t)
+
+    reads := 0
+    env.onget = func(key string) {
+        reads++
+    }
+    before := env.snapshot()
+
+    // Neither needs the caller to be a registered user.
+    pong := mustcall(env, "nobody", env.cc.Ping)
+    if pong != "pong" {
+        t.Errorf("Ping = %q, want \"pong\"", pong)
+    }
+
+    ver := mustcall(env, "nobody", env.cc.GetVersion)
+    if ver != Version {
+        t.Errorf("GetVersion = %q, want %q", ver, Version)
+    }
+
+    if reads != 0 {
+        t.Errorf("Ping and GetVersion read the world state %d times", reads)
+    }
+    if !reflect.DeepEqual(env.snapshot(), before) {
+        t.Error("Ping and GetVersion changed the world state")
+    }
+}
@@ -18,6 +18,9 @@ const dishas_endpoint = "127.0.0.1:8080"
 const dishas_accesskey = "fill_in_access_key"
 const dishas_secretkey = "fill_in_secret_key"
 
+const listing_default_pagesize = 1000
+const listing_max_pagesize = 1000
+
 func main() {
     client, err := minio.New(dishas_endpoint, &minio.Options{
         Creds: credentials.NewStaticV4(dishas_accesskey, dishas_secretkey, ""),
@@ -31,7 +34,11 @@ func main() {
         return
     }
 
-    shigureChaincode, err := contractapi.NewChaincode(&chaincode.SmartContract{S3client: client})
+    shigureChaincode, err := contractapi.NewChaincode(&chaincode.SmartContract{
+        S3client: client,
+        DefaultPageSize: listing_default_pagesize,
+        MaxPageSize: listing_max_pagesize,
+    })
     if err != nil {
         log.Panicf("Error creating shigure chaincode: %v", err)
     }